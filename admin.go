@@ -0,0 +1,373 @@
+package dhtlistener
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the state of a DHT.
+type Stats struct {
+	ID               string            `json:"id"` // hex
+	Addr             string            `json:"addr"`
+	ExternalAddr     string            `json:"external_addr,omitempty"`
+	Nodes            int               `json:"nodes"`
+	Peers            int               `json:"peers"`
+	InfoHashes       int               `json:"infohashes"` // having peers stored
+	Transactions     int               `json:"transactions"`
+	PeakTransactions int               `json:"peak_transactions"`
+	RejectedQueries  uint64            `json:"rejected_queries"` // at MaxTransactions
+	DroppedQueries   uint64            `json:"dropped_queries"`  // by the full queue
+	PacketsIn        map[string]uint64 `json:"packets_in"`
+	PacketsOut       map[string]uint64 `json:"packets_out"`
+	Clients          map[string]uint64 `json:"clients"`     // packets in by client
+	ClientsOut       map[string]uint64 `json:"clients_out"` // packets out by client
+	Responses        map[string]uint64 `json:"responses"`   // by query type
+	Timeouts         map[string]uint64 `json:"timeouts"`    // by query type
+	Queries          QueryTypeStats    `json:"queries"`
+	BytesIn          uint64            `json:"bytes_in"`
+	BytesOut         uint64            `json:"bytes_out"`
+	DroppedPackets   uint64            `json:"dropped_packets"`
+	DroppedUTP       uint64            `json:"dropped_utp"` // uTP packets, see UTPConn
+	ThrottledQueries uint64            `json:"throttled_queries"`
+	SpoofedResponses uint64            `json:"spoofed_responses"`
+	Bans             int               `json:"bans"`
+	Verifications    VerifyStats       `json:"verifications"`
+	Uptime           time.Duration     `json:"uptime"` // since Run, nanoseconds in JSON
+}
+
+// Stats returns a snapshot of the state of dht.
+func (dht *DHT) Stats() Stats {
+	s := Stats{
+		ID:               dht.ID(),
+		Addr:             dht.conn.LocalAddr().String(),
+		PacketsIn:        dht.metrics.packetsIn.Snapshot(),
+		PacketsOut:       dht.metrics.packetsOut.Snapshot(),
+		Clients:          dht.metrics.clients.Snapshot(),
+		ClientsOut:       dht.metrics.clientsOut.Snapshot(),
+		Responses:        dht.metrics.responses.Snapshot(),
+		Timeouts:         dht.metrics.timeouts.Snapshot(),
+		Queries:          dht.QueryStats(),
+		BytesIn:          atomic.LoadUint64(&dht.metrics.bytesIn),
+		BytesOut:         atomic.LoadUint64(&dht.metrics.bytesOut),
+		DroppedPackets:   dht.DroppedPackets(),
+		DroppedUTP:       atomic.LoadUint64(&dht.metrics.utpDropped),
+		ThrottledQueries: dht.ThrottledQueries(),
+		SpoofedResponses: dht.SpoofedResponses(),
+		DroppedQueries:   dht.DroppedQueries(),
+		Bans:             len(dht.Bans()),
+		Verifications:    dht.VerifyStats(),
+	}
+	if ext := dht.ExternalAddr(); ext != nil {
+		s.ExternalAddr = ext.String()
+	}
+
+	// the following are only available once the dht runs.
+	if dht.initialized() {
+		s.Nodes = dht.rt.Len()
+		s.Peers = dht.peers.Count()
+		if pm, ok := dht.peers.(*peersManager); ok {
+			s.InfoHashes = pm.InfoHashes()
+		}
+		s.Uptime = dht.now().Sub(dht.metrics.started)
+		s.Transactions = dht.transacts.len()
+		s.PeakTransactions = dht.transacts.peakLen()
+		s.RejectedQueries = atomic.LoadUint64(&dht.transacts.rejected)
+	}
+	return s
+}
+
+// NodeInfo describes a node of the routing table, or one returned by Ping
+// or FindNode, whose Bucket, State and Score are then unset.
+type NodeInfo struct {
+	ID         string    `json:"id"` // hex
+	Addr       string    `json:"addr"`
+	Bucket     int       `json:"bucket"`
+	Good       bool      `json:"good"`
+	State      string    `json:"state,omitempty"` // good, questionable or bad
+	LastActive time.Time `json:"last_active"`
+	RTT        float64   `json:"rtt_ms,omitempty"` // smoothed, 0 if unknown
+	Score      float64   `json:"score"`            // reliability in [0, 1]
+}
+
+// BucketInfo describes a bucket of the routing table.
+type BucketInfo struct {
+	Index        int        `json:"index"` // prefix length shared with our id
+	LastChanged  time.Time  `json:"last_changed"`
+	Nodes        []NodeInfo `json:"nodes"`
+	Replacements int        `json:"replacements"` // cached nodes
+}
+
+// RoutingTableInfo is a snapshot of the routing table.
+type RoutingTableInfo struct {
+	ID      string       `json:"id"` // hex, ours
+	Nodes   int          `json:"nodes"`
+	Buckets []BucketInfo `json:"buckets"`
+}
+
+// nodeStates names the node states.
+var nodeStates = [...]string{
+	nodeGood:         "good",
+	nodeQuestionable: "questionable",
+	nodeBad:          "bad",
+}
+
+// RoutingTable returns a snapshot of the buckets of the routing table and
+// their nodes, nil if the dht doesn't run.
+func (dht *DHT) RoutingTable() *RoutingTableInfo {
+	if !dht.initialized() {
+		return nil
+	}
+
+	ret := &RoutingTableInfo{ID: dht.ID()}
+	for _, bucket := range dht.rt.Buckets() {
+		bi := BucketInfo{
+			Index:        bucket.idx,
+			LastChanged:  bucket.LastChanged(),
+			Nodes:        make([]NodeInfo, 0, bucket.Len()),
+			Replacements: bucket.replacements.Len(),
+		}
+		bucket.Foreach(func(v interface{}) bool {
+			no := v.(*node)
+			state := no.state(dht.now(), dht.NodeExpireTime)
+			score := no.score(dht.now())
+			addr := no.address()
+
+			no.RLock()
+			bi.Nodes = append(bi.Nodes, NodeInfo{
+				ID:         hex.EncodeToString([]byte(no.id.RawString())),
+				Addr:       addr.String(),
+				Bucket:     bucket.idx,
+				Good:       state == nodeGood,
+				State:      nodeStates[state],
+				LastActive: no.lastActiveTime,
+				RTT:        no.srtt.Seconds() * 1000,
+				Score:      score,
+			})
+			no.RUnlock()
+			return true
+		})
+		ret.Nodes += len(bi.Nodes)
+		ret.Buckets = append(ret.Buckets, bi)
+	}
+	return ret
+}
+
+// AllNodes returns the nodes of all the buckets of t, nil if t is.
+func (t *RoutingTableInfo) AllNodes() []NodeInfo {
+	if t == nil {
+		return nil
+	}
+
+	ret := make([]NodeInfo, 0, t.Nodes)
+	for _, bucket := range t.Buckets {
+		ret = append(ret, bucket.Nodes...)
+	}
+	return ret
+}
+
+// peerInfo is the json form of a Peer.
+type peerInfo struct {
+	IP       string    `json:"ip"`
+	Port     int       `json:"port"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func peerInfos(peers []*Peer) []peerInfo {
+	ret := make([]peerInfo, 0, len(peers))
+	for _, p := range peers {
+		ret = append(ret, peerInfo{p.IP.String(), p.Port, p.LastSeen})
+	}
+	return ret
+}
+
+// writeJSON writes v with status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err with status code.
+func writeError(w http.ResponseWriter, code int, err string) {
+	writeJSON(w, code, map[string]string{"error": err})
+}
+
+// parseInfoHash returns the raw infohash of its hex form.
+func parseInfoHash(s string) (string, bool) {
+	data, err := hex.DecodeString(s)
+	if err != nil || len(data) != 20 {
+		return "", false
+	}
+	return string(data), true
+}
+
+// AdminHandler returns a http.Handler of the admin API of dht, mount it on
+// your own mux, with http.StripPrefix if needed, or see ServeAdmin:
+//
+//	GET  /stats              Stats
+//	GET  /livez              Health, 503 unless it's Live
+//	GET  /readyz             Health, 503 unless it's Ready
+//	GET  /routing-table      the AllNodes of RoutingTable
+//	GET  /buckets            RoutingTable
+//	GET  /peers/{infohash}   the stored peers of the hex infohash
+//	POST /lookup/{infohash}  GetPeers
+//	POST /announce           Announce {"infohash": "hex", "port": 6881}
+//	POST /ban                Ban {"ip": "1.2.3.4", "duration": "1h", "reason": ""}
+//	GET  /events             EventsHandler
+//
+// It has no authentication, don't expose it.
+func (dht *DHT) AdminHandler() http.Handler {
+	route := func(method string, h func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != method {
+				w.Header().Set("Allow", method)
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			h(w, r)
+		}
+	}
+
+	running := func(h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !dht.running() {
+				writeError(w, http.StatusServiceUnavailable, "dht is not running")
+				return
+			}
+			h(w, r)
+		}
+	}
+
+	mux := http.NewServeMux()
+
+	mux.Handle("/stats", route("GET", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, dht.Stats())
+	}))
+
+	health := func(ok func(Health) bool) func(w http.ResponseWriter, r *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			h := dht.Health()
+			if !ok(h) {
+				writeJSON(w, http.StatusServiceUnavailable, h)
+				return
+			}
+			writeJSON(w, http.StatusOK, h)
+		}
+	}
+	mux.Handle("/livez", route("GET", health(Health.Live)))
+	mux.Handle("/readyz", route("GET", health(Health.Ready)))
+
+	mux.Handle("/events", route("GET", dht.EventsHandler().ServeHTTP))
+
+	mux.Handle("/routing-table", route("GET", running(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, dht.RoutingTable().AllNodes())
+	})))
+
+	mux.Handle("/buckets", route("GET", running(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, dht.RoutingTable())
+	})))
+
+	mux.Handle("/peers/", route("GET", running(func(w http.ResponseWriter, r *http.Request) {
+		infoHash, ok := parseInfoHash(strings.TrimPrefix(r.URL.Path, "/peers/"))
+		if !ok {
+			writeError(w, http.StatusBadRequest, errInvalidInfoHash.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, peerInfos(dht.peers.GetPeers(InfoHash(infoHash), dht.K)))
+	})))
+
+	mux.Handle("/lookup/", route("POST", running(func(w http.ResponseWriter, r *http.Request) {
+		infoHash, ok := parseInfoHash(strings.TrimPrefix(r.URL.Path, "/lookup/"))
+		if !ok {
+			writeError(w, http.StatusBadRequest, errInvalidInfoHash.Error())
+			return
+		}
+
+		peers, err := dht.GetPeers(infoHash)
+		if err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, peerInfos(peers))
+	})))
+
+	mux.Handle("/announce", route("POST", running(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			InfoHash string `json:"infohash"`
+			Port     int    `json:"port"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		infoHash, ok := parseInfoHash(req.InfoHash)
+		if !ok || req.Port < 0 || req.Port > 65535 {
+			writeError(w, http.StatusBadRequest, "invalid infohash or port")
+			return
+		}
+
+		n, err := dht.Announce(infoHash, req.Port)
+		if err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"nodes": n})
+	})))
+
+	mux.Handle("/ban", route("POST", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			IP       string `json:"ip"`
+			Duration string `json:"duration"`
+			Reason   string `json:"reason"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		ip := net.ParseIP(req.IP)
+		if ip == nil {
+			writeError(w, http.StatusBadRequest, "invalid ip")
+			return
+		}
+
+		d := dht.BanDuration
+		if req.Duration != "" {
+			var err error
+			if d, err = time.ParseDuration(req.Duration); err != nil || d <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid duration")
+				return
+			}
+		}
+		if req.Reason == "" {
+			req.Reason = "admin"
+		}
+
+		dht.Ban(ip, d, req.Reason)
+		writeJSON(w, http.StatusOK, dht.Bans())
+	}))
+
+	return mux
+}
+
+// ServeAdmin serves the AdminHandler on addr until the dht is closed, see
+// AdminHandler.
+func (dht *DHT) ServeAdmin(addr string) error {
+	srv := &http.Server{Addr: addr, Handler: dht.AdminHandler()}
+
+	dht.spawn(func() {
+		<-dht.done
+		srv.Close()
+	})
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
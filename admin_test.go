@@ -0,0 +1,188 @@
+package dhtlistener
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminHandler(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.Close(context.Background())
+
+	infoHash := "mnopqrstuvwxyz123456"
+	dht.peers.Insert(InfoHash(infoHash), newPeer(net.IPv4(1, 2, 3, 4), 6881, ""))
+
+	srv := httptest.NewServer(dht.AdminHandler())
+	defer srv.Close()
+
+	get := func(path string, v interface{}) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(v)
+		return resp.StatusCode
+	}
+
+	var stats Stats
+	if code := get("/stats", &stats); code != 200 || stats.Peers != 1 || len(stats.ID) != 40 {
+		t.Fatalf("unexpected stats %d %+v", code, stats)
+	}
+
+	var peers []peerInfo
+	if code := get("/peers/6d6e6f707172737475767778797a313233343536", &peers); code != 200 ||
+		len(peers) != 1 || peers[0].IP != "1.2.3.4" {
+		t.Fatalf("unexpected peers %d %+v", code, peers)
+	}
+	if code := get("/peers/zz", &peers); code != http.StatusBadRequest {
+		t.Fatal("expected a bad request, got", code)
+	}
+
+	var nodes []NodeInfo
+	if code := get("/routing-table", &nodes); code != 200 || len(nodes) != 0 {
+		t.Fatalf("unexpected routing table %d %+v", code, nodes)
+	}
+	var table RoutingTableInfo
+	if code := get("/buckets", &table); code != 200 || table.ID != dht.ID() || len(table.Buckets) != 1 {
+		t.Fatalf("unexpected buckets %d %+v", code, table)
+	}
+
+	resp, err := http.Post(srv.URL+"/stats", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("expected method not allowed, got", resp.StatusCode)
+	}
+
+	resp, err = http.Post(srv.URL+"/ban", "application/json",
+		strings.NewReader(`{"ip": "5.6.7.8", "duration": "1m"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || !dht.bans.banned(net.IPv4(5, 6, 7, 8), dht.now()) {
+		t.Fatal("expected 5.6.7.8 to be banned, got", resp.StatusCode)
+	}
+}
+
+func TestRoutingTable(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.Close(context.Background())
+
+	for i := 0; i < 3; i++ {
+		no, _ := newNode(GetRandString(20), "udp", genAddress("1.2.3.4", 6881+i), time.Now())
+		if i == 0 {
+			no.heardResponse(time.Now())
+		}
+		dht.rt.Insert(no)
+	}
+
+	table := dht.RoutingTable()
+	if table.Nodes != 3 || len(table.Buckets) != 1 || len(table.Buckets[0].Nodes) != 3 {
+		t.Fatalf("unexpected snapshot %+v", table)
+	}
+	states := make(map[string]int)
+	for _, info := range table.Buckets[0].Nodes {
+		states[info.State]++
+	}
+	if states["good"] != 1 || states["questionable"] != 2 {
+		t.Errorf("expected 1 good node, got %v", states)
+	}
+	if nodes := table.AllNodes(); len(nodes) != 3 {
+		t.Errorf("expected 3 nodes, got %d", len(nodes))
+	}
+}
+
+func TestStats(t *testing.T) {
+	mem := &memNet{}
+	addrA := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	addrB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+
+	a, err := New(WithTransport(mem.listen(addrA)), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(WithTransport(mem.listen(addrB)), WithBootstrapNodes(addrA.String()),
+		WithTry(1), WithQueryTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.MinQueryTimeout = 10 * time.Millisecond
+
+	for _, dht := range []*DHT{a, b} {
+		dht.rt = newRouteTable(dht) // before Run, read below
+		go dht.Run()
+		defer func(dht *DHT) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			dht.Close(ctx)
+		}(dht)
+	}
+	if !waitUntil(func() bool { return hasNode(b, addrA.String()) }) {
+		t.Fatal("b should join a")
+	}
+
+	b.transacts.ping(&node{addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 6881}})
+	if !waitUntil(func() bool { return b.Stats().Timeouts[pingType] == 1 }) {
+		t.Fatalf("expected a ping timeout, got %v", b.Stats().Timeouts)
+	}
+
+	s := b.Stats()
+	if s.Responses[findNodeType] == 0 || s.BytesIn == 0 || s.BytesOut == 0 || s.Uptime <= 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestAdminHandlerStarting(t *testing.T) {
+	dht, err := New(WithAddr("127.0.0.1:0"), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := dht.AdminHandler()
+
+	// the handler is served while Run initializes the dht.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			for _, path := range []string{"/stats", "/routing-table", "/buckets"} {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+			}
+			select {
+			case <-dht.Started():
+				return
+			default:
+			}
+		}
+	}()
+
+	go dht.Run()
+	<-done
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dht.Close(ctx)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/routing-table", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected a closed dht unavailable, got %d", w.Code)
+	}
+}
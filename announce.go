@@ -0,0 +1,116 @@
+package dhtlistener
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// announceLookupTime is how long Announce looks up the nodes closest to the
+// infohash before announcing to them.
+const announceLookupTime = time.Second * 5
+
+// announceTokens collects the tokens received from get_peers responses of
+// the infohashes being announced.
+type announceTokens struct {
+	sync.Mutex
+	pending map[string]map[string]nodeToken // infohash : addr : token
+}
+
+// nodeToken is a token received from a node.
+type nodeToken struct {
+	no    *node
+	token string
+}
+
+// newAnnounceTokens returns a new announceTokens pointer.
+func newAnnounceTokens() *announceTokens {
+	return &announceTokens{pending: make(map[string]map[string]nodeToken)}
+}
+
+// start starts collecting the tokens of infoHash, it returns false if it's
+// already being announced.
+func (at *announceTokens) start(infoHash string) bool {
+	at.Lock()
+	defer at.Unlock()
+
+	if _, ok := at.pending[infoHash]; ok {
+		return false
+	}
+	at.pending[infoHash] = make(map[string]nodeToken)
+	return true
+}
+
+// record keeps the token no gave for infoHash if it's being announced.
+func (at *announceTokens) record(infoHash string, no *node, token string) {
+	at.Lock()
+	defer at.Unlock()
+
+	if tokens, ok := at.pending[infoHash]; ok {
+		tokens[no.address().String()] = nodeToken{no, token}
+	}
+}
+
+// stop stops collecting the tokens of infoHash and returns them.
+func (at *announceTokens) stop(infoHash string) []nodeToken {
+	at.Lock()
+	defer at.Unlock()
+
+	tokens := at.pending[infoHash]
+	delete(at.pending, infoHash)
+
+	ret := make([]nodeToken, 0, len(tokens))
+	for _, nt := range tokens {
+		ret = append(ret, nt)
+	}
+	return ret
+}
+
+// Announce announces that we are a peer of infoHash, raw or hex encoded or a
+// magnet link, on port, 0 meaning our dht port. It looks up the nodes
+// closest to infoHash, then announces to the K closest ones which gave us a
+// token, and returns their number. It's also announced on the local network if LSD is enabled.
+func (dht *DHT) Announce(infoHash string, port int) (int, error) {
+	if dht.Passive {
+		return 0, errPassive
+	}
+	if dht.Router {
+		return 0, errRouter
+	}
+
+	infoHash, err := rawInfoHash(infoHash)
+	if err != nil {
+		return 0, err
+	}
+
+	if !dht.announces.start(infoHash) {
+		return 0, errAnnouncing
+	}
+	dht.lsdAnnounce(infoHash, port)
+
+	target := newHashId(infoHash)
+	for _, no := range dht.lookupNodes(target, dht.K) {
+		dht.transacts.getPeers(context.Background(), no, infoHash)
+	}
+
+	timer := dht.Clock.NewTimer(announceLookupTime)
+	select {
+	case <-timer.C():
+	case <-dht.done:
+		timer.Stop()
+	}
+
+	tokens := dht.announces.stop(infoHash)
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].no.id.Xor(target).RawString() < tokens[j].no.id.Xor(target).RawString()
+	})
+	if len(tokens) > dht.K {
+		tokens = tokens[:dht.K]
+	}
+
+	for _, nt := range tokens {
+		dht.transacts.announcePeer(nt.no, infoHash, port, nt.token)
+	}
+	return len(tokens), nil
+}
@@ -0,0 +1,167 @@
+package dhtlistener
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// EventNodeBanned is published when an ip is banned for misbehaving.
+const EventNodeBanned EventType = EventMetadataReceived + 1
+
+// NodeBanned is the event of a banned ip.
+type NodeBanned struct {
+	IP     string
+	Reason string
+	Until  time.Time
+}
+
+// Type implements Event.
+func (NodeBanned) Type() EventType { return EventNodeBanned }
+
+// Ban is an entry of the ban table.
+type Ban struct {
+	IP     string
+	Reason string
+	Until  time.Time
+}
+
+// maxOffenders bounds the ips whose violations are counted.
+const maxOffenders = 1 << 16
+
+// offense counts the violations of an ip since a time.
+type offense struct {
+	count int
+	since time.Time
+}
+
+// banTable counts the protocol violations per ip and bans the offenders.
+type banTable struct {
+	sync.Mutex
+	offenses map[string]*offense // ip : violations
+	bans     map[string]Ban      // ip : ban
+}
+
+// newBanTable returns a new banTable pointer.
+func newBanTable() *banTable {
+	return &banTable{
+		offenses: make(map[string]*offense),
+		bans:     make(map[string]Ban),
+	}
+}
+
+// banned returns whether ip is banned at now, forgetting the expired ban.
+func (bt *banTable) banned(ip net.IP, now time.Time) bool {
+	key := string(ip.To16())
+
+	bt.Lock()
+	defer bt.Unlock()
+
+	if len(bt.bans) == 0 {
+		return false
+	}
+
+	b, ok := bt.bans[key]
+	if ok && now.After(b.Until) {
+		delete(bt.bans, key)
+		return false
+	}
+	return ok
+}
+
+// sweep forgets the bans expired at now and the offenses older than window.
+func (bt *banTable) sweep(now time.Time, window time.Duration) {
+	bt.Lock()
+	defer bt.Unlock()
+
+	for key, b := range bt.bans {
+		if now.After(b.Until) {
+			delete(bt.bans, key)
+		}
+	}
+	for key, o := range bt.offenses {
+		if now.Sub(o.since) > window {
+			delete(bt.offenses, key)
+		}
+	}
+}
+
+// offend records a protocol violation of ip, and bans it for BanDuration
+// once it commits BanThreshold violations within BanWindow.
+func (dht *DHT) offend(ip net.IP, reason string) {
+	if dht.BanThreshold <= 0 {
+		return
+	}
+
+	key, now := string(ip.To16()), dht.now()
+	bt := dht.bans
+
+	bt.Lock()
+	o, ok := bt.offenses[key]
+	if !ok || now.Sub(o.since) > dht.BanWindow {
+		if !ok && len(bt.offenses) >= maxOffenders {
+			bt.offenses = make(map[string]*offense)
+		}
+		o = &offense{since: now}
+		bt.offenses[key] = o
+	}
+	o.count++
+
+	banned := o.count >= dht.BanThreshold
+	if banned {
+		delete(bt.offenses, key)
+	}
+	bt.Unlock()
+
+	dht.Logger.Debug("protocol violation", F("ip", ip), F("reason", reason))
+	if banned {
+		dht.Ban(ip, dht.BanDuration, reason)
+	}
+}
+
+// Ban bans ip for d: its packets are dropped and it's never queried.
+func (dht *DHT) Ban(ip net.IP, d time.Duration, reason string) {
+	b := Ban{IP: ip.String(), Reason: reason, Until: dht.now().Add(d)}
+
+	dht.bans.Lock()
+	dht.bans.bans[string(ip.To16())] = b
+	dht.bans.Unlock()
+
+	dht.Logger.Info("ip banned", F("ip", b.IP), F("reason", reason), F("until", b.Until))
+	dht.publish(EventNodeBanned, func() Event {
+		return NodeBanned(b)
+	})
+}
+
+// Unban lifts the ban of ip and returns whether it was banned.
+func (dht *DHT) Unban(ip net.IP) bool {
+	key := string(ip.To16())
+
+	dht.bans.Lock()
+	defer dht.bans.Unlock()
+
+	_, ok := dht.bans.bans[key]
+	delete(dht.bans.bans, key)
+	delete(dht.bans.offenses, key)
+	return ok
+}
+
+// Bans returns the ban table, the bans ending first first.
+func (dht *DHT) Bans() []Ban {
+	now := dht.now()
+
+	dht.bans.Lock()
+	ret := make([]Ban, 0, len(dht.bans.bans))
+	for _, b := range dht.bans.bans {
+		if b.Until.After(now) {
+			ret = append(ret, b)
+		}
+	}
+	dht.bans.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Until.Before(ret[j].Until)
+	})
+	return ret
+}
@@ -0,0 +1,113 @@
+package dhtlistener
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBan(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	defer dht.conn.Close()
+	dht.BanThreshold = 3
+
+	events := dht.Subscribe(EventNodeBanned)
+	ip := net.IPv4(1, 2, 3, 4)
+
+	for i := 0; i < 2; i++ {
+		dht.offend(ip, "invalid token")
+	}
+	if dht.bans.banned(ip, dht.now()) {
+		t.Fatal("banned before the threshold")
+	}
+
+	dht.offend(ip, "invalid token")
+	if !dht.bans.banned(ip, dht.now()) {
+		t.Fatal("expected a ban at the threshold")
+	}
+
+	select {
+	case e := <-events:
+		if b := e.(NodeBanned); b.IP != "1.2.3.4" || b.Reason != "invalid token" {
+			t.Fatal("unexpected event", b)
+		}
+	default:
+		t.Fatal("expected a NodeBanned event")
+	}
+
+	if bans := dht.Bans(); len(bans) != 1 || bans[0].IP != "1.2.3.4" {
+		t.Fatal("unexpected ban table", bans)
+	}
+
+	if !dht.Unban(ip) || dht.bans.banned(ip, dht.now()) || len(dht.Bans()) != 0 {
+		t.Fatal("expected the ban to be lifted")
+	}
+
+	dht.Ban(ip, -time.Second, "expired")
+	if dht.bans.banned(ip, dht.now()) {
+		t.Fatal("an expired ban should not apply")
+	}
+}
+
+func TestStaleToken(t *testing.T) {
+	tm := newTokenMgr(time.Now)
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+
+	token := tm.getToken(addr)
+	tm.rotate()
+	tm.rotate()
+	if tm.check(addr, token) || !tm.stale(addr, token) {
+		t.Fatal("expected a stale token")
+	}
+	if tm.stale(addr, "forged12") {
+		t.Fatal("a forged token isn't stale")
+	}
+}
+
+func TestBanDisabled(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	defer dht.conn.Close()
+
+	ip := net.IPv4(1, 2, 3, 4)
+	for i := 0; i < 100; i++ {
+		dht.offend(ip, "invalid token")
+	}
+	if dht.bans.banned(ip, dht.now()) {
+		t.Fatal("banning should be off by default")
+	}
+}
+
+func TestBanClock(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	defer dht.conn.Close()
+	clock := newFakeClock()
+	dht.Clock = clock
+	dht.BanThreshold, dht.BanWindow = 2, time.Minute
+
+	// the offenses more than BanWindow apart don't add up.
+	ip := net.IPv4(1, 2, 3, 4)
+	dht.offend(ip, "invalid token")
+	clock.Advance(time.Minute * 2)
+	dht.offend(ip, "invalid token")
+	if dht.bans.banned(ip, dht.now()) {
+		t.Fatal("expected the first offense forgotten")
+	}
+
+	dht.Ban(ip, time.Hour, "manual")
+	if bans := dht.Bans(); len(bans) != 1 || !bans[0].Until.Equal(clock.Now().Add(time.Hour)) {
+		t.Fatalf("unexpected ban table %v", bans)
+	}
+	clock.Advance(time.Hour + time.Second)
+	if dht.bans.banned(ip, dht.now()) || len(dht.Bans()) != 0 {
+		t.Fatal("expected the ban expired by the clock")
+	}
+}
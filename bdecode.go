@@ -32,6 +32,7 @@ func getStr(data []byte) (str string, err error) {
 func getInt(data []byte) (num int, err error) {
 	if data[len(data)-1] != 'e' {
 		err = errors.New("getInt donot find tag e")
+		return
 	}
 	numStr := data[1 : len(data)-1]
 	num, err = strconv.Atoi(string(numStr))
@@ -39,27 +40,79 @@ func getInt(data []byte) (num int, err error) {
 	return
 }
 
+// Unmarshal reads the Bencode-encoded data and stores the result in the
+// value pointed to by v, see Marshal for the naming of struct fields. Unlike
+// Decode, it requires data to be exactly one complete value and never
+// panics on malformed data.
+func Unmarshal(data []byte, v interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed bencode: %v", r)
+		}
+	}()
+
+	if len(data) == 0 {
+		return errors.New("empty data")
+	}
+
+	_, end, err := findFirstNode(data, 0)
+	if err != nil {
+		return err
+	}
+	if end != len(data)-1 {
+		return errors.New("trailing data after value")
+	}
+
+	return Decode(data, v)
+}
+
 // Decode reads the Becode-encoded text from data,stores in the value pointed to by  v
 func Decode(data []byte, v interface{}) error {
 	rv := reflect.ValueOf(v)
 	if rv.Kind() != reflect.Ptr || rv.IsNil() {
 		return fmt.Errorf("type dont support expect ptr, now:%s", rv.Kind())
 	}
+	if len(data) == 0 {
+		return errors.New("empty data")
+	}
 	rv = rv.Elem()
 	rk := rv.Kind()
 
+	if rv.Type() == rawMessageType {
+		rv.SetBytes(append([]byte(nil), data...))
+		return nil
+	}
+
+	if rk == reflect.Ptr {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return Decode(data, rv.Interface())
+	}
+
 	switch data[0] {
 	case 'i':
 		num, err := getInt(data)
 		if err != nil {
 			return err
 		}
-		if rk == reflect.Interface {
+		switch {
+		case rk == reflect.Interface:
 			rv.Set(reflect.ValueOf(num))
-		} else if rk <= reflect.Int64 {
+		case rk == reflect.Bool:
+			rv.SetBool(num != 0)
+		case reflect.Int <= rk && rk <= reflect.Int64:
+			if rv.OverflowInt(int64(num)) {
+				return fmt.Errorf("%d overflows %s", num, rk)
+			}
 			rv.SetInt(int64(num))
-		} else {
+		case reflect.Uint <= rk && rk <= reflect.Uint64:
+			if num < 0 || rv.OverflowUint(uint64(num)) {
+				return fmt.Errorf("%d overflows %s", num, rk)
+			}
 			rv.SetUint(uint64(num))
+		default:
+			return fmt.Errorf("cannot decode int into %s", rk)
 		}
 	case 'l':
 		if rk == reflect.Interface {
@@ -168,10 +221,15 @@ func Decode(data []byte, v interface{}) error {
 		if err != nil {
 			return err
 		}
-		if rv.Kind() == reflect.Interface {
+		switch {
+		case rk == reflect.Interface:
 			rv.Set(reflect.ValueOf(str))
-		} else {
+		case rk == reflect.String:
 			rv.SetString(str)
+		case rk == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8:
+			rv.SetBytes([]byte(str))
+		default:
+			return fmt.Errorf("cannot decode string into %s", rk)
 		}
 	}
 
@@ -184,60 +242,51 @@ func findStructFieldName(v reflect.Value, name string) (reflect.Type, string, bo
 	for idx := 0; idx != t.NumField(); idx++ {
 		if v.Field(idx).CanInterface() {
 			fname := t.Field(idx).Name
-			if tagName := t.Field(idx).Tag.Get("json"); tagName != "" {
-				if tagName == name {
-					return t.Field(idx).Type, fname, true
-				}
-			}
-			if fname == name {
+			if tagName, _, skip := fieldTag(t.Field(idx)); !skip && tagName == name {
 				return t.Field(idx).Type, fname, true
 			}
 		}
 	}
 	return nil, "", false
 }
+
+// findFirstNode returns the type and the end index of the value starting at
+// data[start].
 func findFirstNode(data []byte, start int) (typeid, end int, err error) {
-	idx := start
-	size := len(data)
-
-	s := newStack()
-
-	for idx != size {
-		switch data[idx] {
-		case 'i':
-			typeid = bencode_type_num
-			end, err = findInt(data, idx)
-		case 'l':
-			s.Push(&typeIdx{bencode_type_list, start, -1})
-			_, end, err = findFirstNode(data, idx+1)
-		case 'd':
-			s.Push(&typeIdx{bencode_type_map, start, -1})
-			_, end, err = findFirstNode(data, idx+1)
-		case 'e':
-			if sitem := s.Pop(); sitem != nil {
-				end = idx
-				typeid = sitem.typeid
-			}
-		default:
-			typeid = bencode_type_str
-			end, err = findString(data, idx)
+	if start >= len(data) {
+		return 0, 0, errors.New("findType can not find end tag")
+	}
 
+	switch data[start] {
+	case 'i':
+		end, err = findInt(data, start)
+		return bencode_type_num, end, err
+	case 'l', 'd':
+		typeid = bencode_type_list
+		if data[start] == 'd' {
+			typeid = bencode_type_map
 		}
-		if err != nil {
-			return
+
+		idx := start + 1
+		for idx < len(data) && data[idx] != 'e' {
+			if _, end, err = findFirstNode(data, idx); err != nil {
+				return
+			}
+			idx = end + 1
 		}
-		if s.Size() == 0 {
-			return
+		if idx >= len(data) {
+			return 0, 0, errors.New("findType can not find end tag")
 		}
-		idx = end + 1
-
+		return typeid, idx, nil
+	default:
+		end, err = findString(data, start)
+		return bencode_type_str, end, err
 	}
-	return 0, end, errors.New("findType can not find end tag")
 }
 
 func findString(data []byte, start int) (end int, err error) {
 	mid := strings.Index(string(data[start:]), ":")
-	if end == -1 {
+	if mid == -1 {
 		err = errors.New("findString donot find tag :")
 		return
 	}
@@ -248,6 +297,10 @@ func findString(data []byte, start int) (end int, err error) {
 	if err != nil {
 		return
 	}
+	if num < 0 {
+		err = errors.New("parseString string length is negative")
+		return
+	}
 	if len(data[mid+1:]) < num {
 		err = errors.New("parseString string length is short")
 		return
@@ -2,57 +2,123 @@ package dhtlistener
 
 import (
 	"errors"
-	"fmt"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 )
 
+// RawMessage is a raw encoded bencode value. It delays the decoding of a
+// value until its type is known, or embeds a precomputed encoding.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// Marshal returns the Bencode encoding of data. Struct fields are named by
+// their `bencode:"name"` tag, their `json` tag or their name, the
+// "omitempty" option and the "-" name are supported as encoding/json does.
+func Marshal(data interface{}) ([]byte, error) {
+	return AppendEncode(nil, data)
+}
+
 // Encode returns the Becode encoding text of data.
 func Encode(data interface{}) (string, error) {
-	v := reflect.Indirect(reflect.ValueOf(data))
+	buf, err := AppendEncode(nil, data)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// AppendEncode appends the Bencode encoding of data to dst and returns the
+// extended buffer, it allocates only when dst runs out of capacity.
+func AppendEncode(dst []byte, data interface{}) ([]byte, error) {
+	return appendValue(dst, reflect.ValueOf(data))
+}
+
+func appendValue(dst []byte, v reflect.Value) ([]byte, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return dst, errors.New("data is nil")
+	}
 	t := v.Type()
 	k := t.Kind()
 
 	switch {
-	case reflect.Invalid < k && k <= reflect.Int64:
-		return encodeInt(int(v.Int()))
-	case reflect.Uint <= k && k <= reflect.Uint64:
-		return encodeInt(int(v.Uint()))
+	case t == rawMessageType:
+		return append(dst, v.Bytes()...), nil
+	case k == reflect.Bool:
+		if v.Bool() {
+			return append(dst, "i1e"...), nil
+		}
+		return append(dst, "i0e"...), nil
+	case reflect.Int <= k && k <= reflect.Int64:
+		return appendInt(dst, v.Int()), nil
+	case reflect.Uint <= k && k <= reflect.Uintptr:
+		dst = append(dst, 'i')
+		dst = strconv.AppendUint(dst, v.Uint(), 10)
+		return append(dst, 'e'), nil
 	case k == reflect.String:
-		return encodeString(v.String())
+		return appendString(dst, v.String()), nil
+	case k == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		dst = strconv.AppendInt(dst, int64(v.Len()), 10)
+		dst = append(dst, ':')
+		return append(dst, v.Bytes()...), nil
 	case k == reflect.Slice || k == reflect.Array:
-		return encodeSlice(v)
+		return appendSlice(dst, v)
 	case k == reflect.Map:
-		return encodeMap(v)
+		return appendMap(dst, v)
 	case k == reflect.Struct:
-		return encodeStruct(v)
+		return appendStruct(dst, v)
 	default:
-		return "", errors.New("data type no support")
+		return dst, errors.New("data type no support")
 	}
-	return "", errors.New("encode fail")
 }
 
 func encodeInt(data int) (string, error) {
-	return fmt.Sprintf("i%de", data), nil
+	return string(appendInt(nil, int64(data))), nil
 }
 func encodeString(data string) (string, error) {
-	return strings.Join([]string{strconv.Itoa(len(data)), data}, ":"), nil
+	return string(appendString(nil, data)), nil
 }
 func encodeSlice(v reflect.Value) (string, error) {
-	ret := "l"
+	buf, err := appendSlice(nil, v)
+	return string(buf), err
+}
+func encodeMap(v reflect.Value) (string, error) {
+	buf, err := appendMap(nil, v)
+	return string(buf), err
+}
+func encodeStruct(v reflect.Value) (string, error) {
+	buf, err := appendStruct(nil, v)
+	return string(buf), err
+}
+
+func appendInt(dst []byte, data int64) []byte {
+	dst = append(dst, 'i')
+	dst = strconv.AppendInt(dst, data, 10)
+	return append(dst, 'e')
+}
+
+func appendString(dst []byte, data string) []byte {
+	dst = strconv.AppendInt(dst, int64(len(data)), 10)
+	dst = append(dst, ':')
+	return append(dst, data...)
+}
 
+func appendSlice(dst []byte, v reflect.Value) ([]byte, error) {
+	var err error
+
+	dst = append(dst, 'l')
 	for idx := 0; idx != v.Len(); idx++ {
-		itemRet, err := Encode(v.Index(idx).Interface())
-		if err != nil {
-			return itemRet, err
+		if dst, err = appendValue(dst, v.Index(idx)); err != nil {
+			return dst, err
 		}
-		ret += itemRet
 	}
-	ret += "e"
-
-	return ret, nil
+	return append(dst, 'e'), nil
 }
 
 type keySli []reflect.Value
@@ -67,42 +133,115 @@ func (sli keySli) Swap(i, j int) {
 	sli[i], sli[j] = sli[j], sli[i]
 }
 
-func encodeMap(v reflect.Value) (string, error) {
-	ret := "d"
+func appendMap(dst []byte, v reflect.Value) ([]byte, error) {
+	if v.Type().Key().Kind() != reflect.String {
+		return dst, errors.New("map key need be string")
+	}
+
+	var err error
 	vkey := v.MapKeys()
 	sort.Sort(keySli(vkey))
 
-	for _, val := range vkey {
-		itemRet, err := Encode(v.MapIndex(val).Interface())
-		if err != nil {
-			return itemRet, err
-		}
-		keyRet, err := encodeString(val.String())
-		if err != nil {
-			return keyRet, err
+	dst = append(dst, 'd')
+	for _, key := range vkey {
+		dst = appendString(dst, key.String())
+		if dst, err = appendValue(dst, v.MapIndex(key)); err != nil {
+			return dst, err
 		}
-		ret += keyRet + itemRet
 	}
-	return ret + "e", nil
+	return append(dst, 'e'), nil
 }
-func encodeMapIt(data interface{}) (string, error) {
-	v := reflect.Indirect(reflect.ValueOf(data))
-	return encodeMap(v)
+
+// structField is an encoded field of a struct.
+type structField struct {
+	index     int
+	name      string
+	omitempty bool
 }
-func encodeStruct(v reflect.Value) (string, error) {
-	m := make(map[string]interface{})
-	t := v.Type()
 
+var structFields sync.Map // reflect.Type : []structField sorted by name
+
+// cachedFields returns the encoded fields of struct type t.
+func cachedFields(t reflect.Type) []structField {
+	if fields, ok := structFields.Load(t); ok {
+		return fields.([]structField)
+	}
+
+	fields := make([]structField, 0, t.NumField())
 	for idx := 0; idx != t.NumField(); idx++ {
-		if v.Field(idx).CanInterface() {
-			name := t.Field(idx).Name
+		if t.Field(idx).PkgPath != "" {
+			continue
+		}
+
+		name, omitempty, skip := fieldTag(t.Field(idx))
+		if !skip {
+			fields = append(fields, structField{idx, name, omitempty})
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].name < fields[j].name
+	})
+
+	structFields.Store(t, fields)
+	return fields
+}
+
+func appendStruct(dst []byte, v reflect.Value) ([]byte, error) {
+	var err error
 
-			if tagName := t.Field(idx).Tag.Get("json"); tagName != "" {
-				name = tagName
-			}
+	dst = append(dst, 'd')
+	for _, f := range cachedFields(v.Type()) {
+		fv := v.Field(f.index)
+		if f.omitempty && isEmptyValue(fv) {
+			continue
+		}
 
-			m[name] = v.Field(idx).Interface()
+		dst = appendString(dst, f.name)
+		if dst, err = appendValue(dst, fv); err != nil {
+			return dst, err
 		}
 	}
-	return encodeMapIt(m)
+	return append(dst, 'e'), nil
+}
+
+// fieldTag returns the key name of a struct field and its options. The
+// `bencode` tag takes precedence over the `json` one.
+func fieldTag(f reflect.StructField) (name string, omitempty, skip bool) {
+	tag := f.Tag.Get("bencode")
+	if tag == "" {
+		tag = f.Tag.Get("json")
+	}
+	if tag == "-" {
+		return "", false, true
+	}
+
+	parts := strings.Split(tag, ",")
+	name = parts[0]
+	if name == "" {
+		name = f.Name
+	}
+
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			omitempty = true
+		}
+	}
+	return
+}
+
+// isEmptyValue reports whether v is the zero value of omitempty fields.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
 }
@@ -422,3 +422,54 @@ func TestDecodeMultiMap(t *testing.T) {
 	err := Decode([]byte(in), &out)
 	t.Logf("%v,%#v", err, out)
 }
+
+func TestMarshalTags(t *testing.T) {
+	type args struct {
+		ID          []byte `bencode:"id"`
+		ImpliedPort bool   `bencode:"implied_port,omitempty"`
+		Port        *int   `bencode:"port,omitempty"`
+		Ignored     string `bencode:"-"`
+		Token       string `json:"token"`
+	}
+	type msg struct {
+		T string `bencode:"t"`
+		Y string `bencode:"y"`
+		A args   `bencode:"a"`
+	}
+
+	port := 6881
+	in := msg{"aa", "q", args{[]byte("abc"), true, &port, "x", "tk"}}
+	out := "d1:ad2:id3:abc12:implied_porti1e4:porti6881e5:token2:tke1:t2:aa1:y1:qe"
+
+	data, err := Marshal(in)
+	if err != nil || string(data) != out {
+		t.Fatal(string(data), err)
+	}
+
+	var back msg
+	if err = Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	in.A.Ignored = ""
+	if !reflect.DeepEqual(in, back) {
+		t.Fatal(in, back)
+	}
+
+	data, err = Marshal(args{ID: []byte("abc")})
+	if err != nil || string(data) != "d2:id3:abc5:token0:e" {
+		t.Fatal(string(data), err)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var st struct {
+		ID   string `bencode:"id"`
+		Port uint16 `bencode:"port"`
+	}
+
+	for _, in := range []string{"", "d2:idi1ee", "d4:porti70000ee", "d4:porti-1ee", "d2:id", "l"} {
+		if err := Unmarshal([]byte(in), &st); err == nil {
+			t.Fatal(in)
+		}
+	}
+}
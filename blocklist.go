@@ -0,0 +1,263 @@
+package dhtlistener
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	errInvalidRange = errors.New("invalid ip range")
+	errNotBlocked   = errors.New("range is not blocked")
+)
+
+// ipRange is an inclusive range of ips in their 16-byte form.
+type ipRange struct {
+	start, end net.IP
+}
+
+// parseIP parses an ip, accepting the zero padded ipv4 of the emule format.
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.To16()
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+
+	ip := make(net.IP, 4)
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return ip.To16()
+}
+
+// parseRange parses an ip, a CIDR like 10.0.0.0/8 or a range like
+// 10.0.0.0-10.255.255.255.
+func parseRange(s string) (ipRange, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return ipRange{}, err
+		}
+
+		start, end := ipnet.IP.To16(), make(net.IP, net.IPv6len)
+		mask := ipnet.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range end {
+			end[i] = start[i] | ^mask[i]
+		}
+		return ipRange{start, end}, nil
+	}
+
+	start, end := s, s
+	if i := strings.Index(s, "-"); i != -1 {
+		start, end = s[:i], s[i+1:]
+	}
+
+	r := ipRange{parseIP(start), parseIP(end)}
+	if r.start == nil || r.end == nil || bytes.Compare(r.start, r.end) > 0 {
+		return ipRange{}, errInvalidRange
+	}
+	return r, nil
+}
+
+// parseLine parses a line of a blocklist: an ip or a CIDR, a P2P range
+// "name:start-end" or an emule range "start - end , level , name". The
+// level is 0 but for the emule ranges.
+func parseLine(line string) (ipRange, int, error) {
+	if r, err := parseRange(line); err == nil {
+		return r, 0, nil
+	}
+
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		if level, err := strconv.Atoi(strings.TrimSpace(fields[1])); err == nil {
+			r, err := parseRange(fields[0])
+			return r, level, err
+		}
+	}
+
+	// the name of a P2P range may contain ':' and ',' and an ipv6 range
+	// contains ':' too, the range is the first suffix after a ':' that
+	// parses.
+	for i := strings.Index(line, ":"); i != -1; {
+		if rest := line[i+1:]; strings.Contains(rest, "-") {
+			if r, err := parseRange(rest); err == nil {
+				return r, 0, nil
+			}
+		}
+		j := strings.Index(line[i+1:], ":")
+		if j == -1 {
+			break
+		}
+		i += j + 1
+	}
+	return ipRange{}, 0, errInvalidRange
+}
+
+// Blocklist is a set of ips and ip ranges. Lookups are binary searches over
+// the ranges sorted by start.
+type Blocklist struct {
+	sync.RWMutex
+	ranges []ipRange // sorted by start
+	maxEnd []net.IP  // max end of ranges[:i+1]
+}
+
+// NewBlocklist returns a new, empty Blocklist pointer.
+func NewBlocklist() *Blocklist {
+	return &Blocklist{}
+}
+
+// rebuild sorts the ranges and computes maxEnd, the caller holds the lock.
+func (bl *Blocklist) rebuild() {
+	sort.Slice(bl.ranges, func(i, j int) bool {
+		return bytes.Compare(bl.ranges[i].start, bl.ranges[j].start) < 0
+	})
+
+	bl.maxEnd = bl.maxEnd[:0]
+	for i, r := range bl.ranges {
+		if i == 0 || bytes.Compare(r.end, bl.maxEnd[i-1]) > 0 {
+			bl.maxEnd = append(bl.maxEnd, r.end)
+		} else {
+			bl.maxEnd = append(bl.maxEnd, bl.maxEnd[i-1])
+		}
+	}
+}
+
+// Add blocks an ip, a CIDR like 10.0.0.0/8 or a range like
+// 10.0.0.0-10.255.255.255.
+func (bl *Blocklist) Add(s string) error {
+	r, err := parseRange(s)
+	if err != nil {
+		return err
+	}
+
+	bl.Lock()
+	defer bl.Unlock()
+
+	bl.ranges = append(bl.ranges, r)
+	bl.rebuild()
+	return nil
+}
+
+// Remove unblocks a range previously added, s is in the same form as in
+// Add.
+func (bl *Blocklist) Remove(s string) error {
+	r, err := parseRange(s)
+	if err != nil {
+		return err
+	}
+
+	bl.Lock()
+	defer bl.Unlock()
+
+	ranges := bl.ranges[:0]
+	for _, br := range bl.ranges {
+		if !br.start.Equal(r.start) || !br.end.Equal(r.end) {
+			ranges = append(ranges, br)
+		}
+	}
+	if len(ranges) == len(bl.ranges) {
+		return errNotBlocked
+	}
+
+	bl.ranges = ranges
+	bl.rebuild()
+	return nil
+}
+
+// Blocked returns whether ip is blocked. A nil Blocklist blocks nothing.
+func (bl *Blocklist) Blocked(ip net.IP) bool {
+	if bl == nil {
+		return false
+	}
+	if ip = ip.To16(); ip == nil {
+		return false
+	}
+
+	bl.RLock()
+	defer bl.RUnlock()
+
+	// i is the last range starting at or before ip, one of the ranges up to
+	// i contains ip if their max end is at or after ip.
+	i := sort.Search(len(bl.ranges), func(i int) bool {
+		return bytes.Compare(bl.ranges[i].start, ip) > 0
+	}) - 1
+
+	return i >= 0 && bytes.Compare(bl.maxEnd[i], ip) >= 0
+}
+
+// replace replaces the ranges by the ones of other.
+func (bl *Blocklist) replace(other *Blocklist) {
+	other.RLock()
+	ranges := append([]ipRange(nil), other.ranges...)
+	other.RUnlock()
+
+	bl.Lock()
+	defer bl.Unlock()
+
+	bl.ranges = ranges
+	bl.rebuild()
+}
+
+// Len returns the number of ranges, 0 for a nil Blocklist.
+func (bl *Blocklist) Len() int {
+	if bl == nil {
+		return 0
+	}
+
+	bl.RLock()
+	defer bl.RUnlock()
+
+	return len(bl.ranges)
+}
+
+// Load adds the ranges read from r, which is a list of ips and CIDRs, a
+// P2P blocklist ("name:1.2.3.0-1.2.3.255") or an emule ipfilter.dat
+// ("001.002.003.000 - 001.002.003.255 , 000 , name"), one range a line.
+// Blank lines and comments starting with # are skipped, as are the emule
+// ranges whose level is 128 or more. It returns the number of ranges added.
+func (bl *Blocklist) Load(r io.Reader) (int, error) {
+	ranges := make([]ipRange, 0)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		r, level, err := parseLine(line)
+		if err != nil || level >= 128 {
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	bl.Lock()
+	defer bl.Unlock()
+
+	bl.ranges = append(bl.ranges, ranges...)
+	bl.rebuild()
+	return len(ranges), nil
+}
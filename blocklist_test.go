@@ -0,0 +1,87 @@
+package dhtlistener
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBlocklist(t *testing.T) {
+	bl := NewBlocklist()
+	for _, s := range []string{"10.0.0.0/8", "1.2.3.4", "5.0.0.0-5.0.0.255", "fd00::/8"} {
+		if err := bl.Add(s); err != nil {
+			t.Fatal(s, err)
+		}
+	}
+	if err := bl.Add("5.0.0.9-5.0.0.1"); err == nil {
+		t.Fatal("expected an error for an inverted range")
+	}
+
+	for ip, blocked := range map[string]bool{
+		"10.1.2.3":  true,
+		"11.0.0.0":  false,
+		"1.2.3.4":   true,
+		"1.2.3.5":   false,
+		"5.0.0.128": true,
+		"5.0.1.0":   false,
+		"fd12::1":   true,
+		"fe80::1":   false,
+	} {
+		if bl.Blocked(net.ParseIP(ip)) != blocked {
+			t.Fatalf("%s: expected blocked %v", ip, blocked)
+		}
+	}
+
+	if err := bl.Remove("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	if bl.Blocked(net.ParseIP("10.1.2.3")) {
+		t.Fatal("10.1.2.3 should be unblocked")
+	}
+	if bl.Remove("10.0.0.0/8") != errNotBlocked {
+		t.Fatal("expected errNotBlocked")
+	}
+
+	var nilList *Blocklist
+	if nilList.Blocked(net.ParseIP("1.2.3.4")) {
+		t.Fatal("a nil blocklist should block nothing")
+	}
+}
+
+func TestBlocklistLoad(t *testing.T) {
+	bl := NewBlocklist()
+	n, err := bl.Load(strings.NewReader(`# comment
+Some org:1.1.1.0-1.1.1.255
+Foo, Inc.: ads:4.4.4.0-4.4.4.255
+v6:2001:db8::-2001:db8::ffff
+
+002.002.002.000 - 002.002.002.255 , 000 , emule
+003.003.003.000 - 003.003.003.255 , 200 , allowed
+192.168.0.0/16
+garbage
+`))
+	if err != nil || n != 5 {
+		t.Fatal(n, err)
+	}
+
+	for ip, blocked := range map[string]bool{
+		"1.1.1.1":     true,
+		"2.2.2.2":     true,
+		"3.3.3.3":     false,
+		"192.168.1.1": true,
+		"4.4.4.4":     true,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+	} {
+		if bl.Blocked(net.ParseIP(ip)) != blocked {
+			t.Fatalf("%s: expected blocked %v", ip, blocked)
+		}
+	}
+}
+
+func TestBlocklistNil(t *testing.T) {
+	var bl *Blocklist
+	if bl.Len() != 0 || bl.Blocked(net.IPv4(1, 2, 3, 4)) {
+		t.Fatal("a nil blocklist should be empty")
+	}
+}
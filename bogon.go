@@ -0,0 +1,79 @@
+package dhtlistener
+
+import (
+	"net"
+)
+
+// mustParseCIDRs parses CIDRs known to be valid.
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	ret := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ret = append(ret, ipnet)
+	}
+	return ret
+}
+
+var (
+	// bogonNets are the reserved ranges no dht node lives in.
+	bogonNets = mustParseCIDRs(
+		"0.0.0.0/8",
+		"192.0.0.0/24",
+		"192.0.2.0/24",
+		"198.18.0.0/15",
+		"198.51.100.0/24",
+		"203.0.113.0/24",
+		"240.0.0.0/4",
+		"2001:db8::/32",
+	)
+	// sharedNets are the carrier-grade NAT ranges, private like the ones
+	// of net.IP.IsPrivate.
+	sharedNets = mustParseCIDRs("100.64.0.0/10")
+)
+
+// inNets returns whether one of nets contains ip.
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivate returns whether ip is a private, loopback or link-local one.
+func isPrivate(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		inNets(ip, sharedNets)
+}
+
+// isSelfAddr returns whether ip and port is the address of our socket.
+func (dht *DHT) isSelfAddr(ip net.IP, port int) bool {
+	local, ok := dht.conn.LocalAddr().(*net.UDPAddr)
+	if !ok || local.Port != port {
+		return false
+	}
+
+	if local.IP.IsUnspecified() {
+		return ip.IsLoopback()
+	}
+	return local.IP.Equal(ip)
+}
+
+// validAddr returns whether ip and port is a reachable address of another
+// node. Private ranges are valid only if AllowPrivateAddrs is set.
+func (dht *DHT) validAddr(ip net.IP, port int) bool {
+	if port <= 0 || port > 65535 || ip == nil ||
+		ip.IsUnspecified() || ip.IsMulticast() || inNets(ip, bogonNets) {
+
+		return false
+	}
+
+	if isPrivate(ip) && !dht.AllowPrivateAddrs {
+		return false
+	}
+	return !dht.isSelfAddr(ip, port)
+}
@@ -0,0 +1,48 @@
+package dhtlistener
+
+import (
+	"net"
+	"testing"
+)
+
+func TestValidAddr(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	defer dht.conn.Close()
+	self := dht.conn.LocalAddr().(*net.UDPAddr)
+
+	cases := []struct {
+		ip      string
+		port    int
+		valid   bool
+		private bool
+	}{
+		{"1.2.3.4", 6881, true, true},
+		{"1.2.3.4", 0, false, false},
+		{"0.0.0.0", 6881, false, false},
+		{"224.0.0.1", 6881, false, false},
+		{"255.255.255.255", 6881, false, false},
+		{"192.0.2.1", 6881, false, false},
+		{"10.0.0.1", 6881, false, true},
+		{"192.168.1.1", 6881, false, true},
+		{"100.64.0.1", 6881, false, true},
+		{"127.0.0.1", 6881, false, true},
+		{"127.0.0.1", self.Port, false, false},
+		{"2001:db8::1", 6881, false, false},
+		{"2a00::1", 6881, true, true},
+	}
+
+	for _, c := range cases {
+		dht.AllowPrivateAddrs = false
+		if dht.validAddr(net.ParseIP(c.ip), c.port) != c.valid {
+			t.Fatalf("%s:%d: expected valid %v", c.ip, c.port, c.valid)
+		}
+
+		dht.AllowPrivateAddrs = true
+		if dht.validAddr(net.ParseIP(c.ip), c.port) != c.private {
+			t.Fatalf("%s:%d: expected valid %v with private addrs", c.ip, c.port, c.private)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Package boltstore implements a dhtlistener.PeerStore backed by bbolt, so
+// announced peers survive restarts and memory stays bounded.
+//
+// To migrate from the in-memory store, copy it before leaving:
+//
+//	store, _ := boltstore.Open("peers.db")
+//	dhtlistener.CopyPeers(store, d.PeerStore.(dhtlistener.PeerRanger))
+package boltstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/2qif49lt/dhtlistener"
+	bolt "go.etcd.io/bbolt"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var peersBucket = []byte("peers")
+
+// Store is a PeerStore persisting peers in a bbolt database. Peers are kept
+// in one bucket per infohash, keyed by their compact ip/port info and
+// valued by the unix nano time they were last seen.
+type Store struct {
+	db *bolt.DB
+	// OnError is called with the errors of Insert and Expire, which can't
+	// return them. It may be nil.
+	OnError func(error)
+	errors  uint64 // accessed atomically
+}
+
+// Open opens or creates the database at path.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(peersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Errors returns how many errors occurred in Insert and Expire.
+func (s *Store) Errors() uint64 {
+	return atomic.LoadUint64(&s.errors)
+}
+
+func (s *Store) fail(err error) {
+	atomic.AddUint64(&s.errors, 1)
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+// encodePeer returns the compact ip/port info of the peer.
+func encodePeer(ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	key := make([]byte, len(ip)+2)
+	copy(key, ip)
+	binary.BigEndian.PutUint16(key[len(ip):], uint16(port))
+	return key
+}
+
+// decodePeer parses the compact ip/port info and the last seen time.
+func decodePeer(k, v []byte) (*dhtlistener.Peer, error) {
+	if (len(k) != 6 && len(k) != 18) || len(v) != 8 {
+		return nil, errors.New("invalid peer record")
+	}
+
+	ip := make(net.IP, len(k)-2)
+	copy(ip, k)
+
+	return &dhtlistener.Peer{
+		IP:       ip,
+		Port:     int(binary.BigEndian.Uint16(k[len(k)-2:])),
+		LastSeen: time.Unix(0, int64(binary.BigEndian.Uint64(v))),
+	}, nil
+}
+
+// Insert adds a peer of infoHash, a known peer just gets its time updated.
+func (s *Store) Insert(infoHash dhtlistener.InfoHash, peer *dhtlistener.Peer) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(peersBucket).CreateBucketIfNotExists([]byte(infoHash))
+		if err != nil {
+			return err
+		}
+
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(peer.LastSeen.UnixNano()))
+		return b.Put(encodePeer(peer.IP, peer.Port), v)
+	})
+	if err != nil {
+		s.fail(err)
+	}
+}
+
+// GetPeers returns at most size peers of infoHash, the recent ones first.
+func (s *Store) GetPeers(infoHash dhtlistener.InfoHash, size int) []*dhtlistener.Peer {
+	peers := make([]*dhtlistener.Peer, 0, size)
+
+	s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(peersBucket).Bucket([]byte(infoHash))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			if p, err := decodePeer(k, v); err == nil {
+				peers = append(peers, p)
+			}
+			return nil
+		})
+	})
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].LastSeen.After(peers[j].LastSeen)
+	})
+	if len(peers) > size {
+		peers = peers[:size]
+	}
+	return peers
+}
+
+// Expire removes the peers last seen before deadline and the infohashes
+// left without peers. It's the TTL-based compaction of the store.
+func (s *Store) Expire(deadline time.Time) int {
+	removed := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(peersBucket)
+		empty := make([][]byte, 0)
+
+		err := root.ForEach(func(infoHash, _ []byte) error {
+			b := root.Bucket(infoHash)
+			if b == nil {
+				return nil
+			}
+
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; {
+				p, err := decodePeer(k, v)
+				if err != nil || p.LastSeen.Before(deadline) {
+					if err := c.Delete(); err != nil {
+						return err
+					}
+					removed++
+					k, v = c.Seek(k)
+					continue
+				}
+				k, v = c.Next()
+			}
+
+			if k, _ := b.Cursor().First(); k == nil {
+				empty = append(empty, append([]byte(nil), infoHash...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, infoHash := range empty {
+			if err := root.DeleteBucket(infoHash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.fail(err)
+		return 0
+	}
+	return removed
+}
+
+// Count returns how many peers are stored.
+func (s *Store) Count() int {
+	n := 0
+
+	s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(peersBucket)
+		return root.ForEach(func(infoHash, _ []byte) error {
+			if b := root.Bucket(infoHash); b != nil {
+				n += b.Stats().KeyN
+			}
+			return nil
+		})
+	})
+	return n
+}
+
+// Range calls f for every peer until f returns false.
+func (s *Store) Range(f func(infoHash dhtlistener.InfoHash, peer *dhtlistener.Peer) bool) {
+	stop := errors.New("stop")
+
+	s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(peersBucket)
+		return root.ForEach(func(infoHash, _ []byte) error {
+			b := root.Bucket(infoHash)
+			if b == nil {
+				return nil
+			}
+
+			return b.ForEach(func(k, v []byte) error {
+				p, err := decodePeer(k, v)
+				if err == nil && !f(dhtlistener.InfoHash(infoHash), p) {
+					return stop
+				}
+				return nil
+			})
+		})
+	})
+}
@@ -0,0 +1,58 @@
+//go:build integration
+// +build integration
+
+// The integration tests need the real bbolt package, run them with
+// "go test -tags integration".
+
+package boltstore
+
+import (
+	"github.com/2qif49lt/dhtlistener"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.db")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i, ip := range []net.IP{net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), net.ParseIP("2001:db8::1")} {
+		s.Insert("infohash-aaaaaaaaaaa", &dhtlistener.Peer{IP: ip, Port: 6881 + i, LastSeen: now.Add(time.Duration(i) * time.Minute)})
+	}
+	s.Insert("infohash-bbbbbbbbbbb", &dhtlistener.Peer{IP: net.IPv4(1, 2, 3, 4), Port: 1, LastSeen: now.Add(-time.Hour)})
+
+	peers := s.GetPeers("infohash-aaaaaaaaaaa", 2)
+	if len(peers) != 2 || !peers[0].IP.Equal(net.ParseIP("2001:db8::1")) || peers[1].Port != 6882 {
+		t.Fatalf("expected the 2 most recent peers, got %+v", peers)
+	}
+	if s.Count() != 4 {
+		t.Fatalf("expected 4 peers, got %d", s.Count())
+	}
+
+	// the store persists across restarts.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if n := s.Expire(now.Add(-time.Minute)); n != 1 {
+		t.Fatalf("expected 1 peer expired, got %d", n)
+	}
+	seen := make(map[dhtlistener.InfoHash]int)
+	s.Range(func(infoHash dhtlistener.InfoHash, peer *dhtlistener.Peer) bool {
+		seen[infoHash]++
+		return true
+	})
+	if len(seen) != 1 || seen["infohash-aaaaaaaaaaa"] != 3 || s.Errors() != 0 {
+		t.Errorf("expected the empty infohash removed, got %v", seen)
+	}
+}
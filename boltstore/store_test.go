@@ -0,0 +1,26 @@
+package boltstore
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerRecord(t *testing.T) {
+	seen := time.Unix(1700000000, 123)
+	for _, ip := range []net.IP{net.IPv4(1, 2, 3, 4), net.ParseIP("2001:db8::1")} {
+		k := encodePeer(ip, 6881)
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(seen.UnixNano()))
+
+		p, err := decodePeer(k, v)
+		if err != nil || !p.IP.Equal(ip) || p.Port != 6881 || !p.LastSeen.Equal(seen) {
+			t.Errorf("unexpected peer %+v, %v", p, err)
+		}
+	}
+
+	if _, err := decodePeer([]byte{1, 2, 3}, make([]byte, 8)); err == nil {
+		t.Error("expected an invalid record rejected")
+	}
+}
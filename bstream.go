@@ -0,0 +1,186 @@
+package dhtlistener
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Limits bounds what a Decoder accepts, a zero field means no limit.
+type Limits struct {
+	MaxSize      int // bytes of a value
+	MaxStringLen int // bytes of a string
+	MaxDepth     int // nesting of lists and dicts
+	MaxDictKeys  int // keys of a dict
+}
+
+// DefaultLimits are the limits of the krpc messages a DHT accepts.
+var DefaultLimits = Limits{
+	MaxSize:      65536,
+	MaxStringLen: 8192,
+	MaxDepth:     8,
+	MaxDictKeys:  64,
+}
+
+var (
+	errMaxSize      = errors.New("value exceeds max size")
+	errMaxStringLen = errors.New("string exceeds max length")
+	errMaxDepth     = errors.New("value exceeds max depth")
+	errMaxDictKeys  = errors.New("dict exceeds max keys")
+)
+
+// byteReader is implemented by bufio.Reader and bytes.Reader.
+type byteReader interface {
+	io.Reader
+	io.ByteScanner
+}
+
+// Decoder reads and decodes bencoded values from a stream. It scans a value
+// checking its limits before decoding it, so crafted input can't allocate
+// huge buffers or recurse deeply.
+type Decoder struct {
+	r      byteReader
+	Limits Limits
+	buf    []byte
+}
+
+// NewDecoder returns a new Decoder reading from r with DefaultLimits.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br, Limits: DefaultLimits}
+}
+
+// Decode reads the next bencoded value from its input and stores it in the
+// value pointed to by v.
+func (d *Decoder) Decode(v interface{}) error {
+	d.buf = d.buf[:0]
+	if err := d.scan(0); err != nil {
+		return err
+	}
+	return Unmarshal(d.buf, v)
+}
+
+// readByte reads a byte into buf.
+func (d *Decoder) readByte() (byte, error) {
+	if d.Limits.MaxSize > 0 && len(d.buf) >= d.Limits.MaxSize {
+		return 0, errMaxSize
+	}
+
+	c, err := d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF && len(d.buf) != 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	d.buf = append(d.buf, c)
+	return c, nil
+}
+
+// readUntil reads the digits of an int or a string length, until delim.
+func (d *Decoder) readUntil(delim byte) (int, error) {
+	num, digits, neg := 0, 0, false
+
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case c == delim && digits != 0:
+			if neg {
+				num = -num
+			}
+			return num, nil
+		case c == '-' && delim == 'e' && digits == 0 && !neg:
+			neg = true
+		case '0' <= c && c <= '9' && digits < 18:
+			num = num*10 + int(c-'0')
+			digits++
+		default:
+			return 0, fmt.Errorf("invalid byte %q", c)
+		}
+	}
+}
+
+// scan reads a complete value at depth into buf.
+func (d *Decoder) scan(depth int) error {
+	c, err := d.readByte()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c == 'i':
+		_, err = d.readUntil('e')
+		return err
+	case c == 'l' || c == 'd':
+		if d.Limits.MaxDepth > 0 && depth >= d.Limits.MaxDepth {
+			return errMaxDepth
+		}
+
+		dict := c == 'd'
+		for n := 0; ; n++ {
+			next, err := d.r.ReadByte()
+			if err != nil {
+				return io.ErrUnexpectedEOF
+			}
+			d.r.UnreadByte()
+
+			if next == 'e' {
+				if dict && n%2 != 0 {
+					return errors.New("dict key without value")
+				}
+				_, err = d.readByte()
+				return err
+			}
+
+			if dict && n%2 == 0 {
+				if next < '0' || next > '9' {
+					return errors.New("expect type string")
+				}
+				if d.Limits.MaxDictKeys > 0 && n/2 >= d.Limits.MaxDictKeys {
+					return errMaxDictKeys
+				}
+			}
+
+			if err := d.scan(depth + 1); err != nil {
+				return err
+			}
+		}
+	case '0' <= c && c <= '9':
+		d.r.UnreadByte()
+		d.buf = d.buf[:len(d.buf)-1]
+
+		size, err := d.readUntil(':')
+		if err != nil {
+			return err
+		}
+		if d.Limits.MaxStringLen > 0 && size > d.Limits.MaxStringLen {
+			return errMaxStringLen
+		}
+		if d.Limits.MaxSize > 0 && len(d.buf)+size > d.Limits.MaxSize {
+			return errMaxSize
+		}
+
+		n := len(d.buf)
+		if cap(d.buf)-n < size {
+			buf := make([]byte, n, n+size)
+			copy(buf, d.buf)
+			d.buf = buf
+		}
+		d.buf = d.buf[:n+size]
+
+		if _, err := io.ReadFull(d.r, d.buf[n:]); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid byte %q", c)
+	}
+}
@@ -0,0 +1,68 @@
+package dhtlistener
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDecoderStream(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("d1:ai1ee4:spaml1:a1:bei-3e"))
+
+	var m map[string]interface{}
+	if err := dec.Decode(&m); err != nil || m["a"] != 1 {
+		t.Fatal(m, err)
+	}
+
+	var s string
+	if err := dec.Decode(&s); err != nil || s != "spam" {
+		t.Fatal(s, err)
+	}
+
+	var l []string
+	if err := dec.Decode(&l); err != nil || len(l) != 2 || l[1] != "b" {
+		t.Fatal(l, err)
+	}
+
+	var i int
+	if err := dec.Decode(&i); err != nil || i != -3 {
+		t.Fatal(i, err)
+	}
+
+	if err := dec.Decode(&i); err != io.EOF {
+		t.Fatal("expected io.EOF, got", err)
+	}
+}
+
+func TestDecoderLimits(t *testing.T) {
+	cases := []struct {
+		data   string
+		limits Limits
+		err    error
+	}{
+		{"999999999:a", Limits{MaxStringLen: 1024}, errMaxStringLen},
+		{"10:abcdefghij", Limits{MaxSize: 8}, errMaxSize},
+		{"llllleeeee", Limits{MaxDepth: 4}, errMaxDepth},
+		{"d1:ai1e1:bi2e1:ci3ee", Limits{MaxDictKeys: 2}, errMaxDictKeys},
+		{"d1:ai1e", Limits{}, io.ErrUnexpectedEOF},
+		{"5:abc", Limits{}, io.ErrUnexpectedEOF},
+	}
+
+	for _, c := range cases {
+		dec := NewDecoder(bytes.NewReader([]byte(c.data)))
+		dec.Limits = c.limits
+
+		var v interface{}
+		if err := dec.Decode(&v); err != c.err {
+			t.Errorf("%q: expected %v, got %v", c.data, c.err, err)
+		}
+	}
+
+	dec := NewDecoder(strings.NewReader("llllleeeee"))
+	dec.Limits = Limits{MaxDepth: 5}
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+}
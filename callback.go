@@ -0,0 +1,118 @@
+package dhtlistener
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// callback is a pending call of OnGetPeers or OnAnnouncePeer.
+type callback struct {
+	f        func(InfoHash, string, int)
+	infoHash InfoHash
+	ip       string
+	port     int
+	queued   time.Time
+}
+
+// dispatcher runs the user callbacks off the packet workers, so that a slow
+// one doesn't stall the packet handling.
+type dispatcher struct {
+	queue   chan callback
+	dropped uint64 // accessed atomically
+	lag     int64  // of the last call in nanoseconds, accessed atomically
+}
+
+// initCallbacks makes the dispatcher of the CallbackWorkers, if any. It's
+// called by init, the dispatcher is read once the dht is initialized.
+func (dht *DHT) initCallbacks() {
+	if dht.CallbackWorkers <= 0 {
+		return
+	}
+	size := dht.CallbackQueueSize
+	if size < 1 {
+		size = 1
+	}
+	dht.dispatcher = &dispatcher{queue: make(chan callback, size)}
+}
+
+// startCallbacks starts the CallbackWorkers calling the callbacks, they stop
+// when the dht is closed.
+func (dht *DHT) startCallbacks() {
+	d := dht.dispatcher
+	if d == nil {
+		return
+	}
+
+	for i := 0; i < dht.CallbackWorkers; i++ {
+		dht.spawn(func() {
+			for {
+				select {
+				case c := <-d.queue:
+					atomic.StoreInt64(&d.lag, int64(dht.now().Sub(c.queued)))
+					c.f(c.infoHash, c.ip, c.port)
+				case <-dht.done:
+					return
+				}
+			}
+		})
+	}
+}
+
+// callback calls f with infoHash, ip and port, through the callback
+// workers if they run. The calls dropped by CallbackDropPolicy are counted.
+func (dht *DHT) callback(f func(InfoHash, string, int), infoHash InfoHash, ip string, port int) {
+	d := dht.dispatcher
+	if d == nil {
+		f(infoHash, ip, port)
+		return
+	}
+
+	c := callback{f, infoHash, ip, port, dht.now()}
+	select {
+	case d.queue <- c:
+		return
+	default:
+	}
+
+	switch dht.CallbackDropPolicy {
+	case Block:
+		select {
+		case d.queue <- c:
+			return
+		case <-dht.done:
+			return
+		}
+	case DropOldest:
+		select {
+		case <-d.queue:
+			atomic.AddUint64(&d.dropped, 1)
+		default:
+		}
+		select {
+		case d.queue <- c:
+			return
+		default:
+		}
+	}
+	atomic.AddUint64(&d.dropped, 1)
+	dht.Logger.Debug("callback dropped, queue full")
+}
+
+// DroppedCallbacks returns how many calls of OnGetPeers and OnAnnouncePeer
+// have been dropped because the callback queue was full.
+func (dht *DHT) DroppedCallbacks() uint64 {
+	if !dht.initialized() || dht.dispatcher == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&dht.dispatcher.dropped)
+}
+
+// CallbackLag returns how long the last call of OnGetPeers or
+// OnAnnouncePeer waited in the callback queue. A growing lag means the
+// callbacks are too slow for the CallbackWorkers.
+func (dht *DHT) CallbackLag() time.Duration {
+	if !dht.initialized() || dht.dispatcher == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&dht.dispatcher.lag))
+}
@@ -0,0 +1,91 @@
+package dhtlistener
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCallbackDispatcher(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+
+	release := make(chan struct{})
+	calls := make(chan InfoHash, 16)
+	slow := func(infoHash InfoHash, ip string, port int) {
+		<-release
+		calls <- infoHash
+	}
+
+	// synchronous by default.
+	close(release)
+	dht.callback(slow, "sync", "1.2.3.4", 6881)
+	if len(calls) != 1 || <-calls != "sync" || dht.DroppedCallbacks() != 0 {
+		t.Fatal("expected a synchronous call")
+	}
+
+	dht = NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.CallbackWorkers, dht.CallbackQueueSize = 1, 2
+	dht.init()
+	defer dht.conn.Close()
+
+	release = make(chan struct{})
+	dht.startCallbacks()
+	defer close(dht.done)
+
+	// the worker is stuck on a, b and c are queued, d is dropped.
+	start := time.Now()
+	for _, ih := range []InfoHash{"a", "b", "c", "d"} {
+		dht.callback(slow, ih, "1.2.3.4", 6881)
+		if ih == "a" {
+			waitUntil(func() bool { return len(dht.dispatcher.queue) == 0 })
+		}
+	}
+	if time.Since(start) > time.Second {
+		t.Error("expected the handler not to be stalled")
+	}
+	if n := dht.DroppedCallbacks(); n != 1 {
+		t.Errorf("expected 1 dropped callback, got %d", n)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	for _, want := range []InfoHash{"a", "b", "c"} {
+		select {
+		case ih := <-calls:
+			if ih != want {
+				t.Errorf("expected %s, got %s", want, ih)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s to be called", want)
+		}
+	}
+	if lag := dht.CallbackLag(); lag < 10*time.Millisecond {
+		t.Errorf("expected the lag of c, got %v", lag)
+	}
+}
+
+func TestCallbackDropOldest(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.CallbackWorkers, dht.CallbackQueueSize, dht.CallbackDropPolicy = 1, 1, DropOldest
+	dht.init()
+	defer dht.conn.Close()
+
+	// no worker consumes the queue until the dht runs.
+	f := func(InfoHash, string, int) {}
+	dht.callback(f, "a", "1.2.3.4", 6881)
+	dht.callback(f, "b", "1.2.3.4", 6881)
+
+	if c := <-dht.dispatcher.queue; c.infoHash != "b" || dht.DroppedCallbacks() != 1 {
+		t.Errorf("expected a dropped for b, got %s", c.infoHash)
+	}
+}
@@ -0,0 +1,201 @@
+package dhtlistener
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// CapturedMessage is a line of a capture file, see StartCapture.
+type CapturedMessage struct {
+	Time time.Time `json:"time"`
+	Dir  string    `json:"dir"` // "in" or "out"
+	Addr string    `json:"addr"`
+	// Msg is the decoded message, its binary strings are hex encoded.
+	Msg interface{} `json:"msg"`
+	// Data is the packet, base64 in JSON.
+	Data []byte `json:"data"`
+}
+
+const (
+	// captureQueueSize is the number of messages waiting to be written to
+	// a capture file, the messages captured while it's full are dropped.
+	captureQueueSize = 1024
+	// captureFlushInterval is how often the capture file is flushed.
+	captureFlushInterval = time.Second
+)
+
+// capturedPacket is a packet waiting to be written to a capture file.
+type capturedPacket struct {
+	time time.Time
+	in   bool
+	addr *net.UDPAddr
+	data []byte
+}
+
+// capture holds the capture file of a DHT, its packets are decoded and
+// written by a goroutine so the capture doesn't slow the packets down.
+type capture struct {
+	file    *rotatingFile
+	mu      sync.RWMutex // guards closed against the sends to packets
+	closed  bool
+	packets chan capturedPacket
+	done    chan struct{} // closed once the packets are written
+	dropped uint64        // packets dropped by the full queue
+}
+
+var errCapturing = errors.New("a capture is already running")
+
+// StartCapture appends the krpc messages received and sent by dht, once
+// decoded, as JSON CapturedMessages to the file at path. The file is
+// rotated when it exceeds maxSize bytes unless it's 0, keeping maxBackups
+// rotated files, like a JSONLSink. It's flushed every second. It may be
+// called while the dht runs.
+func (dht *DHT) StartCapture(path string, maxSize int64, maxBackups int) error {
+	dht.captureMu.Lock()
+	defer dht.captureMu.Unlock()
+
+	if c, _ := dht.capture.Load().(*capture); c != nil {
+		return errCapturing
+	}
+
+	f, err := openRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return err
+	}
+	c := &capture{
+		file:    f,
+		packets: make(chan capturedPacket, captureQueueSize),
+		done:    make(chan struct{}),
+	}
+	go dht.writeCapture(c)
+	dht.capture.Store(c)
+	return nil
+}
+
+// StopCapture stops the capture started by StartCapture, once its
+// messages are written, and closes its file. It does nothing if none runs.
+func (dht *DHT) StopCapture() error {
+	dht.captureMu.Lock()
+	defer dht.captureMu.Unlock()
+
+	c, _ := dht.capture.Load().(*capture)
+	if c == nil {
+		return nil
+	}
+	dht.capture.Store((*capture)(nil))
+
+	c.mu.Lock()
+	c.closed = true
+	close(c.packets)
+	c.mu.Unlock()
+	<-c.done
+
+	if n := atomic.LoadUint64(&c.dropped); n > 0 {
+		dht.Logger.Warn("capture dropped messages", F("messages", n))
+	}
+	return c.file.Close()
+}
+
+// captureMessage records the message data, received from addr if in, sent
+// to it otherwise.
+func (dht *DHT) captureMessage(in bool, addr *net.UDPAddr, data []byte) {
+	c, _ := dht.capture.Load().(*capture)
+	if c == nil {
+		return
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return
+	}
+	select {
+	case c.packets <- capturedPacket{dht.now(), in, addr, append([]byte(nil), data...)}:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+// writeCapture writes the packets of c to its file until they're all
+// written, it flushes the file periodically.
+func (dht *DHT) writeCapture(c *capture) {
+	defer close(c.done)
+
+	ticker := time.NewTicker(captureFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case p, ok := <-c.packets:
+			if !ok {
+				return
+			}
+
+			var msg interface{}
+			Unmarshal(p.data, &msg)
+
+			dir := "out"
+			if p.in {
+				dir = "in"
+			}
+			if err := c.file.writeLine(&CapturedMessage{
+				Time: p.time,
+				Dir:  dir,
+				Addr: p.addr.String(),
+				Msg:  readable(msg),
+				Data: p.data,
+			}); err != nil {
+				dht.Logger.Warn("capture failed", F("err", err))
+			}
+		case <-ticker.C:
+			if err := c.file.Flush(); err != nil {
+				dht.Logger.Warn("capture failed", F("err", err))
+			}
+		}
+	}
+}
+
+// readable returns v, a decoded bencode value, with its strings which are
+// not printable text hex encoded.
+func readable(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if !printable(v) {
+			return hex.EncodeToString([]byte(v))
+		}
+		return v
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, item := range v {
+			ret[i] = readable(item)
+		}
+		return ret
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			ret[k] = readable(item)
+		}
+		return ret
+	default:
+		return v
+	}
+}
+
+// printable returns whether s is text without control characters.
+func printable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package dhtlistener
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.LocalAddr().(*net.UDPAddr)
+
+	id := GetRandString(20)
+	data, _ := Marshal(makeQuery("aa", pingType, &PingArgs{ID: id}))
+	handle(dht, packet{data: data, raddr: addr})
+
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	if err := dht.StartCapture(path, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := dht.StartCapture(path, 0, 0); err != errCapturing {
+		t.Errorf("expected %v, got %v", errCapturing, err)
+	}
+	handle(dht, packet{data: data, raddr: addr})
+	if err := dht.StopCapture(); err != nil {
+		t.Fatal(err)
+	}
+	handle(dht, packet{data: data, raddr: addr})
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var msgs []CapturedMessage
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var m CapturedMessage
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, m)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected the query and its response, got %d messages", len(msgs))
+	}
+
+	in, out := msgs[0], msgs[1]
+	if in.Dir != "in" || in.Addr != addr.String() || string(in.Data) != string(data) {
+		t.Errorf("unexpected query %+v", in)
+	}
+	q, _ := in.Msg.(map[string]interface{})
+	a, _ := q["a"].(map[string]interface{})
+	if q["q"] != pingType || a["id"] != hex.EncodeToString([]byte(id)) {
+		t.Errorf("expected a readable ping, got %v", in.Msg)
+	}
+	if r, _ := out.Msg.(map[string]interface{}); out.Dir != "out" || r["y"] != "r" {
+		t.Errorf("unexpected response %+v", out)
+	}
+}
+
+func TestCaptureStop(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	if err := dht.StartCapture(path, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+	data, _ := Marshal(makeQuery("aa", pingType, &PingArgs{ID: GetRandString(20)}))
+	dht.captureMessage(true, addr, data)
+
+	// the messages are flushed without stopping the capture.
+	for i := 0; ; i++ {
+		if fi, err := os.Stat(path); err == nil && fi.Size() > 0 {
+			break
+		}
+		if i == 30 {
+			t.Fatal("expected the capture flushed")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	// the messages captured while the capture stops are written or
+	// dropped.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				dht.captureMessage(j%2 == 0, addr, data)
+			}
+		}()
+	}
+	if err := dht.StopCapture(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,137 @@
+package dhtlistener
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// clientCacheSize bounds the number of addresses whose client is
+// remembered, to count the packets sent by client.
+const clientCacheSize = 1 << 14
+
+// clientNames maps the two first bytes of the "v" field of krpc messages,
+// see BEP 20, to the name of the client.
+var clientNames = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BT": "BitTorrent",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"ML": "MLDonkey",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"XL": "Xunlei",
+	"lt": "rTorrent",
+}
+
+// ClientName returns the name of the client sending the "v" field v,
+// "unknown" if its prefix isn't known and "none" if v is empty.
+func ClientName(v string) string {
+	if v == "" {
+		return "none"
+	}
+	if len(v) >= 2 {
+		if name, ok := clientNames[v[:2]]; ok {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// version returns the "v" field of m, ok is false if it's set but isn't
+// a string.
+func (m *rawMessage) version() (v string, ok bool) {
+	if len(m.V) == 0 {
+		return "", true
+	}
+	return v, Unmarshal(m.V, &v) == nil
+}
+
+// client returns the name of the client sending m, see ClientName.
+func (m *rawMessage) client() string {
+	v, ok := m.version()
+	if !ok {
+		return "unknown"
+	}
+	return ClientName(v)
+}
+
+// clientCache remembers the client of the addresses heard from. It keeps
+// two generations of at most clientCacheSize/2 addresses, the older one is
+// dropped when the newer one is full.
+type clientCache struct {
+	sync.Mutex
+	cur  map[netip.AddrPort]string
+	prev map[netip.AddrPort]string
+}
+
+// newClientCache returns a new clientCache pointer.
+func newClientCache() *clientCache {
+	return &clientCache{
+		cur:  make(map[netip.AddrPort]string),
+		prev: make(map[netip.AddrPort]string),
+	}
+}
+
+// clientKey returns the key of addr in a clientCache.
+func clientKey(addr *net.UDPAddr) netip.AddrPort {
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// put records that addr runs the client name.
+func (c *clientCache) put(addr *net.UDPAddr, name string) {
+	key := clientKey(addr)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.cur[key]; !ok && len(c.cur) >= clientCacheSize/2 {
+		c.prev, c.cur = c.cur, make(map[netip.AddrPort]string)
+	}
+	c.cur[key] = name
+}
+
+// get returns the client of addr, "unknown" if it's not been heard from
+// recently.
+func (c *clientCache) get(addr *net.UDPAddr) string {
+	key := clientKey(addr)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if name, ok := c.cur[key]; ok {
+		return name
+	}
+	if name, ok := c.prev[key]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ClientTraffic is the number of packets exchanged with a client.
+type ClientTraffic struct {
+	PacketsIn  uint64 `json:"packets_in"`
+	PacketsOut uint64 `json:"packets_out"` // to the addresses heard from
+}
+
+// ClientStats returns the packets received and sent by client name, see
+// ClientName. The packets sent to addresses not heard from recently are
+// counted as unknown.
+func (dht *DHT) ClientStats() map[string]ClientTraffic {
+	ret := make(map[string]ClientTraffic)
+	for name, n := range dht.metrics.clients.Snapshot() {
+		t := ret[name]
+		t.PacketsIn = n
+		ret[name] = t
+	}
+	for name, n := range dht.metrics.clientsOut.Snapshot() {
+		t := ret[name]
+		t.PacketsOut = n
+		ret[name] = t
+	}
+	return ret
+}
@@ -0,0 +1,77 @@
+package dhtlistener
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientName(t *testing.T) {
+	for v, name := range map[string]string{
+		"":           "none",
+		"LT\x01\x02": "libtorrent",
+		"UT\x00\x05": "µTorrent",
+		"lt\x0d\x65": "rTorrent",
+		"ZZ\x00\x00": "unknown",
+		"L":          "unknown",
+	} {
+		if got := ClientName(v); got != name {
+			t.Errorf("%q: expected %s, got %s", v, name, got)
+		}
+	}
+}
+
+func TestClientVersion(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.Version = "DL\x00\x01"
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.LocalAddr().(*net.UDPAddr)
+
+	q := makeQuery("aa", pingType, &PingArgs{ID: GetRandString(20)})
+	q.V = "TR\x02\x94"
+	data, _ := Marshal(q)
+	handle(dht, packet{data: data, raddr: addr})
+
+	buf := make([]byte, 1500)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := l.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply rawMessage
+	if err := Unmarshal(buf[:n], &reply); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := reply.version(); v != dht.Version {
+		t.Errorf("expected our version %q, got %q", dht.Version, v)
+	}
+
+	if n := dht.ClientStats()["Transmission"]; n != (ClientTraffic{1, 1}) {
+		t.Errorf("expected a Transmission packet each way, got %+v", n)
+	}
+
+	// a "v" which isn't a string doesn't drop the message.
+	data, _ = Marshal(map[string]interface{}{
+		"t": "bb", "y": "q", "q": pingType, "v": 5,
+		"a": map[string]interface{}{"id": GetRandString(20)},
+	})
+	handle(dht, packet{data: data, raddr: addr})
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := l.ReadFromUDP(buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := dht.ClientStats()["unknown"]; n != (ClientTraffic{1, 1}) {
+		t.Errorf("expected an unknown packet each way, got %+v", n)
+	}
+}
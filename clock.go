@@ -0,0 +1,62 @@
+package dhtlistener
+
+import "time"
+
+// Clock is the time source of a DHT: the transaction timeouts, the token
+// rotation, the peer expiry and the bucket refresh follow it. It's the
+// system clock by default, tests replace it to skip time instead of
+// sleeping.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTicker returns a Ticker sending the time every d.
+	NewTicker(d time.Duration) Ticker
+	// NewTimer returns a Timer sending the time once d elapsed.
+	NewTimer(d time.Duration) Timer
+}
+
+// Ticker is a time.Ticker of a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer is a time.Timer of a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time { return t.Ticker.C }
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
+
+// now returns the current time of the clock of dht, of the system clock if
+// it's unset.
+func (dht *DHT) now() time.Time {
+	if dht.Clock == nil {
+		return time.Now()
+	}
+	return dht.Clock.Now()
+}
@@ -0,0 +1,238 @@
+package dhtlistener
+
+import (
+	"encoding/hex"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only moves by Advance.
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer is a Ticker, or a Timer if period is 0, of a fakeClock.
+type fakeTimer struct {
+	clock  *fakeClock
+	c      chan time.Time
+	next   time.Time
+	period time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1e9, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) add(d, period time.Duration) *fakeTimer {
+	c.Lock()
+	defer c.Unlock()
+
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), next: c.now.Add(d), period: period}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker { return fakeTicker{c.add(d, d)} }
+func (c *fakeClock) NewTimer(d time.Duration) Timer   { return c.add(d, 0) }
+
+// Advance moves the time d forward and fires the timers which are due,
+// a ticker sends a single tick like a time.Ticker its reader is late for.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		if t.next.After(c.now) {
+			timers = append(timers, t)
+			continue
+		}
+
+		select {
+		case t.c <- c.now:
+		default:
+		}
+		if t.period > 0 {
+			for !t.next.After(c.now) {
+				t.next = t.next.Add(t.period)
+			}
+			timers = append(timers, t)
+		}
+	}
+	c.timers = timers
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+// fakeTicker is the Ticker of a fakeTimer.
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() { t.fakeTimer.Stop() }
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.Lock()
+	defer c.Unlock()
+
+	for i, v := range c.timers {
+		if v == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// waitUntil waits for f to return true, for at most a second.
+func waitUntil(f func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+func TestClockTransactionTimeout(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	clock := newFakeClock()
+	dht.Clock = clock
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+	tm := dht.transacts
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go tm.run()
+	tm.ping(&node{addr: l.LocalAddr().(*net.UDPAddr)})
+	if !waitUntil(func() bool { return tm.len() == 1 }) {
+		t.Fatal("expected a transaction")
+	}
+
+	// sent Try times, each waits for QueryTimeout.
+	clock.Advance(dht.QueryTimeout - time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if tm.len() != 1 {
+		t.Fatal("the transaction should not time out yet")
+	}
+
+	clock.Advance(dht.QueryTimeout * time.Duration(dht.Try))
+	if !waitUntil(func() bool { return tm.len() == 0 }) {
+		t.Fatal("the transaction should time out")
+	}
+	if n := atomic.LoadUint64(&dht.metrics.transTimeout); n != 1 {
+		t.Fatalf("expected a timeout, got %d", n)
+	}
+}
+
+func TestClockPeerExpiry(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	clock := newFakeClock()
+	dht.Clock = clock
+	dht.PeerTTL = time.Minute
+	dht.init()
+	defer dht.conn.Close()
+
+	p := newPeer(net.IPv4(1, 2, 3, 4), 6881, "")
+	p.LastSeen = dht.now()
+	dht.peers.Insert("abcdefghij0123456789", p)
+
+	dht.spawn(dht.expirePeers)
+	defer dht.wg.Wait()
+	defer close(dht.done)
+
+	clock.Advance(dht.PeerTTL / 2)
+	time.Sleep(10 * time.Millisecond)
+	if dht.peers.Count() != 1 {
+		t.Fatal("the peer should be kept")
+	}
+
+	// the clock moves on before expirePeers waits for its ticker.
+	for i := 0; i < 3 && dht.peers.Count() != 0; i++ {
+		clock.Advance(dht.PeerTTL)
+		waitUntil(func() bool { return dht.peers.Count() == 0 })
+	}
+	if dht.peers.Count() != 0 {
+		t.Fatal("the peer should expire")
+	}
+}
+
+func TestClockNodeState(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	defer dht.conn.Close()
+	clock := newFakeClock()
+	dht.Clock = clock
+
+	no, _ := newNode(GetRandString(20), "udp", "127.0.0.1:6881", time.Now())
+	no.heardResponse(dht.now())
+	if s := no.state(dht.now(), dht.NodeExpireTime); s != nodeGood {
+		t.Fatalf("expected a good node, got %d", s)
+	}
+	clock.Advance(dht.NodeExpireTime)
+	if s := no.state(dht.now(), dht.NodeExpireTime); s != nodeQuestionable {
+		t.Fatalf("expected a questionable node, got %d", s)
+	}
+}
+
+func TestClockTokens(t *testing.T) {
+	clock := newFakeClock()
+	tm := newTokenMgr(clock.Now)
+	s := tm.state()
+	if !s.Rotated.Equal(clock.Now()) {
+		t.Fatalf("unexpected rotation time %v", s.Rotated)
+	}
+
+	clock.Advance(time.Minute * 7)
+	tm.rotate()
+	if !tm.state().Rotated.Equal(clock.Now()) {
+		t.Fatal("expected the rotation at the clock time")
+	}
+
+	// the saved secret is as old as the clock says.
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+	for _, c := range []struct {
+		age   time.Duration
+		valid bool
+	}{
+		{time.Minute * 7, true},
+		{time.Minute * 11, false},
+	} {
+		restored := newTokenMgr(clock.Now)
+		s.Rotated = clock.Now().Add(-c.age)
+		restored.restore(s, time.Minute*5)
+		secret, _ := hex.DecodeString(s.Secret)
+		if ok := restored.check(addr, genToken(string(secret), addr.IP)); ok != c.valid {
+			t.Errorf("expected the token of secrets %v old valid: %v", c.age, c.valid)
+		}
+	}
+}
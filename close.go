@@ -0,0 +1,118 @@
+package dhtlistener
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var errClosed = errors.New("dht closed")
+
+// spawn runs f in a goroutine which Close waits for.
+func (dht *DHT) spawn(f func()) {
+	dht.wg.Add(1)
+	go func() {
+		defer dht.wg.Done()
+		f()
+	}()
+}
+
+// every calls f every interval until the dht is closed.
+func (dht *DHT) every(interval time.Duration, f func()) {
+	ticker := dht.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			f()
+		case <-dht.done:
+			return
+		}
+	}
+}
+
+// isStarted returns whether Run has started the dht, what it initialized
+// may be read once it returns true.
+func (dht *DHT) isStarted() bool {
+	select {
+	case <-dht.started:
+		return true
+	default:
+		return false
+	}
+}
+
+// initialized returns whether init is done, what it sets may be read once
+// it returns true.
+func (dht *DHT) initialized() bool {
+	return atomic.LoadInt32(&dht.inited) != 0
+}
+
+// running returns whether the dht is initialized and Close hasn't been
+// called.
+func (dht *DHT) running() bool {
+	return dht.initialized() && !dht.closed()
+}
+
+// closed returns whether Close has been called.
+func (dht *DHT) closed() bool {
+	select {
+	case <-dht.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the dht: it stops the read loops, cancels the in-flight
+// queries, closes the sockets and waits for the goroutines of the dht to
+// exit, then removes the port mapping and closes the PeerStore if it's an
+// io.Closer so persistent stores flush their writes. It returns ctx.Err()
+// if ctx is done first, Close may be called again to keep waiting. Run
+// returns once Close is called.
+func (dht *DHT) Close(ctx context.Context) error {
+	dht.closeOnce.Do(func() {
+		dht.startMu.Lock()
+		defer dht.startMu.Unlock()
+
+		close(dht.done)
+
+		conns := dht.conns
+		if conns == nil {
+			conns = []Transport{dht.conn}
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+
+		if dht.queue != nil {
+			dht.queue.close()
+		}
+	})
+
+	exited := make(chan struct{})
+	go func() {
+		dht.wg.Wait()
+		close(exited)
+	}()
+
+	select {
+	case <-exited:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	dht.unmapPort()
+	dht.StopCapture()
+
+	var err error
+	dht.storeOnce.Do(func() {
+		if c, ok := dht.peers.(io.Closer); ok {
+			err = c.Close()
+		}
+	})
+	return err
+}
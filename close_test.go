@@ -0,0 +1,82 @@
+package dhtlistener
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type closingStore struct {
+	PeerStore
+	closed int
+}
+
+func (s *closingStore) Close() error {
+	s.closed++
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.EntranceAddrs = nil
+	dht.FetchMetadata = true
+
+	store := &closingStore{}
+	store.PeerStore = newPeersManager(dht)
+	dht.PeerStore = store
+
+	returned := make(chan struct{})
+	go func() {
+		dht.Run()
+		close(returned)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := dht.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := dht.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("Run should return once closed")
+	}
+
+	if store.closed != 1 {
+		t.Fatalf("expected the store to be closed once, got %d", store.closed)
+	}
+	if _, err := dht.conn.WriteToUDP([]byte("x"), dht.me.addr); err == nil {
+		t.Fatal("the socket should be closed")
+	}
+}
+
+func TestCloseShards(t *testing.T) {
+	dht, err := New(WithAddr("127.0.0.1:0"), WithShards(4), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Close races with the start of Run.
+	go dht.Run()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := dht.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1)
+	for _, conn := range dht.conns {
+		if _, _, err := conn.ReadFromUDP(buf); err == nil {
+			t.Fatalf("expected %v closed", conn.LocalAddr())
+		}
+	}
+}
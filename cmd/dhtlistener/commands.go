@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/2qif49lt/dhtlistener"
+	"net/http"
+	"os"
+	"time"
+)
+
+// node runs the commands other than run.
+type node interface {
+	getPeers(infoHash string) ([]peer, error)
+	announce(infoHash string, port int) (int, error)
+	routingTable() ([]dhtlistener.NodeInfo, error)
+	close()
+}
+
+// adminNode is a running listener reached by its admin api.
+type adminNode struct {
+	url string
+}
+
+// call sends a request to the admin api and decodes its response into v.
+func (a adminNode) call(method, path string, body, v interface{}) error {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+
+	req, err := http.NewRequest(method, a.url+path, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("admin api: %s: %s", resp.Status, e.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (a adminNode) getPeers(infoHash string) (peers []peer, err error) {
+	err = a.call("POST", "/lookup/"+infoHash, nil, &peers)
+	return
+}
+
+func (a adminNode) announce(infoHash string, port int) (int, error) {
+	var resp struct {
+		Nodes int `json:"nodes"`
+	}
+	err := a.call("POST", "/announce", map[string]interface{}{
+		"infohash": infoHash,
+		"port":     port,
+	}, &resp)
+	return resp.Nodes, err
+}
+
+func (a adminNode) routingTable() (nodes []dhtlistener.NodeInfo, err error) {
+	err = a.call("GET", "/routing-table", nil, &nodes)
+	return
+}
+
+func (a adminNode) close() {}
+
+// localNode is a temporary node joining the dht for a command.
+type localNode struct {
+	*dhtlistener.DHT
+}
+
+// newLocalNode returns a running localNode, once its routing table is big
+// enough or after --bootstrap-wait.
+func newLocalNode() (*localNode, error) {
+	d, err := newDHT(":0")
+	if err != nil {
+		return nil, err
+	}
+	go d.Run()
+
+	deadline := time.Now().Add(*bootstrapWait)
+	for time.Now().Before(deadline) && d.Stats().Nodes < 2*d.K {
+		time.Sleep(time.Millisecond * 200)
+	}
+	return &localNode{d}, nil
+}
+
+func (l *localNode) getPeers(infoHash string) ([]peer, error) {
+	peers, err := l.GetPeers(infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]peer, 0, len(peers))
+	for _, p := range peers {
+		ret = append(ret, peer{p.IP.String(), p.Port, p.LastSeen})
+	}
+	return ret, nil
+}
+
+func (l *localNode) announce(infoHash string, port int) (int, error) {
+	return l.Announce(infoHash, port)
+}
+
+func (l *localNode) routingTable() ([]dhtlistener.NodeInfo, error) {
+	return l.RoutingTable().AllNodes(), nil
+}
+
+func (l *localNode) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	l.Close(ctx)
+}
+
+// openNode returns the node of the commands, see usage.
+func openNode() (node, error) {
+	if *adminAddr != "" {
+		return adminNode{"http://" + *adminAddr}, nil
+	}
+	return newLocalNode()
+}
+
+// checkInfoHash checks a hex infohash.
+func checkInfoHash(infoHash string) error {
+	if data, err := hex.DecodeString(infoHash); err != nil || len(data) != 20 {
+		return errors.New("invalid infohash, 40 hex digits expected")
+	}
+	return nil
+}
+
+// writeLines writes each value of v as a JSON line to stdout.
+func writeLines(n int, v func(i int) interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	for i := 0; i < n; i++ {
+		enc.Encode(v(i))
+	}
+}
+
+func getPeers(infoHash string) error {
+	if err := checkInfoHash(infoHash); err != nil {
+		return err
+	}
+
+	no, err := openNode()
+	if err != nil {
+		return err
+	}
+	defer no.close()
+
+	peers, err := no.getPeers(infoHash)
+	if err != nil {
+		return err
+	}
+	writeLines(len(peers), func(i int) interface{} { return peers[i] })
+	return nil
+}
+
+func announce(infoHash string, port int) error {
+	if err := checkInfoHash(infoHash); err != nil {
+		return err
+	}
+	if port < 0 || port > 65535 {
+		return errors.New("invalid port")
+	}
+
+	no, err := openNode()
+	if err != nil {
+		return err
+	}
+	defer no.close()
+
+	n, err := no.announce(infoHash, port)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("announced to %d nodes\n", n)
+	return nil
+}
+
+func dumpRoutingTable() error {
+	no, err := openNode()
+	if err != nil {
+		return err
+	}
+	defer no.close()
+
+	nodes, err := no.routingTable()
+	if err != nil {
+		return err
+	}
+	writeLines(len(nodes), func(i int) interface{} { return nodes[i] })
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/2qif49lt/dhtlistener"
+	"github.com/2qif49lt/dhtlistener/geoip"
+	flag "github.com/2qif49lt/pflag"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var srvaddr = flag.StringP("addr", "a", "", "address ip:port")
+var proxyURL = flag.String("proxy", "", "socks5://[user:password@]host:port proxy relaying the dht packets and the metadata connections")
+var lsd = flag.Bool("lsd", false, "discover the peers of the local network, see BEP 14")
+var nodeIDFile = flag.String("node-id-file", "", "file keeping the node id across restarts")
+var configPath = flag.StringP("config", "c", "", "config file, reloaded on SIGHUP")
+var adminAddr = flag.String("admin", "", "admin api address ip:port, served by run and used by the other commands, disabled if empty")
+var output = flag.StringP("output", "o", "", "file the events are appended to by run, stdout if empty")
+var outputMaxSize = flag.Int64("output-max-size", 100, "size in MB the output file is rotated at, 0 disables the rotation")
+var outputBackups = flag.Int("output-backups", 5, "number of rotated output files kept")
+var capturePath = flag.String("capture", "", "file the krpc messages are appended to by run for debugging, rotated like the output")
+var eventNames = flag.StringSlice("events", []string{"metadata"}, "events written by run: announce, get_peers, metadata")
+var geoipCity = flag.String("geoip-city", "", "MaxMind City database locating the peers of the events, reloaded when it changes")
+var geoipASN = flag.String("geoip-asn", "", "MaxMind ASN database of the peers of the events, reloaded when it changes")
+var bootstrapWait = flag.Duration("bootstrap-wait", time.Second*10, "max time the other commands wait for the bootstrap without --admin")
+
+const usage = `usage: dhtlistener [flags] [command]
+
+commands:
+  run                          run the listener, writing its events as JSON lines
+  get-peers <infohash>         print the peers of a hex infohash
+  announce <infohash> <port>   announce a peer of a hex infohash, 0 for our port
+  dump-routing-table           print the nodes of the routing table
+  router                       run a bootstrap router on :6881 unless --addr is set
+
+The other commands than run use the admin api of a running listener with
+--admin, a temporary node otherwise.
+
+flags:
+`
+
+var eventTypes = map[string]dhtlistener.EventType{
+	"announce":  dhtlistener.EventPeerAnnounced,
+	"get_peers": dhtlistener.EventGetPeersSeen,
+	"metadata":  dhtlistener.EventMetadataReceived,
+}
+
+// stdoutSink writes the events as JSON lines to stdout.
+type stdoutSink struct {
+	w *bufio.Writer
+}
+
+func (s stdoutSink) Write(e dhtlistener.Event) error {
+	if se := dhtlistener.NewStreamEvent(e); se != nil {
+		return json.NewEncoder(s.w).Encode(se)
+	}
+	return nil
+}
+
+func (s stdoutSink) Flush() error { return s.w.Flush() }
+func (s stdoutSink) Close() error { return s.w.Flush() }
+
+// peer is a line written by get-peers.
+type peer struct {
+	IP       string    `json:"ip"`
+	Port     int       `json:"port"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func fatal(v ...interface{}) {
+	fmt.Fprintln(os.Stderr, v...)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cmd, args := "run", flag.Args()
+	if len(args) != 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+	switch {
+	case cmd == "run" && len(args) == 0:
+		err = run()
+	case cmd == "get-peers" && len(args) == 1:
+		err = getPeers(args[0])
+	case cmd == "announce" && len(args) == 2:
+		var port int
+		if port, err = strconv.Atoi(args[1]); err == nil {
+			err = announce(args[0], port)
+		}
+	case cmd == "dump-routing-table" && len(args) == 0:
+		err = dumpRoutingTable()
+	case cmd == "router" && len(args) == 0:
+		err = router()
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// newDHT returns a DHT configured by the flags, listening on defaultAddr
+// unless they set the address.
+func newDHT(defaultAddr string) (*dhtlistener.DHT, error) {
+	if *srvaddr == "" && *configPath == "" {
+		*srvaddr = defaultAddr
+	}
+
+	opts := make([]dhtlistener.Option, 0, 4)
+	if *configPath != "" {
+		opts = append(opts, dhtlistener.WithConfigFile(*configPath))
+	}
+	if *srvaddr != "" {
+		opts = append(opts, dhtlistener.WithAddr(*srvaddr))
+	}
+	if *proxyURL != "" {
+		opts = append(opts, dhtlistener.WithProxy(*proxyURL))
+	}
+	if *lsd {
+		opts = append(opts, dhtlistener.WithLSD())
+	}
+	if *nodeIDFile != "" {
+		opts = append(opts, dhtlistener.WithNodeIDFile(*nodeIDFile))
+	}
+	return dhtlistener.New(opts...)
+}
+
+// router runs a bootstrap router until it's interrupted.
+func router() error {
+	d, err := newDHT(":6881")
+	if err != nil {
+		return err
+	}
+	d.Router = true
+	d.PublishExpvar("dht")
+
+	if *adminAddr != "" {
+		go func() {
+			if err := d.ServeAdmin(*adminAddr); err != nil {
+				fmt.Fprintln(os.Stderr, "admin api:", err)
+			}
+		}()
+	}
+
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		d.Close(ctx)
+	}()
+
+	d.Run()
+	return nil
+}
+
+func run() error {
+	go func() {
+		http.ListenAndServe(":6060", nil)
+	}()
+
+	types := make([]dhtlistener.EventType, 0, len(*eventNames))
+	for _, name := range *eventNames {
+		t, ok := eventTypes[name]
+		if !ok {
+			return fmt.Errorf("unknown event %q", name)
+		}
+		types = append(types, t)
+	}
+
+	d, err := newDHT(":0")
+	if err != nil {
+		return err
+	}
+	d.FetchMetadata = true
+	d.PublishExpvar("dht")
+
+	if *geoipCity != "" || *geoipASN != "" {
+		geo, err := geoip.Open(*geoipCity, *geoipASN, time.Minute)
+		if err != nil {
+			return err
+		}
+		defer geo.Close()
+		geo.OnError = func(err error) { fmt.Fprintln(os.Stderr, "geoip reload failed:", err) }
+		d.GeoIP = geo
+	}
+
+	if *adminAddr != "" {
+		go func() {
+			if err := d.ServeAdmin(*adminAddr); err != nil {
+				fmt.Fprintln(os.Stderr, "admin api:", err)
+			}
+		}()
+	}
+
+	var sink dhtlistener.Sink = stdoutSink{bufio.NewWriter(os.Stdout)}
+	if *output != "" {
+		if sink, err = dhtlistener.NewJSONLSink(*output, *outputMaxSize<<20, *outputBackups); err != nil {
+			return err
+		}
+	}
+	d.AddSink(sink, types...)
+
+	if *capturePath != "" {
+		if err := d.StartCapture(*capturePath, *outputMaxSize<<20, *outputBackups); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		hups := make(chan os.Signal, 1)
+		signal.Notify(hups, syscall.SIGHUP)
+		for range hups {
+			if *configPath == "" {
+				continue
+			}
+			if err := d.ReloadFile(*configPath); err != nil {
+				fmt.Fprintln(os.Stderr, "reload failed:", err)
+			}
+		}
+	}()
+
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		d.Close(ctx)
+	}()
+
+	d.Run()
+
+	// Run returns once Close is called, wait for the sink to be closed.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	return d.Close(ctx)
+}
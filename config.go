@@ -1,9 +1,600 @@
 package dhtlistener
 
-const ()
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
 
-// Config defines the configuration of a dht listener.
+// Config is the configuration of the DHT made by New. Validate fills its
+// zero fields with defaults. The other settings are the exported fields of
+// DHT, which may be changed before Run.
+//
+// The fields from QueryRateLimit on may also be changed at runtime, see
+// Reload.
 type Config struct {
-	// the size of nodes in response
+	// Addr is the listen address, "ip:port" or an ip for a random port.
+	Addr string
+	// Transport, if set, is used instead of a socket listening on Addr. The
+	// dht closes it when it's closed.
+	Transport Transport
+	// Proxy, if set, is the "socks5://[user:password@]host:port" url of
+	// the proxy relaying the UDP packets, from a socket listening on Addr,
+	// and the TCP connections of the metadata fetcher, see Socks5. It's
+	// ignored if Transport is set, Shards and the socket options can't be
+	// used with it.
+	Proxy string
+	// K is the size of the buckets and of the nodes lists in responses.
 	K int
+	// Try is the number of times a query is sent before it fails.
+	Try int
+	// QueryTries overrides Try by built-in query type, each in [1, 16].
+	QueryTries map[string]int
+	// AdaptiveTries stops retrying the query types rarely answered once
+	// retried, see DHT.AdaptiveTries.
+	AdaptiveTries bool
+	// QueryTimeout is how long a response is waited for, Try times.
+	QueryTimeout time.Duration
+	// BootstrapNodes are the "host:port" addresses joined at startup, the
+	// default ones if nil.
+	BootstrapNodes []string
+	// Workers is the number of goroutines handling the received packets.
+	Workers int
+	// QueueSize is the max number of received packets waiting for workers.
+	QueueSize int
+	// QueryQueueSize is the max number of queries waiting to be sent.
+	QueryQueueSize int
+	// CallbackWorkers is the number of goroutines calling OnGetPeers and
+	// OnAnnouncePeer, 0 calls them synchronously, CallbackQueueSize the max
+	// number of pending calls and CallbackDropPolicy one of "newest", the
+	// default, "oldest" and "block", see DHT.CallbackWorkers.
+	CallbackWorkers    int
+	CallbackQueueSize  int
+	CallbackDropPolicy string
+	// MaxTransactions is the max number of queries in flight, a negative
+	// value means no limit.
+	MaxTransactions int
+	// MaxSubnetQueries is the max number of queries in flight to a subnet,
+	// 0, the default, means no limit, see DHT.MaxSubnetQueries.
+	MaxSubnetQueries int
+	// CongestionRate is the timeout rate, in [0, 1], over which fewer
+	// queries are sent, 0, the default, never, see DHT.CongestionRate.
+	CongestionRate float64
+	// QueryDedupePolicy is one of "target", the default, "type" and "none",
+	// see DHT.QueryDedupePolicy.
+	QueryDedupePolicy string
+	// ReadBuffer and WriteBuffer are the socket buffer sizes, TOS and TTL
+	// the IP options of the packets sent, see DHT.ReadBuffer and DHT.TOS.
+	ReadBuffer  int
+	WriteBuffer int
+	TOS         int
+	TTL         int
+	// Shards is the number of sockets bound to Addr, see DHT.Shards.
+	Shards int
+	// Version is the client version sent in the "v" field, see
+	// DHT.Version.
+	Version string
+	// NodeID is our hex encoded node id, NodeIDFile the file keeping it
+	// across restarts and IDRotateInterval how often it's replaced, see
+	// DHT.NodeID.
+	NodeID           string
+	NodeIDFile       string
+	IDRotateInterval time.Duration
+	// TokenFile keeps the secrets of the tokens across restarts, see
+	// DHT.TokenFile.
+	TokenFile string
+	// Router and RouterMaxNodes make a bootstrap router of the dht, see
+	// DHT.Router.
+	Router         bool
+	RouterMaxNodes int
+	// LSD enables the local service discovery, see DHT.LSD.
+	LSD bool
+	// HealthMinNodes is the number of nodes of a bootstrapped routing
+	// table and HealthWindow how recent the traffic of a healthy dht is,
+	// see DHT.HealthMinNodes.
+	HealthMinNodes int
+	HealthWindow   time.Duration
+	// EventsOrigins are the origins of the web pages allowed to open the
+	// websocket of EventsHandler, see DHT.EventsOrigins.
+	EventsOrigins []string
+	// MinAnnouncePort is the lowest port accepted from the announce_peer
+	// queries and ImpliedPortPolicy one of "honor", the default, "ignore"
+	// and "reject", see DHT.MinAnnouncePort. MatchAnnouncePort rejects the
+	// announced ports other than the source port, see
+	// DHT.MatchAnnouncePort.
+	MinAnnouncePort   int
+	ImpliedPortPolicy string
+	MatchAnnouncePort bool
+	// Logger receives the events of the dht. If nil, they are written to
+	// stderr when LogLevel is set and discarded otherwise.
+	Logger Logger
+
+	// QueryRateLimit and QueryBurst limit the queries per second accepted
+	// from a source ip, GlobalQueryRateLimit and GlobalQueryBurst from all
+	// of them. A negative rate means no limit.
+	QueryRateLimit       float64
+	QueryBurst           int
+	GlobalQueryRateLimit float64
+	GlobalQueryBurst     int
+	// AnnounceRateLimit and AnnounceBurst limit the announces of an
+	// infohash per second accepted from a source ip, see
+	// DHT.AnnounceRateLimit. They're not limited if it's 0 or negative.
+	AnnounceRateLimit float64
+	AnnounceBurst     int
+	// SendRateLimit and SendByteRateLimit limit the packets and bytes per
+	// second sent, a negative rate means no limit.
+	SendRateLimit     float64
+	SendByteRateLimit float64
+	// LogLevel is one of "debug", "info", "warn" and "error", it applies to
+	// a StdLogger.
+	LogLevel string
+	// DisableCallbacks stops calling OnGetPeers and OnAnnouncePeer, the
+	// events are still published.
+	DisableCallbacks bool
+	// Blocklist are the blocked ips and ranges, see Blocklist.Add, and
+	// BlocklistFiles the blocklist files, see Blocklist.Load. If both are
+	// nil, the blocklist is left unchanged.
+	Blocklist      []string
+	BlocklistFiles []string
+
+	err error // of an option
+}
+
+// DefaultConfig returns the default configuration.
+func DefaultConfig() Config {
+	return Config{
+		Addr:         ":6881",
+		K:            8,
+		Try:          2,
+		QueryTimeout: time.Second * 15,
+		BootstrapNodes: []string{
+			"router.bittorrent.com:6881",
+			"router.utorrent.com:6881",
+			"dht.transmissionbt.com:6881",
+		},
+		Workers:         100,
+		QueueSize:       1024,
+		QueryQueueSize:  1024,
+		MaxTransactions: 4096,
+		QueryRateLimit:  10,
+		QueryBurst:      20,
+	}
+}
+
+// parseLevel returns the level of a StdLogger named name.
+func parseLevel(name string) (int, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// Validate fills the zero fields of c with defaults and checks the others.
+func (c *Config) Validate() error {
+	if c.err != nil {
+		return c.err
+	}
+	def := DefaultConfig()
+
+	if c.Addr == "" {
+		c.Addr = def.Addr
+	}
+	if c.BootstrapNodes == nil {
+		c.BootstrapNodes = def.BootstrapNodes
+	}
+	if c.MaxTransactions == 0 {
+		c.MaxTransactions = def.MaxTransactions
+	}
+	if c.CongestionRate < 0 || c.CongestionRate > 1 {
+		return fmt.Errorf("CongestionRate should be in [0, 1], got %g", c.CongestionRate)
+	}
+	if c.QueryTimeout == 0 {
+		c.QueryTimeout = def.QueryTimeout
+	}
+	if c.QueryRateLimit == 0 {
+		c.QueryRateLimit = def.QueryRateLimit
+	}
+
+	for _, f := range []struct {
+		name string
+		v    *int
+		def  int
+		max  int
+	}{
+		{"K", &c.K, def.K, 256},
+		{"Try", &c.Try, def.Try, 16},
+		{"Workers", &c.Workers, def.Workers, 1 << 16},
+		{"QueueSize", &c.QueueSize, def.QueueSize, 1 << 24},
+		{"QueryQueueSize", &c.QueryQueueSize, def.QueryQueueSize, 1 << 24},
+		{"CallbackWorkers", &c.CallbackWorkers, 0, 1 << 16},
+		{"CallbackQueueSize", &c.CallbackQueueSize, 0, 1 << 24},
+		{"QueryBurst", &c.QueryBurst, def.QueryBurst, 1 << 24},
+		{"GlobalQueryBurst", &c.GlobalQueryBurst, 0, 1 << 24},
+		{"AnnounceBurst", &c.AnnounceBurst, 0, 1 << 16},
+		{"ReadBuffer", &c.ReadBuffer, 0, 1 << 30},
+		{"WriteBuffer", &c.WriteBuffer, 0, 1 << 30},
+		{"TOS", &c.TOS, 0, 255},
+		{"TTL", &c.TTL, 0, 255},
+		{"Shards", &c.Shards, 0, 1024},
+		{"RouterMaxNodes", &c.RouterMaxNodes, 0, 1 << 26},
+		{"MinAnnouncePort", &c.MinAnnouncePort, 0, 65535},
+		{"HealthMinNodes", &c.HealthMinNodes, 0, 1 << 20},
+	} {
+		if *f.v == 0 {
+			*f.v = f.def
+		}
+		if *f.v < 0 || *f.v > f.max {
+			return fmt.Errorf("%s should be in [0, %d], got %d", f.name, f.max, *f.v)
+		}
+	}
+
+	for q, try := range c.QueryTries {
+		if !queryTypes[q] {
+			return errors.New("unknown query type " + q)
+		}
+		if try < 1 || try > 16 {
+			return fmt.Errorf("QueryTries of %s should be in [1, 16], got %d", q, try)
+		}
+	}
+
+	if c.Proxy != "" {
+		if _, err := ParseSocks5(c.Proxy); err != nil {
+			return err
+		}
+		if c.Transport == nil && (c.Shards > 1 || c.ReadBuffer > 0 ||
+			c.WriteBuffer > 0 || c.TOS > 0 || c.TTL > 0) {
+			return errors.New("Shards and the socket options can't be used with Proxy")
+		}
+	}
+
+	if c.NodeID != "" {
+		if _, err := parseNodeID(c.NodeID); err != nil {
+			return err
+		}
+	}
+	if c.IDRotateInterval < 0 {
+		return errors.New("IDRotateInterval should be positive")
+	}
+	if c.HealthWindow < 0 {
+		return errors.New("HealthWindow should be positive")
+	}
+	for _, o := range c.EventsOrigins {
+		if _, err := parseOrigin(o); err != nil {
+			return err
+		}
+	}
+
+	if c.CallbackDropPolicy != "" {
+		if _, err := parseDropPolicy(c.CallbackDropPolicy); err != nil {
+			return err
+		}
+	}
+	if c.ImpliedPortPolicy != "" {
+		if _, err := parseImpliedPortPolicy(c.ImpliedPortPolicy); err != nil {
+			return err
+		}
+	}
+	if c.QueryDedupePolicy != "" {
+		if _, err := parseQueryDedupePolicy(c.QueryDedupePolicy); err != nil {
+			return err
+		}
+	}
+
+	if c.LogLevel != "" {
+		if _, err := parseLevel(c.LogLevel); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range c.Blocklist {
+		if _, err := parseRange(s); err != nil {
+			return fmt.Errorf("invalid blocklist range %q: %v", s, err)
+		}
+	}
+
+	if c.QueryTimeout < 0 {
+		return errors.New("QueryTimeout should be positive")
+	}
+
+	for _, addr := range c.BootstrapNodes {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid bootstrap node %q: %v", addr, err)
+		}
+	}
+	return nil
+}
+
+// Option changes a Config.
+type Option func(*Config)
+
+// WithAddr sets the listen address.
+func WithAddr(addr string) Option {
+	return func(c *Config) { c.Addr = addr }
+}
+
+// WithK sets the size of the buckets and of the nodes lists.
+func WithK(k int) Option {
+	return func(c *Config) { c.K = k }
+}
+
+// WithTry sets the number of times a query is sent.
+func WithTry(try int) Option {
+	return func(c *Config) { c.Try = try }
+}
+
+// WithQueryTimeout sets how long a response is waited for.
+func WithQueryTimeout(d time.Duration) Option {
+	return func(c *Config) { c.QueryTimeout = d }
+}
+
+// WithBootstrapNodes sets the addresses joined at startup, none disables
+// the bootstrap.
+func WithBootstrapNodes(addrs ...string) Option {
+	return func(c *Config) { c.BootstrapNodes = append([]string{}, addrs...) }
+}
+
+// WithWorkers sets the number of goroutines handling the received packets.
+func WithWorkers(n int) Option {
+	return func(c *Config) { c.Workers = n }
+}
+
+// WithQueueSize sets the max number of received packets waiting for
+// workers.
+func WithQueueSize(n int) Option {
+	return func(c *Config) { c.QueueSize = n }
+}
+
+// WithQueryQueueSize sets the max number of queries waiting to be sent.
+func WithQueryQueueSize(n int) Option {
+	return func(c *Config) { c.QueryQueueSize = n }
+}
+
+// WithCallbackWorkers calls OnGetPeers and OnAnnouncePeer from workers
+// goroutines, queueing at most queueSize calls, see
+// Config.CallbackWorkers.
+func WithCallbackWorkers(workers, queueSize int, dropPolicy string) Option {
+	return func(c *Config) {
+		c.CallbackWorkers, c.CallbackQueueSize, c.CallbackDropPolicy = workers, queueSize, dropPolicy
+	}
+}
+
+// WithMaxSubnetQueries sets the max number of queries in flight to a
+// subnet.
+func WithMaxSubnetQueries(n int) Option {
+	return func(c *Config) { c.MaxSubnetQueries = n }
+}
+
+// WithCongestionRate sets the timeout rate over which fewer queries are
+// sent.
+func WithCongestionRate(rate float64) Option {
+	return func(c *Config) { c.CongestionRate = rate }
+}
+
+// WithMaxTransactions sets the max number of queries in flight.
+func WithMaxTransactions(n int) Option {
+	return func(c *Config) { c.MaxTransactions = n }
+}
+
+// WithQueryTries sets the number of times a query of type q is sent,
+// instead of Try.
+func WithQueryTries(q string, try int) Option {
+	return func(c *Config) {
+		if c.QueryTries == nil {
+			c.QueryTries = make(map[string]int)
+		}
+		c.QueryTries[q] = try
+	}
+}
+
+// WithAdaptiveTries stops retrying the query types rarely answered once
+// retried.
+func WithAdaptiveTries() Option {
+	return func(c *Config) { c.AdaptiveTries = true }
+}
+
+// WithQueryDedupePolicy sets which query to a node is dropped while another
+// one is in flight, see Config.QueryDedupePolicy.
+func WithQueryDedupePolicy(policy string) Option {
+	return func(c *Config) { c.QueryDedupePolicy = policy }
+}
+
+// WithTransport sets the transport used instead of a UDP socket.
+func WithTransport(t Transport) Option {
+	return func(c *Config) { c.Transport = t }
+}
+
+// WithProxy sets the url of the SOCKS5 proxy, see Config.Proxy.
+func WithProxy(proxy string) Option {
+	return func(c *Config) { c.Proxy = proxy }
+}
+
+// WithSocketBuffers sets the SO_RCVBUF and SO_SNDBUF sizes of the sockets.
+func WithSocketBuffers(read, write int) Option {
+	return func(c *Config) { c.ReadBuffer, c.WriteBuffer = read, write }
+}
+
+// WithShards sets the number of sockets bound to the address with
+// SO_REUSEPORT, see DHT.Shards.
+func WithShards(shards int) Option {
+	return func(c *Config) { c.Shards = shards }
+}
+
+// WithVersion sets the client version sent in the "v" field.
+func WithVersion(v string) Option {
+	return func(c *Config) { c.Version = v }
+}
+
+// WithPacketConn sets the conn used instead of a UDP socket, see
+// PacketConnTransport. The dht closes it when it's closed.
+func WithPacketConn(pc net.PacketConn) Option {
+	return func(c *Config) { c.Transport = PacketConnTransport(pc) }
+}
+
+// WithNodeID sets our hex encoded node id.
+func WithNodeID(id string) Option {
+	return func(c *Config) { c.NodeID = id }
+}
+
+// WithNodeIDFile sets the file keeping our node id across restarts.
+func WithNodeIDFile(path string) Option {
+	return func(c *Config) { c.NodeIDFile = path }
+}
+
+// WithTokenFile sets the file keeping the token secrets across restarts.
+func WithTokenFile(path string) Option {
+	return func(c *Config) { c.TokenFile = path }
+}
+
+// WithIDRotateInterval sets how often our node id is replaced.
+func WithIDRotateInterval(d time.Duration) Option {
+	return func(c *Config) { c.IDRotateInterval = d }
+}
+
+// WithRouter makes a bootstrap router caching up to maxNodes nodes, the
+// default if 0, see DHT.Router.
+func WithRouter(maxNodes int) Option {
+	return func(c *Config) { c.Router, c.RouterMaxNodes = true, maxNodes }
+}
+
+// WithLSD enables the local service discovery, see DHT.LSD.
+func WithLSD() Option {
+	return func(c *Config) { c.LSD = true }
+}
+
+// WithHealth sets the number of nodes of a bootstrapped routing table and
+// how recent the traffic of a healthy dht is, see DHT.HealthMinNodes.
+func WithHealth(minNodes int, window time.Duration) Option {
+	return func(c *Config) { c.HealthMinNodes, c.HealthWindow = minNodes, window }
+}
+
+// WithEventsOrigins sets the origins of the web pages allowed to open the
+// websocket of EventsHandler, see DHT.EventsOrigins.
+func WithEventsOrigins(origins ...string) Option {
+	return func(c *Config) { c.EventsOrigins = origins }
+}
+
+// WithAnnouncePorts sets the lowest port accepted from the announce_peer
+// queries and how their implied_port flag is handled, see
+// Config.MinAnnouncePort.
+func WithAnnouncePorts(minPort int, impliedPortPolicy string) Option {
+	return func(c *Config) { c.MinAnnouncePort, c.ImpliedPortPolicy = minPort, impliedPortPolicy }
+}
+
+// WithMatchAnnouncePort rejects the announced ports other than the source
+// port of the announce_peer queries, see Config.MatchAnnouncePort.
+func WithMatchAnnouncePort() Option {
+	return func(c *Config) { c.MatchAnnouncePort = true }
+}
+
+// WithLogger sets the logger.
+func WithLogger(logger Logger) Option {
+	return func(c *Config) { c.Logger = logger }
+}
+
+// WithLogLevel sets the level of a StdLogger, see Config.LogLevel.
+func WithLogLevel(level string) Option {
+	return func(c *Config) { c.LogLevel = level }
+}
+
+// WithConfig replaces the whole configuration, later options change it.
+func WithConfig(config Config) Option {
+	return func(c *Config) { *c = config }
+}
+
+// New returns a new DHT configured by opts applied to DefaultConfig, or
+// the error of the invalid configuration or of the listen.
+func New(opts ...Option) (*DHT, error) {
+	config := DefaultConfig()
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	var dht *DHT
+	var err error
+	var proxy *Socks5
+	if config.Transport == nil && config.Proxy != "" {
+		proxy, _ = ParseSocks5(config.Proxy) // checked by Validate
+		if config.Transport, err = proxy.ListenUDP(config.Addr); err != nil {
+			return nil, err
+		}
+	}
+	if config.Transport != nil {
+		if dht, err = newDhtOn(config.Transport); err == nil {
+			dht.shared = true
+		} else if proxy != nil {
+			config.Transport.Close()
+		}
+	} else {
+		dht, err = newDht(config.Addr, config.Shards)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if proxy != nil {
+		dht.DialTCP = proxy.Dial
+	}
+	dht.K = config.K
+	dht.Try = config.Try
+	dht.QueryTimeout = config.QueryTimeout
+	dht.EntranceAddrs = config.BootstrapNodes
+	dht.Workers = config.Workers
+	dht.QueueSize = config.QueueSize
+	dht.QueryQueueSize = config.QueryQueueSize
+	dht.CallbackWorkers = config.CallbackWorkers
+	if config.CallbackQueueSize > 0 {
+		dht.CallbackQueueSize = config.CallbackQueueSize
+	}
+	if config.CallbackDropPolicy != "" {
+		dht.CallbackDropPolicy, _ = parseDropPolicy(config.CallbackDropPolicy) // checked by Validate
+	}
+	dht.MaxTransactions = config.MaxTransactions
+	dht.MaxSubnetQueries, dht.CongestionRate = config.MaxSubnetQueries, config.CongestionRate
+	dht.Version = config.Version
+	dht.NodeID, dht.NodeIDFile = config.NodeID, config.NodeIDFile
+	dht.TokenFile = config.TokenFile
+	dht.IDRotateInterval = config.IDRotateInterval
+	dht.Router, dht.RouterMaxNodes = config.Router, config.RouterMaxNodes
+	dht.LSD = config.LSD
+	dht.HealthMinNodes, dht.HealthWindow = config.HealthMinNodes, config.HealthWindow
+	dht.EventsOrigins = config.EventsOrigins
+	dht.MinAnnouncePort, dht.MatchAnnouncePort = config.MinAnnouncePort, config.MatchAnnouncePort
+	if config.ImpliedPortPolicy != "" {
+		dht.ImpliedPortPolicy, _ = parseImpliedPortPolicy(config.ImpliedPortPolicy) // checked by Validate
+	}
+	if config.QueryDedupePolicy != "" {
+		dht.QueryDedupePolicy, _ = parseQueryDedupePolicy(config.QueryDedupePolicy) // checked by Validate
+	}
+	dht.QueryTries, dht.AdaptiveTries = config.QueryTries, config.AdaptiveTries
+	dht.ReadBuffer, dht.WriteBuffer = config.ReadBuffer, config.WriteBuffer
+	dht.TOS, dht.TTL = config.TOS, config.TTL
+	if dht.MaxTransactions < 0 {
+		dht.MaxTransactions = 0
+	}
+	if dht.MaxSubnetQueries < 0 {
+		dht.MaxSubnetQueries = 0
+	}
+
+	switch {
+	case config.Logger != nil:
+		dht.Logger = config.Logger
+	case config.LogLevel != "":
+		dht.Logger = NewStdLogger(os.Stderr, LevelInfo)
+	}
+
+	if err := dht.reload(&config); err != nil {
+		for _, conn := range dht.conns {
+			conn.Close()
+		}
+		return nil, err
+	}
+	return dht, nil
 }
@@ -0,0 +1,68 @@
+package dhtlistener
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	c := Config{K: 16}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.K != 16 || c.Try != 2 || c.Workers != 100 || len(c.BootstrapNodes) != 3 {
+		t.Fatalf("unexpected defaults %+v", c)
+	}
+
+	for _, c := range []Config{
+		{K: -1},
+		{Try: 100},
+		{Workers: -5},
+		{BootstrapNodes: []string{"no-port"}},
+		{HealthWindow: -time.Second},
+		{EventsOrigins: []string{"example.com"}},
+		{Proxy: "socks5://127.0.0.1:1080", Shards: 4},
+		{Proxy: "socks5://127.0.0.1:1080", ReadBuffer: 1 << 20},
+		{CallbackWorkers: -1},
+		{CallbackDropPolicy: "random"},
+		{QueryTries: map[string]int{"pnig": 2}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Fatalf("expected %+v to be invalid", c)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	dht, err := New(
+		WithAddr("127.0.0.1:0"),
+		WithK(16),
+		WithTry(3),
+		WithBootstrapNodes(),
+		WithWorkers(4),
+		WithQueryQueueSize(8),
+		WithMaxTransactions(-1),
+		WithHealth(4, 30*time.Second),
+		WithCallbackWorkers(2, 16, "oldest"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dht.Close(context.Background())
+
+	if dht.K != 16 || dht.Try != 3 || dht.Workers != 4 || dht.MaxTransactions != 0 ||
+		len(dht.EntranceAddrs) != 0 || dht.HealthMinNodes != 4 || dht.HealthWindow != 30*time.Second ||
+		dht.CallbackWorkers != 2 || dht.CallbackQueueSize != 16 || dht.CallbackDropPolicy != DropOldest {
+		t.Fatal("options not applied")
+	}
+
+	dht.init()
+	if cap(dht.transacts.queryChan) != 8 {
+		t.Fatal("expected a query queue of 8, got", cap(dht.transacts.queryChan))
+	}
+
+	if _, err := New(WithK(0), WithTry(-1)); err == nil {
+		t.Fatal("expected an invalid config error")
+	}
+}
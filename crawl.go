@@ -0,0 +1,92 @@
+package dhtlistener
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// CrawlOptions configures Crawl.
+type CrawlOptions struct {
+	// Rate is the number of find_node queries sent per second.
+	Rate int
+	// MaxNodes stops the crawl once this many distinct nodes have been
+	// queried, 0 means no limit.
+	MaxNodes int
+	// Duration stops the crawl once elapsed, 0 means no limit.
+	Duration time.Duration
+}
+
+// discover hands a node learned from a response to the running crawl, it
+// never blocks.
+func (dht *DHT) discover(no *node) {
+	if atomic.LoadInt32(&dht.crawling) == 0 {
+		return
+	}
+
+	select {
+	case dht.frontier <- no:
+	default:
+	}
+}
+
+// Crawl random-walks the network: it sends find_node queries for random
+// targets, at opts.Rate per second, to the nodes learned from the previous
+// responses, or to the routing table nodes closest to the target when there
+// is none. It expands the routing table and spreads our id to as many nodes
+// as possible. It returns the number of distinct nodes queried once a stop
+// condition is met or the dht is closed, 0 in router mode. The dht must be
+// running.
+func (dht *DHT) Crawl(opts CrawlOptions) int {
+	if dht.Router {
+		return 0
+	}
+	if opts.Rate < 1 {
+		opts.Rate = 1
+	}
+
+	atomic.AddInt32(&dht.crawling, 1)
+	defer atomic.AddInt32(&dht.crawling, -1)
+
+	ticker := dht.Clock.NewTicker(time.Second / time.Duration(opts.Rate))
+	defer ticker.Stop()
+
+	var deadline <-chan time.Time
+	if opts.Duration > 0 {
+		timer := dht.Clock.NewTimer(opts.Duration)
+		defer timer.Stop()
+		deadline = timer.C()
+	}
+
+	queried := newDedupeCache(time.Hour, 1<<20)
+	count := 0
+
+	for opts.MaxNodes <= 0 || count < opts.MaxNodes {
+		select {
+		case <-ticker.C():
+		case <-deadline:
+			return count
+		case <-dht.done:
+			return count
+		}
+
+		target := GetRandString(20)
+
+		var no *node
+		select {
+		case no = <-dht.frontier:
+		default:
+			if closest := dht.rt.FindClosest(newHashId(target), 1); len(closest) != 0 {
+				no = closest[0]
+			}
+		}
+		if no == nil {
+			continue
+		}
+
+		if !queried.Seen(no.address().String()) {
+			count++
+		}
+		dht.transacts.findNode(no, target)
+	}
+	return count
+}
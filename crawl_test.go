@@ -0,0 +1,43 @@
+package dhtlistener
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCrawl(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.Close(context.Background())
+
+	discover := func(port int) {
+		atomic.StoreInt32(&dht.crawling, 1)
+		dht.discover(&node{
+			id:   newHashId(GetRandString(20)),
+			addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port},
+		})
+		atomic.StoreInt32(&dht.crawling, 0)
+	}
+	for _, port := range []int{1, 1, 2, 3} {
+		discover(port)
+	}
+
+	if n := dht.Crawl(CrawlOptions{Rate: 1000, MaxNodes: 3, Duration: time.Second}); n != 3 {
+		t.Fatalf("expected 3 nodes, got %d", n)
+	}
+	if n := len(dht.transacts.queryChan); n != 4 {
+		t.Fatalf("expected 4 queries, got %d", n)
+	}
+
+	start := time.Now()
+	dht.Crawl(CrawlOptions{Rate: 1000, Duration: 50 * time.Millisecond})
+	if time.Since(start) > time.Second {
+		t.Fatal("the crawl should stop after its duration")
+	}
+}
@@ -0,0 +1,249 @@
+package dhtlistener
+
+import (
+	"container/list"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// Deduper remembers keys for a while, see DHT.FirstSeen.
+type Deduper interface {
+	// Seen returns whether key has been seen recently, then remembers it.
+	Seen(key string) bool
+}
+
+// dedupeCache remembers keys for about ttl, holding at most size keys. It
+// keeps two generations of keys, the older one is dropped when the newer
+// one is full or older than ttl, so a key is remembered between ttl and
+// twice ttl unless the cache overflows.
+type dedupeCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	size    int
+	cur     map[string]struct{}
+	prev    map[string]struct{}
+	rotated time.Time
+}
+
+// firstSeen returns whether the callbacks of query type q fire for
+// infoHash, see FirstSeen.
+func (dht *DHT) firstSeen(q, infoHash string) bool {
+	return dht.FirstSeen == nil || !dht.FirstSeen.Seen(q+infoHash)
+}
+
+// NewBucketDeduper returns a Deduper remembering at most size keys in two
+// generations of ttl. It's cheap and approximate: a key is remembered
+// between ttl and twice ttl unless size keys come in between.
+func NewBucketDeduper(ttl time.Duration, size int) Deduper {
+	return newDedupeCache(ttl, size)
+}
+
+// newDedupeCache returns a new dedupeCache pointer.
+func newDedupeCache(ttl time.Duration, size int) *dedupeCache {
+	if size < 2 {
+		size = 2
+	}
+
+	return &dedupeCache{
+		ttl:     ttl,
+		size:    size,
+		cur:     make(map[string]struct{}),
+		prev:    make(map[string]struct{}),
+		rotated: time.Now(),
+	}
+}
+
+// Seen implements Deduper.
+func (dc *dedupeCache) Seen(key string) bool {
+	dc.Lock()
+	defer dc.Unlock()
+
+	if len(dc.cur) >= dc.size/2 || time.Since(dc.rotated) > dc.ttl {
+		dc.prev, dc.cur = dc.cur, make(map[string]struct{})
+		dc.rotated = time.Now()
+	}
+
+	if _, ok := dc.cur[key]; ok {
+		return true
+	}
+	_, ok := dc.prev[key]
+	dc.cur[key] = struct{}{}
+	return ok
+}
+
+// forget forgets key, so it's not seen anymore.
+func (dc *dedupeCache) forget(key string) {
+	dc.Lock()
+	defer dc.Unlock()
+
+	delete(dc.cur, key)
+	delete(dc.prev, key)
+}
+
+// len returns how many keys are remembered.
+func (dc *dedupeCache) len() int {
+	dc.Lock()
+	defer dc.Unlock()
+
+	return len(dc.cur) + len(dc.prev)
+}
+
+// lruEntry is an element of an lruDeduper.
+type lruEntry struct {
+	key  string
+	seen time.Time
+}
+
+// lruDeduper remembers the size most recently seen keys for ttl each.
+type lruDeduper struct {
+	sync.Mutex
+	ttl   time.Duration
+	size  int
+	order *list.List // of *lruEntry, most recent first
+	keys  map[string]*list.Element
+}
+
+// NewLRUDeduper returns a Deduper remembering a key for ttl after it was
+// reported unseen, it forgets the least recently seen keys beyond size.
+// It's exact but takes about 100 bytes per key.
+func NewLRUDeduper(ttl time.Duration, size int) Deduper {
+	if size < 1 {
+		size = 1
+	}
+
+	return &lruDeduper{
+		ttl:   ttl,
+		size:  size,
+		order: list.New(),
+		keys:  make(map[string]*list.Element),
+	}
+}
+
+// Seen implements Deduper.
+func (ld *lruDeduper) Seen(key string) bool {
+	ld.Lock()
+	defer ld.Unlock()
+
+	now := time.Now()
+	if el, ok := ld.keys[key]; ok {
+		ld.order.MoveToFront(el)
+
+		e := el.Value.(*lruEntry)
+		if now.Sub(e.seen) < ld.ttl {
+			return true
+		}
+		e.seen = now
+		return false
+	}
+
+	ld.keys[key] = ld.order.PushFront(&lruEntry{key, now})
+	if ld.order.Len() > ld.size {
+		oldest := ld.order.Back()
+		ld.order.Remove(oldest)
+		delete(ld.keys, oldest.Value.(*lruEntry).key)
+	}
+	return false
+}
+
+// bloomFilter is a bloom filter using double hashing.
+type bloomFilter struct {
+	bits []uint64
+	k    uint64 // hashes per key
+	n    int    // keys added
+}
+
+// newBloomFilter returns a bloomFilter sized for n keys at a false
+// positive rate p.
+func newBloomFilter(n int, p float64) *bloomFilter {
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(n)*math.Ln2))
+
+	return &bloomFilter{
+		bits: make([]uint64, (uint64(m)+63)/64),
+		k:    uint64(k),
+	}
+}
+
+// hashes returns the two hashes of key the bit indexes derive from.
+func hashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+	h.Write([]byte{0})
+	return h1, h.Sum64() | 1
+}
+
+// has returns whether key may have been added.
+func (bf *bloomFilter) has(h1, h2 uint64) bool {
+	m := uint64(len(bf.bits)) * 64
+	for i := uint64(0); i < bf.k; i++ {
+		bit := (h1 + i*h2) % m
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// add adds a key.
+func (bf *bloomFilter) add(h1, h2 uint64) {
+	m := uint64(len(bf.bits)) * 64
+	for i := uint64(0); i < bf.k; i++ {
+		bit := (h1 + i*h2) % m
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	}
+	bf.n++
+}
+
+// bloomDeduper keeps two generations of bloom filters, like dedupeCache.
+type bloomDeduper struct {
+	sync.Mutex
+	ttl       time.Duration
+	size      int
+	p         float64
+	cur, prev *bloomFilter
+	rotated   time.Time
+}
+
+// NewBloomDeduper returns a Deduper remembering keys in two generations of
+// bloom filters of ttl, each holding size keys with a false positive rate
+// p. It takes a few bytes per key but reports some unseen keys as seen.
+func NewBloomDeduper(ttl time.Duration, size int, p float64) Deduper {
+	if size < 1 {
+		size = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.001
+	}
+
+	return &bloomDeduper{
+		ttl:     ttl,
+		size:    size,
+		p:       p,
+		cur:     newBloomFilter(size, p),
+		prev:    newBloomFilter(size, p),
+		rotated: time.Now(),
+	}
+}
+
+// Seen implements Deduper.
+func (bd *bloomDeduper) Seen(key string) bool {
+	h1, h2 := hashes(key)
+
+	bd.Lock()
+	defer bd.Unlock()
+
+	if bd.cur.n >= bd.size || time.Since(bd.rotated) > bd.ttl {
+		bd.prev, bd.cur = bd.cur, newBloomFilter(bd.size, bd.p)
+		bd.rotated = time.Now()
+	}
+
+	if bd.cur.has(h1, h2) {
+		return true
+	}
+	seen := bd.prev.has(h1, h2)
+	bd.cur.add(h1, h2)
+	return seen
+}
@@ -0,0 +1,70 @@
+package dhtlistener
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLRUDeduper(t *testing.T) {
+	d := NewLRUDeduper(time.Hour, 2)
+	if d.Seen("a") || !d.Seen("a") {
+		t.Fatal("expected a to be seen once")
+	}
+
+	d.Seen("b")
+	d.Seen("a")
+	d.Seen("c") // evicts b, the least recently seen
+	if !d.Seen("a") || d.Seen("b") {
+		t.Error("expected b to be evicted")
+	}
+
+	d = NewLRUDeduper(time.Millisecond, 2)
+	d.Seen("a")
+	time.Sleep(time.Millisecond * 2)
+	if d.Seen("a") {
+		t.Error("expected a to expire")
+	}
+}
+
+func TestBloomDeduper(t *testing.T) {
+	d := NewBloomDeduper(time.Hour, 1000, 0.01)
+	if d.Seen("a") || !d.Seen("a") {
+		t.Fatal("expected a to be seen once")
+	}
+
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if d.Seen(fmt.Sprint("key", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 30 {
+		t.Errorf("too many false positives: %d", falsePositives)
+	}
+
+	// the keys are kept for a generation once the filter is full.
+	if !d.Seen("key999") {
+		t.Error("expected key999 to be remembered")
+	}
+}
+
+func TestFirstSeen(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	defer dht.conn.Close()
+
+	if !dht.firstSeen(getPeersType, "a") || !dht.firstSeen(getPeersType, "a") {
+		t.Error("expected every sight without deduper")
+	}
+
+	dht.FirstSeen = NewBucketDeduper(time.Hour, 16)
+	if !dht.firstSeen(getPeersType, "a") || dht.firstSeen(getPeersType, "a") {
+		t.Error("expected the first sight only")
+	}
+	if !dht.firstSeen(announcePeerType, "a") {
+		t.Error("expected the query types to be deduplicated apart")
+	}
+}
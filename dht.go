@@ -1,9 +1,13 @@
 package dhtlistener
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,114 +15,609 @@ type DHT struct {
 	K              int
 	me             *node
 	addr           string
-	conn           *net.UDPConn
+	conn           Transport
+	conns          []Transport
 	Try            int
 	EntranceAddrs  []string
-	packets        chan packet
-	works          chan struct{}
-	rt             *routetable
-	peers          *peersManager
+	queue          *packetQueue
+	done           chan struct{}
+	started        chan struct{} // closed once Run has started the dht
+	inited         int32         // set atomically once init is done
+	closeOnce      sync.Once
+	startMu        sync.Mutex // held while Run starts the dht, and by Close
+	storeOnce      sync.Once
+	wg             sync.WaitGroup
+	rt             routingTable // set before init to replace the trie
+	peers          PeerStore
 	transacts      *transactionManager
 	tokens         *tokenMgr
-	OnGetPeers     func(string, string, int)
-	OnAnnouncePeer func(string, string, int)
+	metrics        *metrics
+	clients        *clientCache
+	events         *eventBus
+	fetcher        *metadataFetcher
+	seen           *dedupeCache                // shared by a Manager, may be nil
+	ids            []*HashID                   // virtual ids, me first
+	targetIDs      []*HashID                   // see AddVirtualIDNear
+	idMu           sync.RWMutex                // guards me.id, ids and targetIDs
+	frontier       chan *node                  // nodes to crawl
+	crawling       int32                       // running crawls, accessed atomically
+	sampler        *Sampler                    // running sampler, may be nil
+	samplerMu      sync.Mutex                  // guards sampler
+	limiter        *ipLimiter                  // inbound query limits
+	announceLimits *announceLimiter            // inbound announce limits
+	queryStats     *queryStats                 // outcomes by query type
+	dispatcher     *dispatcher                 // callback workers, may be nil
+	pacer          *pacer                      // outbound packet limits
+	bans           *banTable                   // banned ips
+	idsPerIP       *idTracker                  // node ids seen per ip
+	external       *addrVoter                  // our external address
+	mappedPort     int32                       // gateway port, accessed atomically
+	callbacksOff   int32                       // accessed atomically
+	announces      *announceTokens             // tokens of the announces
+	items          *itemStore                  // BEP 44 items put by other nodes
+	itemLookups    *itemLookups                // running GetItem and PutItem
+	republished    map[string]*Item            // target : item, see Republish
+	republishMu    sync.Mutex                  // guards republished
+	follows        map[string]chan struct{}    // public key : stop, see FollowMutableTorrent
+	followMu       sync.Mutex                  // guards follows
+	lsd            *lsd                        // see LSD, may be nil
+	webhooks       *webhooks                   // watched infohashes
+	verifier       *verifier                   // peers waiting for verification
+	writer         packetWriter                // of conn, set by init
+	queryHandlers  map[string]QueryHandler     // custom queries, see RegisterQueryHandler
+	queryMu        sync.RWMutex                // guards queryHandlers
+	capture        atomic.Value                // *capture, see StartCapture
+	captureMu      sync.Mutex                  // guards the capture starts
+	replaying      bool                        // see Replay
+	shared         bool                        // conn given by the user, not reopened
+	utp            *utpConn                    // see UTPConn, may be nil
+	utpMu          sync.Mutex                  // guards utp
+	OnGetPeers     func(InfoHash, string, int) // infohash, ip, port; prefer Subscribe
+	OnAnnouncePeer func(InfoHash, string, int) // infohash, ip, port; prefer Subscribe
+	// OnError, if set, is called with an *Error when a packet is dropped or
+	// a query fails, addr is the remote address. It must not block.
+	OnError func(err error, addr *net.UDPAddr)
+	// OnPacketIn and OnPacketOut, if set, see the packets received from and
+	// sent to addr. They return the packet, which they may change, or nil
+	// to drop it. A dropped query is lost like on the network.
+	OnPacketIn  func(addr *net.UDPAddr, data []byte) []byte
+	OnPacketOut func(addr *net.UDPAddr, data []byte) []byte
+	// OnQueryIn and OnResponseIn, if set, see the decoded arguments of the
+	// queries and bodies of the responses before they are handled, q is the
+	// query type. They may change them, or return false to drop the message.
+	OnQueryIn    func(addr *net.UDPAddr, q string, args map[string]interface{}) bool
+	OnResponseIn func(addr *net.UDPAddr, q string, r map[string]interface{}) bool
+	// DialTCP, if set, connects the metadata fetcher to a peer instead of
+	// a plain TCP dial, through a proxy for instance, see Socks5.Dial.
+	DialTCP func(addr string, timeout time.Duration) (net.Conn, error)
+	// DialUTP, if set, connects to a peer with uTP, typically through a
+	// uTP stack on UTPConn. The metadata fetcher uses it for the peers it
+	// can't reach with TCP, it's read at every dial so it may be set once
+	// the dht is made, before Run.
+	DialUTP func(addr string, timeout time.Duration) (net.Conn, error)
+	// Tracer, if set, traces the lookups, the transactions and the metadata
+	// fetches.
+	Tracer Tracer
+	// GeoIP, if set, locates the ips of the peer events, see GeoInfo.
+	GeoIP GeoResolver
+	// CallbackWorkers is the number of goroutines calling OnGetPeers and
+	// OnAnnouncePeer once the dht runs, off the packet workers so that a
+	// slow callback doesn't stall them. 0, the default, calls them
+	// synchronously, in order.
+	// CallbackQueueSize is the max number of pending calls and
+	// CallbackDropPolicy, one of DropNewest, DropOldest and Block, applies
+	// when they're reached. See DroppedCallbacks and CallbackLag.
+	CallbackWorkers    int
+	CallbackQueueSize  int
+	CallbackDropPolicy int
+	// FirstSeen, if set, makes OnGetPeers and OnAnnouncePeer fire only for
+	// the infohashes it hasn't seen recently, see NewLRUDeduper,
+	// NewBloomDeduper and NewBucketDeduper. The events are not affected.
+	FirstSeen Deduper
+	// RefreshTime is how long a bucket may stay unchanged before it is
+	// refreshed by a find_node for a random id in its range.
+	RefreshTime time.Duration
+	// NodeExpireTime is how long a node may stay silent before it is
+	// pinged, nodes failing the ping are evicted.
+	NodeExpireTime time.Duration
+	// TokenRotateTime is how often the secret tokens derive from rotates.
+	TokenRotateTime time.Duration
+	// TokenFile, if set, keeps the token secrets across restarts, so that
+	// the tokens handed out before a short restart are still accepted.
+	// It's read at startup and written whenever the secrets rotate.
+	TokenFile string
+	// Logger receives the events of the dht, they are discarded by default.
+	Logger Logger
+	// Clock is the time source of the timeouts and periodic tasks, the
+	// system clock by default. It's set before Run.
+	Clock Clock
+	// EventBufferSize is the buffer size of the channels made by Subscribe.
+	EventBufferSize int
+	// EventDropPolicy is one of DropNewest, DropOldest and Block.
+	EventDropPolicy int
+	// EventsOrigins are the origins, such as "https://example.com", of the
+	// web pages allowed to open the websocket of EventsHandler besides the
+	// same origin one, "*" allows them all. The clients sending no Origin,
+	// the ones not running in a browser, are always allowed.
+	EventsOrigins []string
+	// PeerStore stores the peers of infohashes, in memory if nil. Once the
+	// dht runs, it's the effective store.
+	PeerStore PeerStore
+	// PeerTTL is how long a peer is stored since it was last seen, forever
+	// if it's not positive.
+	PeerTTL time.Duration
+	// MaxPeersPerInfoHash is the max number of peers the in-memory store
+	// keeps per infohash, 0 means no limit.
+	MaxPeersPerInfoHash int
+	// FetchMetadata enables downloading the metadata info of announced
+	// infohashes from the announcing peers, see EventMetadataReceived.
+	FetchMetadata bool
+	// MetadataWorkers is the max number of concurrent metadata downloads.
+	MetadataWorkers int
+	// MetadataQueueSize is the max number of infohashes waiting for download.
+	MetadataQueueSize int
+	// MetadataMaxTries is the max number of peers tried per infohash.
+	MetadataMaxTries int
+	// MetadataDoneTime is how long a downloaded infohash is not fetched again.
+	MetadataDoneTime time.Duration
+	// MetadataBackoff is how long a failed infohash is not fetched again.
+	MetadataBackoff time.Duration
+	// Workers is the number of goroutines handling the received packets.
+	Workers int
+	// QueueSize is the max number of received packets waiting for workers.
+	QueueSize int
+	// QueueDropPolicy applies when the queue is full, it's one of DropNewest,
+	// DropOldest and Block. Block leaves the drops to the kernel socket
+	// buffer. See DroppedPackets.
+	QueueDropPolicy int
+	// QueryRateLimit is the number of queries per second accepted from a
+	// source ip, with bursts of QueryBurst. 0 means no limit.
+	QueryRateLimit float64
+	QueryBurst     int
+	// GlobalQueryRateLimit is the number of queries per second accepted
+	// from all sources, with bursts of GlobalQueryBurst. 0 means no limit.
+	// A 0 burst is a second of queries. Use Reload to change the limits
+	// once the dht runs.
+	GlobalQueryRateLimit float64
+	GlobalQueryBurst     int
+	// AnnounceRateLimit is the number of announces of an infohash per
+	// second accepted from a source ip, with bursts of AnnounceBurst, 0,
+	// the default, means no limit. The others are answered with a protocol
+	// error, and an AnnounceThrottled event is published, so that an ip
+	// can't inflate a swarm nor spam the callbacks. 1.0/60 with bursts of 5
+	// suits most nodes. Use Reload to change them once the dht runs. See
+	// ThrottledAnnounces.
+	AnnounceRateLimit float64
+	AnnounceBurst     int
+	// SendRateLimit and SendByteRateLimit are the packets and bytes per
+	// second sent at most, 0 means no limit. Use SetSendRate to change them
+	// once the dht runs.
+	SendRateLimit     float64
+	SendByteRateLimit float64
+	// ReplyThrottled replies an error to the throttled queries instead of
+	// silently dropping them.
+	ReplyThrottled bool
+	// Blocklist holds the ips whose packets are dropped and which are never
+	// queried, it may be changed at runtime.
+	Blocklist *Blocklist
+	// Watchlist, unless it's empty, restricts the events and the callbacks
+	// of infohashes to its infohashes. The infohashes of Ignorelist never
+	// produce events and their peers are never stored. Both may be changed
+	// at runtime.
+	Watchlist  *InfoHashSet
+	Ignorelist *InfoHashSet
+	// VerifyInfoHashes are the infohashes whose announced and found peers
+	// are verified by a BitTorrent handshake, by VerifyWorkers goroutines
+	// waiting VerifyTimeout at most. See Peer.Verification and VerifyStats.
+	VerifyInfoHashes *InfoHashSet
+	VerifyWorkers    int
+	VerifyTimeout    time.Duration
+	// BanThreshold is the number of protocol violations within BanWindow
+	// which bans an ip for BanDuration, 0, the default, disables banning.
+	// Violations are malformed messages, invalid ids, forged tokens, but
+	// the ones which just expired, and node ids used from another ip. See
+	// Bans.
+	BanThreshold int
+	BanWindow    time.Duration
+	BanDuration  time.Duration
+	// MaxIDsPerIP is the max number of node ids an ip may present, the
+	// nodes of the ips presenting more are kept out of the routing table.
+	// 0 means no limit.
+	MaxIDsPerIP int
+	// SuspiciousPrefixLen is the number of leading bits a node id may share
+	// with a looked up target before it's deemed a sybil and kept out of the
+	// routing table. 0 disables the check.
+	SuspiciousPrefixLen int
+	// AllowPrivateAddrs accepts the nodes and peers of private, loopback and
+	// link-local addresses advertised by other nodes, for LAN testing.
+	// Bogon addresses and ours are always rejected.
+	AllowPrivateAddrs bool
+	// SecureID makes our node id comply with BEP 42 for ExternalIP, or for
+	// the external ip the entrance nodes report at startup if it's nil.
+	// See ExternalAddr.
+	SecureID   bool
+	ExternalIP net.IP
+	// NodeID, if set, is our hex encoded node id, a random one otherwise.
+	// NodeIDFile, if set, keeps our node id across restarts: it's read at
+	// startup unless NodeID is set, and written whenever the id changes.
+	// See ID.
+	NodeID     string
+	NodeIDFile string
+	// IDRotateInterval, if set, is how often our node id is replaced by a
+	// new random one, BEP 42 compliant if SecureID. The routing table is
+	// kept.
+	IDRotateInterval time.Duration
+	// PortMapper maps our port on the gateway while the dht runs, the
+	// mapping is renewed every half PortMapLifetime and removed on Close.
+	// See the nat package.
+	PortMapper      PortMapper
+	PortMapLifetime time.Duration
+	// WebhookRetries is the number of times a webhook is retried after a
+	// failure, waiting WebhookBackoff then twice longer each time.
+	// WebhookTimeout bounds a request. See Watch.
+	WebhookRetries int
+	WebhookBackoff time.Duration
+	WebhookTimeout time.Duration
+	// Passive makes a sniffer of the dht: it stays routable by answering
+	// ping and find_node queries but never stores peers nor looks them up,
+	// GetPeers fails. Repeated get_peers and announce_peer queries are
+	// deduplicated by a bounded cache. Unlike the original listener, which
+	// neither answered find_node nor stored peers, a dht which isn't
+	// passive does both: the announced peers go to its PeerStore and are
+	// returned to get_peers.
+	Passive bool
+	// Router makes a bootstrap router of the dht, like router.bittorrent.com:
+	// it never looks up nor pings nodes, it only answers the queries and
+	// caches the nodes sending them, up to RouterMaxNodes, 1<<20 if 0. Every
+	// full bucket splits until then, and the least recently seen
+	// questionable node makes room after. Peers aren't stored. The query
+	// rate limits usually need to be raised.
+	Router         bool
+	RouterMaxNodes int
+	// MinAnnouncePort is the lowest port accepted from the announce_peer
+	// queries, 1 if 0: 1024 rejects the privileged ports. The ports past
+	// 65535 are always rejected. ImpliedPortPolicy is one of
+	// ImpliedPortHonor, ImpliedPortIgnore and ImpliedPortReject, it tells
+	// how their implied_port flag is handled. The flag must be 0 or 1 in
+	// strict mode. MatchAnnouncePort rejects the queries not setting it
+	// whose port isn't their source port, for the networks where the peers
+	// listen on their dht port.
+	MinAnnouncePort   int
+	ImpliedPortPolicy int
+	MatchAnnouncePort bool
+	// LSD enables the local service discovery of BEP 14: the infohashes of
+	// Announce are also multicast on the local network, for an hour after
+	// their last Announce, and the peers multicasting theirs are stored and
+	// published as PeerFound events.
+	LSD bool
+	// HealthMinNodes is the number of nodes of a bootstrapped routing
+	// table, 16 if 0, and HealthWindow how recent the traffic of a healthy
+	// dht is, 1m if 0. See Health.
+	HealthMinNodes int
+	HealthWindow   time.Duration
+	// ItemTTL is how long the BEP 44 items put by other nodes are kept, 2h
+	// if 0, and MaxItems how many are kept, 1<<14 if 0. RepublishInterval
+	// is how often the items of Republish are put again, 1h if 0.
+	ItemTTL           time.Duration
+	MaxItems          int
+	RepublishInterval time.Duration
+	// FollowInterval is how often the mutable torrents of
+	// FollowMutableTorrent are looked up, 10m if 0.
+	FollowInterval time.Duration
+	// MaxTransactions is the max number of queries in flight, 0 means no
+	// limit. The queued queries wait for it, the others are dropped while
+	// it's reached, see Stats.
+	MaxTransactions int
+	// MaxSubnetQueries is the max number of queries in flight to a /24, a
+	// /64 in IPv6, 0, the default, means no limit. The others are sent
+	// first.
+	MaxSubnetQueries int
+	// CongestionRate is the recent timeout rate over which the queries in
+	// flight are halved, 0, the default, or 1 or more means never. They
+	// grow back by one on every response, see QueryWindow. The queries
+	// looking up infohashes or items, or waited for, are sent before the
+	// ones of the routing table maintenance and of the crawls.
+	CongestionRate float64
+	// QueryQueueSize is the max number of queries waiting to be sent.
+	QueryQueueSize int
+	// QueryQueueDropPolicy applies when the query queue is full, it's one
+	// of DropNewest, DropOldest and Block. Block waits QueryQueueTimeout at
+	// most, a second if it's 0, before dropping the query. The queries held
+	// by the scheduler, see MaxSubnetQueries, are dropped once they waited
+	// as long, the oldest first with DropOldest. See DroppedQueries.
+	QueryQueueDropPolicy int
+	QueryQueueTimeout    time.Duration
+	// QueryDedupePolicy tells which query to a node is dropped while
+	// another one is in flight, it's one of QueryDedupeTarget, the default,
+	// QueryDedupeType and QueryDedupeNone.
+	QueryDedupePolicy int
+	// QueryTimeout is how long a response is waited for, Try times. Once
+	// the round-trip time of a node is known, its responses are waited for
+	// its retransmission timeout, from MinQueryTimeout to QueryTimeout,
+	// doubled on every try.
+	QueryTimeout    time.Duration
+	MinQueryTimeout time.Duration
+	// QueryTries overrides Try by query type, such as "ping" or
+	// "get_peers".
+	QueryTries map[string]int
+	// AdaptiveTries sends a query once while the query type is rarely
+	// answered once retried, probing every tenth one with the full tries.
+	// See QueryStats.
+	AdaptiveTries bool
+	// VirtualIDs is the number of node ids the dht operates on its socket,
+	// spread uniformly across the keyspace. Each query is answered by the
+	// id closest to its target, so more ids see more get_peers and
+	// announce_peer traffic.
+	VirtualIDs int
+	// Shards is the number of sockets bound to the dht address with
+	// SO_REUSEPORT, each one having its own read loop. It's Linux only and
+	// set by WithShards, the sockets are opened by New.
+	Shards int
+	// ReadBuffer and WriteBuffer are the SO_RCVBUF and SO_SNDBUF sizes of
+	// the sockets, the system defaults if zero. The default receive buffer
+	// is too small for the high rates, packets are dropped when it's full.
+	ReadBuffer  int
+	WriteBuffer int
+	// TOS is the IP_TOS, or IPv6 traffic class, of the packets sent, the
+	// DSCP shifted left by 2, and TTL their TTL or hop limit. The system
+	// defaults are kept if zero.
+	TOS int
+	TTL int
+	// ReadBatchSize is the max number of packets read per syscall, on Linux
+	// they are read with recvmmsg.
+	ReadBatchSize int
+	// WriteBatchSize is the max number of packets written per syscall, on
+	// Linux the ones sent concurrently are written with sendmmsg.
+	WriteBatchSize int
+	// DecodeLimits bounds the received krpc messages, see DefaultLimits.
+	DecodeLimits Limits
+	// Version is the "v" field of the messages sent, a two letters client
+	// id and two bytes of version (BEP 20), none if empty.
+	Version string
+	// ParseMode is ParseLenient or ParseStrict, it tells whether the
+	// received values which don't conform are coerced or rejected.
+	ParseMode int
 }
 
+// NewDht returns a new DHT listening on addr, an "ip:port" or an ip for a
+// random port, nil if it fails. See New.
 func NewDht(addr string) *DHT {
-	var err error = nil
+	dht, _ := newDht(addr, 1)
+	return dht
+}
 
+// newDht returns a new DHT listening on addr with the default settings,
+// with shards sockets, see Shards.
+func newDht(addr string, shards int) (*DHT, error) {
 	var me *node = nil
-	var udp_conn *net.UDPConn = nil
+	var conns []*net.UDPConn = nil
 
 	if strings.Contains(addr, ":") {
-		udp_addr, ok := net.ResolveUDPAddr("udp", addr)
-		if ok != nil {
-			return nil
+		udp_addr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
 		}
-		me = newRandomNodeFromUdpAddr(udp_addr)
+		me = newRandomNodeFromUdpAddr(udp_addr, time.Now())
 
-		udp_conn, err = net.ListenUDP("udp", udp_addr)
+		conns, err = listenShards(udp_addr, shards)
 		if err != nil {
-			return nil
+			return nil, err
 		}
 
 	} else {
 		addr += ":0"
-		udp_addr, ok := net.ResolveUDPAddr("udp", addr)
-		if ok != nil {
-			return nil
+		udp_addr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
 		}
-		udp_conn, err = net.ListenUDP("udp", udp_addr)
+		conns, err = listenShards(udp_addr, shards)
 		if err != nil {
-			return nil
+			return nil, err
 		}
-		me = newRandomNodeFromUdpAddr(udp_conn.LocalAddr().(*net.UDPAddr))
+		me = newRandomNodeFromUdpAddr(conns[0].LocalAddr().(*net.UDPAddr), time.Now())
 	}
 
+	dht := newDhtWith(conns[0], me, addr)
+	if shards > 1 {
+		dht.Shards = shards
+	}
+	dht.conns = make([]Transport, len(conns))
+	for i, conn := range conns {
+		dht.conns[i] = conn
+	}
+	return dht, nil
+}
+
+// newDhtWith returns a new DHT of id me using conn with the default
+// settings.
+func newDhtWith(conn Transport, me *node, addr string) *DHT {
 	ret := &DHT{
 		K:    8,
 		me:   me,
 		addr: addr,
-		conn: udp_conn,
+		conn: conn,
 		Try:  2,
 		EntranceAddrs: []string{
 			"router.bittorrent.com:6881",
 			"router.utorrent.com:6881",
 			"dht.transmissionbt.com:6881",
 		},
-		packets:        make(chan packet, 1024),
-		works:          make(chan struct{}, 100),
-		tokens:         newTokenMgr(),
-		OnGetPeers:     nil,
-		OnAnnouncePeer: nil,
+		metrics:              newMetrics(),
+		OnGetPeers:           nil,
+		OnAnnouncePeer:       nil,
+		RefreshTime:          time.Minute * 15,
+		NodeExpireTime:       time.Minute * 15,
+		TokenRotateTime:      time.Minute * 5,
+		Logger:               nopLogger{},
+		Clock:                systemClock{},
+		EventBufferSize:      1024,
+		CallbackQueueSize:    1024,
+		CallbackDropPolicy:   DropNewest,
+		EventDropPolicy:      DropNewest,
+		PeerTTL:              time.Minute * 30,
+		MaxPeersPerInfoHash:  100,
+		MetadataWorkers:      256,
+		MetadataQueueSize:    1024,
+		MetadataMaxTries:     5,
+		MetadataDoneTime:     time.Hour * 24,
+		MetadataBackoff:      time.Hour,
+		Workers:              100,
+		QueueSize:            1024,
+		QueueDropPolicy:      DropNewest,
+		QueryRateLimit:       10,
+		QueryBurst:           20,
+		MaxTransactions:      4096,
+		QueryQueueSize:       1024,
+		QueryQueueDropPolicy: DropNewest,
+		QueryQueueTimeout:    time.Second,
+		QueryTimeout:         time.Second * 15,
+		MinQueryTimeout:      time.Millisecond * 500,
+		VirtualIDs:           1,
+		Shards:               1,
+		ReadBatchSize:        32,
+		WriteBatchSize:       32,
+		DecodeLimits:         DefaultLimits,
+		Blocklist:            NewBlocklist(),
+		Watchlist:            NewInfoHashSet(),
+		Ignorelist:           NewInfoHashSet(),
+		VerifyInfoHashes:     NewInfoHashSet(),
+		VerifyWorkers:        16,
+		VerifyTimeout:        time.Second * 10,
+		BanWindow:            time.Minute * 10,
+		BanDuration:          time.Hour,
+		MaxIDsPerIP:          8,
+		SuspiciousPrefixLen:  40,
+		PortMapLifetime:      time.Hour,
+		WebhookRetries:       5,
+		WebhookBackoff:       time.Second,
+		WebhookTimeout:       time.Second * 10,
 	}
+	ret.events = newEventBus(ret)
+	ret.done = make(chan struct{})
+	ret.started = make(chan struct{})
+	ret.pacer = &pacer{}
+	ret.bans = newBanTable()
+	ret.external = newAddrVoter()
+	ret.announces = newAnnounceTokens()
+	ret.announceLimits = newAnnounceLimiter()
+	ret.queryStats = newQueryStats()
+	ret.items = newItemStore()
+	ret.itemLookups = newItemLookups()
+	ret.webhooks = newWebhooks()
+	ret.verifier = newVerifier()
+	ret.clients = newClientCache()
+	ret.tokens = newTokenMgr(ret.now)
+	ret.conns = []Transport{conn}
 
 	return ret
 }
 
 func (dht *DHT) init() {
-	dht.rt = newRouteTable(dht)
-	dht.peers = newPeersManager(dht)
+	if dht.Logger == nil {
+		dht.Logger = nopLogger{}
+	}
+	if dht.Clock == nil {
+		dht.Clock = systemClock{}
+	}
+	dht.metrics.started = dht.now()
+	if dht.Shards > 1 && len(dht.conns) < dht.Shards {
+		dht.Logger.Warn("sharding disabled", F("shards", len(dht.conns)),
+			F("err", errReusePortUnsupported))
+	}
+	dht.setSocketOptions()
+	if w, err := newPacketWriter(dht.conn, dht.WriteBatchSize); err == nil {
+		dht.writer = w
+	} else {
+		dht.Logger.Warn("batch writes failed", F("err", err))
+	}
+	dht.initID()
+	dht.initTokens()
+	dht.queue = newPacketQueue(dht.QueueSize, dht.QueueDropPolicy)
+	if dht.rt == nil {
+		dht.rt = newRouteTable(dht)
+	}
+	dht.peers = dht.PeerStore
+	if dht.peers == nil {
+		dht.peers = newPeersManager(dht)
+		dht.PeerStore = dht.peers
+	}
 	dht.transacts = newTransactionManager(dht)
+	dht.frontier = make(chan *node, 1024)
+	dht.idsPerIP = newIDTracker(dht.NodeExpireTime, maxOffenders)
+	dht.SetSendRate(dht.SendRateLimit, dht.SendByteRateLimit)
+	dht.limiter = newIPLimiter(dht.QueryRateLimit, dht.QueryBurst,
+		dht.GlobalQueryRateLimit, dht.GlobalQueryBurst)
+	dht.announceLimits.setRate(dht.AnnounceRateLimit, dht.AnnounceBurst)
+
+	if dht.Passive && dht.seen == nil {
+		dht.seen = newDedupeCache(time.Minute, 1<<16)
+	}
+
+	if dht.FetchMetadata && dht.fetcher == nil {
+		dht.fetcher = newMetadataFetcher(dht)
+	}
+	dht.initCallbacks()
+	atomic.StoreInt32(&dht.inited, 1)
 }
 
 func (dht *DHT) srv() {
-	go func() {
-		buff := make([]byte, 8192)
-		for {
-			n, raddr, err := dht.conn.ReadFromUDP(buff)
-			if err != nil {
-				continue
-			}
-
-			dht.packets <- packet{buff[:n], raddr, time.Now()}
-		}
-	}()
+	for _, conn := range dht.conns {
+		conn := conn
+		dht.spawn(func() {
+			dht.readLoop(conn)
+		})
+	}
 }
 
 func (dht *DHT) join() {
+	dht.Logger.Info("bootstrap", F("routers", len(dht.EntranceAddrs)))
+
 	for _, addr := range dht.EntranceAddrs {
 		raddr, err := net.ResolveUDPAddr("udp", addr)
 		if err != nil {
+			dht.Logger.Warn("resolve router failed", F("addr", addr), F("err", err))
 			continue
 		}
-		dht.transacts.findNode(
-			&node{addr: raddr},
-			dht.me.id.RawString(),
-		)
+		for _, id := range dht.virtualIDs() {
+			dht.transacts.findNode(&node{addr: raddr}, id.RawString())
+		}
 	}
 }
 
-func (dht *DHT) GetPeers(infoHash string) ([]*Peer, error) {
-	if len(infoHash) == 40 {
-		data, err := hex.DecodeString(infoHash)
-		if err != nil {
-			return nil, err
-		}
-		infoHash = string(data)
+var (
+	errPassive         = errors.New("lookups are disabled in passive mode")
+	errRouter          = errors.New("lookups are disabled in router mode")
+	errInvalidInfoHash = errors.New("invalid info hash")
+	errAnnouncing      = errors.New("info hash is already being announced")
+)
+
+// GetPeers looks up the peers of infoHash, raw or hex encoded or a magnet
+// link, returning the ones found.
+func (dht *DHT) GetPeers(infoHash string) (peers []*Peer, err error) {
+	if dht.Passive {
+		return nil, errPassive
+	}
+	if dht.Router {
+		return nil, errRouter
+	}
+
+	infoHash, err = rawInfoHash(infoHash)
+	if err != nil {
+		return nil, err
 	}
 
-	peers := dht.peers.GetPeers(infoHash, dht.K)
+	start := dht.now()
+	ctx, span := dht.startSpan(context.Background(), "dht.get_peers",
+		F("infohash", hex.EncodeToString([]byte(infoHash))))
+	defer func() {
+		span.SetFields(F("peers", len(peers)))
+		span.End(err)
+		dht.publish(EventLookupFinished, func() Event {
+			return LookupFinished{InfoHash(infoHash), peers, dht.now().Sub(start)}
+		})
+	}()
+
+	peers = dht.peers.GetPeers(InfoHash(infoHash), dht.K)
 	if len(peers) != 0 {
 		return peers, nil
 	}
@@ -126,17 +625,24 @@ func (dht *DHT) GetPeers(infoHash string) ([]*Peer, error) {
 	ch := make(chan struct{})
 
 	go func() {
-		neighbors := dht.rt.FindClosestNode(newHashId(infoHash), dht.K)
+		neighbors := dht.lookupNodes(newHashId(infoHash), dht.K)
 
 		for _, no := range neighbors {
-			dht.transacts.getPeers(no, infoHash)
+			dht.transacts.getPeers(ctx, no, infoHash)
 		}
 
-		i := 0
-		for _ = range time.Tick(time.Second * 1) {
-			i++
-			peers = dht.peers.GetPeers(infoHash, dht.K)
-			if len(peers) != 0 || i == 30 {
+		ticker := dht.Clock.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for i := 0; i < 30; i++ {
+			select {
+			case <-ticker.C():
+			case <-dht.done:
+				i = 30
+			}
+
+			peers = dht.peers.GetPeers(InfoHash(infoHash), dht.K)
+			if len(peers) != 0 {
 				break
 			}
 		}
@@ -148,23 +654,93 @@ func (dht *DHT) GetPeers(infoHash string) ([]*Peer, error) {
 	return peers, nil
 }
 
+// RejectedTokens returns how many announce_peer queries have been rejected
+// because of an invalid token.
+func (dht *DHT) RejectedTokens() uint64 {
+	return dht.tokens.Rejected()
+}
+
+// maintain keeps the routing table alive: it rejoins the network when the
+// table is empty, refreshes stale buckets and pings silent nodes.
+func (dht *DHT) maintain() {
+	dht.every(time.Second*5, func() {
+		if dht.rt.Len() == 0 {
+			dht.join()
+			return
+		}
+
+		dht.refresh(dht.RefreshTime)
+		dht.keepAlive(dht.NodeExpireTime)
+	})
+}
+
 func (dht *DHT) Run() {
+	if dht.start() {
+		<-dht.done
+	}
+}
+
+// start initializes the dht and starts its goroutines, Close waits for it.
+// It returns false if the dht is already closed.
+func (dht *DHT) start() bool {
+	dht.startMu.Lock()
+	defer dht.startMu.Unlock()
+
+	if dht.closed() || dht.isStarted() {
+		return false
+	}
+
 	dht.init()
 	dht.srv()
-	dht.join()
-
-	var pkt packet
-
-	for {
-		select {
-		case pkt = <-dht.packets:
-			handle(dht, pkt)
-		case <-time.After(time.Second * 5):
-			if dht.rt.Len() == 0 {
-				dht.join()
-			} else {
-				go dht.rt.Fresh()
-			}
+	if dht.PortMapper != nil {
+		dht.spawn(dht.mapPort)
+	}
+	dht.secureID()
+	dht.spawn(dht.transacts.run)
+	dht.spawn(func() {
+		dht.every(dht.TokenRotateTime, dht.rotateTokens)
+	})
+	dht.spawn(dht.expirePeers)
+	dht.spawn(dht.expireItems)
+	dht.spawn(func() {
+		dht.every(time.Minute, func() { dht.bans.sweep(dht.now(), dht.BanWindow) })
+	})
+	if dht.fetcher != nil && dht.fetcher.dht == dht {
+		dht.spawn(dht.fetcher.run)
+	}
+	if !dht.Router {
+		dht.join()
+		dht.spawn(dht.maintain)
+		dht.spawn(func() {
+			dht.every(dht.republishInterval(), dht.republish)
+		})
+	}
+	if dht.LSD && !dht.Router {
+		if err := dht.startLSD(); err != nil {
+			dht.Logger.Warn("lsd disabled", F("err", err))
 		}
 	}
+	if dht.IDRotateInterval > 0 {
+		dht.spawn(func() {
+			dht.every(dht.IDRotateInterval, dht.rotateID)
+		})
+	}
+
+	dht.Logger.Info("dht running", F("addr", dht.conn.LocalAddr()), F("id", dht.ID()))
+
+	dht.startCallbacks()
+	for i := 0; i < dht.Workers; i++ {
+		dht.spawn(dht.work)
+	}
+	for i := 0; i < dht.VerifyWorkers; i++ {
+		dht.spawn(dht.verify)
+	}
+	close(dht.started)
+	return true
+}
+
+// Started returns a channel closed once Run has initialized the dht and
+// started its goroutines, it handles packets from then on.
+func (dht *DHT) Started() <-chan struct{} {
+	return dht.started
 }
@@ -0,0 +1,439 @@
+package dhtgrpc
+
+import (
+	"errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of dht.proto, encoded by hand with protowire so the package
+// needs no generated code.
+
+// message is implemented by the messages of dht.proto.
+type message interface {
+	marshal(b []byte) []byte
+	unmarshal(b []byte) error
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendMessage(b []byte, num protowire.Number, m message) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m.marshal(nil))
+}
+
+// field is a decoded field, v holds a bytes field and x a varint one.
+type field struct {
+	num protowire.Number
+	typ protowire.Type
+	v   []byte
+	x   uint64
+}
+
+// walk calls f for every field of b, skipping the fields of other types.
+func walk(b []byte, f func(field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		fd := field{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			fd.x, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			fd.v, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ == protowire.VarintType || typ == protowire.BytesType {
+			if err := f(fd); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var errWireType = errors.New("unexpected wire type")
+
+// bytesOf returns the bytes of a bytes field.
+func bytesOf(fd field) ([]byte, error) {
+	if fd.typ != protowire.BytesType {
+		return nil, errWireType
+	}
+	return append([]byte(nil), fd.v...), nil
+}
+
+// varintOf returns the value of a varint field.
+func varintOf(fd field) (uint64, error) {
+	if fd.typ != protowire.VarintType {
+		return 0, errWireType
+	}
+	return fd.x, nil
+}
+
+// LookupRequest is the request of Lookup.
+type LookupRequest struct {
+	InfoHash []byte
+}
+
+func (m *LookupRequest) marshal(b []byte) []byte {
+	return appendBytes(b, 1, m.InfoHash)
+}
+
+func (m *LookupRequest) unmarshal(b []byte) error {
+	return walk(b, func(fd field) (err error) {
+		if fd.num == 1 {
+			m.InfoHash, err = bytesOf(fd)
+		}
+		return
+	})
+}
+
+// Peer is a peer of an infohash.
+type Peer struct {
+	IP       string
+	Port     uint32
+	LastSeen int64 // unix seconds
+}
+
+func (m *Peer) marshal(b []byte) []byte {
+	b = appendString(b, 1, m.IP)
+	b = appendVarint(b, 2, uint64(m.Port))
+	return appendVarint(b, 3, uint64(m.LastSeen))
+}
+
+func (m *Peer) unmarshal(b []byte) error {
+	return walk(b, func(fd field) error {
+		switch fd.num {
+		case 1:
+			v, err := bytesOf(fd)
+			m.IP = string(v)
+			return err
+		case 2:
+			x, err := varintOf(fd)
+			m.Port = uint32(x)
+			return err
+		case 3:
+			x, err := varintOf(fd)
+			m.LastSeen = int64(x)
+			return err
+		}
+		return nil
+	})
+}
+
+// LookupResponse is the response of Lookup.
+type LookupResponse struct {
+	Peers []*Peer
+}
+
+func (m *LookupResponse) marshal(b []byte) []byte {
+	for _, p := range m.Peers {
+		b = appendMessage(b, 1, p)
+	}
+	return b
+}
+
+func (m *LookupResponse) unmarshal(b []byte) error {
+	return walk(b, func(fd field) error {
+		if fd.num != 1 {
+			return nil
+		}
+
+		v, err := bytesOf(fd)
+		if err != nil {
+			return err
+		}
+		p := &Peer{}
+		if err := p.unmarshal(v); err != nil {
+			return err
+		}
+		m.Peers = append(m.Peers, p)
+		return nil
+	})
+}
+
+// AnnounceRequest is the request of Announce.
+type AnnounceRequest struct {
+	InfoHash []byte
+	Port     uint32 // 0 announces the dht port
+}
+
+func (m *AnnounceRequest) marshal(b []byte) []byte {
+	b = appendBytes(b, 1, m.InfoHash)
+	return appendVarint(b, 2, uint64(m.Port))
+}
+
+func (m *AnnounceRequest) unmarshal(b []byte) error {
+	return walk(b, func(fd field) error {
+		switch fd.num {
+		case 1:
+			v, err := bytesOf(fd)
+			m.InfoHash = v
+			return err
+		case 2:
+			x, err := varintOf(fd)
+			m.Port = uint32(x)
+			return err
+		}
+		return nil
+	})
+}
+
+// AnnounceResponse is the response of Announce.
+type AnnounceResponse struct {
+	Nodes uint32
+}
+
+func (m *AnnounceResponse) marshal(b []byte) []byte {
+	return appendVarint(b, 1, uint64(m.Nodes))
+}
+
+func (m *AnnounceResponse) unmarshal(b []byte) error {
+	return walk(b, func(fd field) error {
+		if fd.num == 1 {
+			x, err := varintOf(fd)
+			m.Nodes = uint32(x)
+			return err
+		}
+		return nil
+	})
+}
+
+// EventType is the type of an Event.
+type EventType int32
+
+// The event types.
+const (
+	EventTypeUnspecified EventType = iota
+	PeerAnnounced
+	GetPeersSeen
+	MetadataReceived
+)
+
+// StreamEventsRequest is the request of StreamEvents.
+type StreamEventsRequest struct {
+	Types          []EventType // all if empty
+	InfoHashPrefix []byte      // all if empty
+}
+
+func (m *StreamEventsRequest) marshal(b []byte) []byte {
+	if len(m.Types) != 0 {
+		packed := make([]byte, 0, len(m.Types))
+		for _, t := range m.Types {
+			packed = protowire.AppendVarint(packed, uint64(t))
+		}
+		b = appendBytes(b, 1, packed)
+	}
+	return appendBytes(b, 2, m.InfoHashPrefix)
+}
+
+func (m *StreamEventsRequest) unmarshal(b []byte) error {
+	return walk(b, func(fd field) error {
+		switch fd.num {
+		case 1:
+			// repeated enums are packed, but parsers accept both forms.
+			if fd.typ == protowire.VarintType {
+				m.Types = append(m.Types, EventType(fd.x))
+				return nil
+			}
+			for v := fd.v; len(v) > 0; {
+				x, n := protowire.ConsumeVarint(v)
+				if n < 0 {
+					return protowire.ParseError(n)
+				}
+				m.Types = append(m.Types, EventType(x))
+				v = v[n:]
+			}
+		case 2:
+			v, err := bytesOf(fd)
+			m.InfoHashPrefix = v
+			return err
+		}
+		return nil
+	})
+}
+
+// Event is an event of the dht.
+type Event struct {
+	Type     EventType
+	InfoHash []byte
+	IP       string
+	Port     uint32
+	Time     int64  // unix seconds
+	Name     string // of MetadataReceived
+	Size     int64  // of MetadataReceived
+}
+
+func (m *Event) marshal(b []byte) []byte {
+	b = appendVarint(b, 1, uint64(m.Type))
+	b = appendBytes(b, 2, m.InfoHash)
+	b = appendString(b, 3, m.IP)
+	b = appendVarint(b, 4, uint64(m.Port))
+	b = appendVarint(b, 5, uint64(m.Time))
+	b = appendString(b, 6, m.Name)
+	return appendVarint(b, 7, uint64(m.Size))
+}
+
+func (m *Event) unmarshal(b []byte) error {
+	return walk(b, func(fd field) error {
+		var (
+			v   []byte
+			x   uint64
+			err error
+		)
+		switch fd.num {
+		case 2, 3, 6:
+			v, err = bytesOf(fd)
+		default:
+			x, err = varintOf(fd)
+		}
+		if err != nil {
+			return err
+		}
+
+		switch fd.num {
+		case 1:
+			m.Type = EventType(x)
+		case 2:
+			m.InfoHash = v
+		case 3:
+			m.IP = string(v)
+		case 4:
+			m.Port = uint32(x)
+		case 5:
+			m.Time = int64(x)
+		case 6:
+			m.Name = string(v)
+		case 7:
+			m.Size = int64(x)
+		}
+		return nil
+	})
+}
+
+// GetStatsRequest is the request of GetStats.
+type GetStatsRequest struct{}
+
+func (m *GetStatsRequest) marshal(b []byte) []byte { return b }
+
+func (m *GetStatsRequest) unmarshal(b []byte) error {
+	return walk(b, func(field) error { return nil })
+}
+
+// Stats is the response of GetStats.
+type Stats struct {
+	ID               string // hex
+	Addr             string
+	ExternalAddr     string
+	Nodes            uint64
+	Peers            uint64
+	Transactions     uint64
+	DroppedPackets   uint64
+	ThrottledQueries uint64
+	Bans             uint64
+}
+
+func (m *Stats) marshal(b []byte) []byte {
+	b = appendString(b, 1, m.ID)
+	b = appendString(b, 2, m.Addr)
+	b = appendString(b, 3, m.ExternalAddr)
+	b = appendVarint(b, 4, m.Nodes)
+	b = appendVarint(b, 5, m.Peers)
+	b = appendVarint(b, 6, m.Transactions)
+	b = appendVarint(b, 7, m.DroppedPackets)
+	b = appendVarint(b, 8, m.ThrottledQueries)
+	return appendVarint(b, 9, m.Bans)
+}
+
+func (m *Stats) unmarshal(b []byte) error {
+	return walk(b, func(fd field) error {
+		if fd.num <= 3 {
+			v, err := bytesOf(fd)
+			if err != nil {
+				return err
+			}
+			switch fd.num {
+			case 1:
+				m.ID = string(v)
+			case 2:
+				m.Addr = string(v)
+			case 3:
+				m.ExternalAddr = string(v)
+			}
+			return nil
+		}
+
+		x, err := varintOf(fd)
+		if err != nil {
+			return err
+		}
+		switch fd.num {
+		case 4:
+			m.Nodes = x
+		case 5:
+			m.Peers = x
+		case 6:
+			m.Transactions = x
+		case 7:
+			m.DroppedPackets = x
+		case 8:
+			m.ThrottledQueries = x
+		case 9:
+			m.Bans = x
+		}
+		return nil
+	})
+}
+
+// codec encodes the messages of dht.proto with the protobuf wire format,
+// it replaces the generated code based codec of grpc.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(message)
+	if !ok {
+		return nil, errors.New("dhtgrpc: unexpected message type")
+	}
+	return m.marshal(nil), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(message)
+	if !ok {
+		return errors.New("dhtgrpc: unexpected message type")
+	}
+	return m.unmarshal(data)
+}
+
+func (codec) Name() string { return "proto" }
@@ -0,0 +1,93 @@
+package dhtgrpc
+
+import (
+	"bytes"
+	"google.golang.org/protobuf/encoding/protowire"
+	"reflect"
+	"testing"
+)
+
+func TestMessages(t *testing.T) {
+	hash := bytes.Repeat([]byte{0xab}, 20)
+	for _, m := range []message{
+		&LookupRequest{InfoHash: hash},
+		&LookupResponse{Peers: []*Peer{
+			{IP: "1.2.3.4", Port: 6881, LastSeen: 1700000000},
+			{IP: "2001:db8::1", Port: 65535, LastSeen: -1},
+		}},
+		&AnnounceRequest{InfoHash: hash, Port: 6881},
+		&AnnounceResponse{Nodes: 8},
+		&StreamEventsRequest{Types: []EventType{PeerAnnounced, MetadataReceived}, InfoHashPrefix: hash[:2]},
+		&Event{
+			Type: MetadataReceived, InfoHash: hash, IP: "1.2.3.4", Port: 6881,
+			Time: 1700000000, Name: "ubuntu.iso", Size: 1 << 40,
+		},
+		&GetStatsRequest{},
+		&Stats{
+			ID: "abab", Addr: "0.0.0.0:6881", ExternalAddr: "1.2.3.4:6881",
+			Nodes: 1, Peers: 2, Transactions: 3, DroppedPackets: 4,
+			ThrottledQueries: 5, Bans: 1 << 63,
+		},
+	} {
+		b, err := codec{}.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := reflect.New(reflect.TypeOf(m).Elem()).Interface().(message)
+		if err := (codec{}).Unmarshal(b, got); err != nil {
+			t.Errorf("%T: %v", m, err)
+		} else if !reflect.DeepEqual(got, m) {
+			t.Errorf("%T: got %+v, expected %+v", m, got, m)
+		}
+	}
+}
+
+func TestMessagesWire(t *testing.T) {
+	// the encoding of a Peer{IP: "1.2.3.4", Port: 6881, LastSeen: 1} by
+	// the generated code.
+	wire := []byte{
+		0x0a, 0x07, '1', '.', '2', '.', '3', '.', '4',
+		0x10, 0xe1, 0x35,
+		0x18, 0x01,
+	}
+	p := &Peer{IP: "1.2.3.4", Port: 6881, LastSeen: 1}
+	if b := p.marshal(nil); !bytes.Equal(b, wire) {
+		t.Errorf("unexpected encoding %x", b)
+	}
+
+	// the unknown fields are skipped, whatever their type.
+	b := protowire.AppendTag(wire, 9, protowire.Fixed32Type)
+	b = append(b, 1, 2, 3, 4)
+	b = protowire.AppendTag(b, 10, protowire.BytesType)
+	b = protowire.AppendBytes(b, []byte("unknown"))
+	got := &Peer{}
+	if err := got.unmarshal(b); err != nil || !reflect.DeepEqual(got, p) {
+		t.Errorf("unexpected peer %+v, %v", got, err)
+	}
+
+	// the unpacked repeated enums are accepted.
+	b = protowire.AppendTag(nil, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(GetPeersSeen))
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(PeerAnnounced))
+	req := &StreamEventsRequest{}
+	if err := req.unmarshal(b); err != nil ||
+		!reflect.DeepEqual(req.Types, []EventType{GetPeersSeen, PeerAnnounced}) {
+		t.Errorf("unexpected types %v, %v", req.Types, err)
+	}
+
+	for _, b := range [][]byte{
+		{0x0a, 0x07, '1'}, // truncated bytes
+		{0x10},            // truncated varint
+		append(protowire.AppendTag(nil, 1, protowire.VarintType), 1), // IP as a varint
+		append(protowire.AppendTag(nil, 2, protowire.BytesType), 0),  // port as bytes
+	} {
+		if err := (&Peer{}).unmarshal(b); err == nil {
+			t.Errorf("expected %x rejected", b)
+		}
+	}
+
+	if _, err := (codec{}).Marshal("peer"); err == nil {
+		t.Error("expected a non message rejected")
+	}
+}
@@ -0,0 +1,259 @@
+// Package dhtgrpc serves a DHT with gRPC, see dht.proto for the service.
+//
+// The messages are encoded by hand rather than by generated code, any
+// protobuf client generated from dht.proto can call the service.
+package dhtgrpc
+
+import (
+	"bytes"
+	"context"
+	"net"
+
+	"github.com/2qif49lt/dhtlistener"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// service is the handler type of the DHT service.
+type service interface {
+	Lookup(context.Context, *LookupRequest) (*LookupResponse, error)
+	Announce(context.Context, *AnnounceRequest) (*AnnounceResponse, error)
+	StreamEvents(*StreamEventsRequest, grpc.ServerStream) error
+	GetStats(context.Context, *GetStatsRequest) (*Stats, error)
+}
+
+// Server implements the DHT service of dht.proto.
+type Server struct {
+	dht *dhtlistener.DHT
+}
+
+// NewServer returns a grpc.Server serving the DHT service of dht, which
+// should be running. Serve it on your own listener.
+func NewServer(dht *dhtlistener.DHT, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(append(opts, grpc.ForceServerCodec(codec{}))...)
+	Register(s, dht)
+	return s
+}
+
+// Register registers the DHT service of dht on s, whose codec should encode
+// the messages of this package, see NewServer.
+func Register(s *grpc.Server, dht *dhtlistener.DHT) {
+	s.RegisterService(&serviceDesc, &Server{dht})
+}
+
+// Lookup returns the peers of an infohash.
+func (s *Server) Lookup(ctx context.Context, req *LookupRequest) (*LookupResponse, error) {
+	if len(req.InfoHash) != 20 {
+		return nil, status.Error(codes.InvalidArgument, "invalid info hash")
+	}
+
+	peers, err := s.dht.GetPeers(string(req.InfoHash))
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	resp := &LookupResponse{Peers: make([]*Peer, 0, len(peers))}
+	for _, p := range peers {
+		resp.Peers = append(resp.Peers, &Peer{
+			IP:       p.IP.String(),
+			Port:     uint32(p.Port),
+			LastSeen: p.LastSeen.Unix(),
+		})
+	}
+	return resp, nil
+}
+
+// Announce announces that we are a peer of an infohash.
+func (s *Server) Announce(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error) {
+	if len(req.InfoHash) != 20 || req.Port > 65535 {
+		return nil, status.Error(codes.InvalidArgument, "invalid info hash or port")
+	}
+
+	n, err := s.dht.Announce(string(req.InfoHash), int(req.Port))
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &AnnounceResponse{Nodes: uint32(n)}, nil
+}
+
+// eventTypes maps the event types of the service to those of the dht.
+var eventTypes = map[EventType]dhtlistener.EventType{
+	PeerAnnounced:    dhtlistener.EventPeerAnnounced,
+	GetPeersSeen:     dhtlistener.EventGetPeersSeen,
+	MetadataReceived: dhtlistener.EventMetadataReceived,
+}
+
+// newEvent returns the Event of e, or nil for the other events.
+func newEvent(e dhtlistener.Event) *Event {
+	switch e := e.(type) {
+	case dhtlistener.PeerAnnounced:
+		return &Event{
+			Type:     PeerAnnounced,
+			InfoHash: []byte(e.InfoHash),
+			IP:       e.IP,
+			Port:     uint32(e.Port),
+			Time:     e.Time.Unix(),
+		}
+	case dhtlistener.GetPeersSeen:
+		return &Event{
+			Type:     GetPeersSeen,
+			InfoHash: []byte(e.InfoHash),
+			IP:       e.IP,
+			Port:     uint32(e.Port),
+			Time:     e.Time.Unix(),
+		}
+	case dhtlistener.MetadataReceived:
+		return &Event{
+			Type:     MetadataReceived,
+			InfoHash: []byte(e.InfoHash),
+			IP:       e.IP,
+			Port:     uint32(e.Port),
+			Time:     e.Time.Unix(),
+			Name:     e.Name,
+			Size:     int64(e.Size),
+		}
+	}
+	return nil
+}
+
+// StreamEvents sends the events of the requested types and infohash prefix
+// until the client goes away.
+func (s *Server) StreamEvents(req *StreamEventsRequest, stream grpc.ServerStream) error {
+	types := req.Types
+	if len(types) == 0 {
+		types = []EventType{PeerAnnounced, GetPeersSeen, MetadataReceived}
+	}
+
+	for _, t := range types {
+		if _, ok := eventTypes[t]; !ok {
+			return status.Error(codes.InvalidArgument, "invalid event type")
+		}
+	}
+
+	// the subscriptions are merged so the events are sent by one goroutine,
+	// which drain them until they are closed.
+	events := make(chan dhtlistener.Event)
+	done := make(chan struct{})
+
+	for _, t := range types {
+		ch := s.dht.Subscribe(eventTypes[t])
+		defer s.dht.Unsubscribe(ch)
+
+		go func() {
+			for e := range ch {
+				select {
+				case events <- e:
+				case <-done:
+				}
+			}
+		}()
+	}
+	defer close(done)
+
+	ctx := stream.Context()
+	for {
+		select {
+		case e := <-events:
+			ev := newEvent(e)
+			if ev == nil || !bytes.HasPrefix(ev.InfoHash, req.InfoHashPrefix) {
+				continue
+			}
+			if err := stream.SendMsg(ev); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// GetStats returns the statistics of the dht.
+func (s *Server) GetStats(ctx context.Context, req *GetStatsRequest) (*Stats, error) {
+	st := s.dht.Stats()
+	return &Stats{
+		ID:               st.ID,
+		Addr:             st.Addr,
+		ExternalAddr:     st.ExternalAddr,
+		Nodes:            uint64(st.Nodes),
+		Peers:            uint64(st.Peers),
+		Transactions:     uint64(st.Transactions),
+		DroppedPackets:   st.DroppedPackets,
+		ThrottledQueries: st.ThrottledQueries,
+		Bans:             uint64(st.Bans),
+	}, nil
+}
+
+// unaryHandler returns the grpc handler of the unary method named name,
+// calling f with a request made by newReq.
+func unaryHandler(name string, newReq func() message,
+	f func(*Server, context.Context, message) (interface{}, error)) grpc.MethodDesc {
+
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+			interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+			req := newReq()
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+
+			s := srv.(*Server)
+			if interceptor == nil {
+				return f(s, ctx, req)
+			}
+
+			info := &grpc.UnaryServerInfo{
+				Server:     srv,
+				FullMethod: "/" + serviceName + "/" + name,
+			}
+			return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return f(s, ctx, req.(message))
+			})
+		},
+	}
+}
+
+const serviceName = "dhtlistener.DHT"
+
+// serviceDesc stands for the one generated from dht.proto.
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*service)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryHandler("Lookup", func() message { return &LookupRequest{} },
+			func(s *Server, ctx context.Context, req message) (interface{}, error) {
+				return s.Lookup(ctx, req.(*LookupRequest))
+			}),
+		unaryHandler("Announce", func() message { return &AnnounceRequest{} },
+			func(s *Server, ctx context.Context, req message) (interface{}, error) {
+				return s.Announce(ctx, req.(*AnnounceRequest))
+			}),
+		unaryHandler("GetStats", func() message { return &GetStatsRequest{} },
+			func(s *Server, ctx context.Context, req message) (interface{}, error) {
+				return s.GetStats(ctx, req.(*GetStatsRequest))
+			}),
+	},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "StreamEvents",
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			req := &StreamEventsRequest{}
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return srv.(*Server).StreamEvents(req, stream)
+		},
+	}},
+	Metadata: "dht.proto",
+}
+
+// Serve serves the DHT service of dht on addr until the listener fails.
+func Serve(dht *dhtlistener.DHT, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return NewServer(dht).Serve(l)
+}
@@ -0,0 +1,57 @@
+package dhtlistener
+
+import (
+	"errors"
+	"net"
+)
+
+// The kinds of the errors passed to OnError, test them with errors.Is.
+var (
+	// ErrTimeout is a query sent Try times without a response.
+	ErrTimeout = errors.New("query timed out")
+	// ErrProtocol is a message breaking the krpc protocol, or a krpc
+	// error answering our query.
+	ErrProtocol = errors.New("protocol error")
+	// ErrTokenInvalid is an announce_peer with a token we didn't give.
+	ErrTokenInvalid = errors.New("invalid token")
+	// ErrSend is a message which could not be encoded or sent.
+	ErrSend = errors.New("send failed")
+	// ErrDecode is a packet which is not a bencoded krpc message.
+	ErrDecode = errors.New("decode failed")
+)
+
+// Error is an error of the dht passed to OnError.
+type Error struct {
+	Kind error  // one of the Err values
+	Q    string // query type of the message, if known
+	Err  error  // cause, may be nil
+}
+
+func (e *Error) Error() string {
+	s := e.Kind.Error()
+	if e.Q != "" {
+		s = e.Q + ": " + s
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+// Is returns whether target is the kind of e.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the cause of e.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// onError passes the error of kind about the message q of addr to OnError,
+// cause may be nil.
+func (dht *DHT) onError(kind error, addr *net.UDPAddr, q string, cause error) {
+	if dht.OnError != nil {
+		dht.OnError(&Error{kind, q, cause}, addr)
+	}
+}
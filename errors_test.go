@@ -0,0 +1,91 @@
+package dhtlistener
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestErrorKinds(t *testing.T) {
+	cause := errors.New("boom")
+	err := error(&Error{ErrSend, pingType, cause})
+
+	if !errors.Is(err, ErrSend) || errors.Is(err, ErrTimeout) {
+		t.Error("errors.Is should test the kind")
+	}
+	if !errors.Is(err, cause) {
+		t.Error("errors.Is should find the cause")
+	}
+	if err.Error() != "ping: send failed: boom" {
+		t.Errorf("unexpected message %q", err)
+	}
+}
+
+func TestOnError(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	clock := newFakeClock()
+	dht.Clock = clock
+
+	var mu sync.Mutex
+	var errs []error
+	dht.OnError = func(err error, addr *net.UDPAddr) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	}
+	// last returns the last error reported.
+	last := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(errs) == 0 {
+			return nil
+		}
+		return errs[len(errs)-1]
+	}
+
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.LocalAddr().(*net.UDPAddr)
+
+	handle(dht, packet{data: []byte("d1:t"), raddr: addr})
+	if !errors.Is(last(), ErrDecode) {
+		t.Errorf("expected a decode error, got %v", last())
+	}
+
+	id := GetRandString(20)
+	data, _ := Marshal(makeQuery("aa", findNodeType, &FindNodeArgs{ID: id, Target: "short"}))
+	handle(dht, packet{data: data, raddr: addr})
+	if e, ok := last().(*Error); !ok || e.Kind != ErrProtocol || e.Q != findNodeType {
+		t.Errorf("expected a find_node protocol error, got %v", last())
+	}
+
+	data, _ = Marshal(makeQuery("ab", announcePeerType, &AnnouncePeerArgs{
+		ID: id, InfoHash: GetRandString(20), Port: 6881, Token: "bad",
+	}))
+	handle(dht, packet{data: data, raddr: addr})
+	if !errors.Is(last(), ErrTokenInvalid) {
+		t.Errorf("expected an invalid token, got %v", last())
+	}
+
+	go dht.transacts.run()
+	dht.transacts.ping(&node{addr: addr})
+	if !waitUntil(func() bool { return dht.transacts.len() == 1 }) {
+		t.Fatal("expected a transaction")
+	}
+	clock.Advance(dht.QueryTimeout * time.Duration(dht.Try+1))
+	if !waitUntil(func() bool { return errors.Is(last(), ErrTimeout) }) {
+		t.Errorf("expected a timeout, got %v", last())
+	}
+}
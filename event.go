@@ -0,0 +1,280 @@
+package dhtlistener
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType represents the type of an Event.
+type EventType int
+
+const (
+	// EventPeerAnnounced is published when a peer announces an infohash.
+	EventPeerAnnounced EventType = iota
+	// EventGetPeersSeen is published when a get_peers query is received.
+	EventGetPeersSeen
+	// EventNodeAdded is published when a node joins the routing table.
+	EventNodeAdded
+	// EventNodeRemoved is published when a node leaves the routing table.
+	EventNodeRemoved
+	// EventLookupFinished is published when GetPeers finishes.
+	EventLookupFinished
+	// EventErrorReceived is published when a krpc error is received.
+	EventErrorReceived
+)
+
+// Drop policies used when a subscriber's channel is full.
+const (
+	// DropNewest discards the event being published.
+	DropNewest = iota
+	// DropOldest discards the oldest buffered event to make room.
+	DropOldest
+	// Block waits until the subscriber has room, it stalls the publisher.
+	Block
+)
+
+var dropPolicies = map[string]int{
+	"newest": DropNewest,
+	"oldest": DropOldest,
+	"block":  Block,
+}
+
+// parseDropPolicy returns the drop policy named s.
+func parseDropPolicy(s string) (int, error) {
+	p, ok := dropPolicies[s]
+	if !ok {
+		return 0, errors.New("unknown drop policy " + s)
+	}
+	return p, nil
+}
+
+// Event is the interface implemented by all events.
+type Event interface {
+	Type() EventType
+}
+
+// PeerAnnounced is the event of an accepted announce_peer query.
+type PeerAnnounced struct {
+	InfoHash InfoHash
+	IP       string
+	Port     int
+	Time     time.Time
+	Geo      *GeoInfo // of IP, see GeoIP
+}
+
+// Type implements Event.
+func (PeerAnnounced) Type() EventType { return EventPeerAnnounced }
+
+// GetPeersSeen is the event of a received get_peers query.
+type GetPeersSeen struct {
+	InfoHash InfoHash
+	IP       string
+	Port     int
+	Time     time.Time
+	Geo      *GeoInfo // of IP, see GeoIP
+}
+
+// Type implements Event.
+func (GetPeersSeen) Type() EventType { return EventGetPeersSeen }
+
+// NodeAdded is the event of a node joining the routing table.
+type NodeAdded struct {
+	ID   string
+	Addr *net.UDPAddr
+}
+
+// Type implements Event.
+func (NodeAdded) Type() EventType { return EventNodeAdded }
+
+// NodeRemoved is the event of a node leaving the routing table.
+type NodeRemoved struct {
+	ID   string
+	Addr *net.UDPAddr
+}
+
+// Type implements Event.
+func (NodeRemoved) Type() EventType { return EventNodeRemoved }
+
+// LookupFinished is the event of a finished GetPeers.
+type LookupFinished struct {
+	InfoHash InfoHash
+	Peers    []*Peer
+	Elapsed  time.Duration
+}
+
+// Type implements Event.
+func (LookupFinished) Type() EventType { return EventLookupFinished }
+
+// ErrorReceived is the event of a received krpc error.
+type ErrorReceived struct {
+	Addr *net.UDPAddr
+	Code int
+	Msg  string
+}
+
+// Type implements Event.
+func (ErrorReceived) Type() EventType { return EventErrorReceived }
+
+// eventBus delivers events to subscribers.
+type eventBus struct {
+	sync.RWMutex
+	subs    map[EventType][]*subscription
+	dropped uint64 // accessed atomically
+	dht     *DHT
+}
+
+// subscription is the channel of a subscriber. Its lock is held while an
+// event is sent to ch, so that ch is closed once no one sends anymore.
+type subscription struct {
+	sync.RWMutex
+	ch     chan Event
+	done   chan struct{} // closed on unsubscribe, unblocks the senders
+	closed bool          // guarded by the lock
+}
+
+// newEventBus returns a new eventBus pointer.
+func newEventBus(dht *DHT) *eventBus {
+	return &eventBus{
+		subs: make(map[EventType][]*subscription),
+		dht:  dht,
+	}
+}
+
+// subscribe returns a new channel receiving the events of type t.
+func (bus *eventBus) subscribe(t EventType, size int) chan Event {
+	sub := &subscription{
+		ch:   make(chan Event, size),
+		done: make(chan struct{}),
+	}
+
+	bus.Lock()
+	defer bus.Unlock()
+
+	bus.subs[t] = append(bus.subs[t], sub)
+	return sub.ch
+}
+
+// unsubscribe removes ch from the subscribers and closes it, once the
+// events being sent to it are delivered or given up.
+func (bus *eventBus) unsubscribe(ch <-chan Event) {
+	var found *subscription
+
+	bus.Lock()
+	for t, subs := range bus.subs {
+		for i, sub := range subs {
+			if sub.ch == ch {
+				bus.subs[t] = append(subs[:i:i], subs[i+1:]...)
+				found = sub
+				break
+			}
+		}
+	}
+	bus.Unlock()
+
+	if found == nil {
+		return
+	}
+	close(found.done)
+	found.Lock()
+	found.closed = true
+	close(found.ch)
+	found.Unlock()
+}
+
+// has returns whether anyone subscribes the events of type t.
+func (bus *eventBus) has(t EventType) bool {
+	bus.RLock()
+	defer bus.RUnlock()
+
+	return len(bus.subs[t]) != 0
+}
+
+// publish delivers e to all its subscribers according to the drop policy.
+// The subscribers are copied first, so that a blocked delivery doesn't
+// hold the bus.
+func (bus *eventBus) publish(e Event) {
+	bus.RLock()
+	subs := append([]*subscription(nil), bus.subs[e.Type()]...)
+	bus.RUnlock()
+
+	for _, sub := range subs {
+		if sub.deliver(e, bus.dht.EventDropPolicy) {
+			atomic.AddUint64(&bus.dropped, 1)
+		}
+	}
+}
+
+// deliver sends e to the subscriber according to policy and returns
+// whether an event, e or a buffered one, is dropped. Nothing is sent once
+// it unsubscribed.
+func (sub *subscription) deliver(e Event, policy int) bool {
+	sub.RLock()
+	defer sub.RUnlock()
+
+	if sub.closed {
+		return false
+	}
+	return deliver(sub.ch, sub.done, e, policy)
+}
+
+// deliver sends e to ch according to policy and returns whether an event,
+// e or a buffered one, is dropped. A blocked send gives up when done is
+// closed.
+func deliver(ch chan Event, done <-chan struct{}, e Event, policy int) bool {
+	if policy == Block {
+		select {
+		case ch <- e:
+			return false
+		case <-done:
+			return true
+		}
+	}
+
+	select {
+	case ch <- e:
+		return false
+	default:
+	}
+
+	if policy != DropOldest {
+		return true
+	}
+
+	select {
+	case <-ch:
+	default:
+	}
+
+	select {
+	case ch <- e:
+	default:
+	}
+	return true
+}
+
+// Subscribe returns a channel receiving the events of type t. The channel
+// buffers EventBufferSize events, when it's full EventDropPolicy applies.
+func (dht *DHT) Subscribe(t EventType) <-chan Event {
+	return dht.events.subscribe(t, dht.EventBufferSize)
+}
+
+// Unsubscribe stops the delivery to ch, which is closed.
+func (dht *DHT) Unsubscribe(ch <-chan Event) {
+	dht.events.unsubscribe(ch)
+}
+
+// DroppedEvents returns how many events have been dropped because
+// subscribers were too slow.
+func (dht *DHT) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&dht.events.dropped)
+}
+
+// publish publishes the event built by f if anyone subscribes type t.
+func (dht *DHT) publish(t EventType, f func() Event) {
+	if dht.events != nil && dht.events.has(t) {
+		dht.events.publish(f())
+	}
+}
@@ -0,0 +1,67 @@
+package dhtlistener
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventDropPolicy(t *testing.T) {
+	dht := &DHT{EventBufferSize: 2}
+	dht.events = newEventBus(dht)
+
+	for _, policy := range []int{DropNewest, DropOldest} {
+		dht.EventDropPolicy = policy
+		ch := dht.Subscribe(EventPeerAnnounced)
+
+		for port := 1; port <= 3; port++ {
+			dht.publish(EventPeerAnnounced, func() Event {
+				return PeerAnnounced{Port: port}
+			})
+		}
+
+		first := (<-ch).(PeerAnnounced).Port
+		if policy == DropNewest && first != 1 || policy == DropOldest && first != 2 {
+			t.Fatal(policy, first)
+		}
+
+		dht.Unsubscribe(ch)
+		if _, ok := <-ch; !ok {
+			t.Fatal(policy, "buffered event lost")
+		}
+		if _, ok := <-ch; ok {
+			t.Fatal(policy, "channel is not closed")
+		}
+	}
+
+	if dht.DroppedEvents() != 2 {
+		t.Fatal(dht.DroppedEvents())
+	}
+}
+
+func TestEventBlockUnsubscribe(t *testing.T) {
+	dht := &DHT{EventBufferSize: 1, EventDropPolicy: Block}
+	dht.events = newEventBus(dht)
+	ch := dht.Subscribe(EventPeerAnnounced)
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for port := 1; port <= 2; port++ {
+			dht.publish(EventPeerAnnounced, func() Event {
+				return PeerAnnounced{Port: port}
+			})
+		}
+	}()
+
+	// the second event blocks on the full channel, if sent yet.
+	for len(ch) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	dht.Unsubscribe(ch)
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publish still blocked after Unsubscribe")
+	}
+}
@@ -0,0 +1,19 @@
+package dhtlistener
+
+import (
+	"errors"
+	"expvar"
+)
+
+// PublishExpvar publishes the Stats of dht as the expvar variable name,
+// served at /debug/vars by the default http mux. The variable can't be
+// removed, publish a dht once.
+func (dht *DHT) PublishExpvar(name string) error {
+	if expvar.Get(name) != nil {
+		return errors.New("expvar " + name + " already published")
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return dht.Stats()
+	}))
+	return nil
+}
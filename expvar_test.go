@@ -0,0 +1,61 @@
+package dhtlistener
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"testing"
+	"time"
+)
+
+func TestPublishExpvar(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	defer dht.conn.Close()
+
+	if err := dht.PublishExpvar("dht_test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dht.PublishExpvar("dht_test"); err == nil {
+		t.Error("expected the name published once")
+	}
+
+	var stats Stats
+	if err := json.Unmarshal([]byte(expvar.Get("dht_test").String()), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.ID) != 40 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPublishExpvarStarting(t *testing.T) {
+	dht, err := New(WithAddr("127.0.0.1:0"), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dht.PublishExpvar("dht_test_starting"); err != nil {
+		t.Fatal(err)
+	}
+	v := expvar.Get("dht_test_starting")
+
+	// the variable is read while Run initializes the dht.
+	go dht.Run()
+	for started := false; !started; {
+		select {
+		case <-dht.Started():
+			started = true
+		default:
+		}
+		var stats Stats
+		if err := json.Unmarshal([]byte(v.String()), &stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dht.Close(ctx)
+}
@@ -0,0 +1,216 @@
+package dhtlistener
+
+import (
+	"hash/crc32"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxExternalVoters is the number of latest voters counted.
+	maxExternalVoters = 64
+	// minExternalVotes is the number of votes electing an external address.
+	minExternalVotes = 2
+	// externalProbeTimeout bounds the wait for votes when SecureID needs
+	// our external ip.
+	externalProbeTimeout = time.Second * 3
+)
+
+// addrVoter elects our external address from the ones echoed back by the
+// latest voters, one vote per voter ip.
+type addrVoter struct {
+	sync.Mutex
+	votes   map[string]string // voter ip : compact addr
+	voters  []string          // voter ips, oldest first
+	elected string            // compact addr
+}
+
+// newAddrVoter returns a new addrVoter pointer.
+func newAddrVoter() *addrVoter {
+	return &addrVoter{votes: make(map[string]string)}
+}
+
+// vote records the vote of voter for addr. It returns the elected address
+// and whether it has changed.
+func (av *addrVoter) vote(voter net.IP, addr string) (string, bool) {
+	key := string(voter.To16())
+
+	av.Lock()
+	defer av.Unlock()
+
+	if _, ok := av.votes[key]; !ok {
+		if len(av.voters) >= maxExternalVoters {
+			delete(av.votes, av.voters[0])
+			av.voters = av.voters[1:]
+		}
+		av.voters = append(av.voters, key)
+	}
+	av.votes[key] = addr
+
+	counts := make(map[string]int)
+	best, most := "", 0
+	for _, v := range av.votes {
+		counts[v]++
+		if counts[v] > most || (counts[v] == most && v == av.elected) {
+			best, most = v, counts[v]
+		}
+	}
+
+	if most < minExternalVotes || best == av.elected {
+		return av.elected, false
+	}
+	av.elected = best
+	return best, true
+}
+
+// get returns the elected address, "" if none.
+func (av *addrVoter) get() string {
+	av.Lock()
+	defer av.Unlock()
+
+	return av.elected
+}
+
+// voteExternal counts the ip field of a response from addr, which is our
+// address as seen by addr.
+func (dht *DHT) voteExternal(addr *net.UDPAddr, ip string) {
+	if ip == "" {
+		return
+	}
+	if ext, _, err := decodeCompactIPPortInfo(ip); err != nil || !dht.validAddr(ext, 1) {
+		return
+	}
+
+	if elected, changed := dht.external.vote(addr.IP, ip); changed {
+		ext, port, _ := decodeCompactIPPortInfo(elected)
+		dht.Logger.Info("external address", F("ip", ext), F("port", port))
+	}
+}
+
+// ExternalAddr returns our address as seen by other nodes, elected from the
+// ip field of their responses (BEP 42). It's nil until enough nodes agree.
+func (dht *DHT) ExternalAddr() *net.UDPAddr {
+	elected := dht.external.get()
+	if elected == "" {
+		return nil
+	}
+
+	ip, port, _ := decodeCompactIPPortInfo(elected)
+	return &net.UDPAddr{IP: ip, Port: port}
+}
+
+// announcePort returns the implied_port and port arguments of an
+// announce_peer for port, 0 meaning our dht port. The external port is used
+// when known, otherwise the remote node is told to use the source port.
+func (dht *DHT) announcePort(port int) (int, int) {
+	if port != 0 {
+		return 0, port
+	}
+
+	if ext := dht.ExternalAddr(); ext != nil {
+		return 0, ext.Port
+	}
+	return 1, dht.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+var (
+	bep42MaskV4 = []byte{0x03, 0x0f, 0x3f, 0xff}
+	bep42MaskV6 = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+)
+
+// bep42Prefix returns the crc32c of ip masked and salted with r, the 21 most
+// significant bits of which prefix a BEP 42 compliant node id.
+func bep42Prefix(ip net.IP, r byte) uint32 {
+	mask := bep42MaskV6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, bep42MaskV4
+	}
+
+	buf := make([]byte, len(mask))
+	for i := range mask {
+		buf[i] = ip[i] & mask[i]
+	}
+	buf[0] |= (r & 0x7) << 5
+
+	return crc32.Checksum(buf, crc32.MakeTable(crc32.Castagnoli))
+}
+
+// bep42ID returns a random node id complying with BEP 42 for ip.
+func bep42ID(ip net.IP) string {
+	id := []byte(GetRandString(20))
+	r := id[19] & 0x7
+	crc := bep42Prefix(ip, r)
+
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x7
+	id[19] = r
+	return string(id)
+}
+
+// bep42Valid returns whether id complies with BEP 42 for ip.
+func bep42Valid(id string, ip net.IP) bool {
+	if len(id) != 20 {
+		return false
+	}
+
+	crc := bep42Prefix(ip, id[19]&0x7)
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) &&
+		id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+// probeExternalAddr pings the entrance nodes and waits for their responses
+// to elect our external address. It runs before the workers, so it reads
+// the packet queue itself.
+func (dht *DHT) probeExternalAddr() *net.UDPAddr {
+	t := GetRandString(2)
+	for _, addr := range dht.EntranceAddrs {
+		raddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			continue
+		}
+		send(dht, raddr, makeQuery(t, pingType, &PingArgs{ID: dht.self().RawString()}))
+	}
+
+	deadline := time.Now().Add(externalProbeTimeout)
+	for ext := dht.ExternalAddr(); ext == nil; ext = dht.ExternalAddr() {
+		pkt, ok := dht.queue.popUntil(deadline)
+		if !ok {
+			return nil
+		}
+
+		msg := &rawMessage{}
+		err := Unmarshal(pkt.data, msg)
+		if err == nil && msg.Y == "r" && msg.T == t {
+			dht.voteExternal(pkt.raddr, msg.IP)
+		}
+		pkt.release()
+	}
+	return dht.ExternalAddr()
+}
+
+// secureID replaces our node id by a BEP 42 compliant one, derived from
+// ExternalIP or else from the probed external address. It runs before the
+// routing table is used.
+func (dht *DHT) secureID() {
+	if !dht.SecureID {
+		return
+	}
+
+	ip := dht.ExternalIP
+	if ip == nil {
+		if ext := dht.probeExternalAddr(); ext != nil {
+			ip = ext.IP
+		}
+	}
+	if ip == nil {
+		dht.Logger.Warn("external ip unknown, node id is not BEP 42 compliant")
+		return
+	}
+
+	if bep42Valid(dht.self().RawString(), ip) {
+		return
+	}
+	dht.changeID(bep42ID(ip))
+}
@@ -0,0 +1,80 @@
+package dhtlistener
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBep42(t *testing.T) {
+	// the test vectors of BEP 42.
+	for _, c := range []struct {
+		ip     string
+		prefix string
+		r      byte
+	}{
+		{"124.31.75.21", "5fbfbf", 1},
+		{"21.75.31.124", "5a3ce9", 86},
+		{"65.23.51.170", "a5d432", 22},
+		{"84.124.73.14", "1b0321", 65},
+		{"43.213.53.83", "e56f6c", 90},
+	} {
+		prefix, _ := hex.DecodeString(c.prefix)
+		id := string(prefix) + GetRandString(16) + string([]byte{c.r})
+		if !bep42Valid(id, net.ParseIP(c.ip)) {
+			t.Fatalf("%s: expected %x to be valid", c.ip, id)
+		}
+	}
+
+	ip := net.ParseIP("1.2.3.4")
+	for i := 0; i < 16; i++ {
+		if id := bep42ID(ip); !bep42Valid(id, ip) {
+			t.Fatalf("generated id %x is not valid", id)
+		}
+	}
+	if bep42Valid(bep42ID(ip), net.ParseIP("5.6.7.8")) {
+		t.Fatal("an id should not be valid for another ip")
+	}
+}
+
+func TestAddrVoter(t *testing.T) {
+	av := newAddrVoter()
+	a, _ := encodeCompactIPPortInfo(net.IPv4(1, 2, 3, 4).To4(), 6881)
+	b, _ := encodeCompactIPPortInfo(net.IPv4(5, 6, 7, 8).To4(), 6881)
+
+	if _, changed := av.vote(net.IPv4(9, 0, 0, 1), a); changed {
+		t.Fatal("one vote should not elect")
+	}
+	if elected, changed := av.vote(net.IPv4(9, 0, 0, 2), a); !changed || elected != a {
+		t.Fatal("expected a to be elected")
+	}
+
+	// a voter changing its vote doesn't vote twice.
+	av.vote(net.IPv4(9, 0, 0, 3), b)
+	av.vote(net.IPv4(9, 0, 0, 3), b)
+	if av.get() != a {
+		t.Fatal("a should stay elected on a tie")
+	}
+
+	av.vote(net.IPv4(9, 0, 0, 4), b)
+	if elected, _ := av.vote(net.IPv4(9, 0, 0, 5), b); elected != b {
+		t.Fatal("expected b to be elected")
+	}
+}
+
+func TestPopUntil(t *testing.T) {
+	q := newPacketQueue(4, DropNewest)
+	start := time.Now()
+	if _, ok := q.popUntil(start.Add(50 * time.Millisecond)); ok {
+		t.Fatal("expected no packet")
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("popUntil returned before the deadline")
+	}
+
+	q.push(packet{data: []byte("x")})
+	if pkt, ok := q.popUntil(time.Now().Add(time.Second)); !ok || string(pkt.data) != "x" {
+		t.Fatal("expected the queued packet")
+	}
+}
@@ -0,0 +1,203 @@
+package dhtlistener
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// fetchJob represents the pending download of an infohash's metadata.
+type fetchJob struct {
+	infoHash   string
+	candidates []Request       // peers to try, in order
+	tried      map[string]bool // address : tried
+	tries      int
+}
+
+// addCandidate appends a peer to the job unless it's known.
+func (job *fetchJob) addCandidate(ip string, port int) {
+	address := genAddress(ip, port)
+	if job.tried[address] {
+		return
+	}
+	job.tried[address] = true
+
+	job.candidates = append(job.candidates, Request{
+		InfoHash: []byte(job.infoHash),
+		IP:       ip,
+		Port:     port,
+	})
+}
+
+var errNoMetadata = errors.New("no peer sent the metadata")
+
+// metadataFetcher schedules metadata downloads. It deduplicates infohashes,
+// caps the concurrent downloads, retries with alternate peers and backs off
+// the infohashes whose metadata can't be fetched.
+type metadataFetcher struct {
+	sync.Mutex
+	wire    *Wire
+	jobs    chan *fetchJob
+	pending map[string]*fetchJob // infohash : job
+	done    map[string]time.Time // infohash : time to forget
+	dht     *DHT
+}
+
+// newMetadataFetcher returns a new metadataFetcher pointer.
+func newMetadataFetcher(dht *DHT) *metadataFetcher {
+	mf := &metadataFetcher{
+		wire:    NewWire(0, 0),
+		jobs:    make(chan *fetchJob, dht.MetadataQueueSize),
+		pending: make(map[string]*fetchJob),
+		done:    make(map[string]time.Time),
+		dht:     dht,
+	}
+	// the dial functions of dht are read at every dial, they may be set
+	// after the fetcher is made.
+	mf.wire.DialTCP = func(addr string, timeout time.Duration) (net.Conn, error) {
+		if dht.DialTCP == nil {
+			return net.DialTimeout("tcp", addr, timeout)
+		}
+		return dht.DialTCP(addr, timeout)
+	}
+	mf.wire.DialUTP = func(addr string, timeout time.Duration) (net.Conn, error) {
+		if dht.DialUTP == nil {
+			return nil, errNoUTP
+		}
+		return dht.DialUTP(addr, timeout)
+	}
+	return mf
+}
+
+// add schedules the download of infoHash's metadata from the peer. If the
+// infohash is already pending, the peer becomes an alternate candidate.
+func (mf *metadataFetcher) add(infoHash, ip string, port int) {
+	if len(infoHash) != 20 {
+		return
+	}
+
+	mf.Lock()
+	defer mf.Unlock()
+
+	if _, ok := mf.done[infoHash]; ok {
+		return
+	}
+
+	if job, ok := mf.pending[infoHash]; ok {
+		job.addCandidate(ip, port)
+		return
+	}
+
+	job := &fetchJob{infoHash: infoHash, tried: make(map[string]bool)}
+	job.addCandidate(ip, port)
+
+	select {
+	case mf.jobs <- job:
+		mf.pending[infoHash] = job
+	default:
+		mf.dht.Logger.Debug("metadata request dropped, queue full",
+			F("ip", ip), F("port", port))
+	}
+}
+
+// next returns the next peer to try for job, falling back to the peers in
+// the peer store. It returns false if there is no more peer to try.
+func (mf *metadataFetcher) next(job *fetchJob) (Request, bool) {
+	mf.Lock()
+	defer mf.Unlock()
+
+	if job.tries >= mf.dht.MetadataMaxTries {
+		return Request{}, false
+	}
+
+	if len(job.candidates) == 0 {
+		for _, p := range mf.dht.peers.GetPeers(InfoHash(job.infoHash), mf.dht.K) {
+			job.addCandidate(p.IP.String(), p.Port)
+		}
+	}
+
+	if len(job.candidates) == 0 {
+		return Request{}, false
+	}
+
+	r := job.candidates[0]
+	job.candidates = job.candidates[1:]
+	job.tries++
+	return r, true
+}
+
+// finish removes job from the pending ones and remembers its infohash for
+// ttl, so it's not fetched again in the meantime.
+func (mf *metadataFetcher) finish(job *fetchJob, ttl time.Duration) {
+	mf.Lock()
+	defer mf.Unlock()
+
+	delete(mf.pending, job.infoHash)
+	mf.done[job.infoHash] = time.Now().Add(ttl)
+}
+
+// work downloads the metadata of the jobs until the dht is closed.
+func (mf *metadataFetcher) work() {
+	for {
+		var job *fetchJob
+		select {
+		case job = <-mf.jobs:
+		case <-mf.dht.done:
+			return
+		}
+
+		fetched := false
+		ctx, span := mf.dht.startSpan(context.Background(), "dht.metadata",
+			F("infohash", hex.EncodeToString([]byte(job.infoHash))))
+
+		for r, ok := mf.next(job); ok; r, ok = mf.next(job) {
+			_, try := mf.dht.startSpan(ctx, "dht.metadata.fetch",
+				F("ip", r.IP), F("port", r.Port))
+			metadataInfo, err := mf.wire.fetch(r)
+			try.End(err)
+			if err != nil {
+				mf.dht.Logger.Debug("fetch metadata failed",
+					F("ip", r.IP), F("port", r.Port), F("err", err))
+				continue
+			}
+
+			mf.dht.dispatchMetadata(Response{Request: r, MetadataInfo: metadataInfo})
+			fetched = true
+			break
+		}
+
+		span.SetFields(F("tries", job.tries))
+		if fetched {
+			span.End(nil)
+			mf.finish(job, mf.dht.MetadataDoneTime)
+		} else {
+			span.End(errNoMetadata)
+			mf.finish(job, mf.dht.MetadataBackoff)
+		}
+	}
+}
+
+// sweep forgets the infohashes whose time is over.
+func (mf *metadataFetcher) sweep() {
+	now := time.Now()
+
+	mf.Lock()
+	defer mf.Unlock()
+
+	for infoHash, t := range mf.done {
+		if now.After(t) {
+			delete(mf.done, infoHash)
+		}
+	}
+}
+
+// run starts the workers and sweeps every minute.
+func (mf *metadataFetcher) run() {
+	for i := 0; i < mf.dht.MetadataWorkers; i++ {
+		mf.dht.spawn(mf.work)
+	}
+	mf.dht.every(time.Minute, mf.sweep)
+}
@@ -0,0 +1,38 @@
+package dhtlistener
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetadataFetcherDedupe(t *testing.T) {
+	dht := &DHT{K: 8, Logger: nopLogger{}, MetadataQueueSize: 4, MetadataMaxTries: 5}
+	dht.peers = newPeersManager(dht)
+	mf := newMetadataFetcher(dht)
+
+	infoHash := GetRandString(20)
+	mf.add(infoHash, "1.1.1.1", 1)
+	mf.add(infoHash, "1.1.1.1", 1)
+	mf.add(infoHash, "2.2.2.2", 2)
+
+	if len(mf.jobs) != 1 {
+		t.Fatal(len(mf.jobs))
+	}
+
+	job := <-mf.jobs
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+		r, ok := mf.next(job)
+		if !ok || r.IP != ip {
+			t.Fatal(r, ok)
+		}
+	}
+	if _, ok := mf.next(job); ok {
+		t.Fatal("no candidate left but next succeeded")
+	}
+
+	mf.finish(job, time.Hour)
+	mf.add(infoHash, "3.3.3.3", 3)
+	if len(mf.jobs) != 0 {
+		t.Fatal("infohash in backoff scheduled again")
+	}
+}
@@ -0,0 +1,122 @@
+package dhtlistener
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventAnnounceThrottled is published when an ip starts being throttled for
+// announcing an infohash too often.
+const EventAnnounceThrottled EventType = EventPeerFound + 1
+
+// AnnounceThrottled is the event of an ip whose announces of an infohash
+// are rejected, see DHT.AnnounceRateLimit. It's published once until the ip
+// slows down.
+type AnnounceThrottled struct {
+	InfoHash InfoHash
+	IP       string
+	Time     time.Time
+}
+
+// Type implements Event.
+func (AnnounceThrottled) Type() EventType { return EventAnnounceThrottled }
+
+// maxAnnounceSources bounds the buckets of an announceLimiter.
+const maxAnnounceSources = 1 << 16
+
+// announceBucket limits the announces of an infohash by an ip.
+type announceBucket struct {
+	tokenBucket
+	throttled bool // since the last allowed announce
+}
+
+// announceLimiter limits the announces per infohash per source ip.
+type announceLimiter struct {
+	sync.Mutex
+	buckets   map[string]*announceBucket // ip + infohash : bucket
+	rate      float64                    // announces per second, 0 means no limit
+	burst     float64                    // announces in a row
+	throttled uint64                     // accessed atomically
+}
+
+// newAnnounceLimiter returns a new announceLimiter pointer.
+func newAnnounceLimiter() *announceLimiter {
+	return &announceLimiter{buckets: make(map[string]*announceBucket)}
+}
+
+// setRate changes the limits, a 0 rate means no limit.
+func (l *announceLimiter) setRate(rate float64, burst int) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.rate, l.burst = rate, burstOf(rate, burst)
+}
+
+// allow returns whether an announce of infoHash by ip is allowed at now, and
+// whether it's the first one throttled since the last allowed.
+func (l *announceLimiter) allow(ip net.IP, infoHash string, now time.Time) (ok, first bool) {
+	key := string(ip.To16()) + infoHash
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.rate <= 0 {
+		return true, false
+	}
+	ab, found := l.buckets[key]
+	if !found {
+		if len(l.buckets) >= maxAnnounceSources {
+			l.sweep(now)
+		}
+		ab = &announceBucket{}
+		l.buckets[key] = ab
+	}
+
+	if ab.take(now, 1, l.rate, l.burst) {
+		ab.throttled = false
+		return true, false
+	}
+	atomic.AddUint64(&l.throttled, 1)
+	first, ab.throttled = !ab.throttled, true
+	return false, first
+}
+
+// sweep forgets the sources whose bucket is full, or all of them if none
+// is.
+func (l *announceLimiter) sweep(now time.Time) {
+	for key, ab := range l.buckets {
+		if ab.full(now, l.rate, l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+
+	if len(l.buckets) >= maxAnnounceSources {
+		l.buckets = make(map[string]*announceBucket)
+	}
+}
+
+// allowAnnounce returns whether the announce of infoHash by addr is allowed
+// by AnnounceRateLimit, publishing an AnnounceThrottled event when addr
+// starts being throttled.
+func (dht *DHT) allowAnnounce(addr *net.UDPAddr, infoHash string) bool {
+	if dht.replaying {
+		return true
+	}
+
+	ok, first := dht.announceLimits.allow(addr.IP, infoHash, dht.now())
+	if first {
+		dht.Logger.Debug("announces throttled", F("addr", addr))
+		dht.publish(EventAnnounceThrottled, func() Event {
+			return AnnounceThrottled{InfoHash(infoHash), addr.IP.String(), dht.now()}
+		})
+	}
+	return ok
+}
+
+// ThrottledAnnounces returns how many announces have been rejected by
+// AnnounceRateLimit.
+func (dht *DHT) ThrottledAnnounces() uint64 {
+	return atomic.LoadUint64(&dht.announceLimits.throttled)
+}
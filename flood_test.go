@@ -0,0 +1,107 @@
+package dhtlistener
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAnnounceLimiter(t *testing.T) {
+	l := newAnnounceLimiter()
+	l.setRate(1, 2)
+	ip, now := net.IPv4(1, 2, 3, 4), time.Now()
+	infoHash := "mnopqrstuvwxyz123456"
+
+	for i, want := range []struct{ ok, first bool }{
+		{true, false}, {true, false}, {false, true}, {false, false},
+	} {
+		if ok, first := l.allow(ip, infoHash, now); ok != want.ok || first != want.first {
+			t.Errorf("announce %d: expected %v, %v, got %v, %v", i, want.ok, want.first, ok, first)
+		}
+	}
+	if ok, _ := l.allow(ip, "abcdefghij0123456789", now); !ok {
+		t.Error("expected another infohash to be allowed")
+	}
+	if ok, _ := l.allow(net.IPv4(1, 2, 3, 5), infoHash, now); !ok {
+		t.Error("expected another ip to be allowed")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := l.allow(ip, infoHash, now); !ok {
+		t.Error("expected the bucket to be refilled")
+	}
+	if ok, first := l.allow(ip, infoHash, now); ok || !first {
+		t.Error("expected a new throttling to be reported")
+	}
+	if l.throttled != 3 {
+		t.Errorf("expected 3 throttled announces, got %d", l.throttled)
+	}
+}
+
+func TestAnnounceFlood(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.AnnounceRateLimit, dht.AnnounceBurst = 1.0/60, 2
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	announced := dht.Subscribe(EventPeerAnnounced)
+	throttled := dht.Subscribe(EventAnnounceThrottled)
+	addr := l.LocalAddr().(*net.UDPAddr)
+	infoHash := "mnopqrstuvwxyz123456"
+
+	for i := 0; i < 5; i++ {
+		msg := &rawMessage{T: "aa", Y: "q", Q: announcePeerType}
+		msg.A, _ = Marshal(&AnnouncePeerArgs{
+			ID:       "abcdefghij0123456789",
+			InfoHash: infoHash,
+			Port:     6881 + i, // not to be deduplicated
+			Token:    dht.tokens.getToken(addr),
+		})
+		handleRequest(dht, addr, msg)
+	}
+
+	// the throttled announces are answered with an error.
+	buf := make([]byte, 1500)
+	for i := 0; i < 3; i++ {
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := l.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply rawMessage
+		if err := Unmarshal(buf[:n], &reply); err != nil || reply.Y != "e" {
+			t.Errorf("expected an error, got %q", buf[:n])
+		}
+	}
+
+	if n := len(announced); n != 2 {
+		t.Errorf("expected 2 announces, got %d", n)
+	}
+	if peers := dht.peers.GetPeers(InfoHash(infoHash), 10); len(peers) != 2 {
+		t.Errorf("expected 2 peers stored, got %d", len(peers))
+	}
+	if n := dht.ThrottledAnnounces(); n != 3 {
+		t.Errorf("expected 3 throttled announces, got %d", n)
+	}
+	select {
+	case e := <-throttled:
+		if at := e.(AnnounceThrottled); at.InfoHash.RawString() != infoHash || at.IP != "127.0.0.1" {
+			t.Errorf("unexpected event %+v", at)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an AnnounceThrottled event")
+	}
+	if len(throttled) != 0 {
+		t.Error("expected a single AnnounceThrottled event")
+	}
+}
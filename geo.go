@@ -0,0 +1,26 @@
+package dhtlistener
+
+import "net"
+
+// GeoInfo is the location of an ip.
+type GeoInfo struct {
+	Country string `json:"country,omitempty"` // ISO 3166-1 alpha-2 code
+	City    string `json:"city,omitempty"`    // english name
+	ASN     uint   `json:"asn,omitempty"`
+	Org     string `json:"org,omitempty"` // of the ASN
+}
+
+// GeoResolver locates ips, see the geoip package for the MaxMind
+// databases.
+type GeoResolver interface {
+	// Lookup returns the location of ip, nil if it's unknown.
+	Lookup(ip net.IP) *GeoInfo
+}
+
+// geo returns the location of ip, nil without GeoIP.
+func (dht *DHT) geo(ip net.IP) *GeoInfo {
+	if dht.GeoIP == nil || ip == nil {
+		return nil
+	}
+	return dht.GeoIP.Lookup(ip)
+}
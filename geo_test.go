@@ -0,0 +1,42 @@
+package dhtlistener
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeResolver map[string]*GeoInfo
+
+func (r fakeResolver) Lookup(ip net.IP) *GeoInfo {
+	return r[ip.String()]
+}
+
+func TestGeo(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	defer dht.conn.Close()
+
+	ip := net.IPv4(1, 2, 3, 4)
+	if dht.geo(ip) != nil {
+		t.Error("expected no location without GeoIP")
+	}
+
+	dht.GeoIP = fakeResolver{"1.2.3.4": {Country: "FR", City: "Paris", ASN: 3215}}
+	geo := dht.geo(ip)
+	if geo == nil || geo.Country != "FR" || dht.geo(net.IPv4(5, 6, 7, 8)) != nil {
+		t.Fatalf("unexpected location %+v", geo)
+	}
+
+	data, err := json.Marshal(NewStreamEvent(PeerAnnounced{"mnopqrstuvwxyz123456", "1.2.3.4", 6881, time.Now(), geo}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"geo":{"country":"FR","city":"Paris","asn":3215}`) {
+		t.Errorf("expected the location in %s", data)
+	}
+}
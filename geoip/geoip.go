@@ -0,0 +1,187 @@
+// Package geoip implements a dhtlistener.GeoResolver reading the MaxMind
+// GeoLite2 or GeoIP2 City and ASN databases, reopened when their files
+// change so they can be updated without restarting.
+package geoip
+
+import (
+	"github.com/2qif49lt/dhtlistener"
+	"github.com/oschwald/geoip2-golang"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// reader is the part of geoip2.Reader used by a Resolver.
+type reader interface {
+	City(ip net.IP) (*geoip2.City, error)
+	ASN(ip net.IP) (*geoip2.ASN, error)
+	Close() error
+}
+
+// openReader opens the mmdb file at path, it's replaced by the tests.
+var openReader = func(path string) (reader, error) {
+	r, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// database is an opened mmdb file.
+type database struct {
+	path    string
+	reader  reader
+	modTime time.Time
+	size    int64
+}
+
+// open opens the file at db.path if it changed since it was opened, it
+// returns the reader it replaces.
+func (db *database) open() (old reader, err error) {
+	fi, err := os.Stat(db.path)
+	if err != nil {
+		return nil, err
+	}
+	if db.reader != nil && fi.ModTime().Equal(db.modTime) && fi.Size() == db.size {
+		return nil, nil
+	}
+
+	r, err := openReader(db.path)
+	if err != nil {
+		return nil, err
+	}
+
+	old = db.reader
+	db.reader, db.modTime, db.size = r, fi.ModTime(), fi.Size()
+	return old, nil
+}
+
+// Resolver is a dhtlistener.GeoResolver. It checks its files for changes
+// periodically and reopens the changed ones.
+type Resolver struct {
+	sync.RWMutex
+	city *database // may be nil
+	asn  *database // may be nil
+	done chan struct{}
+	wg   sync.WaitGroup
+	// OnError is called with the errors of the reloads, the previous
+	// databases are kept. It may be nil, set it holding the lock once
+	// the Resolver is open.
+	OnError func(error)
+}
+
+// Open returns a Resolver reading the City database at cityPath and the
+// ASN database at asnPath, either may be empty. Their files are checked
+// for changes every interval, unless it's 0.
+//
+//	r, err := geoip.Open("GeoLite2-City.mmdb", "GeoLite2-ASN.mmdb", time.Minute)
+//	...
+//	dht.GeoIP = r
+func Open(cityPath, asnPath string, interval time.Duration) (*Resolver, error) {
+	r := &Resolver{done: make(chan struct{})}
+	if cityPath != "" {
+		r.city = &database{path: cityPath}
+	}
+	if asnPath != "" {
+		r.asn = &database{path: asnPath}
+	}
+
+	if err := r.Reload(); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	if interval > 0 {
+		r.wg.Add(1)
+		go r.reloadLoop(interval)
+	}
+	return r, nil
+}
+
+// Reload reopens the files which changed since they were opened.
+func (r *Resolver) Reload() error {
+	for _, db := range []*database{r.city, r.asn} {
+		if db == nil {
+			continue
+		}
+
+		r.Lock()
+		old, err := db.open()
+		r.Unlock()
+
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			old.Close()
+		}
+	}
+	return nil
+}
+
+// reloadLoop calls Reload every interval until Close.
+func (r *Resolver) reloadLoop(interval time.Duration) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := r.Reload()
+
+			r.RLock()
+			onError := r.OnError
+			r.RUnlock()
+			if err != nil && onError != nil {
+				onError(err)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// Lookup implements dhtlistener.GeoResolver.
+func (r *Resolver) Lookup(ip net.IP) *dhtlistener.GeoInfo {
+	r.RLock()
+	defer r.RUnlock()
+
+	var info dhtlistener.GeoInfo
+	if r.city != nil && r.city.reader != nil {
+		if c, err := r.city.reader.City(ip); err == nil {
+			info.Country = c.Country.IsoCode
+			info.City = c.City.Names["en"]
+		}
+	}
+	if r.asn != nil && r.asn.reader != nil {
+		if a, err := r.asn.reader.ASN(ip); err == nil {
+			info.ASN = a.AutonomousSystemNumber
+			info.Org = a.AutonomousSystemOrganization
+		}
+	}
+
+	if info == (dhtlistener.GeoInfo{}) {
+		return nil
+	}
+	return &info
+}
+
+// Close stops the reloads and closes the databases.
+func (r *Resolver) Close() error {
+	close(r.done)
+	r.wg.Wait()
+
+	r.Lock()
+	defer r.Unlock()
+
+	for _, db := range []*database{r.city, r.asn} {
+		if db != nil && db.reader != nil {
+			db.reader.Close()
+			db.reader = nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package geoip
+
+import (
+	"errors"
+	"github.com/2qif49lt/dhtlistener"
+	"github.com/oschwald/geoip2-golang"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeReader answers the records of its file, "country city" for a City
+// database, "number org" for an ASN one.
+type fakeReader struct {
+	a, b   string
+	closed *int32
+}
+
+func (r *fakeReader) City(ip net.IP) (*geoip2.City, error) {
+	if ip.IsLoopback() {
+		return nil, errors.New("not found")
+	}
+	c := &geoip2.City{}
+	c.Country.IsoCode = r.a
+	c.City.Names = map[string]string{"en": r.b}
+	return c, nil
+}
+
+func (r *fakeReader) ASN(ip net.IP) (*geoip2.ASN, error) {
+	n, err := strconv.Atoi(r.a)
+	if err != nil || ip.IsLoopback() {
+		return nil, errors.New("not found")
+	}
+	return &geoip2.ASN{AutonomousSystemNumber: uint(n), AutonomousSystemOrganization: r.b}, nil
+}
+
+func (r *fakeReader) Close() error {
+	atomic.AddInt32(r.closed, 1)
+	return nil
+}
+
+// fakeDatabases makes openReader read the fake databases, it returns the
+// number of readers closed.
+func fakeDatabases(t *testing.T) *int32 {
+	closed := new(int32)
+	open := openReader
+	openReader = func(path string) (reader, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 {
+			return nil, errors.New("invalid database")
+		}
+		return &fakeReader{fields[0], fields[1], closed}, nil
+	}
+	t.Cleanup(func() { openReader = open })
+	return closed
+}
+
+func TestResolver(t *testing.T) {
+	closed := fakeDatabases(t)
+	dir := t.TempDir()
+	city, asn := filepath.Join(dir, "city.mmdb"), filepath.Join(dir, "asn.mmdb")
+	os.WriteFile(city, []byte("FR Paris"), 0600)
+	os.WriteFile(asn, []byte("3215 Orange"), 0600)
+
+	r, err := Open(city, asn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.IPv4(1, 2, 3, 4)
+	if g := r.Lookup(ip); g == nil ||
+		*g != (dhtlistener.GeoInfo{Country: "FR", City: "Paris", ASN: 3215, Org: "Orange"}) {
+		t.Fatalf("unexpected geo %+v", g)
+	}
+	if g := r.Lookup(net.IPv4(127, 0, 0, 1)); g != nil {
+		t.Errorf("expected an unknown ip, got %+v", g)
+	}
+
+	// the unchanged files aren't reopened.
+	if err := r.Reload(); err != nil || atomic.LoadInt32(closed) != 0 {
+		t.Fatalf("expected nothing reloaded, %v", err)
+	}
+
+	os.WriteFile(city, []byte("DE Berlin!"), 0600)
+	if err := r.Reload(); err != nil || atomic.LoadInt32(closed) != 1 {
+		t.Fatalf("expected the city database reloaded, %v", err)
+	}
+	if g := r.Lookup(ip); g == nil || g.Country != "DE" || g.ASN != 3215 {
+		t.Fatalf("unexpected geo %+v", g)
+	}
+
+	// a broken file keeps the previous database.
+	os.WriteFile(city, []byte("broken"), 0600)
+	if err := r.Reload(); err == nil {
+		t.Fatal("expected the reload to fail")
+	}
+	if g := r.Lookup(ip); g == nil || g.Country != "DE" {
+		t.Fatalf("expected the previous database kept, got %+v", g)
+	}
+
+	r.Close()
+	if n := atomic.LoadInt32(closed); n != 3 {
+		t.Errorf("expected the databases closed, %d closed", n)
+	}
+}
+
+func TestResolverReloadLoop(t *testing.T) {
+	fakeDatabases(t)
+	dir := t.TempDir()
+	asn := filepath.Join(dir, "asn.mmdb")
+	os.WriteFile(asn, []byte("3215 Orange"), 0600)
+
+	r, err := Open("", asn, time.Millisecond*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	errs := make(chan error, 1)
+	r.Lock()
+	r.OnError = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	r.Unlock()
+
+	os.WriteFile(asn, []byte("12322 Free"), 0600)
+	for i := 0; ; i++ {
+		if g := r.Lookup(net.IPv4(1, 2, 3, 4)); g != nil && g.ASN == 12322 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expected the asn database reloaded")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	os.Remove(asn)
+	select {
+	case <-errs:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected the reload error reported")
+	}
+}
+
+func TestOpenMissing(t *testing.T) {
+	fakeDatabases(t)
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.mmdb"), "", 0); err == nil {
+		t.Error("expected a missing database to fail")
+	}
+}
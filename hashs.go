@@ -1,6 +1,8 @@
 package dhtlistener
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"strings"
 )
@@ -9,85 +11,101 @@ const (
 	hash_size = 20
 )
 
-// hashid holds information about node id
-type hashid struct {
+var (
+	errHashIDSize = errors.New("id should be 20 bytes")
+	errPrefixBits = errors.New("prefix bits should be between 0 and 160")
+)
+
+// HashID is a node id or an infohash, or a prefix of one, as bits. The
+// distance between two ids is their Xor, see Distance. An id shorter than
+// another is padded with zero bits, the zero HashID is the zero id.
+type HashID struct {
 	data [hash_size]byte
 	len  int
 }
 
-func newSizeHashId(size int) *hashid {
+func newSizeHashId(size int) *HashID {
 	if size > hash_size*8 {
 		panic("size is  bigger than 160")
 	}
-	ret := &hashid{}
+	ret := &HashID{}
 	ret.len = size
 
 	return ret
 }
 
-// newHashId takes string parameter and returns a hashid point
-func newHashId(data string) *hashid {
+// newHashId takes string parameter and returns a HashID point
+func newHashId(data string) *HashID {
 	return newHashIdFromBytes([]byte(data))
 }
 
-// newHashId takes byte slice parameter and returns a hashid point
-func newHashIdFromBytes(data []byte) *hashid {
+// newHashId takes byte slice parameter and returns a HashID point
+func newHashIdFromBytes(data []byte) *HashID {
 	if len(data) > hash_size {
 		panic("data length is bigger than 20")
 	}
 
-	id := &hashid{}
+	id := &HashID{}
 	copy(id.data[:], data)
 	id.len = len(data) * 8
 
 	return id
 }
 
-// newSubRandHashIdFromIdSize take another hasdid and prefix size parameter returns a new hashid poing
-func newSubRandHashIdFromIdSize(other *hashid, size int) *hashid {
-	if size > hash_size*8 {
-		panic("prefix size is invaild")
+// HashIDFromBytes returns the HashID of the raw 20 bytes id.
+func HashIDFromBytes(id []byte) (*HashID, error) {
+	if len(id) != hash_size {
+		return nil, errHashIDSize
 	}
-	div, mod := size/8, size%8
-
-	ret := newSizeHashId(size)
+	return newHashIdFromBytes(id), nil
+}
 
-	for idx := 0; idx != div; div++ {
-		ret.data[idx] = other.data[idx]
+// HashIDFromHex returns the HashID of the hex encoded id.
+func HashIDFromHex(s string) (*HashID, error) {
+	id, err := parseNodeID(s)
+	if err != nil {
+		return nil, err
 	}
-	if mod != 0 {
-		rd := GetRandString(hash_size - div)
+	return newHashId(id), nil
+}
 
-		for idx := 0; div != hash_size; div++ {
-			ret.data[div] = rd[idx]
-			idx++
-		}
+// RandomHashID returns a random HashID.
+func RandomHashID() *HashID {
+	return newHashId(GetRandString(hash_size))
+}
 
-		for idx := 0; idx != mod; idx++ {
-			if other.Bit(div*8+idx) == 1 {
-				ret.Set(div*8 + idx)
-			} else {
-				ret.UnSet(div*8 + idx)
-			}
-		}
+// RandomHashIDInPrefix returns a random HashID sharing its first bits with
+// prefix, i.e. in the bucket of prefix at depth bits.
+func RandomHashIDInPrefix(prefix *HashID, bits int) (*HashID, error) {
+	if bits < 0 || bits > hash_size*8 {
+		return nil, errPrefixBits
 	}
-	return ret
+
+	ret := RandomHashID()
+	div, mod := bits/8, bits%8
+	copy(ret.data[:div], prefix.data[:div])
+	if mod != 0 {
+		mask := byte(0xff << uint(8-mod))
+		ret.data[div] = prefix.data[div]&mask | ret.data[div]&^mask
+	}
+	return ret, nil
 }
 
-// Bit returns the idx-th position's bit, 0 or 1
-func (h *hashid) Bit(idx int) int {
-	if idx >= h.len {
-		panic("index is out of range")
+// Bit returns the idx-th position's bit, 0 or 1, 0 if idx is out of range.
+func (h *HashID) Bit(idx int) int {
+	if idx < 0 || idx >= h.len {
+		return 0
 	}
 
 	byteIdx, bitIdx := idx/8, idx%8
 	return int((h.data[byteIdx] >> uint(8-bitIdx-1)) & 0x1)
 }
 
-// set sets the idx-th postions's bit to bit value
-func (h *hashid) set(idx, bit int) {
-	if idx >= h.len {
-		panic("index is out of range")
+// set sets the idx-th postions's bit to bit value, it does nothing if idx
+// is out of range.
+func (h *HashID) set(idx, bit int) {
+	if idx < 0 || idx >= h.len {
+		return
 	}
 
 	byteIdx, bitIdx := idx/8, idx%8
@@ -100,7 +118,7 @@ func (h *hashid) set(idx, bit int) {
 }
 
 // Inverse inverse the idx-th position bit,returns the old value
-func (h *hashid) Inverse(idx int) int {
+func (h *HashID) Inverse(idx int) int {
 	old := h.Bit(idx)
 	if old == 0 {
 		h.Set(idx)
@@ -111,22 +129,21 @@ func (h *hashid) Inverse(idx int) int {
 }
 
 // Set sets the idx-th postions's bit to 1
-func (h *hashid) Set(idx int) {
+func (h *HashID) Set(idx int) {
 	h.set(idx, 1)
 }
 
 // UnSet sets the idx-th postions's bit to 0
-func (h *hashid) UnSet(idx int) {
+func (h *HashID) UnSet(idx int) {
 	h.set(idx, 0)
 }
 
-// Xor returns xor value of two hashid
-func (h *hashid) Xor(rhs *hashid) *hashid {
-	if h.len != rhs.len {
-		panic("size not the same")
-	}
-
+// Xor returns xor value of two HashID, as long as the longer one.
+func (h *HashID) Xor(rhs *HashID) *HashID {
 	ret := newSizeHashId(h.len)
+	if rhs.len > ret.len {
+		ret.len = rhs.len
+	}
 
 	for k, _ := range h.data {
 		ret.data[k] = h.data[k] ^ rhs.data[k]
@@ -135,13 +152,52 @@ func (h *hashid) Xor(rhs *hashid) *hashid {
 	return ret
 }
 
+// Distance returns the xor distance between h and other, comparable with
+// Cmp.
+func (h *HashID) Distance(other *HashID) *HashID {
+	return h.Xor(other)
+}
+
+// CommonPrefixLen returns the number of leading bits shared by h and other.
+func (h *HashID) CommonPrefixLen(other *HashID) int {
+	n := h.len
+	if other.len > n {
+		n = other.len
+	}
+	for i := 0; i < n; i++ {
+		if h.Bit(i) != other.Bit(i) {
+			return i
+		}
+	}
+	return n
+}
+
+// Cmp compares h and other as big endian numbers, returning -1, 0 or 1.
+func (h *HashID) Cmp(other *HashID) int {
+	return h.Compare(other, hash_size*8)
+}
+
+// Equal returns whether h and other are the same id.
+func (h *HashID) Equal(other *HashID) bool {
+	return h.Cmp(other) == 0
+}
+
+// Closer returns whether a is closer to h than b is.
+func (h *HashID) Closer(a, b *HashID) bool {
+	return h.Xor(a).Cmp(h.Xor(b)) < 0
+}
+
 // Compare compares the prefixLen-prefix of two bitmap.
 //   - If bitmap.data[:prefixLen] < other.data[:prefixLen], return -1.
 //   - If bitmap.data[:prefixLen] > other.data[:prefixLen], return 1.
 //   - Otherwise return 0.
-func (h *hashid) Compare(other *hashid, prefixLen int) int {
-	if prefixLen > h.len || prefixLen > other.len {
-		panic("index out of range")
+//
+// prefixLen is bounded by the 160 bits of an id.
+func (h *HashID) Compare(other *HashID, prefixLen int) int {
+	if prefixLen < 0 {
+		prefixLen = 0
+	} else if prefixLen > hash_size*8 {
+		prefixLen = hash_size * 8
 	}
 	div, mod := prefixLen/8, prefixLen%8
 
@@ -165,7 +221,7 @@ func (h *hashid) Compare(other *hashid, prefixLen int) int {
 	return 0
 }
 
-func (h *hashid) String() string {
+func (h *HashID) String() string {
 	div, mod := h.len/8, h.len%8
 	var arr []string
 	if mod > 0 {
@@ -189,12 +245,26 @@ func (h *hashid) String() string {
 	return strings.Join(arr[:], " ")
 }
 
-func (h *hashid) RawString() string {
+// valid returns whether h is a whole id, rather than a prefix or the zero
+// HashID.
+func (h *HashID) valid() bool {
+	return h != nil && h.len == hash_size*8
+}
+
+// RawString returns the raw bytes of h.
+func (h *HashID) RawString() string {
 	return string(h.data[:])
 }
 
-func (h *hashid) PrefixLen() int {
-	for idx := 0; idx != h.len; idx++ {
+// Hex returns the hex encoding of h.
+func (h *HashID) Hex() string {
+	return hex.EncodeToString(h.data[:])
+}
+
+// PrefixLen returns the number of leading zero bits, len-1 for a zero id
+// so that it's a bucket index.
+func (h *HashID) PrefixLen() int {
+	for idx := 0; idx != h.len/8; idx++ {
 		for idxbit := 0; idxbit != 8; idxbit++ {
 			if h.data[idx]&(0x1<<(7-uint(idxbit))) != 0 {
 				return idx*8 + idxbit
@@ -202,5 +272,5 @@ func (h *hashid) PrefixLen() int {
 		}
 	}
 
-	return h.len*8 - 1
+	return h.len - 1
 }
@@ -2,6 +2,7 @@ package dhtlistener
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -72,6 +73,31 @@ func TestHashIdSet(t *testing.T) {
 	}
 }
 
+func TestHashIdPrefixLen(t *testing.T) {
+	zero := strings.Repeat("\x00", 20)
+
+	cases := []struct {
+		in  int // the bit set, -1 for none
+		out int
+	}{
+		{0, 0},
+		{12, 12},
+		{87, 87},
+		{159, 159},
+		{-1, 159}, // the last bucket
+	}
+
+	for k, v := range cases {
+		id := newHashId(zero)
+		if v.in >= 0 {
+			id.Set(v.in)
+		}
+		if l := id.PrefixLen(); l != v.out {
+			t.Fatal(k, l, v.out)
+		}
+	}
+}
+
 func TestHashIdXor(t *testing.T) {
 	data := "0123456789abcdefghij"
 	inverseHashId := newHashId(data)
@@ -130,3 +156,62 @@ func TestHashIdCompare(t *testing.T) {
 		t.Fatal(rst, halfZerohalfOne, other)
 	}
 }
+
+func TestHashIDExported(t *testing.T) {
+	if _, err := HashIDFromBytes([]byte("0123")); err != errHashIDSize {
+		t.Errorf("expected errHashIDSize, got %v", err)
+	}
+	if _, err := HashIDFromHex("0123"); err != errNodeID {
+		t.Errorf("expected errNodeID, got %v", err)
+	}
+
+	a, err := HashIDFromHex("ff00000000000000000000000000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := HashIDFromBytes([]byte("\xf0\x0f\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"))
+	if a.Hex() != "ff00000000000000000000000000000000000000" {
+		t.Errorf("unexpected hex %s", a.Hex())
+	}
+	if n := a.CommonPrefixLen(b); n != 4 {
+		t.Errorf("expected 4 common bits, got %d", n)
+	}
+	if n := a.CommonPrefixLen(a); n != 160 {
+		t.Errorf("expected 160 common bits, got %d", n)
+	}
+	if a.Cmp(b) != 1 || b.Cmp(a) != -1 || !a.Equal(a) || a.Equal(b) {
+		t.Error("unexpected comparison")
+	}
+	if d := a.Distance(b); d.Hex() != "0f0f000000000000000000000000000000000000" {
+		t.Errorf("unexpected distance %s", d.Hex())
+	}
+
+	c := RandomHashID()
+	if !a.Closer(a, c) && !a.Equal(c) {
+		t.Error("expected a to be the closest to itself")
+	}
+	for bits := 0; bits <= 160; bits += 3 {
+		if id, err := RandomHashIDInPrefix(c, bits); err != nil || id.CommonPrefixLen(c) < bits {
+			t.Errorf("expected %d common bits, got %v", bits, err)
+		}
+	}
+	if _, err := RandomHashIDInPrefix(c, 161); err != errPrefixBits {
+		t.Errorf("expected errPrefixBits, got %v", err)
+	}
+
+	// the zero HashID is the zero id, out of range bits are 0.
+	zero := &HashID{}
+	if d := zero.Distance(a); d.Hex() != a.Hex() || !zero.Closer(b, a) || zero.Cmp(a) != -1 {
+		t.Errorf("unexpected distance %s to the zero id", d.Hex())
+	}
+	if !zero.Equal(newSizeHashId(160)) || zero.CommonPrefixLen(a) != 0 {
+		t.Error("expected the zero HashID to be the zero id")
+	}
+	if zero.Bit(3) != 0 || a.Bit(-1) != 0 || a.Bit(160) != 0 || a.Compare(b, 200) != 1 {
+		t.Error("unexpected out of range bits")
+	}
+	a.Set(160)
+	if a.Hex() != "ff00000000000000000000000000000000000000" {
+		t.Errorf("expected an out of range bit ignored, got %s", a.Hex())
+	}
+}
@@ -0,0 +1,81 @@
+package dhtlistener
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Health is the health of a DHT, for liveness and readiness probes.
+type Health struct {
+	// Running tells whether Run has been called and Close hasn't.
+	Running bool `json:"running"`
+	// Bootstrapped tells whether the routing table holds HealthMinNodes.
+	Bootstrapped bool `json:"bootstrapped"`
+	Nodes        int  `json:"nodes"`
+	// Receiving tells whether a packet has been received during the last
+	// HealthWindow.
+	Receiving bool `json:"receiving"`
+	// Reachable tells whether a query has been received during the last
+	// HealthWindow. Most queries are unsolicited, a NAT or firewall
+	// dropping them makes us unreachable.
+	Reachable     bool      `json:"reachable"`
+	LastPacketIn  time.Time `json:"last_packet_in"`  // zero if none
+	LastPacketOut time.Time `json:"last_packet_out"` // zero if none
+	LastQueryIn   time.Time `json:"last_query_in"`   // zero if none
+}
+
+// Live tells whether the dht runs, a quiet network doesn't make it dead.
+func (h Health) Live() bool {
+	return h.Running
+}
+
+// Ready tells whether the dht runs, receives packets and is bootstrapped.
+func (h Health) Ready() bool {
+	return h.Running && h.Receiving && h.Bootstrapped
+}
+
+// healthMinNodes returns the number of nodes of a bootstrapped routing
+// table.
+func (dht *DHT) healthMinNodes() int {
+	if dht.HealthMinNodes > 0 {
+		return dht.HealthMinNodes
+	}
+	return 16
+}
+
+// healthWindow returns how recent the traffic of a healthy dht is.
+func (dht *DHT) healthWindow() time.Duration {
+	if dht.HealthWindow > 0 {
+		return dht.HealthWindow
+	}
+	return time.Minute
+}
+
+// unixTime returns the time of the unix nano t, zero if t is.
+func unixTime(t int64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, t)
+}
+
+// Health returns the health of dht.
+func (dht *DHT) Health() Health {
+	h := Health{
+		LastPacketIn:  unixTime(atomic.LoadInt64(&dht.metrics.lastIn)),
+		LastPacketOut: unixTime(atomic.LoadInt64(&dht.metrics.lastOut)),
+		LastQueryIn:   unixTime(atomic.LoadInt64(&dht.metrics.lastQuery)),
+	}
+
+	// the following are only available once the dht runs.
+	if dht.initialized() {
+		h.Running = !dht.closed()
+		h.Nodes = dht.rt.Len()
+		h.Bootstrapped = h.Nodes >= dht.healthMinNodes()
+	}
+
+	since := dht.now().Add(-dht.healthWindow())
+	h.Receiving = h.LastPacketIn.After(since)
+	h.Reachable = h.LastQueryIn.After(since)
+	return h
+}
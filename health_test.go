@@ -0,0 +1,69 @@
+package dhtlistener
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	clock := newFakeClock()
+	dht.Clock = clock
+	dht.HealthMinNodes = 1
+
+	if h := dht.Health(); h.Running || h.Live() {
+		t.Errorf("expected a dht not running, got %+v", h)
+	}
+
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+
+	srv := httptest.NewServer(dht.AdminHandler())
+	defer srv.Close()
+	status := func(path string) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if h := dht.Health(); !h.Live() || h.Receiving || h.Ready() {
+		t.Errorf("expected a dht without traffic, got %+v", h)
+	}
+	if code := status("/livez"); code != http.StatusOK {
+		t.Errorf("expected /livez to succeed, got %d", code)
+	}
+	if code := status("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz to fail, got %d", code)
+	}
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	data, _ := Marshal(makeQuery("aa", pingType, &PingArgs{ID: GetRandString(20)}))
+	handle(dht, packet{data: data, raddr: l.LocalAddr().(*net.UDPAddr)})
+
+	h := dht.Health()
+	if !h.Ready() || !h.Reachable || h.Nodes != 1 || !h.LastQueryIn.Equal(clock.Now()) || h.LastPacketOut.IsZero() {
+		t.Errorf("expected a ready dht, got %+v", h)
+	}
+	if code := status("/readyz"); code != http.StatusOK {
+		t.Errorf("expected /readyz to succeed, got %d", code)
+	}
+
+	clock.Advance(time.Minute * 2)
+	if h := dht.Health(); h.Receiving || h.Reachable || h.Ready() || !h.Live() {
+		t.Errorf("expected a silent dht, got %+v", h)
+	}
+}
@@ -0,0 +1,61 @@
+package dhtlistener
+
+import "net"
+
+// packetIn runs OnPacketIn on data received from addr, it returns nil if
+// the packet is dropped.
+func (dht *DHT) packetIn(addr *net.UDPAddr, data []byte) []byte {
+	if dht.OnPacketIn == nil {
+		return data
+	}
+	return dht.OnPacketIn(addr, data)
+}
+
+// packetOut runs OnPacketOut on data sent to addr, it returns nil if the
+// packet is dropped.
+func (dht *DHT) packetOut(addr *net.UDPAddr, data []byte) []byte {
+	if dht.OnPacketOut == nil {
+		return data
+	}
+	return dht.OnPacketOut(addr, data)
+}
+
+// intercept decodes the body of a message of addr, passes it to hook and
+// encodes it back into body. It returns false if hook drops the message,
+// a body which can't be decoded is left to the handlers.
+func intercept(addr *net.UDPAddr, q string, body *RawMessage,
+	hook func(*net.UDPAddr, string, map[string]interface{}) bool) bool {
+
+	var m map[string]interface{}
+	if Unmarshal(*body, &m) != nil {
+		return true
+	}
+	if !hook(addr, q, m) {
+		return false
+	}
+
+	data, err := Marshal(m)
+	if err != nil {
+		return false
+	}
+	*body = data
+	return true
+}
+
+// queryIn runs OnQueryIn on the query msg of addr, it returns false if the
+// query is dropped.
+func (dht *DHT) queryIn(addr *net.UDPAddr, msg *rawMessage) bool {
+	if dht.OnQueryIn == nil {
+		return true
+	}
+	return intercept(addr, msg.Q, &msg.A, dht.OnQueryIn)
+}
+
+// responseIn runs OnResponseIn on the response msg of addr to a query of
+// type q, it returns false if the response is dropped.
+func (dht *DHT) responseIn(addr *net.UDPAddr, q string, msg *rawMessage) bool {
+	if dht.OnResponseIn == nil {
+		return true
+	}
+	return intercept(addr, q, &msg.R, dht.OnResponseIn)
+}
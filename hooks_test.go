@@ -0,0 +1,108 @@
+package dhtlistener
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	mem := &memNet{}
+	addrA := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	addrB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+
+	a, err := New(WithTransport(mem.listen(addrA)), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(WithTransport(mem.listen(addrB)), WithBootstrapNodes(addrA.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.RegisterQueryHandler("echo", func(addr *net.UDPAddr, args map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"echo": args["msg"]}, nil
+	})
+
+	var out, in int32
+	a.OnPacketOut = func(addr *net.UDPAddr, data []byte) []byte {
+		atomic.AddInt32(&out, 1)
+		return data
+	}
+	b.OnPacketIn = func(addr *net.UDPAddr, data []byte) []byte {
+		atomic.AddInt32(&in, 1)
+		return data
+	}
+	a.OnQueryIn = func(addr *net.UDPAddr, q string, args map[string]interface{}) bool {
+		if q != "echo" {
+			return true
+		}
+		if args["msg"] == "drop" {
+			return false
+		}
+		args["msg"] = args["msg"].(string) + "!"
+		return true
+	}
+	b.OnResponseIn = func(addr *net.UDPAddr, q string, r map[string]interface{}) bool {
+		if q == "echo" {
+			r["echo"] = r["echo"].(string) + "?"
+		}
+		return true
+	}
+
+	for _, dht := range []*DHT{a, b} {
+		dht.rt = newRouteTable(dht) // before Run, read below
+		go dht.Run()
+		defer func(dht *DHT) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			dht.Close(ctx)
+		}(dht)
+	}
+	if !waitUntil(func() bool { return hasNode(b, addrA.String()) }) {
+		t.Fatal("b should join a")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := b.Query(ctx, addrA, "echo", map[string]interface{}{"msg": "hi"})
+	if err != nil || r["echo"] != "hi!?" {
+		t.Errorf("expected the echo changed by the hooks, got %v, %v", r, err)
+	}
+	if atomic.LoadInt32(&out) == 0 || atomic.LoadInt32(&in) == 0 {
+		t.Error("expected the packet hooks called")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := b.Query(ctx, addrA, "echo", map[string]interface{}{"msg": "drop"}); err != context.DeadlineExceeded {
+		t.Errorf("expected the query dropped, got %v", err)
+	}
+}
+
+func TestPacketOutDrop(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+	dht.OnPacketOut = func(addr *net.UDPAddr, data []byte) []byte { return nil }
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.LocalAddr().(*net.UDPAddr)
+
+	data, _ := Marshal(makeQuery("aa", pingType, &PingArgs{ID: GetRandString(20)}))
+	handle(dht, packet{data: data, raddr: addr})
+
+	l.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := l.ReadFromUDP(make([]byte, 1500)); err == nil {
+		t.Error("expected the response dropped")
+	}
+}
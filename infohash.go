@@ -0,0 +1,58 @@
+package dhtlistener
+
+import (
+	"encoding/hex"
+	"encoding/json"
+)
+
+// InfoHash is a raw 20 bytes infohash, as held by the events and passed to
+// the callbacks. Print it with Hex or String, not as is.
+type InfoHash string
+
+// ParseInfoHash returns the InfoHash of s, raw or hex encoded.
+func ParseInfoHash(s string) (InfoHash, error) {
+	raw, err := rawInfoHash(s)
+	if err != nil {
+		return "", err
+	}
+	return InfoHash(raw), nil
+}
+
+// RawString returns the raw 20 bytes of ih.
+func (ih InfoHash) RawString() string {
+	return string(ih)
+}
+
+// Bytes returns a copy of the raw bytes of ih.
+func (ih InfoHash) Bytes() []byte {
+	return []byte(ih)
+}
+
+// Hex returns the lowercase hex encoding of ih.
+func (ih InfoHash) Hex() string {
+	return hex.EncodeToString([]byte(ih))
+}
+
+// String implements fmt.Stringer, it returns the hex encoding of ih.
+func (ih InfoHash) String() string {
+	return ih.Hex()
+}
+
+// MarshalJSON encodes ih as a hex string.
+func (ih InfoHash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ih.Hex())
+}
+
+// UnmarshalJSON decodes the hex string of an infohash.
+func (ih *InfoHash) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseInfoHash(s)
+	if err != nil {
+		return err
+	}
+	*ih = parsed
+	return nil
+}
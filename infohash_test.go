@@ -0,0 +1,33 @@
+package dhtlistener
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestInfoHash(t *testing.T) {
+	const hexed = "0123456789abcdef0123456789abcdef01234567"
+
+	ih, err := ParseInfoHash(hexed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ih.RawString()) != 20 || ih.Hex() != hexed || ih.String() != hexed {
+		t.Errorf("unexpected infohash %q", ih.RawString())
+	}
+	if raw, err := ParseInfoHash(ih.RawString()); err != nil || raw != ih {
+		t.Errorf("expected the raw form parsed, got %q, %v", raw, err)
+	}
+	if _, err := ParseInfoHash("0123"); err != errInvalidInfoHash {
+		t.Errorf("expected errInvalidInfoHash, got %v", err)
+	}
+
+	data, err := json.Marshal(PeerFound{InfoHash: ih})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pf PeerFound
+	if err := json.Unmarshal(data, &pf); err != nil || pf.InfoHash != ih {
+		t.Errorf("expected %s round tripped, got %s, %v", ih, pf.InfoHash, err)
+	}
+}
@@ -0,0 +1,207 @@
+package dhtlistener
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"strings"
+	"sync"
+)
+
+// InfoHashSet is a set of infohashes. It's an open addressing hash table
+// of the raw infohashes, indexed by their first bytes since infohashes are
+// uniformly distributed. It takes less than 60 bytes per infohash, so it
+// holds millions of them.
+type InfoHashSet struct {
+	sync.RWMutex
+	slots [][20]byte // the zero value marks an empty slot
+	n     int        // infohashes in slots
+	zero  bool       // holds the zero infohash
+}
+
+// NewInfoHashSet returns a new, empty InfoHashSet pointer.
+func NewInfoHashSet() *InfoHashSet {
+	return &InfoHashSet{}
+}
+
+// home returns the slot of h in slots of size mask+1.
+func home(h *[20]byte, mask uint64) uint64 {
+	return binary.BigEndian.Uint64(h[:8]) & mask
+}
+
+// find returns the slot holding h, or the empty slot where it would be.
+func (s *InfoHashSet) find(h *[20]byte) uint64 {
+	mask := uint64(len(s.slots) - 1)
+	for i := home(h, mask); ; i = (i + 1) & mask {
+		if s.slots[i] == *h || s.slots[i] == [20]byte{} {
+			return i
+		}
+	}
+}
+
+// grow doubles the slots.
+func (s *InfoHashSet) grow() {
+	old := s.slots
+	size := len(old) * 2
+	if size == 0 {
+		size = 16
+	}
+
+	s.slots = make([][20]byte, size)
+	for i := range old {
+		if old[i] != ([20]byte{}) {
+			s.slots[s.find(&old[i])] = old[i]
+		}
+	}
+}
+
+// parseInfoHash20 returns the raw infohash of its raw or hex form.
+func parseInfoHash20(infoHash string) (h [20]byte, err error) {
+	raw, err := rawInfoHash(infoHash)
+	if err == nil {
+		copy(h[:], raw)
+	}
+	return
+}
+
+// Add adds infoHash, raw or hex encoded.
+func (s *InfoHashSet) Add(infoHash string) error {
+	h, err := parseInfoHash20(infoHash)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.add(&h)
+	return nil
+}
+
+// add adds h, the caller holds the lock.
+func (s *InfoHashSet) add(h *[20]byte) {
+	if *h == ([20]byte{}) {
+		s.zero = true
+		return
+	}
+
+	if (s.n+1)*4 > len(s.slots)*3 {
+		s.grow()
+	}
+	if i := s.find(h); s.slots[i] != *h {
+		s.slots[i] = *h
+		s.n++
+	}
+}
+
+// Remove removes infoHash, raw or hex encoded, and returns whether it was
+// in the set.
+func (s *InfoHashSet) Remove(infoHash string) bool {
+	h, err := parseInfoHash20(infoHash)
+	if err != nil {
+		return false
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if h == ([20]byte{}) {
+		ok := s.zero
+		s.zero = false
+		return ok
+	}
+	if len(s.slots) == 0 {
+		return false
+	}
+
+	i := s.find(&h)
+	if s.slots[i] != h {
+		return false
+	}
+
+	// shift back the following slots which can't be found past the hole.
+	mask := uint64(len(s.slots) - 1)
+	for j := (i + 1) & mask; s.slots[j] != ([20]byte{}); j = (j + 1) & mask {
+		k := home(&s.slots[j], mask)
+		if i <= j && i < k && k <= j || i > j && (i < k || k <= j) {
+			continue
+		}
+		s.slots[i] = s.slots[j]
+		i = j
+	}
+	s.slots[i] = [20]byte{}
+	s.n--
+	return true
+}
+
+// Has returns whether the raw infoHash is in the set, false if s is nil.
+func (s *InfoHashSet) Has(infoHash string) bool {
+	if s == nil || len(infoHash) != 20 {
+		return false
+	}
+
+	var h [20]byte
+	copy(h[:], infoHash)
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if h == ([20]byte{}) {
+		return s.zero
+	}
+	return len(s.slots) != 0 && s.slots[s.find(&h)] == h
+}
+
+// Len returns the number of infohashes, 0 if s is nil.
+func (s *InfoHashSet) Len() int {
+	if s == nil {
+		return 0
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.zero {
+		return s.n + 1
+	}
+	return s.n
+}
+
+// Load adds the hex infohashes read from r, one a line. Blank lines and
+// comments starting with # are skipped, as are the invalid lines. It
+// returns the number of infohashes read.
+func (s *InfoHashSet) Load(r io.Reader) (int, error) {
+	hashes := make([][20]byte, 0)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if h, err := parseInfoHash20(line); err == nil && len(line) == 40 {
+			hashes = append(hashes, h)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for i := range hashes {
+		s.add(&hashes[i])
+	}
+	return len(hashes), nil
+}
+
+// wanted returns whether the events of infoHash are published: it's not
+// ignored and the watchlist is empty or holds it.
+func (dht *DHT) wanted(infoHash string) bool {
+	if dht.Ignorelist.Has(infoHash) {
+		return false
+	}
+	return dht.Watchlist.Len() == 0 || dht.Watchlist.Has(infoHash)
+}
@@ -0,0 +1,101 @@
+package dhtlistener
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestInfoHashSet(t *testing.T) {
+	s := NewInfoHashSet()
+	ref := make(map[string]bool)
+	r := rand.New(rand.NewSource(1))
+
+	random := func() string {
+		b := make([]byte, 20)
+		// few distinct first bytes, so the probes collide.
+		b[0] = byte(r.Intn(4))
+		r.Read(b[1:])
+		return string(b)
+	}
+
+	hashes := make([]string, 0, 5000)
+	for i := 0; i < 5000; i++ {
+		h := random()
+		hashes = append(hashes, h)
+		s.Add(h)
+		ref[h] = true
+	}
+	s.Add(strings.Repeat("\x00", 20))
+	ref[strings.Repeat("\x00", 20)] = true
+
+	for i, h := range hashes {
+		if i%3 == 0 {
+			if !s.Remove(h) {
+				t.Fatal("expected to remove", i)
+			}
+			delete(ref, h)
+		}
+	}
+	if s.Remove(hashes[0]) {
+		t.Error("expected the infohash to be removed already")
+	}
+
+	if s.Len() != len(ref) {
+		t.Fatalf("expected %d infohashes, got %d", len(ref), s.Len())
+	}
+	for _, h := range hashes {
+		if s.Has(h) != ref[h] {
+			t.Fatalf("unexpected Has(%x) %v", h, !ref[h])
+		}
+	}
+	if !s.Has(strings.Repeat("\x00", 20)) || s.Has(random()) {
+		t.Error("unexpected Has")
+	}
+
+	var nilSet *InfoHashSet
+	if nilSet.Has(hashes[1]) || nilSet.Len() != 0 {
+		t.Error("expected a nil set to be empty")
+	}
+}
+
+func TestInfoHashSetLoad(t *testing.T) {
+	s := NewInfoHashSet()
+	n, err := s.Load(strings.NewReader(`# watched
+6d6e6f707172737475767778797a313233343536
+
+zz
+6162636465666768696A6B6C6D6E6F7071727374
+`))
+	if err != nil || n != 2 {
+		t.Fatal("expected 2 infohashes, got", n, err)
+	}
+	if !s.Has("mnopqrstuvwxyz123456") || !s.Has("abcdefghijklmnopqrst") {
+		t.Error("expected the loaded infohashes")
+	}
+	if err := s.Add("zz"); err != errInvalidInfoHash {
+		t.Error("expected an invalid infohash, got", err)
+	}
+}
+
+func TestWanted(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	defer dht.conn.Close()
+
+	if !dht.wanted("mnopqrstuvwxyz123456") {
+		t.Error("expected all infohashes without watchlist")
+	}
+
+	dht.Watchlist.Add("abcdefghijklmnopqrst")
+	if dht.wanted("mnopqrstuvwxyz123456") || !dht.wanted("abcdefghijklmnopqrst") {
+		t.Error("expected the watched infohashes only")
+	}
+
+	dht.Ignorelist.Add("abcdefghijklmnopqrst")
+	if dht.wanted("abcdefghijklmnopqrst") {
+		t.Error("expected the ignored infohash not to be wanted")
+	}
+}
@@ -0,0 +1,339 @@
+package dhtlistener
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// getType and putType are the queries of BEP 44, see
+// http://www.bittorrent.org/beps/bep_0044.html.
+const (
+	getType = "get"
+	putType = "put"
+)
+
+// The errors of BEP 44.
+const (
+	itemTooBigError  = 205
+	invalidSigError  = 206
+	saltTooBigError  = 207
+	casMismatchError = 301
+	seqTooLowError   = 302
+)
+
+const (
+	// maxItemSize is the max size of a bencoded item value.
+	maxItemSize = 1000
+	// maxSaltSize is the max size of the salt of a mutable item.
+	maxSaltSize = 64
+)
+
+// GetArgs is the arguments of a get query, Seq asks for the value of a
+// mutable item only if it's newer.
+type GetArgs struct {
+	ID     string `bencode:"id"`
+	Target string `bencode:"target"`
+	Seq    *int64 `bencode:"seq,omitempty"`
+}
+
+// PutArgs is the arguments of a put query, K, Sig, Seq, Salt and Cas are
+// those of the mutable items.
+type PutArgs struct {
+	ID    string     `bencode:"id"`
+	Token string     `bencode:"token"`
+	V     RawMessage `bencode:"v"`
+	K     string     `bencode:"k,omitempty"`
+	Sig   string     `bencode:"sig,omitempty"`
+	Seq   *int64     `bencode:"seq,omitempty"`
+	Salt  string     `bencode:"salt,omitempty"`
+	Cas   *int64     `bencode:"cas,omitempty"`
+}
+
+// GetResponse is the response to a get query, V is set if the item is
+// stored, with K, Sig and Seq if it's mutable.
+type GetResponse struct {
+	ID    string     `bencode:"id"`
+	Token string     `bencode:"token"`
+	Nodes string     `bencode:"nodes,omitempty"`
+	V     RawMessage `bencode:"v,omitempty"`
+	K     string     `bencode:"k,omitempty"`
+	Sig   string     `bencode:"sig,omitempty"`
+	Seq   *int64     `bencode:"seq,omitempty"`
+}
+
+// Item is a BEP 44 item: an immutable one, stored under the SHA1 of its
+// value, or a mutable one, signed by the ed25519 key K and stored under the
+// SHA1 of K and Salt.
+type Item struct {
+	V    RawMessage // bencoded value
+	K    string     // public key, mutable items only
+	Salt string
+	Seq  int64
+	Sig  string
+}
+
+// NewImmutableItem returns the immutable item of the value v.
+func NewImmutableItem(v interface{}) (*Item, error) {
+	data, err := Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	it := &Item{V: data}
+	if ke := it.check(); ke != nil {
+		return nil, ke
+	}
+	return it, nil
+}
+
+// NewMutableItem returns the mutable item of the value v signed by key,
+// seq is its version which must grow with every update.
+func NewMutableItem(key ed25519.PrivateKey, salt string, seq int64, v interface{}) (*Item, error) {
+	data, err := Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	it := &Item{
+		V:    data,
+		K:    string(key.Public().(ed25519.PublicKey)),
+		Salt: salt,
+		Seq:  seq,
+	}
+	it.Sig = string(ed25519.Sign(key, it.signed()))
+	if ke := it.check(); ke != nil {
+		return nil, ke
+	}
+	return it, nil
+}
+
+// MutableTarget returns the raw target of the mutable items of key and
+// salt.
+func MutableTarget(key ed25519.PublicKey, salt string) string {
+	sum := sha1.Sum(append(append([]byte{}, key...), salt...))
+	return string(sum[:])
+}
+
+// Mutable tells whether it is a mutable item.
+func (it *Item) Mutable() bool {
+	return it.K != ""
+}
+
+// Target returns the raw target of it.
+func (it *Item) Target() string {
+	if it.Mutable() {
+		return MutableTarget(ed25519.PublicKey(it.K), it.Salt)
+	}
+	sum := sha1.Sum(it.V)
+	return string(sum[:])
+}
+
+// Value decodes the value of it into v.
+func (it *Item) Value(v interface{}) error {
+	return Unmarshal(it.V, v)
+}
+
+// signed returns the buffer signed for a mutable item.
+func (it *Item) signed() []byte {
+	buf := make([]byte, 0, 32+len(it.Salt)+len(it.V))
+	if it.Salt != "" {
+		buf = append(buf, "4:salt"...)
+		buf = appendString(buf, it.Salt)
+	}
+	buf = append(buf, "3:seqi"...)
+	buf = strconv.AppendInt(buf, it.Seq, 10)
+	buf = append(buf, "e1:v"...)
+	return append(buf, it.V...)
+}
+
+// check returns the BEP 44 error of an invalid item, nil if it's valid.
+func (it *Item) check() *KRPCError {
+	if len(it.V) == 0 {
+		return &KRPCError{protocolError, "no value"}
+	}
+	if len(it.V) > maxItemSize {
+		return &KRPCError{itemTooBigError, "message (v field) too big"}
+	}
+	if !it.Mutable() {
+		return nil
+	}
+	if len(it.Salt) > maxSaltSize {
+		return &KRPCError{saltTooBigError, "salt (salt field) too big"}
+	}
+	if len(it.K) != ed25519.PublicKeySize || len(it.Sig) != ed25519.SignatureSize ||
+		!ed25519.Verify(ed25519.PublicKey(it.K), it.signed(), []byte(it.Sig)) {
+		return &KRPCError{invalidSigError, "invalid signature"}
+	}
+	return nil
+}
+
+// storedItem is an item of an itemStore.
+type storedItem struct {
+	*Item
+	target  string
+	expires time.Time
+}
+
+// itemStore keeps the items put by other nodes until they expire, the
+// least recently used one is dropped to make room.
+type itemStore struct {
+	sync.Mutex
+	items map[string]*list.Element // raw target : element of order
+	order *list.List               // of *storedItem, most recently used first
+}
+
+// newItemStore returns a new itemStore pointer.
+func newItemStore() *itemStore {
+	return &itemStore{items: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the item of target, nil if none.
+func (s *itemStore) get(target string) *Item {
+	s.Lock()
+	defer s.Unlock()
+
+	if el, ok := s.items[target]; ok {
+		s.order.MoveToFront(el)
+		return el.Value.(*storedItem).Item
+	}
+	return nil
+}
+
+// put stores the valid item it until expires, keeping at most max items.
+// An update of a mutable item must have a higher seq, or the same value, and
+// the seq expected by cas if it's set. It returns the BEP 44 error of a
+// rejected item.
+func (s *itemStore) put(it *Item, cas *int64, expires time.Time, max int) *KRPCError {
+	target := it.Target()
+
+	s.Lock()
+	defer s.Unlock()
+
+	el, ok := s.items[target]
+	if ok && it.Mutable() {
+		cur := el.Value.(*storedItem)
+		if cas != nil && *cas != cur.Seq {
+			return &KRPCError{casMismatchError, "CAS mismatch"}
+		}
+		if it.Seq < cur.Seq || it.Seq == cur.Seq && !bytes.Equal(it.V, cur.V) {
+			return &KRPCError{seqTooLowError, "sequence number less than current"}
+		}
+	}
+
+	si := &storedItem{it, target, expires}
+	if ok {
+		el.Value = si
+		s.order.MoveToFront(el)
+		return nil
+	}
+	if s.order.Len() >= max {
+		s.remove(s.order.Back())
+	}
+	s.items[target] = s.order.PushFront(si)
+	return nil
+}
+
+// remove removes the item of el.
+func (s *itemStore) remove(el *list.Element) {
+	s.order.Remove(el)
+	delete(s.items, el.Value.(*storedItem).target)
+}
+
+// expire removes the items expired at now and returns their number.
+func (s *itemStore) expire(now time.Time) int {
+	s.Lock()
+	defer s.Unlock()
+
+	n := 0
+	for el := s.order.Front(); el != nil; {
+		next := el.Next()
+		if !el.Value.(*storedItem).expires.After(now) {
+			s.remove(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// itemTTL returns how long the items put by other nodes are kept.
+func (dht *DHT) itemTTL() time.Duration {
+	if dht.ItemTTL > 0 {
+		return dht.ItemTTL
+	}
+	return time.Hour * 2
+}
+
+// maxItems returns the max number of items put by other nodes kept.
+func (dht *DHT) maxItems() int {
+	if dht.MaxItems > 0 {
+		return dht.MaxItems
+	}
+	return 1 << 14
+}
+
+// expireItems drops the expired items every minute.
+func (dht *DHT) expireItems() {
+	dht.every(time.Minute, func() {
+		if n := dht.items.expire(dht.now()); n != 0 {
+			dht.Logger.Debug("items expired", F("count", n))
+		}
+	})
+}
+
+// answerGet answers the get query a of addr.
+func answerGet(dht *DHT, addr *net.UDPAddr, msg *rawMessage, a *GetArgs) {
+	r := &GetResponse{
+		ID:    dht.idFor(a.Target),
+		Token: dht.tokens.getToken(addr),
+		Nodes: strings.Join(dht.closestNodeInfos(newHashId(a.Target), dht.K), ""),
+	}
+	if it := dht.items.get(a.Target); it != nil {
+		if it.Mutable() {
+			seq := it.Seq
+			r.Seq = &seq
+		}
+		// a requester knowing this seq already doesn't need the value.
+		if !it.Mutable() || a.Seq == nil || *a.Seq < it.Seq {
+			r.V, r.K, r.Sig = it.V, it.K, it.Sig
+		}
+	}
+	send(dht, addr, makeResponse(msg.T, r))
+}
+
+// answerPut stores the item of the put query a of addr and answers it.
+func answerPut(dht *DHT, addr *net.UDPAddr, msg *rawMessage, a *PutArgs) {
+	if !dht.replaying && !dht.tokens.check(addr, a.Token) {
+		dht.Logger.Debug("invalid token", F("addr", addr))
+		if !dht.tokens.stale(addr, a.Token) {
+			dht.offend(addr.IP, "invalid token")
+		}
+		dht.onError(ErrTokenInvalid, addr, msg.Q, nil)
+		return
+	}
+
+	it := &Item{V: a.V, K: a.K, Salt: a.Salt, Sig: a.Sig}
+	if it.Mutable() {
+		if a.Seq == nil {
+			reject(dht, addr, msg, "no seq")
+			return
+		}
+		it.Seq = *a.Seq
+	}
+
+	ke := it.check()
+	if ke == nil {
+		ke = dht.items.put(it, a.Cas, dht.now().Add(dht.itemTTL()), dht.maxItems())
+	}
+	if ke != nil {
+		dht.onError(ErrProtocol, addr, msg.Q, ke)
+		send(dht, addr, makeError(msg.T, ke.Code, ke.Message))
+		return
+	}
+	send(dht, addr, makeResponse(msg.T, &PingResponse{ID: dht.idFor(it.Target())}))
+}
@@ -0,0 +1,239 @@
+package dhtlistener
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestItemSigned(t *testing.T) {
+	// the first test vector of BEP 44.
+	it := &Item{V: RawMessage("12:Hello World!"), Salt: "foobar", Seq: 1}
+	if got, want := string(it.signed()), "4:salt6:foobar3:seqi1e1:v12:Hello World!"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestItemStore(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	s := newItemStore()
+	expires := time.Now().Add(time.Hour)
+
+	v1, _ := NewMutableItem(key, "salt", 1, "v1")
+	v2, _ := NewMutableItem(key, "salt", 2, "v2")
+	if ke := s.put(v2, nil, expires, 10); ke != nil {
+		t.Fatal(ke)
+	}
+	if ke := s.put(v1, nil, expires, 10); ke == nil || ke.Code != seqTooLowError {
+		t.Errorf("expected a 302 error, got %v", ke)
+	}
+
+	v3, _ := NewMutableItem(key, "salt", 3, "v3")
+	cas := int64(1)
+	if ke := s.put(v3, &cas, expires, 10); ke == nil || ke.Code != casMismatchError {
+		t.Errorf("expected a 301 error, got %v", ke)
+	}
+	cas = 2
+	if ke := s.put(v3, &cas, expires, 10); ke != nil || s.get(v1.Target()) != v3 {
+		t.Errorf("expected v3 stored, got %v", ke)
+	}
+
+	bad := *v3
+	bad.Seq = 4
+	if ke := bad.check(); ke == nil || ke.Code != invalidSigError {
+		t.Errorf("expected a 206 error, got %v", ke)
+	}
+
+	im, _ := NewImmutableItem("immutable")
+	if ke := s.put(im, nil, expires.Add(time.Hour), 1); ke != nil || s.get(v3.Target()) != nil {
+		t.Error("expected the least recently used item to make room")
+	}
+	if n := s.expire(expires.Add(2 * time.Hour)); n != 1 || s.get(im.Target()) != nil {
+		t.Errorf("expected 1 expired item, got %d", n)
+	}
+
+	var items []*Item
+	for _, v := range []string{"a", "b", "c"} {
+		it, _ := NewImmutableItem(v)
+		s.put(it, nil, expires, 3)
+		items = append(items, it)
+	}
+	s.get(items[0].Target())
+	d, _ := NewImmutableItem("d")
+	s.put(d, nil, expires, 3)
+	if s.get(items[1].Target()) != nil || s.get(items[0].Target()) == nil || s.get(d.Target()) == nil {
+		t.Error("expected the least recently used item dropped")
+	}
+}
+
+func TestLookupItemJoin(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	clock := newFakeClock()
+	dht.Clock = clock
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+
+	it, _ := NewImmutableItem("joined")
+	target := it.Target()
+	type result struct {
+		it  *Item
+		err error
+	}
+	results := make(chan result, 2)
+	lookup := func() {
+		it, _, err := dht.lookupItem(context.Background(), target, "")
+		results <- result{it, err}
+	}
+	go lookup()
+	if !waitUntil(func() bool {
+		dht.itemLookups.Lock()
+		defer dht.itemLookups.Unlock()
+		return dht.itemLookups.pending[target] != nil
+	}) {
+		t.Fatal("expected a running lookup")
+	}
+	go lookup()
+	time.Sleep(time.Millisecond * 50) // joining the running lookup
+
+	dht.itemLookups.record(target, &node{addr: &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}},
+		&GetResponse{V: it.V, Token: "token"})
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			if r.err != nil || r.it == nil || string(r.it.V) != string(it.V) {
+				t.Errorf("expected the item, got %v, %v", r.it, r.err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the lookups to end")
+		}
+	}
+}
+
+func TestAnswerGetPut(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.LocalAddr().(*net.UDPAddr)
+
+	// query sends a query of type q to dht and returns its reply.
+	query := func(q string, a interface{}) map[string]interface{} {
+		data, _ := Marshal(makeQuery("aa", q, a))
+		handle(dht, packet{data: data, raddr: addr})
+
+		buf := make([]byte, 1500)
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := l.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("%s: no reply: %v", q, err)
+		}
+		var reply map[string]interface{}
+		if err := Unmarshal(buf[:n], &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	_, key, _ := ed25519.GenerateKey(nil)
+	it, _ := NewMutableItem(key, "salt", 5, "hello")
+	put := func(it *Item, token string) map[string]interface{} {
+		seq := it.Seq
+		return query(putType, &PutArgs{
+			ID: GetRandString(20), Token: token, V: it.V,
+			K: it.K, Sig: it.Sig, Seq: &seq, Salt: it.Salt,
+		})
+	}
+
+	if reply := put(it, dht.tokens.getToken(addr)); reply["r"] == nil {
+		t.Fatalf("expected the item stored, got %v", reply)
+	}
+	old, _ := NewMutableItem(key, "salt", 4, "old")
+	reply := put(old, dht.tokens.getToken(addr))
+	if e, ok := reply["e"].([]interface{}); !ok || e[0] != seqTooLowError {
+		t.Errorf("expected a 302 error, got %v", reply)
+	}
+
+	reply = query(getType, &GetArgs{ID: GetRandString(20), Target: it.Target()})
+	r, _ := reply["r"].(map[string]interface{})
+	if r["v"] != "hello" || r["seq"] != 5 || r["k"] != it.K || r["token"] == nil {
+		t.Errorf("expected the item, got %v", reply)
+	}
+
+	seq := int64(5)
+	reply = query(getType, &GetArgs{ID: GetRandString(20), Target: it.Target(), Seq: &seq})
+	r, _ = reply["r"].(map[string]interface{})
+	if _, ok := r["v"]; ok || r["seq"] != 5 {
+		t.Errorf("expected the seq only, got %v", reply)
+	}
+}
+
+func TestPutGetItem(t *testing.T) {
+	mem := &memNet{}
+	addrA := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	addrB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+
+	a, err := New(WithTransport(mem.listen(addrA)), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(WithTransport(mem.listen(addrB)), WithBootstrapNodes(addrA.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dht := range []*DHT{a, b} {
+		dht.rt = newRouteTable(dht) // before Run, read below
+		go dht.Run()
+		defer func(dht *DHT) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			dht.Close(ctx)
+		}(dht)
+	}
+	if !waitUntil(func() bool { return hasNode(b, addrA.String()) }) {
+		t.Fatal("b should join a")
+	}
+
+	// the puts wait for the whole lookup.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	it, _ := NewImmutableItem("shared")
+	if n, err := b.PutItem(ctx, it); n != 1 || err != nil {
+		t.Fatalf("expected the item put on a, got %d, %v", n, err)
+	}
+	if a.items.get(it.Target()) == nil {
+		t.Fatal("expected a to store the item")
+	}
+
+	got, err := b.GetItem(ctx, it.Target(), "")
+	if err != nil || string(got.V) != string(it.V) {
+		t.Errorf("expected the item, got %v, %v", got, err)
+	}
+
+	_, key, _ := ed25519.GenerateKey(nil)
+	stale, _ := NewMutableItem(key, "", 1, "stale")
+	a.items.put(stale, nil, time.Now().Add(time.Hour), 10)
+	newer, _ := NewMutableItem(key, "", 2, "newer")
+	_, err = b.PutItemCAS(ctx, newer, 0)
+	var ke *KRPCError
+	if !errors.As(err, &ke) || ke.Code != casMismatchError {
+		t.Errorf("expected a 301 error, got %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+package dhtlistener
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// itemLookupTime is how long GetItem and PutItem look up the nodes closest
+// to the target.
+const itemLookupTime = time.Second * 5
+
+var errItemNotFound = errors.New("item not found")
+
+// itemLookup collects the tokens and the latest item received from the get
+// responses of a target.
+type itemLookup struct {
+	salt   string
+	tokens map[string]nodeToken // addr : token
+	item   *Item
+	found  chan struct{} // closed once an immutable item is found
+	done   chan struct{} // closed once the lookup is stopped
+	result []nodeToken   // tokens of the closest nodes, set once done
+}
+
+// itemLookups are the running item lookups.
+type itemLookups struct {
+	sync.Mutex
+	pending map[string]*itemLookup // raw target : lookup
+}
+
+// newItemLookups returns a new itemLookups pointer.
+func newItemLookups() *itemLookups {
+	return &itemLookups{pending: make(map[string]*itemLookup)}
+}
+
+// start starts the lookup of the items of target, salted with salt if
+// mutable. If target is already being looked up, it returns its running
+// lookup and false.
+func (il *itemLookups) start(target, salt string) (*itemLookup, bool) {
+	il.Lock()
+	defer il.Unlock()
+
+	if l, ok := il.pending[target]; ok {
+		return l, false
+	}
+	l := &itemLookup{
+		salt:   salt,
+		tokens: make(map[string]nodeToken),
+		found:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	il.pending[target] = l
+	return l, true
+}
+
+// record keeps the token of no and the item of its get response r for
+// target, if it's being looked up. The items which don't match target, or
+// whose signature is invalid, are dropped.
+func (il *itemLookups) record(target string, no *node, r *GetResponse) {
+	il.Lock()
+	defer il.Unlock()
+
+	l, ok := il.pending[target]
+	if !ok {
+		return
+	}
+	l.tokens[no.address().String()] = nodeToken{no, r.Token}
+
+	if len(r.V) == 0 {
+		return
+	}
+	it := &Item{V: r.V}
+	if r.K != "" {
+		it.K, it.Sig, it.Salt = r.K, r.Sig, l.salt
+		if r.Seq != nil {
+			it.Seq = *r.Seq
+		}
+	}
+	if it.Target() != target || it.check() != nil {
+		return
+	}
+
+	switch {
+	case !it.Mutable():
+		if l.item == nil {
+			l.item = it
+			close(l.found)
+		}
+	case l.item == nil || it.Seq > l.item.Seq:
+		l.item = it
+	}
+}
+
+// stop stops the lookup of target, keeping the tokens of the k nodes
+// closest to it as its result, and returns it.
+func (il *itemLookups) stop(target string, k int) *itemLookup {
+	il.Lock()
+	defer il.Unlock()
+
+	l := il.pending[target]
+	delete(il.pending, target)
+
+	tar := newHashId(target)
+	tokens := make([]nodeToken, 0, len(l.tokens))
+	for _, nt := range l.tokens {
+		tokens = append(tokens, nt)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].no.id.Xor(tar).RawString() < tokens[j].no.id.Xor(tar).RawString()
+	})
+	if len(tokens) > k {
+		tokens = tokens[:k]
+	}
+	l.result = tokens
+	close(l.done)
+	return l
+}
+
+// get sends get query to the chan.
+func (tm *transactionManager) get(no *node, target string) {
+	tm.sendQuery(no, getType, &GetArgs{
+		ID:     tm.dht.idFor(target),
+		Target: target,
+	})
+}
+
+// lookupItem looks up the nodes closest to target with get queries, for
+// itemLookupTime or until an immutable item is found or ctx is done. It
+// returns the latest item received and the tokens of the K closest nodes.
+// The concurrent lookups of target join the first one, which ends with the
+// ctx of its caller.
+func (dht *DHT) lookupItem(ctx context.Context, target, salt string) (*Item, []nodeToken, error) {
+	if dht.Router {
+		return nil, nil, errRouter
+	}
+	if !dht.initialized() {
+		return nil, nil, errNotRunning
+	}
+
+	l, first := dht.itemLookups.start(target, salt)
+	if !first {
+		select {
+		case <-l.done:
+			return l.item, l.result, nil
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-dht.done:
+			return nil, nil, errClosed
+		}
+	}
+
+	tar := newHashId(target)
+	for _, no := range dht.lookupNodes(tar, dht.K) {
+		dht.transacts.get(no, target)
+	}
+
+	timer := dht.Clock.NewTimer(itemLookupTime)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+	case <-l.found:
+	case <-ctx.Done():
+	case <-dht.done:
+	}
+
+	l = dht.itemLookups.stop(target, dht.K)
+	return l.item, l.result, ctx.Err()
+}
+
+// GetItem looks up the BEP 44 item of target, raw or hex encoded, and
+// returns it, the latest one if it's mutable. salt is the one of a mutable
+// item, the target being MutableTarget of its key and salt. It waits 5s at
+// most, or until an immutable item is found or ctx is done.
+func (dht *DHT) GetItem(ctx context.Context, target, salt string) (*Item, error) {
+	target, err := rawInfoHash(target)
+	if err != nil {
+		return nil, err
+	}
+
+	it, _, err := dht.lookupItem(ctx, target, salt)
+	if stored := dht.items.get(target); stored != nil && (it == nil || stored.Seq > it.Seq) {
+		it = stored
+	}
+	if it == nil {
+		if err == nil {
+			err = errItemNotFound
+		}
+		return nil, err
+	}
+	return it, nil
+}
+
+// PutItem stores it on the K nodes closest to its target which gave us a
+// token, and returns how many accepted it. The error is the one of the
+// nodes if none did, a *KRPCError of code 302 if one has a newer mutable
+// item for instance.
+func (dht *DHT) PutItem(ctx context.Context, it *Item) (int, error) {
+	return dht.putItem(ctx, it, nil)
+}
+
+// PutItemCAS is PutItem for a mutable item replacing the one of seq cas:
+// the nodes storing another one reject it with a *KRPCError of code 301.
+func (dht *DHT) PutItemCAS(ctx context.Context, it *Item, cas int64) (int, error) {
+	if !it.Mutable() {
+		return 0, errors.New("cas of an immutable item")
+	}
+	return dht.putItem(ctx, it, &cas)
+}
+
+func (dht *DHT) putItem(ctx context.Context, it *Item, cas *int64) (int, error) {
+	if ke := it.check(); ke != nil {
+		return 0, ke
+	}
+
+	_, tokens, err := dht.lookupItem(ctx, it.Target(), it.Salt)
+	if err != nil {
+		return 0, err
+	}
+	if len(tokens) == 0 {
+		return 0, errors.New("no node found")
+	}
+
+	results := make(chan error, len(tokens))
+	for _, nt := range tokens {
+		a := &PutArgs{
+			ID:    dht.idFor(it.Target()),
+			Token: nt.token,
+			V:     it.V,
+		}
+		if it.Mutable() {
+			seq := it.Seq
+			a.K, a.Sig, a.Seq, a.Salt, a.Cas = it.K, it.Sig, &seq, it.Salt, cas
+		}
+		go func(no *node) {
+			_, err := dht.sendWait(ctx, no, putType, a)
+			results <- err
+		}(nt.no)
+	}
+
+	n := 0
+	for range tokens {
+		if e := <-results; e == nil {
+			n++
+		} else if err == nil {
+			err = e
+		}
+	}
+	if n == 0 {
+		return 0, err
+	}
+	return n, nil
+}
+
+// republishInterval returns how often the items of Republish are put.
+func (dht *DHT) republishInterval() time.Duration {
+	if dht.RepublishInterval > 0 {
+		return dht.RepublishInterval
+	}
+	return time.Hour
+}
+
+// Republish puts it again every RepublishInterval, before the nodes
+// storing it drop it, until StopRepublish. It replaces the item of the same
+// target, the previous version of a mutable item. The first put is up to
+// the caller, see PutItem.
+func (dht *DHT) Republish(it *Item) error {
+	if ke := it.check(); ke != nil {
+		return ke
+	}
+
+	dht.republishMu.Lock()
+	defer dht.republishMu.Unlock()
+
+	if dht.republished == nil {
+		dht.republished = make(map[string]*Item)
+	}
+	dht.republished[it.Target()] = it
+	return nil
+}
+
+// StopRepublish stops republishing the item of target, raw or hex encoded.
+func (dht *DHT) StopRepublish(target string) {
+	target, err := rawInfoHash(target)
+	if err != nil {
+		return
+	}
+
+	dht.republishMu.Lock()
+	defer dht.republishMu.Unlock()
+
+	delete(dht.republished, target)
+}
+
+// republish puts the items of Republish.
+func (dht *DHT) republish() {
+	dht.republishMu.Lock()
+	items := make([]*Item, 0, len(dht.republished))
+	for _, it := range dht.republished {
+		items = append(items, it)
+	}
+	dht.republishMu.Unlock()
+
+	for _, it := range items {
+		ctx, cancel := context.WithTimeout(context.Background(), itemLookupTime*2)
+		if _, err := dht.PutItem(ctx, it); err != nil {
+			dht.Logger.Warn("republish failed", F("target", hex.EncodeToString([]byte(it.Target()))), F("err", err))
+		}
+		cancel()
+	}
+}
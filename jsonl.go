@@ -0,0 +1,151 @@
+package dhtlistener
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile appends lines to a file which is rotated once it exceeds
+// its max size: path is renamed path.1, path.1 path.2 and so on, up to the
+// max number of backups.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	w          *bufio.Writer
+	size       int64 // of file, with the buffered bytes
+}
+
+// openRotatingFile returns a new rotatingFile appending to path, rotated
+// when it exceeds maxSize bytes unless it's 0, keeping maxBackups rotated
+// files.
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file at path to append to it.
+func (s *rotatingFile) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file, s.size = f, fi.Size()
+	if s.w == nil {
+		s.w = bufio.NewWriter(f)
+	} else {
+		s.w.Reset(f)
+	}
+	return nil
+}
+
+// backup returns the name of the rotated file n.
+func (s *rotatingFile) backup(n int) string {
+	return fmt.Sprintf("%s.%d", s.path, n)
+}
+
+// rotate renames the files and opens a new one.
+func (s *rotatingFile) rotate() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	if s.maxBackups <= 0 {
+		os.Remove(s.path)
+	} else {
+		os.Remove(s.backup(s.maxBackups))
+		for n := s.maxBackups - 1; n > 0; n-- {
+			os.Rename(s.backup(n), s.backup(n+1))
+		}
+		if err := os.Rename(s.path, s.backup(1)); err != nil {
+			return err
+		}
+	}
+	return s.open()
+}
+
+// writeLine appends the JSON of v as a line.
+func (s *rotatingFile) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.w.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// Flush writes the buffered lines to the file.
+func (s *rotatingFile) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.w.Flush()
+}
+
+// Close flushes and closes the file.
+func (s *rotatingFile) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.w.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// JSONLSink is a Sink appending the get_peers, announce, peer and metadata
+// events as JSON StreamEvents, one per line, to a file. The file is rotated
+// once it exceeds its max size: path is renamed path.1, path.1 path.2 and so
+// on, up to the max number of backups.
+type JSONLSink struct {
+	*rotatingFile
+}
+
+// NewJSONLSink returns a new JSONLSink appending to path, rotated when it
+// exceeds maxSize bytes unless it's 0, keeping maxBackups rotated files.
+func NewJSONLSink(path string, maxSize int64, maxBackups int) (*JSONLSink, error) {
+	f, err := openRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLSink{f}, nil
+}
+
+// Write implements Sink, it ignores the other events.
+func (s *JSONLSink) Write(e Event) error {
+	if se := NewStreamEvent(e); se != nil {
+		return s.writeLine(se)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package dhtlistener
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJSONLSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	s, err := NewJSONLSink(path, 300, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 8; i++ {
+		if err := s.Write(PeerAnnounced{"mnopqrstuvwxyz123456", "1.2.3.4", 6881 + i, now, nil}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Write(NodeAdded{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ports := make(map[int]bool)
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 300 {
+			t.Errorf("%s exceeds the max size: %d", name, fi.Size())
+		}
+
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for sc := bufio.NewScanner(f); sc.Scan(); {
+			var e StreamEvent
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Type != "announce" || e.InfoHash != "6d6e6f707172737475767778797a313233343536" {
+				t.Fatalf("unexpected event %+v", e)
+			}
+			ports[e.Port] = true
+		}
+		f.Close()
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("expected 2 backups only")
+	}
+	if !ports[6888] || ports[6881] {
+		t.Errorf("expected the latest events to be kept, got %v", ports)
+	}
+}
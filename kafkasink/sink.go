@@ -0,0 +1,128 @@
+// Package kafkasink implements a dhtlistener.Sink publishing the events of
+// a DHT to a Kafka topic, for feeding them into a streaming pipeline.
+//
+// The messages hold the JSON dhtlistener.StreamEvent of the events and are
+// keyed by their hex infohash by default, so the events of an infohash land
+// in the same partition with a hash balancer.
+package kafkasink
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/2qif49lt/dhtlistener"
+	"github.com/segmentio/kafka-go"
+	"time"
+)
+
+// writer is the part of kafka.Writer used by a Sink.
+type writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Sink is a dhtlistener.Sink publishing the get_peers, announce, peer and
+// metadata events with a kafka.Writer. The messages are batched until
+// BatchSize or the periodic Flush of dhtlistener.AddSink.
+type Sink struct {
+	w            writer
+	key          func(e *dhtlistener.StreamEvent) []byte
+	batchSize    int
+	writeTimeout time.Duration
+	batch        []kafka.Message
+}
+
+// Options holds the settings of a Sink.
+type Options struct {
+	// Key returns the key of the message of an event, the hex infohash by
+	// default.
+	Key func(e *dhtlistener.StreamEvent) []byte
+	// BatchSize is the max number of messages per write, 256 by default.
+	BatchSize int
+	// WriteTimeout bounds a write of a batch, 10 seconds by default.
+	WriteTimeout time.Duration
+}
+
+// New returns a Sink writing with w, whose Topic should be set. opts may
+// be nil. w is closed by the Sink.
+//
+//	w := &kafka.Writer{
+//		Addr:     kafka.TCP("localhost:9092"),
+//		Topic:    "dht-events",
+//		Balancer: &kafka.Hash{},
+//	}
+//	dht.AddSink(kafkasink.New(w, nil), dhtlistener.EventPeerAnnounced, dhtlistener.EventMetadataReceived)
+func New(w *kafka.Writer, opts *Options) *Sink {
+	return newSink(w, opts)
+}
+
+// newSink returns a Sink writing with w.
+func newSink(w writer, opts *Options) *Sink {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Key == nil {
+		o.Key = func(e *dhtlistener.StreamEvent) []byte { return []byte(e.InfoHash) }
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 256
+	}
+	if o.WriteTimeout <= 0 {
+		o.WriteTimeout = time.Second * 10
+	}
+
+	return &Sink{
+		w:            w,
+		key:          o.Key,
+		batchSize:    o.BatchSize,
+		writeTimeout: o.WriteTimeout,
+		batch:        make([]kafka.Message, 0, o.BatchSize),
+	}
+}
+
+// Write implements dhtlistener.Sink, it ignores the other events.
+func (s *Sink) Write(e dhtlistener.Event) error {
+	se := dhtlistener.NewStreamEvent(e)
+	if se == nil {
+		return nil
+	}
+
+	value, err := json.Marshal(se)
+	if err != nil {
+		return err
+	}
+
+	s.batch = append(s.batch, kafka.Message{
+		Key:   s.key(se),
+		Value: value,
+		Time:  se.Time,
+	})
+	if len(s.batch) >= s.batchSize {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Flush writes the batched messages, they are dropped if it fails.
+func (s *Sink) Flush() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.writeTimeout)
+	defer cancel()
+
+	err := s.w.WriteMessages(ctx, s.batch...)
+	s.batch = s.batch[:0]
+	return err
+}
+
+// Close implements dhtlistener.Sink, it flushes the batched messages and
+// closes the writer.
+func (s *Sink) Close() error {
+	err := s.Flush()
+	if cerr := s.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
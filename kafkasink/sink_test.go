@@ -0,0 +1,95 @@
+package kafkasink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/2qif49lt/dhtlistener"
+	"github.com/segmentio/kafka-go"
+	"testing"
+	"time"
+)
+
+// fakeWriter records the batches written.
+type fakeWriter struct {
+	batches [][]kafka.Message
+	err     error
+	closed  bool
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return errors.New("no write timeout")
+	}
+	w.batches = append(w.batches, append([]kafka.Message(nil), msgs...))
+	return w.err
+}
+
+func (w *fakeWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestSink(t *testing.T) {
+	w := &fakeWriter{}
+	s := newSink(w, &Options{BatchSize: 2})
+
+	now := time.Unix(1700000000, 0).UTC()
+	announce := dhtlistener.PeerAnnounced{InfoHash: "mnopqrstuvwxyz123456", IP: "1.2.3.4", Port: 6881, Time: now}
+	for _, e := range []dhtlistener.Event{
+		announce,
+		dhtlistener.NodeAdded{ID: "node"}, // ignored
+		dhtlistener.GetPeersSeen{InfoHash: "abcdefghijklmnopqrst", IP: "5.6.7.8", Port: 1, Time: now},
+		announce,
+	} {
+		if err := s.Write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w.batches) != 1 || len(w.batches[0]) != 2 {
+		t.Fatalf("expected a batch of 2 messages, got %v", w.batches)
+	}
+
+	m := w.batches[0][0]
+	var se dhtlistener.StreamEvent
+	if err := json.Unmarshal(m.Value, &se); err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Key) != "6d6e6f707172737475767778797a313233343536" || !m.Time.Equal(now) ||
+		se.Type != "announce" || se.IP != "1.2.3.4" || se.Port != 6881 {
+		t.Fatalf("unexpected message %s %s", m.Key, m.Value)
+	}
+	if w.batches[0][1].Key[0] != '6' {
+		t.Errorf("unexpected key %s", w.batches[0][1].Key)
+	}
+
+	if err := s.Close(); err != nil || len(w.batches) != 2 || len(w.batches[1]) != 1 || !w.closed {
+		t.Fatalf("expected the last message flushed and the writer closed, %v", err)
+	}
+}
+
+func TestSinkFailure(t *testing.T) {
+	w := &fakeWriter{err: errors.New("broker down")}
+	s := newSink(w, &Options{
+		Key: func(e *dhtlistener.StreamEvent) []byte { return []byte(e.IP) },
+	})
+
+	e := dhtlistener.PeerAnnounced{InfoHash: "mnopqrstuvwxyz123456", IP: "1.2.3.4", Port: 6881}
+	s.Write(e)
+	if err := s.Flush(); err == nil {
+		t.Fatal("expected the write error")
+	}
+	if string(w.batches[0][0].Key) != "1.2.3.4" {
+		t.Errorf("unexpected key %s", w.batches[0][0].Key)
+	}
+
+	// the failed batch is dropped.
+	w.err = nil
+	s.Write(e)
+	if err := s.Flush(); err != nil || len(w.batches[1]) != 1 {
+		t.Fatalf("expected a single message, got %v %v", w.batches, err)
+	}
+	if err := s.Flush(); err != nil || len(w.batches) != 2 {
+		t.Error("expected nothing written without messages")
+	}
+}
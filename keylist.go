@@ -42,7 +42,7 @@ func (kl *keylist) Push(key, val interface{}) {
 
 	e, exist := kl.keyMap[key]
 	if exist {
-		kl.Remove(e)
+		kl.syncList.Remove(e)
 	}
 
 	e = kl.PushBack(val)
@@ -56,7 +56,7 @@ func (kl *keylist) Remove(key interface{}) interface{} {
 
 	e, exist := kl.keyMap[key]
 	if exist {
-		kl.Remove(e)
+		kl.syncList.Remove(e)
 		delete(kl.keyMap, key)
 		return e.Value
 	}
@@ -1,11 +1,16 @@
 package dhtlistener
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"errors"
-	"math"
+	"fmt"
+	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,481 +33,978 @@ type packet struct {
 	data     []byte
 	raddr    *net.UDPAddr
 	recvTime time.Time
+	buf      *[]byte // pooled buffer of data
 }
 
 // makeQuery returns a query-formed data.
-func makeQuery(t, q string, a map[string]interface{}) map[string]interface{} {
-	return map[string]interface{}{
-		"t": t,
-		"y": "q",
-		"q": q,
-		"a": a,
-	}
+func makeQuery(t, q string, a interface{}) *QueryMsg {
+	return &QueryMsg{T: t, Y: "q", Q: q, A: a}
 }
 
 // makeResponse returns a response-formed data.
-func makeResponse(t string, r map[string]interface{}) map[string]interface{} {
-	return map[string]interface{}{
-		"t": t,
-		"y": "r",
-		"r": r,
-	}
+func makeResponse(t string, r interface{}) *ResponseMsg {
+	return &ResponseMsg{T: t, Y: "r", R: r}
 }
 
 // makeError returns a err-formed data.
-func makeError(t string, errCode int, errMsg string) map[string]interface{} {
-	return map[string]interface{}{
-		"t": t,
-		"y": "e",
-		"e": []interface{}{errCode, errMsg},
-	}
+func makeError(t string, errCode int, errMsg string) *ErrorMsg {
+	return &ErrorMsg{T: t, Y: "e", E: []interface{}{errCode, errMsg}}
+}
+
+// sendBuffers holds the buffers messages are encoded into.
+var sendBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 1024)
+		return &buf
+	},
 }
 
-func send(dht *DHT, addr *net.UDPAddr, data map[string]interface{}) error {
-	msg, err := Encode(data)
+// send encodes msg, which is a *QueryMsg, *ResponseMsg or *ErrorMsg, and
+// sends it to addr.
+func send(dht *DHT, addr *net.UDPAddr, msg interface{}) error {
+	buf := sendBuffers.Get().(*[]byte)
+	defer sendBuffers.Put(buf)
+
+	var q string
+	switch m := msg.(type) {
+	case *QueryMsg:
+		q, m.V = m.Q, dht.Version
+	case *ResponseMsg:
+		m.V = dht.Version
+	case *ErrorMsg:
+		m.V = dht.Version
+	}
+
+	data, err := AppendEncode((*buf)[:0], msg)
+	*buf = data[:0]
 	if err != nil {
+		dht.Logger.Error("encode message failed", F("addr", addr), F("err", err))
+		dht.onError(ErrSend, addr, q, err)
 		return err
 	}
-	_, err = dht.conn.WriteToUDP([]byte(msg), addr)
-	return err
+
+	if data = dht.packetOut(addr, data); data == nil {
+		return nil
+	}
+
+	dht.captureMessage(false, addr, data)
+
+	if !dht.pace(len(data)) {
+		return errClosed
+	}
+	_, err = dht.writeTo(data, addr)
+	if err != nil {
+		dht.Logger.Warn("send failed", F("addr", addr), F("err", err))
+		if !dht.closed() {
+			dht.onError(ErrSend, addr, q, err)
+		}
+		return err
+	}
+
+	atomic.AddUint64(&dht.metrics.bytesOut, uint64(len(data)))
+	atomic.StoreInt64(&dht.metrics.lastOut, dht.now().UnixNano())
+	switch m := msg.(type) {
+	case *QueryMsg:
+		dht.metrics.packetsOut.Inc(messageType(m.Y, m.Q))
+	case *ResponseMsg:
+		dht.metrics.packetsOut.Inc(messageType(m.Y, ""))
+	case *ErrorMsg:
+		dht.metrics.packetsOut.Inc(messageType(m.Y, ""))
+	}
+	dht.metrics.clientsOut.Inc(dht.clients.get(addr))
+	return nil
 }
 
 // query represents the query data included queried node and query-formed data.
 type query struct {
-	tar  *node
-	data map[string]interface{}
+	tar     *node
+	msg     *QueryMsg
+	replies chan<- queryReply // of Query, nil otherwise
+	ctx     context.Context   // holding the span of the lookup, nil if none
 }
 
 // transaction implements transaction.
 type transaction struct {
 	*query
-	id       string
-	response chan struct{}
+	id      string
+	tries   int           // sends so far, guarded by the wheel
+	maxTry  int           // sends before the transaction fails
+	slot    int           // slot in the wheel, -1 if not scheduled
+	timeout time.Duration // of the last send, guarded by the wheel
+	start   time.Time     // of the first send
+	span    Span
+	addr    *net.UDPAddr // of tar when the transaction is created
+	key     string       // in the index of the transactions
+	joined  []*query     // sharing its outcome, added while it's indexed
 }
 
+// transactionManager sends the queries and matches their responses. Its
+// lock guards the transactions, their index and peak, which are always
+// changed together.
 type transactionManager struct {
-	*sync.RWMutex
-	transactions *syncMap // transid : transaction
-	index        *syncMap // query type + addr : transaction
-	curTransId   uint64   // MaxInt32
+	sync.RWMutex
+	transactions map[string]*transaction // transid : transaction
+	index        map[string]*transaction // query type + addr : transaction
 	queryChan    chan *query
+	sched        *scheduler    // queries read from the chan, not sent yet
+	wheel        *timerWheel   // timeouts of the transactions
+	freed        chan struct{} // signaled when a transaction finishes
+	peak         int           // max number of transactions, guarded by the lock
+	rejected     uint64        // queries dropped at MaxTransactions, accessed atomically
+	dropped      uint64        // queries dropped by the full queue, accessed atomically
 	dht          *DHT
 }
 
 func newTransactionManager(dht *DHT) *transactionManager {
 	return &transactionManager{
-		RWMutex:      &sync.RWMutex{},
-		transactions: newsyncMap(),
-		index:        newsyncMap(),
-		queryChan:    make(chan *query, 1024),
+		transactions: make(map[string]*transaction),
+		index:        make(map[string]*transaction),
+		queryChan:    make(chan *query, dht.QueryQueueSize),
+		sched:        newScheduler(dht),
+		wheel:        newTimerWheel(wheelInterval, wheelSize),
+		freed:        make(chan struct{}, 1),
 		dht:          dht,
 	}
 }
 
-// genTransID generates a transaction id and returns it.
-func (tm *transactionManager) genTransID() string {
-	tm.Lock()
-	defer tm.Unlock()
+// transIDSize is the length of our transaction ids, 2 bytes as mainline
+// clients do.
+const transIDSize = 2
+
+// transIDRetries is the number of random ids tried before a transaction
+// looks for a free one.
+const transIDRetries = 8
 
-	tm.curTransId = (tm.curTransId + 1) % math.MaxUint32
-	return string(I64toA(tm.curTransId))
+// transIDReader is the source of the transaction ids.
+var transIDReader io.Reader = rand.Reader
+
+// genTransID generates a random transaction id and returns it, so that the
+// responses can't be forged by guessing it. insert handles the collisions.
+// If the system source fails, the id is read from math/rand rather than
+// failing the query.
+func (tm *transactionManager) genTransID() string {
+	id := make([]byte, transIDSize)
+	if _, err := io.ReadFull(transIDReader, id); err != nil {
+		return GetRandString(transIDSize)
+	}
+	return string(id)
 }
 
+// newTransaction returns the transaction of q, sent to the current address
+// of its node.
 func (tm *transactionManager) newTransaction(id string, q *query) *transaction {
+	addr := q.tar.address()
 	return &transaction{
-		id:       id,
-		query:    q,
-		response: make(chan struct{}, tm.dht.Try+1),
+		id:    id,
+		query: q,
+		slot:  -1,
+		addr:  addr,
+		key:   tm.genIndexKey(q.msg.Q, addr.String(), queryTarget(q.msg.A)),
 	}
 }
 
-// genIndexKey generates an indexed key which consists of queryType and
-// address.
-func (tm *transactionManager) genIndexKey(queryType, address string) string {
-	return strings.Join([]string{queryType, address}, ":")
+// The QueryDedupePolicies, which query to a node is dropped while another
+// one is in flight.
+const (
+	// QueryDedupeTarget drops a query of the same type and target, or
+	// infohash, as one in flight.
+	QueryDedupeTarget = iota
+	// QueryDedupeType drops a query of the same type as one in flight,
+	// whatever its target.
+	QueryDedupeType
+	// QueryDedupeNone drops no query.
+	QueryDedupeNone
+)
+
+var queryDedupePolicies = map[string]int{
+	"target": QueryDedupeTarget,
+	"type":   QueryDedupeType,
+	"none":   QueryDedupeNone,
+}
+
+// parseQueryDedupePolicy returns the QueryDedupePolicy named s.
+func parseQueryDedupePolicy(s string) (int, error) {
+	p, ok := queryDedupePolicies[s]
+	if !ok {
+		return 0, errors.New("unknown query dedupe policy " + s)
+	}
+	return p, nil
 }
 
-// genIndexKeyByTrans generates an indexed key by a transaction.
-func (tm *transactionManager) genIndexKeyByTrans(trans *transaction) string {
-	return tm.genIndexKey(trans.data["q"].(string), trans.tar.addr.String())
+// queryTarget returns the raw target or infohash of the query arguments a,
+// empty if they have none.
+func queryTarget(a interface{}) string {
+	switch a := a.(type) {
+	case *FindNodeArgs:
+		return a.Target
+	case *GetPeersArgs:
+		return a.InfoHash
+	case *AnnouncePeerArgs:
+		return a.InfoHash
+	case *GetArgs:
+		return a.Target
+	case *PutArgs:
+		return (&Item{V: a.V, K: a.K, Salt: a.Salt}).Target()
+	case *SampleInfoHashesArgs:
+		return a.Target
+	}
+	return ""
+}
+
+// genIndexKey generates an indexed key which consists of queryType, address
+// and target according to QueryDedupePolicy, empty if the queries aren't
+// indexed.
+func (tm *transactionManager) genIndexKey(queryType, address, target string) string {
+	switch tm.dht.QueryDedupePolicy {
+	case QueryDedupeType:
+		return strings.Join([]string{queryType, address}, ":")
+	case QueryDedupeNone:
+		return ""
+	}
+	return strings.Join([]string{queryType, address, target}, ":")
 }
 
-// insert adds a transaction to transactionManager.
-func (tm *transactionManager) insert(trans *transaction) {
+// insert adds a transaction to transactionManager. The id of trans is
+// replaced while it's in use, insert returns false if all of them are.
+func (tm *transactionManager) insert(trans *transaction) bool {
 	tm.Lock()
 	defer tm.Unlock()
 
-	tm.transactions.Set(trans.id, trans)
-	tm.index.Set(tm.genIndexKeyByTrans(trans), trans)
+	for i := 0; tm.used(trans.id); i++ {
+		if i == transIDRetries {
+			id, ok := tm.freeTransID(trans.id)
+			if !ok {
+				return false
+			}
+			trans.id = id
+			break
+		}
+		trans.id = tm.genTransID()
+	}
+	trans.msg.T = trans.id
+	tm.transactions[trans.id] = trans
+	if trans.key != "" {
+		tm.index[trans.key] = trans
+	}
+	if n := len(tm.transactions); n > tm.peak {
+		tm.peak = n
+	}
+	return true
 }
 
-// delete removes a transaction from transactionManager.
-func (tm *transactionManager) delete(transID string) {
-	v, ok := tm.transactions.Get(transID)
-	if !ok {
-		return
+// used returns whether the transaction id is in use, the caller holds the
+// lock.
+func (tm *transactionManager) used(id string) bool {
+	_, ok := tm.transactions[id]
+	return ok
+}
+
+// freeTransID returns the first transaction id not in use after from, it
+// rolls over at 0xffff. The caller holds the lock.
+func (tm *transactionManager) freeTransID(from string) (string, bool) {
+	start := uint16(from[0])<<8 | uint16(from[1])
+	for i := 1; i <= 1<<16; i++ {
+		v := start + uint16(i)
+		if id := string([]byte{byte(v >> 8), byte(v)}); !tm.used(id) {
+			return id, true
+		}
 	}
+	return "", false
+}
 
+// delete removes trans from transactionManager, if it's still there.
+func (tm *transactionManager) delete(trans *transaction) {
 	tm.Lock()
 	defer tm.Unlock()
 
-	trans := v.(*transaction)
-	tm.transactions.Delete(trans.id)
-	tm.index.Delete(tm.genIndexKeyByTrans(trans))
+	if tm.transactions[trans.id] == trans {
+		delete(tm.transactions, trans.id)
+	}
+	if tm.index[trans.key] == trans {
+		delete(tm.index, trans.key)
+	}
 }
 
 // len returns how many transactions are requesting now.
 func (tm *transactionManager) len() int {
-	return tm.transactions.Len()
-}
+	tm.RLock()
+	defer tm.RUnlock()
 
-// transaction returns a transaction. keyType should be one of 0, 1 which
-// represents transId and index each.
-func (tm *transactionManager) transaction(key string, keyType int) *transaction {
+	return len(tm.transactions)
+}
 
-	sm := tm.transactions
-	if keyType == 1 {
-		sm = tm.index
-	}
+// peakLen returns the max number of transactions requesting at once.
+func (tm *transactionManager) peakLen() int {
+	tm.RLock()
+	defer tm.RUnlock()
 
-	v, ok := sm.Get(key)
-	if !ok {
-		return nil
-	}
+	return tm.peak
+}
 
-	return v.(*transaction)
+// full returns whether MaxTransactions are requesting.
+func (tm *transactionManager) full() bool {
+	return tm.dht.MaxTransactions > 0 && tm.len() >= tm.dht.MaxTransactions
 }
 
 // getByTransID returns a transaction by transID.
 func (tm *transactionManager) getByTransID(transID string) *transaction {
-	return tm.transaction(transID, 0)
+	tm.RLock()
+	defer tm.RUnlock()
+
+	return tm.transactions[transID]
 }
 
 // getByIndex returns a transaction by indexed key.
 func (tm *transactionManager) getByIndex(index string) *transaction {
-	return tm.transaction(index, 1)
+	tm.RLock()
+	defer tm.RUnlock()
+
+	return tm.index[index]
 }
 
-// transaction gets the proper transaction with whose id is transId and address is addr.
+// filterOne returns the transaction whose id is transID, sent to addr, nil
+// unless it's also the one of its index key.
 func (tm *transactionManager) filterOne(transID string, addr *net.UDPAddr) *transaction {
+	tm.RLock()
+	defer tm.RUnlock()
 
-	trans := tm.getByTransID(transID)
-	if trans == nil || trans.tar.addr.String() != addr.String() {
+	trans := tm.transactions[transID]
+	if trans == nil || trans.addr.String() != addr.String() ||
+		trans.key != "" && tm.index[trans.key] != trans {
 		return nil
 	}
-
 	return trans
 }
 
-// query sends the query-formed data to udp and wait for the response.
-// When timeout, it will retry `try - 1` times, which means it will query
-// `try` times totally.
-func (tm *transactionManager) query(q *query, try int) {
-	transID := q.data["t"].(string)
-	trans := tm.newTransaction(transID, q)
+// join makes q share the outcome of the transaction indexed by key, it
+// returns false if there's none. A Query caller gets errQueryBusy instead
+// unless both are the same built-in ping or find_node query.
+func (tm *transactionManager) join(key string, q *query) bool {
+	if key == "" {
+		return false
+	}
 
-	tm.insert(trans)
-	defer tm.delete(trans.id)
+	tm.Lock()
+	defer tm.Unlock()
 
-	success := false
-	for i := 0; i < try; i++ {
-		if err := send(tm.dht, q.tar.addr, q.data); err != nil {
-			break
+	busy := tm.index[key]
+	if busy == nil {
+		return false
+	}
+	if q.replies == nil {
+		return true
+	}
+	switch a := q.msg.A.(type) {
+	case *PingArgs:
+		if _, ok := busy.msg.A.(*PingArgs); ok {
+			busy.joined = append(busy.joined, q)
+			return true
 		}
-
-		select {
-		case <-trans.response:
-			success = true
-			break
-		case <-time.After(time.Second * 15):
+	case *FindNodeArgs:
+		if b, ok := busy.msg.A.(*FindNodeArgs); ok && b.Target == a.Target {
+			busy.joined = append(busy.joined, q)
+			return true
 		}
 	}
+	q.reply(nil, errQueryBusy)
+	return true
+}
 
-	if !success && q.tar.id != nil {
-		tm.dht.rt.Remove(q.tar.id)
+// reply passes the outcome of trans to the Query callers waiting for it,
+// once it's removed.
+func (trans *transaction) reply(r map[string]interface{}, err error) {
+	trans.query.reply(r, err)
+	for _, q := range trans.joined {
+		q.reply(r, err)
 	}
 }
 
-// run starts to listen and consume the query chan.
-func (tm *transactionManager) run() {
-	var q *query
+// waited returns whether Query callers wait for the outcome of trans, once
+// it's removed.
+func (trans *transaction) waited() bool {
+	return trans.replies != nil || len(trans.joined) > 0
+}
 
-	for {
-		select {
-		case q = <-tm.queryChan:
-			go tm.query(q, tm.dht.Try)
-		}
+// query sends the query-formed data to udp, its response is waited for by
+// the wheel. When timeout, it will retry `try - 1` times, which means it
+// will query `try` times totally, try being the tries of its query type.
+func (tm *transactionManager) query(q *query) {
+	trans := tm.newTransaction(q.msg.T, q)
+
+	// another one was queued meanwhile.
+	if tm.join(trans.key, q) {
+		return
 	}
+
+	if !tm.insert(trans) {
+		tm.dht.Logger.Debug("query dropped, no free transaction id",
+			F("q", q.msg.Q), F("addr", trans.addr))
+		q.reply(nil, errQueryDropped)
+		return
+	}
+
+	tm.sched.start(trans.addr)
+	atomic.AddUint64(&tm.dht.metrics.transStarted, 1)
+	tm.dht.Logger.Debug("transaction started", F("t", trans.id),
+		F("q", q.msg.Q), F("addr", trans.addr))
+
+	q.tar.queried()
+	ctx := q.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, trans.span = tm.dht.startSpan(ctx, "krpc."+q.msg.Q,
+		F("q", q.msg.Q), F("addr", trans.addr.String()))
+	trans.start = tm.dht.now()
+	trans.tries = 1
+	trans.maxTry = tm.dht.tries(q.msg.Q)
+	trans.timeout = q.tar.timeout(tm.dht.MinQueryTimeout, tm.dht.QueryTimeout)
+	tm.wheel.add(trans, trans.timeout)
+	tm.send(trans)
 }
 
-// sendQuery send query-formed data to the chan.
-func (tm *transactionManager) sendQuery(no *node, queryType string, a map[string]interface{}) {
+// send sends the query of trans, which is scheduled in the wheel. The
+// transaction fails if the send does.
+func (tm *transactionManager) send(trans *transaction) {
+	if err := send(tm.dht, trans.addr, trans.msg); err != nil && tm.wheel.remove(trans) {
+		tm.finish(trans, false)
+		trans.end(err)
+		trans.reply(nil, &Error{ErrSend, trans.msg.Q, err})
+	}
+}
 
-	// If the target is self, then stop.
-	if (no.id != nil && no.id.RawString() == tm.dht.me.id.RawString()) ||
-		tm.getByIndex(tm.genIndexKey(queryType, no.addr.String())) != nil {
+// respond ends trans, unless it already timed out, with its response
+// received at recvTime, an error message if err isn't nil. It returns the
+// round-trip time, which is recorded by the target node, or 0 if the query
+// was sent several times.
+func (tm *transactionManager) respond(trans *transaction, recvTime time.Time, err error) (rtt time.Duration) {
+	if !tm.wheel.remove(trans) {
 		return
 	}
 
-	data := makeQuery(tm.genTransID(), queryType, a)
-	tm.queryChan <- &query{
-		tar:  no,
-		data: data,
+	tm.finish(trans, true)
+	tm.dht.queryStats.finish(trans.msg.Q, trans.tries, true)
+	trans.tar.answered()
+	elapsed := tm.dht.now().Sub(trans.start)
+	trans.end(err, F("elapsed", elapsed))
+	tm.dht.metrics.transactionTimes.Observe(elapsed.Seconds())
+	tm.dht.Logger.Debug("transaction finished", F("t", trans.id),
+		F("q", trans.msg.Q), F("addr", trans.addr), F("elapsed", elapsed))
+
+	if trans.tries != 1 || recvTime.Before(trans.start) {
+		return 0
 	}
+	rtt = recvTime.Sub(trans.start)
+	trans.tar.observeRTT(rtt)
+	return rtt
 }
 
-// ping sends ping query to the chan.
-func (tm *transactionManager) ping(no *node) {
-	tm.sendQuery(no, pingType, map[string]interface{}{
-		"id": tm.dht.me.id.RawString(),
-	})
+// end ends the span of trans, which failed if err isn't nil.
+func (trans *transaction) end(err error, fields ...Field) {
+	if trans.span == nil {
+		return
+	}
+	trans.span.SetFields(append(fields, F("tries", trans.tries))...)
+	trans.span.End(err)
 }
 
-// findNode sends find_node query to the chan.
-func (tm *transactionManager) findNode(no *node, target string) {
-	tm.sendQuery(no, findNodeType, map[string]interface{}{
-		"id":     tm.dht.me.id.RawString(),
-		"target": target,
-	})
+// finish removes trans, which is not in the wheel anymore, and fails its
+// node unless it's successful.
+func (tm *transactionManager) finish(trans *transaction, success bool) {
+	tm.delete(trans)
+	tm.sched.done(trans.addr, success)
+	select {
+	case tm.freed <- struct{}{}:
+	default:
+	}
+
+	if !success && trans.tar.id != nil {
+		tm.dht.rt.Fail(trans.tar.id)
+	}
 }
 
-// getPeers sends get_peers query to the chan.
-func (tm *transactionManager) getPeers(no *node, infoHash string) {
-	tm.sendQuery(no, getPeersType, map[string]interface{}{
-		"id":        tm.dht.me.id.RawString(),
-		"info_hash": infoHash,
+// expire advances the wheel, it sends the timed out queries again or fails
+// them once they are sent as many times as their query type allows.
+func (tm *transactionManager) expire() {
+	again, expired := tm.wheel.tick(func(trans *transaction) time.Duration {
+		if trans.tries >= trans.maxTry {
+			return 0
+		}
+		trans.tries++
+		trans.timeout = clampDuration(2*trans.timeout, tm.dht.MinQueryTimeout, tm.dht.QueryTimeout)
+		return trans.timeout
 	})
+
+	for _, trans := range expired {
+		atomic.AddUint64(&tm.dht.metrics.transTimeout, 1)
+		tm.dht.metrics.timeouts.Inc(messageType("q", trans.msg.Q))
+		tm.dht.Logger.Debug("transaction timeout", F("t", trans.id),
+			F("q", trans.msg.Q), F("addr", trans.addr))
+		tm.finish(trans, false)
+		tm.dht.queryStats.finish(trans.msg.Q, trans.tries, false)
+		tm.dht.onError(ErrTimeout, trans.addr, trans.msg.Q, nil)
+		trans.end(ErrTimeout)
+		trans.reply(nil, &Error{ErrTimeout, trans.msg.Q, nil})
+	}
+	for _, trans := range again {
+		tm.send(trans)
+	}
 }
 
-// announcePeer sends announce_peer query to the chan.
-func (tm *transactionManager) announcePeer(
-	no *node, infoHash string, impliedPort, port int, token string) {
-
-	tm.sendQuery(no, announcePeerType, map[string]interface{}{
-		"id":           tm.dht.me.id.RawString(),
-		"info_hash":    infoHash,
-		"implied_port": impliedPort,
-		"port":         port,
-		"token":        token,
-	})
+// run starts to listen and consume the query chan and to expire the
+// transactions, until the dht is closed. The queries read from the chan
+// wait in the scheduler until it sends them, QueryQueueTimeout at most, and
+// in the chan while the scheduler holds as many as the chan, but with
+// DropOldest which drops the oldest one. The wheel catches up with the
+// ticks the ticker drops.
+func (tm *transactionManager) run() {
+	ticker := tm.dht.Clock.NewTicker(tm.wheel.interval)
+	defer ticker.Stop()
+	last := tm.dht.now()
+
+	backlog := cap(tm.queryChan)
+	if backlog == 0 {
+		backlog = 1
+	}
+	for {
+		tm.expireQueued()
+		tm.dispatch()
+		queries := tm.queryChan
+		if tm.sched.len() >= backlog && tm.dht.QueryQueueDropPolicy != DropOldest {
+			queries = nil
+		}
+
+		select {
+		case q := <-queries:
+			tm.sched.push(q)
+			if tm.sched.len() > backlog {
+				tm.drop(tm.sched.oldest(time.Time{}), "query dropped, queue full")
+			}
+		case <-tm.freed:
+		case now := <-ticker.C():
+			for ; !now.Before(last.Add(tm.wheel.interval)); last = last.Add(tm.wheel.interval) {
+				tm.expire()
+			}
+		case <-tm.dht.done:
+			return
+		}
+	}
 }
 
-// parseKey parses the key in dict data. `t` is type of the keyed value.
-// It's one of "int", "string", "map", "list".
-func parseKey(data map[string]interface{}, key string, t string) error {
-	val, ok := data[key]
-	if !ok {
-		return errors.New("lack of key")
-	}
-
-	switch t {
-	case "string":
-		_, ok = val.(string)
-	case "int":
-		_, ok = val.(int)
-	case "map":
-		_, ok = val.(map[string]interface{})
-	case "list":
-		_, ok = val.([]interface{})
-	default:
-		panic("invalid type")
+// expireQueued drops the queries which waited for the scheduler longer
+// than the QueryQueueTimeout.
+func (tm *transactionManager) expireQueued() {
+	deadline := tm.dht.now().Add(-tm.queueTimeout())
+	for q := tm.sched.oldest(deadline); q != nil; q = tm.sched.oldest(deadline) {
+		tm.drop(q, "query dropped, queued too long")
 	}
+}
 
-	if !ok {
-		return errors.New("invalid key type")
+// drop drops q, which waited in the scheduler, for reason.
+func (tm *transactionManager) drop(q *query, reason string) {
+	atomic.AddUint64(&tm.dropped, 1)
+	tm.dht.Logger.Debug(reason, F("q", q.msg.Q), F("addr", q.tar.address()))
+	q.reply(nil, errQueryDropped)
+}
+
+// dispatch sends the queries the scheduler allows while MaxTransactions
+// aren't requesting.
+func (tm *transactionManager) dispatch() {
+	for !tm.full() {
+		q := tm.sched.next()
+		if q == nil {
+			return
+		}
+		tm.query(q)
 	}
+}
 
-	return nil
+// sendQuery send query-formed data to the chan. a is the typed arguments of
+// queryType, or a map for custom queries.
+func (tm *transactionManager) sendQuery(no *node, queryType string, a interface{}) {
+	tm.sendQueryContext(context.Background(), no, queryType, a)
 }
 
-// parseKeys parses keys. It just wraps parseKey.
-func parseKeys(data map[string]interface{}, pairs [][]string) error {
-	for _, args := range pairs {
-		key, t := args[0], args[1]
-		if err := parseKey(data, key, t); err != nil {
-			return err
+// sendQueryContext is sendQuery, the span of the transaction is a child of
+// that of ctx.
+func (tm *transactionManager) sendQueryContext(ctx context.Context, no *node,
+	queryType string, a interface{}) {
+
+	// If the target is self, blocked or banned, then stop.
+	addr := no.address()
+	if (no.id != nil && tm.dht.isSelf(no.id.RawString())) ||
+		tm.dht.Blocklist.Blocked(addr.IP) || tm.dht.bans.banned(addr.IP, tm.dht.now()) ||
+		tm.getByIndex(tm.genIndexKey(queryType, addr.String(), queryTarget(a))) != nil {
+		return
+	}
+
+	if tm.full() {
+		atomic.AddUint64(&tm.rejected, 1)
+		tm.dht.Logger.Debug("query dropped, too many transactions",
+			F("q", queryType), F("addr", addr))
+		return
+	}
+
+	q := &query{
+		tar: no,
+		msg: makeQuery(tm.genTransID(), queryType, a),
+		ctx: ctx,
+	}
+	if tm.enqueue(q) {
+		atomic.AddUint64(&tm.dropped, 1)
+		tm.dht.Logger.Debug("query dropped, queue full",
+			F("q", queryType), F("addr", addr))
+	}
+}
+
+// defaultQueryQueueTimeout is how long a query waits for room in the query
+// chan with the Block policy, or for the scheduler, when QueryQueueTimeout
+// is 0.
+const defaultQueryQueueTimeout = time.Second
+
+// queueTimeout returns the QueryQueueTimeout, or its default.
+func (tm *transactionManager) queueTimeout() time.Duration {
+	if tm.dht.QueryQueueTimeout <= 0 {
+		return defaultQueryQueueTimeout
+	}
+	return tm.dht.QueryQueueTimeout
+}
+
+// enqueue pushes q into the query chan according to QueryQueueDropPolicy
+// and returns whether a query, q or a queued one, is dropped.
+func (tm *transactionManager) enqueue(q *query) bool {
+	select {
+	case tm.queryChan <- q:
+		return false
+	default:
+	}
+
+	switch tm.dht.QueryQueueDropPolicy {
+	case Block:
+		timer := tm.dht.Clock.NewTimer(tm.queueTimeout())
+		defer timer.Stop()
+
+		select {
+		case tm.queryChan <- q:
+			return false
+		case <-timer.C():
+		case <-tm.dht.done:
+			return false
+		}
+	case DropOldest:
+		select {
+		case old := <-tm.queryChan:
+			old.reply(nil, errQueryDropped)
+		default:
+		}
+
+		select {
+		case tm.queryChan <- q:
+			return true
+		default:
 		}
 	}
-	return nil
+	q.reply(nil, errQueryDropped)
+	return true
 }
 
-// parseMessage parses the basic data received from udp.
-// It returns a map value.
-func parseMessage(data interface{}) (map[string]interface{}, error) {
-	response, ok := data.(map[string]interface{})
-	if !ok {
-		return nil, errors.New("response is not dict")
+// DroppedQueries returns how many queries have been dropped because the
+// query queue was full.
+func (dht *DHT) DroppedQueries() uint64 {
+	if !dht.initialized() {
+		return 0
 	}
+	return atomic.LoadUint64(&dht.transacts.dropped)
+}
 
-	if err := parseKeys(
-		response, [][]string{{"t", "string"}, {"y", "string"}}); err != nil {
-		return nil, err
+// ping sends ping query to the chan.
+func (tm *transactionManager) ping(no *node) {
+	var id string
+	if no.id != nil {
+		id = no.id.RawString()
 	}
 
-	return response, nil
+	tm.sendQuery(no, pingType, &PingArgs{
+		ID: tm.dht.idFor(id),
+	})
 }
 
-// handleRequest handles the requests received from udp.
-func handleRequest(dht *DHT, addr *net.UDPAddr, response map[string]interface{}) (success bool) {
+// findNode sends find_node query to the chan.
+func (tm *transactionManager) findNode(no *node, target string) {
+	tm.sendQuery(no, findNodeType, &FindNodeArgs{
+		ID:     tm.dht.idFor(target),
+		Target: target,
+	})
+}
+
+// getPeers sends get_peers query to the chan.
+func (tm *transactionManager) getPeers(ctx context.Context, no *node, infoHash string) {
+	tm.sendQueryContext(ctx, no, getPeersType, &GetPeersArgs{
+		ID:       tm.dht.idFor(infoHash),
+		InfoHash: infoHash,
+	})
+}
 
-	t := response["t"].(string)
+// announcePeer sends announce_peer query to the chan, a port of 0 announces
+// our dht port.
+func (tm *transactionManager) announcePeer(
+	no *node, infoHash string, port int, token string) {
+
+	impliedPort, port := tm.dht.announcePort(port)
+	tm.sendQuery(no, announcePeerType, &AnnouncePeerArgs{
+		ID:          tm.dht.idFor(infoHash),
+		InfoHash:    infoHash,
+		ImpliedPort: impliedPort,
+		Port:        port,
+		Token:       token,
+	})
+}
 
-	if err := parseKeys(response, [][]string{{"q", "string"}, {"a", "map"}}); err != nil {
+// reject answers the query msg of addr with a protocol error and reports
+// it to OnError.
+func reject(dht *DHT, addr *net.UDPAddr, msg *rawMessage, text string) {
+	dht.onError(ErrProtocol, addr, msg.Q, errors.New(text))
+	send(dht, addr, makeError(msg.T, protocolError, text))
+}
 
-		send(dht, addr, makeError(t, protocolError, err.Error()))
+// handleRequest handles the requests received from udp.
+func handleRequest(dht *DHT, addr *net.UDPAddr, msg *rawMessage) (success bool) {
+
+	if !dht.queryIn(addr, msg) {
 		return
 	}
+	atomic.StoreInt64(&dht.metrics.lastQuery, dht.now().UnixNano())
 
-	q := response["q"].(string)
-	a := response["a"].(map[string]interface{})
+	t := msg.T
 
-	if err := parseKey(a, "id", "string"); err != nil {
-		send(dht, addr, makeError(t, protocolError, err.Error()))
+	var (
+		args    interface{}
+		id      string
+		handler QueryHandler
+	)
+	switch msg.Q {
+	case pingType:
+		args = &PingArgs{}
+	case findNodeType:
+		args = &FindNodeArgs{}
+	case getPeersType:
+		args = &GetPeersArgs{}
+	case announcePeerType:
+		args = &AnnouncePeerArgs{}
+	case getType:
+		args = &GetArgs{}
+	case putType:
+		args = &PutArgs{}
+	default:
+		if handler = dht.queryHandler(msg.Q); handler == nil {
+			dht.onError(ErrProtocol, addr, msg.Q, errors.New("unknown query"))
+			send(dht, addr, makeError(t, unknownError, "Method Unknown"))
+			return
+		}
+		args = &map[string]interface{}{}
+	}
+
+	if err := dht.decodeBody(msg.A, args); err != nil {
+		dht.Logger.Debug("invalid query", F("addr", addr), F("err", err))
+		dht.offend(addr.IP, "malformed query")
+		reject(dht, addr, msg, err.Error())
 		return
 	}
 
-	id := a["id"].(string)
+	switch a := args.(type) {
+	case *PingArgs:
+		id = a.ID
+	case *FindNodeArgs:
+		id = a.ID
+	case *GetPeersArgs:
+		id = a.ID
+	case *AnnouncePeerArgs:
+		id = a.ID
+	case *GetArgs:
+		id = a.ID
+	case *PutArgs:
+		id = a.ID
+	case *map[string]interface{}:
+		id, _ = (*a)["id"].(string)
+	}
 
-	if id == dht.me.id.RawString() {
+	if dht.isSelf(id) {
 		return
 	}
 
 	if len(id) != 20 {
-		send(dht, addr, makeError(t, protocolError, "invalid id"))
+		dht.offend(addr.IP, "invalid id")
+		reject(dht, addr, msg, "invalid id")
 		return
 	}
+
+	if dht.BanThreshold > 0 {
+		if no := dht.rt.GetNode(id); no != nil && !no.address().IP.Equal(addr.IP) {
+			dht.offend(addr.IP, "id spoofing")
+		}
+	}
 	/*
 		if no := dht.rt.getNode(id); no != nil {
 			send(dht, addr, makeError(t, protocolError, "invalid id"))
 			return
 		}
 	*/
-	switch q {
-	case pingType:
-		send(dht, addr, makeResponse(t, map[string]interface{}{
-			"id": dht.me.id.RawString(),
-		}))
-	case findNodeType:
-		if false {
-			if err := parseKey(a, "target", "string"); err != nil {
-				send(dht, addr, makeError(t, protocolError, err.Error()))
-				return
-			}
 
-			target := a["target"].(string)
-			if len(target) != 20 {
-				send(dht, addr, makeError(t, protocolError, "invalid target"))
-				return
-			}
+	switch a := args.(type) {
+	case *PingArgs:
+		send(dht, addr, makeResponse(t, &PingResponse{
+			ID: dht.idFor(id),
+		}))
+	case *FindNodeArgs:
+		if len(a.Target) != 20 {
+			reject(dht, addr, msg, "invalid target")
+			return
+		}
 
-			var nodes string
-			targetID := newHashId(target)
-
-			no := dht.rt.getNode(target)
-			if no != nil {
-				nodes = no.CompactNodeInfo()
-			} else {
-				nodes = strings.Join(
-					dht.rt.GetClosestNodeCompactInfo(targetID, dht.K),
-					"",
-				)
-			}
+		var nodes string
+		targetID := newHashId(a.Target)
 
-			send(dht, addr, makeResponse(t, map[string]interface{}{
-				"id":    dht.me.id.RawString(),
-				"nodes": nodes,
-			}))
-		}
-	case getPeersType:
-		if err := parseKey(a, "info_hash", "string"); err != nil {
-			send(dht, addr, makeError(t, protocolError, err.Error()))
-			return
+		no := dht.rt.GetNode(a.Target)
+		if no != nil {
+			nodes = no.CompactNodeInfo()
+		} else {
+			nodes = strings.Join(
+				dht.closestNodeInfos(targetID, dht.K),
+				"",
+			)
 		}
 
-		infoHash := a["info_hash"].(string)
+		send(dht, addr, makeResponse(t, &FindNodeResponse{
+			ID:    dht.idFor(a.Target),
+			Nodes: nodes,
+		}))
+	case *GetPeersArgs:
+		infoHash := a.InfoHash
 
 		if len(infoHash) != 20 {
-			send(dht, addr, makeError(t, protocolError, "invalid info_hash"))
+			reject(dht, addr, msg, "invalid info_hash")
 			return
 		}
 
-		if peers := dht.peers.GetPeers(infoHash, dht.K); len(peers) > 0 {
-			// donot reply
-		} else {
-			targetID := newHashId(infoHash)
-			send(dht, addr, makeResponse(t, map[string]interface{}{
-				"id":    dht.me.id.RawString(),
-				"token": dht.tokens.getToken(addr),
-				"nodes": strings.Join(dht.rt.GetClosestNodeCompactInfo(targetID, dht.K), ""),
-			}))
+		r := &GetPeersResponse{
+			ID:    dht.idFor(infoHash),
+			Token: dht.tokens.getToken(addr),
+		}
+		for _, p := range dht.peers.GetPeers(InfoHash(infoHash), dht.K) {
+			if info := p.CompactIPPortInfo(); info != "" {
+				r.Values = append(r.Values, info)
+			}
 		}
+		if len(r.Values) == 0 {
+			r.Nodes = strings.Join(dht.closestNodeInfos(newHashId(infoHash), dht.K), "")
+		}
+		send(dht, addr, makeResponse(t, r))
 
-		if dht.OnGetPeers != nil {
-			dht.OnGetPeers(infoHash, addr.IP.String(), addr.Port)
+		if !dht.wanted(infoHash) ||
+			dht.seen != nil && dht.seen.Seen(getPeersType+infoHash+addr.String()) {
+			break
 		}
-	case announcePeerType:
-		if err := parseKeys(a, [][]string{{"info_hash", "string"}, {"port", "int"},
-			{"token", "string"}}); err != nil {
 
-			send(dht, addr, makeError(t, protocolError, err.Error()))
-			return
+		dht.publish(EventGetPeersSeen, func() Event {
+			return GetPeersSeen{InfoHash(infoHash), addr.IP.String(), addr.Port, dht.now(), dht.geo(addr.IP)}
+		})
+		if dht.OnGetPeers != nil && dht.callbacks() && dht.firstSeen(getPeersType, infoHash) {
+			dht.callback(dht.OnGetPeers, InfoHash(infoHash), addr.IP.String(), addr.Port)
 		}
+	case *AnnouncePeerArgs:
+		infoHash := a.InfoHash
 
-		infoHash := a["info_hash"].(string)
-		port := a["port"].(int)
-		token := a["token"].(string)
+		if len(infoHash) != 20 {
+			reject(dht, addr, msg, "invalid info_hash")
+			return
+		}
 
-		if !dht.tokens.check(addr, token) {
+		if !dht.replaying && !dht.tokens.check(addr, a.Token) {
+			dht.Logger.Debug("invalid token", F("addr", addr))
+			if !dht.tokens.stale(addr, a.Token) {
+				dht.offend(addr.IP, "invalid token")
+			}
+			dht.onError(ErrTokenInvalid, addr, msg.Q, nil)
 			return
 		}
 
-		if impliedPort, ok := a["implied_port"]; ok &&
-			impliedPort.(int) != 0 {
+		port, err := dht.announcedPort(addr, a)
+		if err != nil {
+			reject(dht, addr, msg, err.Error())
+			return
+		}
+		if !dht.allowAnnounce(addr, infoHash) {
+			send(dht, addr, makeError(msg.T, protocolError, "announce throttled"))
+			return
+		}
 
-			port = addr.Port
+		if !dht.Passive && !dht.Router && !dht.Ignorelist.Has(infoHash) {
+			p := newPeer(addr.IP, port, a.Token)
+			p.LastSeen = dht.now()
+			dht.peers.Insert(InfoHash(infoHash), p)
+			dht.verifyPeer(infoHash, addr.IP, port)
 		}
 
-		if false {
-			dht.peers.Insert(infoHash, newPeer(addr.IP, port, token))
+		if !dht.wanted(infoHash) || dht.seen != nil &&
+			dht.seen.Seen(announcePeerType+infoHash+genAddress(addr.IP.String(), port)) {
+			break
 		}
 
-		if dht.OnAnnouncePeer != nil {
-			dht.OnAnnouncePeer(infoHash, addr.IP.String(), port)
+		dht.publish(EventPeerAnnounced, func() Event {
+			return PeerAnnounced{InfoHash(infoHash), addr.IP.String(), port, dht.now(), dht.geo(addr.IP)}
+		})
+		if dht.OnAnnouncePeer != nil && dht.callbacks() && dht.firstSeen(announcePeerType, infoHash) {
+			dht.callback(dht.OnAnnouncePeer, InfoHash(infoHash), addr.IP.String(), port)
 		}
-	default:
-		return
+		dht.requestMetadata(infoHash, addr.IP, port)
+	case *GetArgs:
+		if len(a.Target) != 20 {
+			reject(dht, addr, msg, "invalid target")
+			return
+		}
+		answerGet(dht, addr, msg, a)
+	case *PutArgs:
+		answerPut(dht, addr, msg, a)
+	case *map[string]interface{}:
+		answerQuery(dht, addr, msg, handler, *a)
 	}
 
-	no, _ := newNode(id, addr.Network(), addr.String())
+	no, _ := newNode(id, addr.Network(), addr.String(), dht.now())
+	no.heardQuery(dht.now())
 	dht.rt.Insert(no)
 	return true
 }
 
 // findOn puts nodes in the response to the routingTable, then if target is in
 // the nodes or all nodes are in the routingTable, it stops. Otherwise it
-// continues to findNode or getPeers.
-func findOn(dht *DHT, r map[string]interface{}, target *hashid, queryType string) error {
-
-	if err := parseKey(r, "nodes", "string"); err != nil {
-		return err
-	}
+// continues to findNode or getPeers. A truncated last node is an error in
+// strict mode and is ignored otherwise.
+func findOn(dht *DHT, nodes string, target *HashID, queryType string) error {
 
-	nodes := r["nodes"].(string)
 	if len(nodes)%26 != 0 {
-		return errors.New("the length of nodes should can be divided by 26")
+		if dht.strict() {
+			return errors.New("the length of nodes should can be divided by 26")
+		}
+		nodes = nodes[:len(nodes)-len(nodes)%26]
 	}
 
 	hasNew, found := false, false
 	for i := 0; i < len(nodes)/26; i++ {
-		no, _ := newNodeFromCompactInfo(string(nodes[i*26 : (i+1)*26]))
+		no, _ := newNodeFromCompactInfo(string(nodes[i*26:(i+1)*26]), dht.now())
+		if addr := no.address(); !dht.validAddr(addr.IP, addr.Port) {
+			continue
+		}
 
 		if no.id.RawString() == target.RawString() {
 			found = true
+		} else if dht.tooClose(no, target) {
+			continue
 		}
 
 		if dht.rt.Insert(no) {
 			hasNew = true
 		}
+		dht.discover(no)
 	}
 
 	if found || !hasNew {
@@ -510,116 +1012,268 @@ func findOn(dht *DHT, r map[string]interface{}, target *hashid, queryType string
 	}
 
 	targetID := target.RawString()
-	for _, no := range dht.rt.FindClosestNode(target, dht.K) {
+	for _, no := range dht.lookupNodes(target, dht.K) {
 		switch queryType {
 		case findNodeType:
 			dht.transacts.findNode(no, targetID)
 		case getPeersType:
-			dht.transacts.getPeers(no, targetID)
+			dht.transacts.getPeers(context.Background(), no, targetID)
+		case getType:
+			dht.transacts.get(no, targetID)
 		default:
-			panic("invalid find type")
+			return fmt.Errorf("invalid find type %q", queryType)
 		}
 	}
 	return nil
 }
 
-// handleResponse handles responses received from udp.
-func handleResponse(dht *DHT, addr *net.UDPAddr, response map[string]interface{}) (success bool) {
+// responseHeader holds the id of a response and the keys telling its
+// query type.
+type responseHeader struct {
+	ID      string      `bencode:"id"`
+	Nodes   interface{} `bencode:"nodes"`
+	Nodes6  interface{} `bencode:"nodes6"`
+	Values  interface{} `bencode:"values"`
+	Token   interface{} `bencode:"token"`
+	Samples interface{} `bencode:"samples"`
+}
+
+// matchesQuery returns whether the response of header shape may answer a
+// query of type q: a response to find_node holds nodes, to get_peers and
+// get a token, to sample_infohashes samples, and a response to ping,
+// announce_peer or put none of them. The responses to custom queries are
+// not checked.
+func matchesQuery(q string, shape *responseHeader) bool {
+	switch q {
+	case pingType, announcePeerType, putType:
+		return shape.Values == nil && shape.Token == nil && shape.Samples == nil
+	case findNodeType:
+		return shape.Nodes != nil || shape.Nodes6 != nil
+	case getPeersType, getType:
+		return shape.Token != nil
+	case sampleInfoHashesType:
+		return shape.Samples != nil
+	}
+	return true
+}
+
+// spoofed drops the response of addr to a query of type q, which doesn't
+// match the query for reason, as a spoof attempt. It's not an offence of
+// addr: the source of a spoofed response is forged, and a node changes its
+// id when it restarts.
+func (dht *DHT) spoofed(addr *net.UDPAddr, q, reason string) {
+	atomic.AddUint64(&dht.metrics.spoofed, 1)
+	dht.Logger.Debug("spoofed response dropped", F("addr", addr),
+		F("q", q), F("reason", reason))
+	dht.onError(ErrProtocol, addr, q, errors.New(reason))
+}
+
+// SpoofedResponses returns how many responses have been dropped because
+// they didn't match their query, by the node id or the query type.
+func (dht *DHT) SpoofedResponses() uint64 {
+	return atomic.LoadUint64(&dht.metrics.spoofed)
+}
 
-	t := response["t"].(string)
+// handleResponse handles responses received from udp. A response is matched
+// to its transaction by its transaction id and address, and dropped as
+// spoofed unless it comes from the node id queried, if known, and has the
+// keys of the response to its query type.
+func handleResponse(dht *DHT, addr *net.UDPAddr, msg *rawMessage) (success bool) {
 
-	trans := dht.transacts.filterOne(t, addr)
+	trans := dht.transacts.filterOne(msg.T, addr)
 	if trans == nil {
 		return
 	}
 
-	// inform transManager to delete the transaction.
-	if err := parseKey(response, "r", "map"); err != nil {
+	q := trans.msg.Q
+	if !dht.responseIn(addr, q, msg) {
 		return
 	}
-
-	q := trans.data["q"].(string)
-	a := trans.data["a"].(map[string]interface{})
-	r := response["r"].(map[string]interface{})
-
-	if err := parseKey(r, "id", "string"); err != nil {
+	var r responseHeader
+	if err := dht.decodeBody(msg.R, &r); err != nil {
+		dht.Logger.Debug("invalid response", F("addr", addr), F("err", err))
+		dht.onError(ErrProtocol, addr, q, err)
 		return
 	}
 
-	id := r["id"].(string)
-
-	if trans.tar.id != nil && trans.tar.id.RawString() != id {
+	if trans.tar.id != nil && trans.tar.id.RawString() != r.ID {
+		dht.spoofed(addr, q, "id mismatch")
+		return
+	}
+	if !matchesQuery(q, &r) {
+		dht.spoofed(addr, q, "query type mismatch")
 		return
 	}
 
-	node, err := newNode(id, addr.Network(), addr.String())
+	node, err := newNode(r.ID, addr.Network(), addr.String(), dht.now())
 	if err != nil {
+		dht.onError(ErrProtocol, addr, q, err)
 		return
 	}
 
-	switch q {
-	case pingType:
-	case findNodeType:
-		if trans.data["q"].(string) != findNodeType {
+	// the Query callers get the response once the transaction is removed.
+	var (
+		replied bool
+		result  map[string]interface{}
+		nodes   string
+	)
+	switch a := trans.msg.A.(type) {
+	case *PingArgs:
+		replied = true
+	case *FindNodeArgs:
+		var r FindNodeResponse
+		if err := dht.decodeBody(msg.R, &r); err != nil {
+			dht.onError(ErrProtocol, addr, q, err)
 			return
 		}
+		replied, nodes = true, r.Nodes
 
-		target := trans.data["a"].(map[string]interface{})["target"].(string)
-		if findOn(dht, r, newHashId(target), findNodeType) != nil {
+		if err := findOn(dht, r.Nodes, newHashId(a.Target), findNodeType); err != nil {
+			dht.onError(ErrProtocol, addr, q, err)
 			return
 		}
-	case getPeersType:
-		if err := parseKey(r, "token", "string"); err != nil {
+	case *GetPeersArgs:
+		var r GetPeersResponse
+		if err := dht.decodeBody(msg.R, &r); err != nil {
+			dht.onError(ErrProtocol, addr, q, err)
 			return
 		}
+		if r.Token == "" {
+			dht.onError(ErrProtocol, addr, q, errors.New("no token"))
+			return
+		}
+		dht.announces.record(a.InfoHash, node, r.Token)
 
-		token := r["token"].(string)
-		infoHash := a["info_hash"].(string)
+		if len(r.Values) != 0 {
+			if dht.Ignorelist.Has(a.InfoHash) {
+				break
+			}
 
-		if err := parseKey(r, "values", "list"); err == nil {
-			values := r["values"].([]interface{})
-			for _, v := range values {
-				p, err := newPeerFromCompactIPPortInfo(v.(string), token)
-				if err != nil {
+			wanted := dht.wanted(a.InfoHash)
+			for _, v := range r.Values {
+				p, err := newPeerFromCompactIPPortInfo(v, r.Token)
+				if err != nil && dht.strict() {
+					dht.onError(ErrProtocol, addr, q, err)
+					return
+				}
+				if err != nil || !dht.validAddr(p.IP, p.Port) {
 					continue
 				}
-				dht.peers.Insert(infoHash, p)
+				p.LastSeen = dht.now()
+				dht.peers.Insert(InfoHash(a.InfoHash), p)
+				dht.verifyPeer(a.InfoHash, p.IP, p.Port)
+				if wanted {
+					dht.publish(EventPeerFound, func() Event {
+						return PeerFound{InfoHash(a.InfoHash), p.IP.String(), p.Port, addr, dht.now(), dht.geo(p.IP)}
+					})
+				}
 			}
-		} else if findOn(dht, r, newHashId(infoHash), getPeersType) != nil {
+		} else if err := findOn(dht, r.Nodes, newHashId(a.InfoHash), getPeersType); err != nil {
+			dht.onError(ErrProtocol, addr, q, err)
 			return
 		}
-	case announcePeerType:
+	case *AnnouncePeerArgs:
+	case *GetArgs:
+		var r GetResponse
+		if err := dht.decodeBody(msg.R, &r); err != nil {
+			dht.onError(ErrProtocol, addr, q, err)
+			return
+		}
+		if r.Token == "" {
+			dht.onError(ErrProtocol, addr, q, errors.New("no token"))
+			return
+		}
+		dht.itemLookups.record(a.Target, node, &r)
+
+		if err := findOn(dht, r.Nodes, newHashId(a.Target), getType); err != nil {
+			dht.onError(ErrProtocol, addr, q, err)
+			return
+		}
+	case *PutArgs:
+		replied = true
+	case *SampleInfoHashesArgs:
+		var r SampleInfoHashesResponse
+		if err := dht.decodeBody(msg.R, &r); err != nil {
+			dht.onError(ErrProtocol, addr, q, err)
+			return
+		}
+		if len(r.Samples)%20 != 0 {
+			dht.onError(ErrProtocol, addr, q, errors.New("invalid samples"))
+			return
+		}
+
+		dht.handleSamples(addr.String(), &r)
+	case map[string]interface{}:
+		var r map[string]interface{}
+		if err := dht.decodeBody(msg.R, &r); err != nil {
+			dht.onError(ErrProtocol, addr, q, err)
+			return
+		}
+		replied, result = true, r
 	default:
 		return
 	}
 
+	dht.metrics.responses.Inc(messageType("q", q))
+
 	// inform transManager to delete transaction.
-	trans.response <- struct{}{}
+	if rtt := dht.transacts.respond(trans, msg.recvTime, nil); rtt > 0 && node != trans.tar {
+		node.observeRTT(rtt)
+	}
+	if replied && trans.waited() {
+		switch trans.msg.A.(type) {
+		case *PingArgs:
+			result = map[string]interface{}{"id": r.ID}
+		case *FindNodeArgs:
+			result = map[string]interface{}{"id": r.ID, "nodes": nodes}
+		}
+		trans.reply(result, nil)
+	}
+	dht.voteExternal(addr, msg.IP)
 
+	if a, ok := trans.msg.A.(*GetPeersArgs); ok && dht.tooClose(node, newHashId(a.InfoHash)) {
+		return
+	}
+
+	node.heardResponse(dht.now())
 	dht.rt.Insert(node)
 
 	return true
 }
 
 // handleError handles errors received from udp.
-func handleError(dht *DHT, addr *net.UDPAddr, response map[string]interface{}) (success bool) {
+func handleError(dht *DHT, addr *net.UDPAddr, msg *rawMessage) (success bool) {
 
-	if err := parseKey(response, "e", "list"); err != nil {
+	var e []interface{}
+	if err := Unmarshal(msg.E, &e); err != nil || len(e) != 2 {
+		dht.onError(ErrProtocol, addr, "", errors.New("invalid error message"))
 		return
 	}
 
-	if e := response["e"].([]interface{}); len(e) != 2 {
+	code, okCode := toInt(e[0], dht.strict())
+	text, okText := e[1].(string)
+	if dht.strict() && (!okCode || !okText) {
+		dht.onError(ErrProtocol, addr, "", errors.New("invalid error message"))
 		return
 	}
+	dht.publish(EventErrorReceived, func() Event {
+		return ErrorReceived{addr, code, text}
+	})
 
-	if trans := dht.transacts.filterOne(response["t"].(string), addr); trans != nil {
-		trans.response <- struct{}{}
+	if trans := dht.transacts.filterOne(msg.T, addr); trans != nil {
+		if trans.span != nil {
+			trans.span.SetFields(F("error", code))
+		}
+		err := &KRPCError{code, text}
+		dht.transacts.respond(trans, msg.recvTime, err)
+		dht.onError(ErrProtocol, addr, trans.msg.Q, fmt.Errorf("error %d: %s", code, text))
+		trans.reply(nil, err)
 	}
 
 	return true
 }
 
-var handlers = map[string]func(*DHT, *net.UDPAddr, map[string]interface{}) bool{
+var handlers = map[string]func(*DHT, *net.UDPAddr, *rawMessage) bool{
 	"q": handleRequest,
 	"r": handleResponse,
 	"e": handleError,
@@ -627,31 +1281,50 @@ var handlers = map[string]func(*DHT, *net.UDPAddr, map[string]interface{}) bool{
 
 // handle handles packets received from udp.
 func handle(dht *DHT, pkt packet) {
-	select {
-	case dht.works <- struct{}{}:
-		go func() {
-			defer func() {
-				<-dht.works
-			}()
+	if dht.Blocklist.Blocked(pkt.raddr.IP) || dht.bans.banned(pkt.raddr.IP, dht.now()) {
+		return
+	}
 
-			data := map[string]interface{}{}
+	atomic.AddUint64(&dht.metrics.bytesIn, uint64(len(pkt.data)))
+	atomic.StoreInt64(&dht.metrics.lastIn, dht.now().UnixNano())
+	if isUTP(pkt.data) && dht.deliverUTP(pkt.data, pkt.raddr) {
+		return
+	}
 
-			err := Decode(pkt.data, &data)
-			if err != nil {
-				return
-			}
+	data := dht.packetIn(pkt.raddr, pkt.data)
+	if data == nil {
+		return
+	}
 
-			response, err := parseMessage(data)
-			if err != nil {
-				return
-			}
+	dec := NewDecoder(bytes.NewReader(data))
+	dec.Limits = dht.DecodeLimits
 
-			if f, ok := handlers[response["y"].(string)]; ok {
-				f(dht, pkt.raddr, response)
-			}
-		}()
-	default:
+	msg := &rawMessage{}
+	if err := dec.Decode(msg); err != nil {
+		dht.Logger.Debug("decode packet failed", F("addr", pkt.raddr), F("err", err))
+		dht.offend(pkt.raddr.IP, "malformed message")
+		dht.onError(ErrDecode, pkt.raddr, "", err)
+		return
+	}
+	msg.recvTime = pkt.recvTime
+	dht.captureMessage(true, pkt.raddr, data)
+	dht.metrics.packetsIn.Inc(messageType(msg.Y, msg.Q))
+	client := msg.client()
+	dht.metrics.clients.Inc(client)
+	dht.clients.put(pkt.raddr, client)
+
+	if msg.T == "" && dht.strict() {
+		dht.onError(ErrProtocol, pkt.raddr, msg.Q, errors.New("no transaction id"))
 		return
 	}
 
+	if msg.Y == "q" && !dht.allowQuery(pkt.raddr, msg.T) {
+		return
+	}
+
+	if f, ok := handlers[msg.Y]; ok {
+		f(dht, pkt.raddr, msg)
+	} else {
+		dht.onError(ErrProtocol, pkt.raddr, "", errors.New("unknown message type"))
+	}
 }
@@ -0,0 +1,375 @@
+package dhtlistener
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestTransIDs(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+	tm := dht.transacts
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 6881}
+
+	a := tm.newTransaction("aaaa", &query{&node{addr: addr}, makeQuery("aaaa", pingType, &PingArgs{}), nil, nil})
+	b := tm.newTransaction("aaaa", &query{&node{addr: other}, makeQuery("aaaa", pingType, &PingArgs{}), nil, nil})
+	tm.insert(a)
+	tm.insert(b)
+
+	if a.id != "aaaa" || len(b.id) != transIDSize || b.msg.T != b.id {
+		t.Fatalf("expected the colliding id replaced, got %q %q", a.id, b.id)
+	}
+	if tm.filterOne("aaaa", addr) != a || tm.filterOne(b.id, other) != b {
+		t.Error("expected the transactions matched")
+	}
+	if tm.filterOne("aaaa", other) != nil || tm.filterOne(b.id, addr) != nil {
+		t.Error("expected the transactions of another address unmatched")
+	}
+
+	// a transaction which isn't the one of its query type and address.
+	tm.index[tm.genIndexKey(pingType, addr.String(), "")] = b
+	if tm.filterOne("aaaa", addr) != nil {
+		t.Error("expected an unindexed transaction unmatched")
+	}
+}
+
+func TestTransIDsFallback(t *testing.T) {
+	r := transIDReader
+	defer func() { transIDReader = r }()
+	transIDReader = iotest.ErrReader(errors.New("no entropy"))
+
+	tm := &transactionManager{}
+	if id := tm.genTransID(); len(id) != transIDSize {
+		t.Fatalf("expected a fallback id, got %q", id)
+	}
+}
+
+func TestTransIDsExhausted(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+	tm := dht.transacts
+
+	for i := 0; i < 1<<16-1; i++ {
+		tm.transactions[string([]byte{byte(i >> 8), byte(i)})] = nil
+	}
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	trans := tm.newTransaction("\x00\x00", &query{&node{addr: addr}, makeQuery("\x00\x00", pingType, &PingArgs{}), nil, nil})
+	if !tm.insert(trans) || trans.id != "\xff\xff" {
+		t.Fatalf("expected the last free id, got %q", trans.id)
+	}
+
+	trans = tm.newTransaction("\x00\x00", &query{&node{addr: addr}, makeQuery("\x00\x00", findNodeType, &PingArgs{}), nil, nil})
+	if tm.insert(trans) {
+		t.Error("expected no free id")
+	}
+}
+
+func TestBinaryTransID(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	data, _ := Marshal(makeQuery("\x00\xff\x80", pingType, &PingArgs{GetRandString(20)}))
+	handle(dht, packet{data: data, raddr: l.LocalAddr().(*net.UDPAddr), recvTime: time.Now()})
+
+	buf := make([]byte, 1024)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := l.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp rawMessage
+	if err := Unmarshal(buf[:n], &resp); err != nil || resp.Y != "r" || resp.T != "\x00\xff\x80" {
+		t.Errorf("expected the transaction id echoed, got %q %v", resp.T, err)
+	}
+}
+
+func TestMaxTransactions(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.MaxTransactions = 2
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+	tm := dht.transacts
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.LocalAddr().(*net.UDPAddr)
+
+	// queued behind the cap, sendQuery drops the queries once it's reached.
+	for _, q := range []string{pingType, findNodeType, getPeersType} {
+		tm.queryChan <- &query{&node{addr: addr}, makeQuery(tm.genTransID(), q, &PingArgs{}), nil, nil}
+	}
+	go tm.run()
+
+	// the scheduler reads the queued query out of the chan.
+	queued := func() int { return len(tm.queryChan) + tm.sched.len() }
+	deadline := time.Now().Add(time.Second * 5)
+	for (len(tm.queryChan) != 0 || queued() != 1) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if tm.len() != 2 || queued() != 1 {
+		t.Fatalf("expected 2 transactions and a queued query, got %d and %d", tm.len(), queued())
+	}
+
+	tm.sendQuery(&node{addr: addr}, announcePeerType, &PingArgs{})
+	if atomic.LoadUint64(&tm.rejected) != 1 {
+		t.Error("expected a rejected query")
+	}
+
+	trans := tm.getByIndex(tm.genIndexKey(pingType, addr.String(), ""))
+	tm.respond(trans, time.Now(), nil)
+	for tm.getByIndex(tm.genIndexKey(getPeersType, addr.String(), "")) == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if tm.getByIndex(tm.genIndexKey(getPeersType, addr.String(), "")) == nil {
+		t.Error("expected the queued query sent once a transaction finished")
+	}
+	if tm.peakLen() != 2 {
+		t.Error("expected a peak of 2, got", tm.peakLen())
+	}
+}
+
+func TestQueryQueueDropPolicy(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.QueryQueueSize = 1
+	dht.init()
+	defer dht.conn.Close()
+	tm := dht.transacts
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 6881}
+	tm.sendQuery(&node{addr: addr}, pingType, &PingArgs{})
+	tm.sendQuery(&node{addr: addr}, findNodeType, &PingArgs{})
+	if q := <-tm.queryChan; q.msg.Q != pingType || dht.DroppedQueries() != 1 {
+		t.Fatal("expected the newest query dropped")
+	}
+
+	dht.QueryQueueDropPolicy = DropOldest
+	tm.sendQuery(&node{addr: addr}, pingType, &PingArgs{})
+	tm.sendQuery(&node{addr: addr}, findNodeType, &PingArgs{})
+	if q := <-tm.queryChan; q.msg.Q != findNodeType || dht.DroppedQueries() != 2 {
+		t.Fatal("expected the oldest query dropped")
+	}
+
+	dht.QueryQueueDropPolicy = Block
+	dht.QueryQueueTimeout = time.Millisecond * 50
+	tm.sendQuery(&node{addr: addr}, pingType, &PingArgs{})
+	start := time.Now()
+	tm.sendQuery(&node{addr: addr}, findNodeType, &PingArgs{})
+	if time.Since(start) < dht.QueryQueueTimeout || dht.DroppedQueries() != 3 {
+		t.Fatal("expected the query dropped after the timeout")
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		<-tm.queryChan
+	}()
+	tm.sendQuery(&node{addr: addr}, findNodeType, &PingArgs{})
+	if q := <-tm.queryChan; q.msg.Q != findNodeType || dht.DroppedQueries() != 3 {
+		t.Fatal("expected the query queued once there's room")
+	}
+}
+
+func TestQueryQueueBlockDefault(t *testing.T) {
+	dht, err := New(WithAddr("127.0.0.1:0"), WithQueryQueueSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+	dht.Clock = clock
+	dht.QueryQueueDropPolicy = Block
+	dht.init()
+	defer dht.conn.Close()
+	tm := dht.transacts
+	if cap(tm.queryChan) != 1 {
+		t.Fatalf("expected a query chan of 1, got %d", cap(tm.queryChan))
+	}
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 6881}
+	tm.sendQuery(&node{addr: addr}, pingType, &PingArgs{})
+
+	// without QueryQueueTimeout, the query waits a second, not forever.
+	done := make(chan struct{})
+	go func() {
+		tm.sendQuery(&node{addr: addr}, findNodeType, &PingArgs{})
+		close(done)
+	}()
+	if !waitUntil(func() bool {
+		clock.Lock()
+		defer clock.Unlock()
+		return len(clock.timers) > 0
+	}) {
+		t.Fatal("expected the query to wait")
+	}
+	clock.Advance(defaultQueryQueueTimeout)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the query dropped after the default timeout")
+	}
+	if dht.DroppedQueries() != 1 {
+		t.Fatalf("expected a dropped query, got %d", dht.DroppedQueries())
+	}
+}
+
+func TestTransactionsConcurrent(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+	tm := dht.transacts
+
+	done := make(chan struct{})
+	for g := 0; g < 8; g++ {
+		go func(g int) {
+			defer func() { done <- struct{}{} }()
+
+			addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, byte(g+1)), Port: 6881}
+			no := &node{addr: addr}
+			for i := 0; i < 200; i++ {
+				id := tm.genTransID()
+				trans := tm.newTransaction(id, &query{no, makeQuery(id, pingType, &PingArgs{}), nil, nil})
+				if !tm.insert(trans) {
+					t.Error("insert failed")
+					return
+				}
+				if tm.filterOne(trans.id, addr) != trans {
+					t.Error("expected the transaction matched")
+				}
+				no.update(&node{addr: addr}) // as the routing table does
+				tm.delete(trans)
+				if tm.getByTransID(trans.id) == trans {
+					t.Error("expected the transaction deleted")
+				}
+			}
+		}(g)
+	}
+	for g := 0; g < 8; g++ {
+		<-done
+	}
+	if tm.len() != 0 || len(tm.index) != 0 {
+		t.Errorf("expected no transaction left, got %d", tm.len())
+	}
+}
+
+func TestQueryDedupePolicy(t *testing.T) {
+	for _, c := range []struct {
+		policy int
+		want   int
+	}{
+		{QueryDedupeTarget, 2},
+		{QueryDedupeType, 1},
+		{QueryDedupeNone, 3},
+	} {
+		dht := NewDht("127.0.0.1:0")
+		if dht == nil {
+			t.Fatal("listen failed")
+		}
+		dht.QueryDedupePolicy = c.policy
+		dht.init()
+		tm := dht.transacts
+
+		addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+		no := &node{addr: addr}
+		for _, infoHash := range []string{"mnopqrstuvwxyz123456", "abcdefghij0123456789", "abcdefghij0123456789"} {
+			tm.query(&query{no, makeQuery(tm.genTransID(), getPeersType, &GetPeersArgs{InfoHash: infoHash}), nil, nil})
+		}
+		if n := tm.len(); n != c.want {
+			t.Errorf("policy %d: expected %d transactions, got %d", c.policy, c.want, n)
+		}
+		dht.conn.Close()
+	}
+}
+
+func TestSpoofedResponses(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+	tm := dht.transacts
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 6881}
+	no := &node{id: RandomHashID(), addr: addr}
+	id := tm.genTransID()
+	trans := tm.newTransaction(id, &query{no, makeQuery(id, findNodeType, &FindNodeArgs{Target: no.id.RawString()}), nil, nil})
+	if !tm.insert(trans) {
+		t.Fatal("insert failed")
+	}
+
+	for i, r := range []map[string]interface{}{
+		{"id": RandomHashID().RawString(), "nodes": ""},
+		{"id": no.id.RawString(), "token": "tok", "values": []interface{}{}},
+	} {
+		body, err := Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if handleResponse(dht, addr, &rawMessage{T: id, Y: "r", R: body}) {
+			t.Errorf("expected the response %d dropped", i)
+		}
+	}
+	if dht.SpoofedResponses() != 2 || tm.getByTransID(id) != trans {
+		t.Errorf("expected 2 spoofed responses and the transaction pending, got %d", dht.SpoofedResponses())
+	}
+
+	for _, c := range []struct {
+		q    string
+		r    string
+		want bool
+	}{
+		{pingType, "d2:id20:aaaaaaaaaaaaaaaaaaaae", true},
+		{pingType, "d2:id20:aaaaaaaaaaaaaaaaaaaa5:token3:toke", false},
+		{getPeersType, "d2:id20:aaaaaaaaaaaaaaaaaaaa5:token3:toke", true},
+		{getPeersType, "d2:id20:aaaaaaaaaaaaaaaaaaaa5:nodes0:e", false},
+		{sampleInfoHashesType, "d2:id20:aaaaaaaaaaaaaaaaaaaa5:nodes0:e", false},
+		{"custom", "d2:id20:aaaaaaaaaaaaaaaaaaaa6:valueslee", true},
+	} {
+		var h responseHeader
+		if err := Unmarshal([]byte(c.r), &h); err != nil {
+			t.Fatal(err)
+		}
+		if got := matchesQuery(c.q, &h); got != c.want {
+			t.Errorf("matchesQuery(%s, %q) = %v", c.q, c.r, got)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package dhtlistener
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Field is a key-value pair attached to a log event.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a Field.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger is the interface used by DHT to report what happens inside.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+// nopLogger discards all events.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...Field) {}
+func (nopLogger) Info(string, ...Field)  {}
+func (nopLogger) Warn(string, ...Field)  {}
+func (nopLogger) Error(string, ...Field) {}
+
+// Log levels of StdLogger.
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// StdLogger is a Logger writing one line per event like
+// `2006-01-02T15:04:05Z07:00 INFO msg key=value`.
+type StdLogger struct {
+	sync.Mutex
+	w     io.Writer
+	Level int
+}
+
+// NewStdLogger returns a StdLogger writing the events whose level is no less
+// than level to w.
+func NewStdLogger(w io.Writer, level int) *StdLogger {
+	return &StdLogger{w: w, Level: level}
+}
+
+// SetLevel changes the level, it may be called while logging.
+func (l *StdLogger) SetLevel(level int) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.Level = level
+}
+
+func (l *StdLogger) log(level int, msg string, fields []Field) {
+	l.Lock()
+	defer l.Unlock()
+
+	if level < l.Level {
+		return
+	}
+
+	parts := make([]string, 0, len(fields)+3)
+	parts = append(parts, time.Now().Format(time.RFC3339), levelNames[level], msg)
+	for _, f := range fields {
+		parts = append(parts, fmt.Sprintf("%s=%v", f.Key, f.Value))
+	}
+
+	fmt.Fprintln(l.w, strings.Join(parts, " "))
+}
+
+// Debug logs a debug event.
+func (l *StdLogger) Debug(msg string, fields ...Field) {
+	l.log(LevelDebug, msg, fields)
+}
+
+// Info logs an info event.
+func (l *StdLogger) Info(msg string, fields ...Field) {
+	l.log(LevelInfo, msg, fields)
+}
+
+// Warn logs a warning event.
+func (l *StdLogger) Warn(msg string, fields ...Field) {
+	l.log(LevelWarn, msg, fields)
+}
+
+// Error logs an error event.
+func (l *StdLogger) Error(msg string, fields ...Field) {
+	l.log(LevelError, msg, fields)
+}
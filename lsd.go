@@ -0,0 +1,259 @@
+package dhtlistener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The multicast groups of BEP 14, see
+// http://www.bittorrent.org/beps/bep_0014.html.
+const (
+	lsdGroup4 = "239.192.152.143:6771"
+	lsdGroup6 = "[ff15::efc0:988f]:6771"
+)
+
+const (
+	// lsdInterval is how often the announced infohashes are multicast.
+	lsdInterval = time.Minute * 5
+	// lsdMinInterval is the min interval between two announces of an
+	// infohash.
+	lsdMinInterval = time.Minute
+	// lsdBatch is the max number of infohashes of a message.
+	lsdBatch = 16
+	// lsdTTL is how long an infohash is multicast after its last announce.
+	lsdTTL = time.Hour
+)
+
+// lsd is the local service discovery of BEP 14: it multicasts BT-SEARCH
+// messages announcing our infohashes and learns the peers of the others.
+type lsd struct {
+	dht    *DHT
+	conns  []*net.UDPConn // joined groups
+	groups []*net.UDPAddr // of conns
+	cookie string         // tells our own messages
+
+	sync.Mutex
+	announced map[string]*lsdAnnounce // infohash : announce
+}
+
+// lsdAnnounce is an infohash multicast by an lsd.
+type lsdAnnounce struct {
+	port    int
+	sent    time.Time // of the last multicast
+	expires time.Time // once not multicast anymore
+}
+
+// startLSD joins the multicast groups of BEP 14, the IPv6 one being
+// optional, and receives their messages until the dht is closed.
+func (dht *DHT) startLSD() error {
+	l := &lsd{
+		dht:       dht,
+		cookie:    hex.EncodeToString([]byte(GetRandString(8))),
+		announced: make(map[string]*lsdAnnounce),
+	}
+	for i, group := range []string{lsdGroup4, lsdGroup6} {
+		network := "udp4"
+		if i == 1 {
+			network = "udp6"
+		}
+		gaddr, _ := net.ResolveUDPAddr(network, group)
+		conn, err := net.ListenMulticastUDP(network, nil, gaddr)
+		if err != nil {
+			if i == 0 {
+				return err
+			}
+			dht.Logger.Debug("lsd ipv6 disabled", F("err", err))
+			continue
+		}
+		l.conns = append(l.conns, conn)
+		l.groups = append(l.groups, gaddr)
+	}
+	dht.lsd = l
+
+	for _, conn := range l.conns {
+		conn := conn
+		dht.spawn(func() { l.recv(conn) })
+	}
+	dht.spawn(func() {
+		dht.every(lsdInterval, l.announceAll)
+		for _, conn := range l.conns {
+			conn.Close()
+		}
+	})
+	return nil
+}
+
+// recv handles the messages received on conn until it's closed.
+func (l *lsd) recv(conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		l.handle(buf[:n], addr)
+	}
+}
+
+// lsdMessage is a BT-SEARCH message.
+type lsdMessage struct {
+	Port       int
+	InfoHashes []string // raw
+	Cookie     string
+}
+
+// parseLSD parses the BT-SEARCH message data.
+func parseLSD(data []byte) (*lsdMessage, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	line, err := r.ReadLine()
+	if err != nil || line != "BT-SEARCH * HTTP/1.1" {
+		return nil, errors.New("not a BT-SEARCH message")
+	}
+	h, err := r.ReadMIMEHeader()
+	if err != nil && len(h) == 0 {
+		return nil, err
+	}
+
+	m := &lsdMessage{Cookie: h.Get("Cookie")}
+	if m.Port, err = strconv.Atoi(h.Get("Port")); err != nil || m.Port <= 0 || m.Port > 65535 {
+		return nil, errors.New("invalid port")
+	}
+	for _, v := range h["Infohash"] {
+		ih, err := hex.DecodeString(strings.TrimSpace(v))
+		if err != nil || len(ih) != hash_size {
+			return nil, errInvalidInfoHash
+		}
+		m.InfoHashes = append(m.InfoHashes, string(ih))
+	}
+	if len(m.InfoHashes) == 0 {
+		return nil, errors.New("no infohash")
+	}
+	return m, nil
+}
+
+// formatLSD returns the BT-SEARCH message announcing the raw infohashes on
+// port to group.
+func formatLSD(group string, port int, infoHashes []string, cookie string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", group, port)
+	for _, ih := range infoHashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", ih)
+	}
+	if cookie != "" {
+		fmt.Fprintf(&b, "cookie: %s\r\n", cookie)
+	}
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+// handle stores the peers of the BT-SEARCH message data received from addr
+// and publishes them as PeerFound events, From being addr.
+func (l *lsd) handle(data []byte, addr *net.UDPAddr) {
+	dht := l.dht
+	m, err := parseLSD(data)
+	if err != nil {
+		dht.Logger.Debug("invalid lsd message", F("addr", addr), F("err", err))
+		return
+	}
+	if m.Cookie == l.cookie || dht.Blocklist.Blocked(addr.IP) {
+		return
+	}
+
+	for _, ih := range m.InfoHashes {
+		if dht.Ignorelist.Has(ih) {
+			continue
+		}
+		if !dht.Passive {
+			p := newPeer(addr.IP, m.Port, "")
+			p.LastSeen = dht.now()
+			dht.peers.Insert(InfoHash(ih), p)
+		}
+		if dht.wanted(ih) {
+			dht.publish(EventPeerFound, func() Event {
+				return PeerFound{InfoHash(ih), addr.IP.String(), m.Port, addr, dht.now(), dht.geo(addr.IP)}
+			})
+		}
+	}
+}
+
+// announce multicasts that we are a peer of the raw infoHash on port, and
+// keeps announcing it every 5m for an hour. An infohash is announced once a
+// minute at most.
+func (l *lsd) announce(infoHash string, port int) {
+	now := l.dht.now()
+
+	l.Lock()
+	a, ok := l.announced[infoHash]
+	if !ok {
+		a = &lsdAnnounce{}
+		l.announced[infoHash] = a
+	}
+	a.port, a.expires = port, now.Add(lsdTTL)
+	if ok && now.Sub(a.sent) < lsdMinInterval {
+		l.Unlock()
+		return
+	}
+	a.sent = now
+	l.Unlock()
+
+	l.send(port, []string{infoHash})
+}
+
+// announceAll multicasts the announced infohashes, it forgets the ones
+// which expired.
+func (l *lsd) announceAll() {
+	now := l.dht.now()
+	ports := make(map[int][]string)
+
+	l.Lock()
+	for ih, a := range l.announced {
+		if !a.expires.After(now) {
+			delete(l.announced, ih)
+			continue
+		}
+		ports[a.port] = append(ports[a.port], ih)
+		a.sent = now
+	}
+	l.Unlock()
+
+	for port, infoHashes := range ports {
+		for len(infoHashes) > lsdBatch {
+			l.send(port, infoHashes[:lsdBatch])
+			infoHashes = infoHashes[lsdBatch:]
+		}
+		l.send(port, infoHashes)
+	}
+}
+
+// send multicasts the BT-SEARCH message of infoHashes on port to the
+// joined groups.
+func (l *lsd) send(port int, infoHashes []string) {
+	for i, conn := range l.conns {
+		group := l.groups[i]
+		data := formatLSD(group.String(), port, infoHashes, l.cookie)
+		if _, err := conn.WriteToUDP(data, group); err != nil {
+			l.dht.Logger.Debug("lsd send failed", F("group", group), F("err", err))
+		}
+	}
+}
+
+// lsdAnnounce announces the raw infoHash on port by LSD if it's enabled, 0
+// meaning our dht port.
+func (dht *DHT) lsdAnnounce(infoHash string, port int) {
+	if dht.lsd == nil {
+		return
+	}
+	if port == 0 {
+		port = dht.conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	dht.lsd.announce(infoHash, port)
+}
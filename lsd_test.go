@@ -0,0 +1,95 @@
+package dhtlistener
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseLSD(t *testing.T) {
+	ih1, ih2 := GetRandString(20), GetRandString(20)
+	data := formatLSD(lsdGroup4, 6881, []string{ih1, ih2}, "abc")
+
+	m, err := parseLSD(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Port != 6881 || m.Cookie != "abc" || len(m.InfoHashes) != 2 ||
+		m.InfoHashes[0] != ih1 || m.InfoHashes[1] != ih2 {
+		t.Errorf("unexpected message %+v", m)
+	}
+
+	for _, data := range []string{
+		"NOTIFY * HTTP/1.1\r\nPort: 6881\r\nInfohash: 0123456789abcdef0123456789abcdef01234567\r\n\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: 0123456789abcdef0123456789abcdef01234567\r\n\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: 0123\r\n\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n\r\n",
+	} {
+		if _, err := parseLSD([]byte(data)); err == nil {
+			t.Errorf("expected %q to be invalid", data)
+		}
+	}
+}
+
+func TestLSDHandle(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+
+	l := &lsd{dht: dht, cookie: "ours"}
+	events := dht.Subscribe(EventPeerFound)
+	addr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 6771}
+	infoHash := GetRandString(20)
+
+	l.handle(formatLSD(lsdGroup4, 6881, []string{infoHash}, "ours"), addr)
+	if peers := dht.peers.GetPeers(InfoHash(infoHash), 10); len(peers) != 0 {
+		t.Error("expected our own message to be ignored")
+	}
+
+	l.handle(formatLSD(lsdGroup4, 6881, []string{infoHash}, "theirs"), addr)
+	peers := dht.peers.GetPeers(InfoHash(infoHash), 10)
+	if len(peers) != 1 || !peers[0].IP.Equal(addr.IP) || peers[0].Port != 6881 {
+		t.Errorf("expected the lan peer stored, got %v", peers)
+	}
+	select {
+	case e := <-events:
+		if pf := e.(PeerFound); pf.InfoHash.RawString() != infoHash || pf.Port != 6881 || pf.From != addr {
+			t.Errorf("unexpected event %+v", pf)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected a PeerFound event")
+	}
+}
+
+func TestLSDAnnounceExpire(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	defer dht.conn.Close()
+	clock := newFakeClock()
+	dht.Clock = clock
+	l := &lsd{dht: dht, announced: make(map[string]*lsdAnnounce)}
+
+	a, b := GetRandString(20), GetRandString(20)
+	l.announce(a, 6881)
+	clock.Advance(lsdTTL / 2)
+	l.announce(b, 6881)
+	clock.Advance(lsdTTL / 2)
+	l.announceAll()
+	if _, ok := l.announced[a]; ok || len(l.announced) != 1 {
+		t.Fatalf("expected %x expired, got %d infohashes", a, len(l.announced))
+	}
+
+	// announcing again keeps it.
+	l.announce(b, 6881)
+	clock.Advance(lsdTTL / 2)
+	l.announceAll()
+	if _, ok := l.announced[b]; !ok {
+		t.Error("expected the announce renewed")
+	}
+}
@@ -0,0 +1,101 @@
+package dhtlistener
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var errInvalidMagnet = errors.New("invalid magnet link")
+
+// Magnet is a BEP 9 magnet link of a torrent.
+type Magnet struct {
+	InfoHash InfoHash
+	Name     string   // dn, the display name
+	Trackers []string // tr
+	Size     int64    // xl, 0 if unknown
+}
+
+// ParseMagnet parses a magnet link, its btih infohash being hex or base32
+// encoded.
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "magnet" {
+		return nil, errInvalidMagnet
+	}
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, errInvalidMagnet
+	}
+
+	m := &Magnet{Name: q.Get("dn"), Trackers: q["tr"]}
+	for _, xt := range q["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		if m.InfoHash, err = parseBtih(xt[len("urn:btih:"):]); err != nil {
+			return nil, err
+		}
+		break
+	}
+	if m.InfoHash == "" {
+		return nil, errInvalidMagnet
+	}
+	if xl := q.Get("xl"); xl != "" {
+		if m.Size, err = strconv.ParseInt(xl, 10, 64); err != nil || m.Size < 0 {
+			return nil, errInvalidMagnet
+		}
+	}
+	return m, nil
+}
+
+// parseBtih decodes the hex or base32 infohash of a btih urn.
+func parseBtih(s string) (InfoHash, error) {
+	var data []byte
+	var err error
+	switch len(s) {
+	case 40:
+		data, err = hex.DecodeString(s)
+	case 32:
+		data, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = errInvalidMagnet
+	}
+	if err != nil || len(data) != 20 {
+		return "", errInvalidMagnet
+	}
+	return InfoHash(data), nil
+}
+
+// String returns the magnet link of m, its infohash hex encoded.
+func (m *Magnet) String() string {
+	b := []byte("magnet:?xt=urn:btih:" + m.InfoHash.Hex())
+	if m.Name != "" {
+		b = append(b, "&dn="+url.QueryEscape(m.Name)...)
+	}
+	if m.Size > 0 {
+		b = append(b, "&xl="+strconv.FormatInt(m.Size, 10)...)
+	}
+	for _, tr := range m.Trackers {
+		b = append(b, "&tr="+url.QueryEscape(tr)...)
+	}
+	return string(b)
+}
+
+// Magnet returns the magnet link of ih, to be completed with a name or
+// trackers if known.
+func (ih InfoHash) Magnet() *Magnet {
+	return &Magnet{InfoHash: ih}
+}
+
+// Magnet returns the magnet link of the torrent described by info.
+func (info *TorrentInfo) Magnet() *Magnet {
+	return &Magnet{
+		InfoHash: InfoHash(info.InfoHash),
+		Name:     info.Name,
+		Size:     int64(info.Length),
+	}
+}
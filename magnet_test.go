@@ -0,0 +1,55 @@
+package dhtlistener
+
+import (
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	const hexed = "0123456789abcdef0123456789abcdef01234567"
+
+	for _, uri := range []string{
+		"magnet:?xt=urn:btih:" + hexed + "&dn=a+b&tr=udp%3A%2F%2Ft1%3A80&tr=udp%3A%2F%2Ft2%3A80&xl=42",
+		"magnet:?dn=a%20b&xt=urn:btih:AERUKZ4JVPG66AJDIVTYTK6N54ASGRLH&tr=udp://t1:80&tr=udp://t2:80&xl=42",
+		"magnet:?xt=urn:btih:aeruKZ4JVPG66AJDIVTYTK6N54ASGRLH&dn=a+b&tr=udp://t1:80&tr=udp://t2:80&xl=42",
+	} {
+		m, err := ParseMagnet(uri)
+		if err != nil {
+			t.Errorf("%s: %v", uri, err)
+			continue
+		}
+		if m.InfoHash.Hex() != hexed || m.Name != "a b" || m.Size != 42 ||
+			len(m.Trackers) != 2 || m.Trackers[1] != "udp://t2:80" {
+			t.Errorf("%s: unexpected magnet %+v", uri, m)
+		}
+	}
+
+	for _, uri := range []string{
+		"http://example.com/?xt=urn:btih:" + hexed,
+		"magnet:?dn=a",
+		"magnet:?xt=urn:btih:0123",
+		"magnet:?xt=urn:btih:" + hexed + "&xl=-1",
+	} {
+		if _, err := ParseMagnet(uri); err != errInvalidMagnet {
+			t.Errorf("%s: expected errInvalidMagnet, got %v", uri, err)
+		}
+	}
+}
+
+func TestMagnetString(t *testing.T) {
+	ih, _ := ParseInfoHash("0123456789abcdef0123456789abcdef01234567")
+	m := ih.Magnet()
+	if s := m.String(); s != "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567" {
+		t.Errorf("unexpected magnet %s", s)
+	}
+
+	m.Name, m.Size, m.Trackers = "a b&c", 42, []string{"udp://t1:80"}
+	parsed, err := ParseMagnet(m.String())
+	if err != nil || parsed.InfoHash != ih || parsed.Name != m.Name || parsed.Size != 42 ||
+		len(parsed.Trackers) != 1 || parsed.Trackers[0] != "udp://t1:80" {
+		t.Errorf("expected %+v round tripped, got %+v, %v", m, parsed, err)
+	}
+
+	if raw, err := rawInfoHash(m.String()); err != nil || raw != ih.RawString() {
+		t.Errorf("expected the magnet infohash, got %q, %v", raw, err)
+	}
+}
@@ -0,0 +1,128 @@
+package dhtlistener
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Manager runs several DHT instances, e.g. on different ports or for both
+// IPv4 and IPv6, to cover a broader part of the keyspace. The instances
+// share their configuration, their events, a cache deduplicating the
+// get_peers and announce_peer queries seen by more than one of them, the
+// FirstSeen deduper and the metadata fetcher of the first one.
+type Manager struct {
+	// OnGetPeers and OnAnnouncePeer are set on every instance, they are
+	// called once per deduplicated query. Prefer Subscribe.
+	OnGetPeers     func(InfoHash, string, int)
+	OnAnnouncePeer func(InfoHash, string, int)
+
+	dhts   []*DHT
+	events *eventBus
+	seen   *dedupeCache
+}
+
+// NewManager returns a new Manager pointer running a DHT per address,
+// config is called on each of them before they share their state. It may
+// be nil.
+func NewManager(addrs []string, config func(*DHT)) (*Manager, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no address")
+	}
+
+	m := &Manager{
+		dhts: make([]*DHT, 0, len(addrs)),
+		seen: newDedupeCache(time.Minute, 1<<16),
+	}
+
+	for _, addr := range addrs {
+		dht := NewDht(addr)
+		if dht == nil {
+			m.closeAll()
+			return nil, errors.New("listen " + addr + " failed")
+		}
+		if config != nil {
+			config(dht)
+		}
+		m.dhts = append(m.dhts, dht)
+	}
+
+	primary := m.dhts[0]
+	m.events = primary.events
+	if primary.FetchMetadata {
+		primary.fetcher = newMetadataFetcher(primary)
+	}
+
+	for _, dht := range m.dhts {
+		dht.events = m.events
+		dht.seen = m.seen
+		dht.FirstSeen = primary.FirstSeen
+		dht.fetcher = primary.fetcher
+	}
+	return m, nil
+}
+
+// DHTs returns the managed instances.
+func (m *Manager) DHTs() []*DHT {
+	return m.dhts
+}
+
+// Subscribe returns a channel receiving the events of type t published by
+// any instance.
+func (m *Manager) Subscribe(t EventType) <-chan Event {
+	return m.events.subscribe(t, m.dhts[0].EventBufferSize)
+}
+
+// Unsubscribe stops the delivery to ch, which is closed.
+func (m *Manager) Unsubscribe(ch <-chan Event) {
+	m.events.unsubscribe(ch)
+}
+
+// Run runs all instances, it returns once they are all closed.
+func (m *Manager) Run() {
+	var wg sync.WaitGroup
+
+	for _, dht := range m.dhts {
+		dht.OnGetPeers = m.OnGetPeers
+		dht.OnAnnouncePeer = m.OnAnnouncePeer
+
+		wg.Add(1)
+		go func(dht *DHT) {
+			defer wg.Done()
+			dht.Run()
+		}(dht)
+	}
+	wg.Wait()
+}
+
+// Started returns a channel closed once all instances are started, see
+// DHT.Started. It's never closed if one is closed before it starts.
+func (m *Manager) Started() <-chan struct{} {
+	ret := make(chan struct{})
+	go func() {
+		for _, dht := range m.dhts {
+			<-dht.Started()
+		}
+		close(ret)
+	}()
+	return ret
+}
+
+// Close closes all instances, it returns the first error.
+func (m *Manager) Close(ctx context.Context) error {
+	var ret error
+	for _, dht := range m.dhts {
+		if err := dht.Close(ctx); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// closeAll closes the instances created so far.
+func (m *Manager) closeAll() {
+	for _, dht := range m.dhts {
+		dht.Close(context.Background())
+	}
+}
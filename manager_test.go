@@ -0,0 +1,80 @@
+package dhtlistener
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDedupeCache(t *testing.T) {
+	dc := newDedupeCache(time.Hour, 4)
+
+	if dc.Seen("a") || !dc.Seen("a") {
+		t.Fatal("a should be seen once remembered")
+	}
+	for _, key := range []string{"b", "c", "d", "e"} {
+		dc.Seen(key)
+	}
+	if dc.len() > 4 {
+		t.Fatalf("expected at most 4 keys, got %d", dc.len())
+	}
+	if dc.Seen("a") {
+		t.Fatal("a should be forgotten")
+	}
+}
+
+func TestManager(t *testing.T) {
+	m, err := NewManager([]string{"127.0.0.1:0", "127.0.0.1:0"}, func(dht *DHT) {
+		dht.EntranceAddrs = nil
+		dht.Workers = 4
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := m.Subscribe(EventGetPeersSeen)
+
+	go m.Run()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := m.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	select {
+	case <-m.Started():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the instances to start")
+	}
+
+	infoHash := "mnopqrstuvwxyz123456"
+	sender := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	for i, dht := range m.DHTs() {
+		if dht.Workers != 4 {
+			t.Fatal("config should apply to all instances")
+		}
+
+		msg := &rawMessage{T: "aa", Y: "q", Q: getPeersType}
+		msg.A, _ = Marshal(&GetPeersArgs{ID: "abcdefghij012345678" + string(rune('0'+i)), InfoHash: infoHash})
+		handleRequest(dht, sender, msg)
+	}
+
+	select {
+	case e := <-events:
+		if e.(GetPeersSeen).InfoHash.RawString() != infoHash {
+			t.Fatal("unexpected event", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a GetPeersSeen event")
+	}
+
+	select {
+	case e := <-events:
+		t.Fatal("the query seen by both instances should be deduplicated", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -4,95 +4,160 @@ import (
 	"sync"
 )
 
+// mapShards is the number of shards of a syncMap, a power of two.
+const mapShards = 32
+
 type mapItem struct {
-	key interface{}
+	key string
 	val interface{}
 }
 
-// syncMap represents a goroutine-safe map.
+// mapShard is a part of a syncMap guarded by its own lock.
+type mapShard struct {
+	sync.RWMutex
+	data map[string]interface{}
+}
+
+// syncMap represents a goroutine-safe map. It's sharded by the hash of the
+// keys, so that goroutines using different keys rarely wait for each other.
 type syncMap struct {
-	*sync.RWMutex
-	data map[interface{}]interface{}
+	shards [mapShards]mapShard
 }
 
 // newsyncMap returns a syncMap pointer.
 func newsyncMap() *syncMap {
-	return &syncMap{
-		RWMutex: &sync.RWMutex{},
-		data:    make(map[interface{}]interface{}),
+	smap := &syncMap{}
+	for i := range smap.shards {
+		smap.shards[i].data = make(map[string]interface{})
+	}
+	return smap
+}
+
+// shard returns the shard of key, by its FNV-1a hash.
+func (smap *syncMap) shard(key string) *mapShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
 	}
+	return &smap.shards[h&(mapShards-1)]
 }
 
 // Get returns the value mapped to key.
-func (smap *syncMap) Get(key interface{}) (val interface{}, ok bool) {
-	smap.RLock()
-	defer smap.RUnlock()
+func (smap *syncMap) Get(key string) (val interface{}, ok bool) {
+	shard := smap.shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
 
-	val, ok = smap.data[key]
+	val, ok = shard.data[key]
 	return
 }
 
 // Has returns whether the syncMap contains the key.
-func (smap *syncMap) Has(key interface{}) bool {
+func (smap *syncMap) Has(key string) bool {
 	_, ok := smap.Get(key)
 	return ok
 }
 
 // Set sets pair {key: val}.
-func (smap *syncMap) Set(key interface{}, val interface{}) {
-	smap.Lock()
-	defer smap.Unlock()
+func (smap *syncMap) Set(key string, val interface{}) {
+	shard := smap.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
 
-	smap.data[key] = val
+	shard.data[key] = val
+}
+
+// SetIfAbsent sets pair {key: val} unless key is mapped, and returns
+// whether it did.
+func (smap *syncMap) SetIfAbsent(key string, val interface{}) bool {
+	shard := smap.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if _, ok := shard.data[key]; ok {
+		return false
+	}
+	shard.data[key] = val
+	return true
+}
+
+// Update replaces the value mapped to key by the one f returns, f being
+// called with the current value under the lock of the key. A nil value
+// deletes the key.
+func (smap *syncMap) Update(key string, f func(val interface{}, ok bool) interface{}) {
+	shard := smap.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	val, ok := shard.data[key]
+	if val = f(val, ok); val == nil {
+		delete(shard.data, key)
+	} else {
+		shard.data[key] = val
+	}
 }
 
 // Delete deletes the key in the map.
-func (smap *syncMap) Delete(key interface{}) {
-	smap.Lock()
-	defer smap.Unlock()
+func (smap *syncMap) Delete(key string) {
+	shard := smap.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
 
-	delete(smap.data, key)
+	delete(shard.data, key)
 }
 
 // DeleteMulti deletes keys in batch.
-func (smap *syncMap) DeleteMulti(keys []interface{}) {
-	smap.Lock()
-	defer smap.Unlock()
-
+func (smap *syncMap) DeleteMulti(keys []string) {
 	for _, key := range keys {
-		delete(smap.data, key)
+		smap.Delete(key)
 	}
 }
 
 // Clear resets the data.
 func (smap *syncMap) Clear() {
-	smap.Lock()
-	defer smap.Unlock()
-
-	smap.data = make(map[interface{}]interface{})
+	for i := range smap.shards {
+		shard := &smap.shards[i]
+		shard.Lock()
+		shard.data = make(map[string]interface{})
+		shard.Unlock()
+	}
 }
 
-// Iter returns a chan which output all items.
-func (smap *syncMap) Iter() <-chan mapItem {
-	ch := make(chan mapItem)
-	go func() {
-		smap.RLock()
-		for key, val := range smap.data {
-			ch <- mapItem{
-				key: key,
-				val: val,
+// Range calls f for every item until f returns false. Each shard is locked
+// while its items are visited, f must not modify the map.
+func (smap *syncMap) Range(f func(key string, val interface{}) bool) {
+	for i := range smap.shards {
+		shard := &smap.shards[i]
+		shard.RLock()
+		for key, val := range shard.data {
+			if !f(key, val) {
+				shard.RUnlock()
+				return
 			}
 		}
-		smap.RUnlock()
-		close(ch)
-	}()
-	return ch
+		shard.RUnlock()
+	}
+}
+
+// Items returns a snapshot of the items.
+func (smap *syncMap) Items() []mapItem {
+	items := make([]mapItem, 0, smap.Len())
+	smap.Range(func(key string, val interface{}) bool {
+		items = append(items, mapItem{key, val})
+		return true
+	})
+	return items
 }
 
 // Len returns the length of syncMap.
 func (smap *syncMap) Len() int {
-	smap.RLock()
-	defer smap.RUnlock()
-
-	return len(smap.data)
+	n := 0
+	for i := range smap.shards {
+		shard := &smap.shards[i]
+		shard.RLock()
+		n += len(shard.data)
+		shard.RUnlock()
+	}
+	return n
 }
@@ -0,0 +1,69 @@
+package dhtlistener
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSyncMap(t *testing.T) {
+	smap := newsyncMap()
+	for i := 0; i < 100; i++ {
+		smap.Set(strconv.Itoa(i), i)
+	}
+	if n := smap.Len(); n != 100 {
+		t.Fatalf("expected 100 items, got %d", n)
+	}
+	if v, ok := smap.Get("42"); !ok || v != 42 {
+		t.Errorf("expected 42, got %v", v)
+	}
+
+	if smap.SetIfAbsent("42", 0) || !smap.SetIfAbsent("100", 100) {
+		t.Error("expected only the absent key to be set")
+	}
+	smap.Update("42", func(v interface{}, ok bool) interface{} { return v.(int) + 1 })
+	smap.Update("43", func(v interface{}, ok bool) interface{} { return nil })
+	if v, _ := smap.Get("42"); v != 43 || smap.Has("43") {
+		t.Errorf("unexpected updates %v, %v", v, smap.Has("43"))
+	}
+
+	smap.DeleteMulti([]string{"0", "1"})
+	sum := 0
+	smap.Range(func(key string, v interface{}) bool {
+		sum += v.(int)
+		return true
+	})
+	if n := len(smap.Items()); n != 98 || sum != 4950+100-43+1-1 {
+		t.Errorf("unexpected items %d, sum %d", n, sum)
+	}
+
+	smap.Clear()
+	if smap.Len() != 0 {
+		t.Error("expected an empty map")
+	}
+}
+
+// BenchmarkSyncMap measures the throughput of concurrent inserts and
+// lookups, one insert for three lookups, as the transactions do.
+func BenchmarkSyncMap(b *testing.B) {
+	smap := newsyncMap()
+	keys := make([]string, 1<<16)
+	for i := range keys {
+		keys[i] = GetRandString(20)
+	}
+
+	var n uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddUint64(&n, 1)
+			key := keys[i%uint64(len(keys))]
+			if i%4 == 0 {
+				smap.Set(key, i)
+			} else {
+				smap.Get(key)
+			}
+		}
+	})
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "ops/s")
+}
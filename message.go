@@ -0,0 +1,94 @@
+package dhtlistener
+
+import "time"
+
+// QueryMsg is a krpc query. A is one of the *Args structs below, or a
+// map[string]interface{} for the queries of custom extensions.
+type QueryMsg struct {
+	T string      `bencode:"t"`
+	Y string      `bencode:"y"`
+	Q string      `bencode:"q"`
+	A interface{} `bencode:"a"`
+	V string      `bencode:"v,omitempty"` // client version, see DHT.Version
+}
+
+// ResponseMsg is a krpc response. R is one of the *Response structs below,
+// or a map[string]interface{} for the responses of custom extensions.
+type ResponseMsg struct {
+	T string      `bencode:"t"`
+	Y string      `bencode:"y"`
+	R interface{} `bencode:"r"`
+	V string      `bencode:"v,omitempty"`
+}
+
+// ErrorMsg is a krpc error, E holds the error code and message.
+type ErrorMsg struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	E []interface{} `bencode:"e"`
+	V string        `bencode:"v,omitempty"`
+}
+
+// rawMessage is a received krpc message whose body is decoded later, once
+// its type is known. The bodies of custom queries can be decoded into a
+// map[string]interface{}.
+type rawMessage struct {
+	T string     `bencode:"t"`
+	Y string     `bencode:"y"`
+	Q string     `bencode:"q"`
+	A RawMessage `bencode:"a"`
+	R RawMessage `bencode:"r"`
+	E RawMessage `bencode:"e"`
+	// IP is our compact address as seen by the sender (BEP 42).
+	IP string `bencode:"ip"`
+	// V is the client version of the sender, see version.
+	V RawMessage `bencode:"v"`
+
+	recvTime time.Time // when the packet was received
+}
+
+// PingArgs is the arguments of a ping query.
+type PingArgs struct {
+	ID string `bencode:"id"`
+}
+
+// FindNodeArgs is the arguments of a find_node query.
+type FindNodeArgs struct {
+	ID     string `bencode:"id"`
+	Target string `bencode:"target"`
+}
+
+// GetPeersArgs is the arguments of a get_peers query.
+type GetPeersArgs struct {
+	ID       string `bencode:"id"`
+	InfoHash string `bencode:"info_hash"`
+}
+
+// AnnouncePeerArgs is the arguments of an announce_peer query.
+type AnnouncePeerArgs struct {
+	ID          string `bencode:"id"`
+	InfoHash    string `bencode:"info_hash"`
+	ImpliedPort int    `bencode:"implied_port"`
+	Port        int    `bencode:"port"`
+	Token       string `bencode:"token"`
+}
+
+// PingResponse is the response to a ping or an announce_peer query.
+type PingResponse struct {
+	ID string `bencode:"id"`
+}
+
+// FindNodeResponse is the response to a find_node query.
+type FindNodeResponse struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"`
+}
+
+// GetPeersResponse is the response to a get_peers query, it holds either
+// Values or Nodes.
+type GetPeersResponse struct {
+	ID     string   `bencode:"id"`
+	Token  string   `bencode:"token"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+}
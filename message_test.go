@@ -0,0 +1,77 @@
+package dhtlistener
+
+import (
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	data, err := Marshal(makeQuery("aa", getPeersType, &GetPeersArgs{
+		ID:       "abcdefghij0123456789",
+		InfoHash: "mnopqrstuvwxyz123456",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &rawMessage{}
+	if err := Unmarshal(data, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.T != "aa" || msg.Y != "q" || msg.Q != getPeersType {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	var a GetPeersArgs
+	if err := Unmarshal(msg.A, &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.ID != "abcdefghij0123456789" || a.InfoHash != "mnopqrstuvwxyz123456" {
+		t.Fatalf("unexpected args %+v", a)
+	}
+
+	// the map-based path of custom extensions.
+	var m map[string]interface{}
+	if err := Unmarshal(msg.A, &m); err != nil || m["info_hash"] != a.InfoHash {
+		t.Fatalf("unexpected map %v, %v", m, err)
+	}
+}
+
+func TestMessageMalformed(t *testing.T) {
+	cases := []string{
+		"d1:ti1e1:y1:qe",
+		"d1:t2:aa1:y1:q1:q4:ping1:ali1eee",
+		"d1:t2:aa1:y1:q1:q4:ping1:ad2:idi1eee",
+	}
+
+	for _, c := range cases {
+		msg := &rawMessage{}
+		if err := Unmarshal([]byte(c), msg); err != nil {
+			continue
+		}
+		var a PingArgs
+		if err := Unmarshal(msg.A, &a); err == nil {
+			t.Errorf("%q: expected an error", c)
+		}
+	}
+}
+
+func TestMessageEncodeAllocs(t *testing.T) {
+	msg := makeResponse("aa", &GetPeersResponse{
+		ID:    "abcdefghij0123456789",
+		Token: "token",
+		Nodes: "nodes",
+	})
+	buf := make([]byte, 0, 1024)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, _ = AppendEncode(buf[:0], msg)
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocation, got %v", allocs)
+	}
+
+	expected := "d1:rd2:id20:abcdefghij01234567895:nodes5:nodes5:token5:tokene1:t2:aa1:y1:re"
+	if string(buf) != expected {
+		t.Fatalf("expected %s, got %s", expected, buf)
+	}
+}
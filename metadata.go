@@ -0,0 +1,59 @@
+package dhtlistener
+
+import (
+	"net"
+	"time"
+)
+
+// EventMetadataReceived is published when the metadata of an announced
+// infohash is downloaded.
+const EventMetadataReceived EventType = EventErrorReceived + 1
+
+// MetadataReceived is the event of downloaded metadata info.
+type MetadataReceived struct {
+	InfoHash InfoHash
+	IP       string
+	Port     int
+	Name     string
+	Size     int
+	Files    []File
+	Metadata []byte // the bencoded info dictionary
+	Info     *TorrentInfo
+	Time     time.Time
+	Geo      *GeoInfo // of IP, see GeoIP
+}
+
+// Type implements Event.
+func (MetadataReceived) Type() EventType { return EventMetadataReceived }
+
+// requestMetadata schedules the download of infoHash's metadata from the
+// announcing peer. It never blocks.
+func (dht *DHT) requestMetadata(infoHash string, ip net.IP, port int) {
+	if dht.fetcher != nil {
+		dht.fetcher.add(infoHash, ip.String(), port)
+	}
+}
+
+// dispatchMetadata publishes the metadata downloaded by the fetcher.
+func (dht *DHT) dispatchMetadata(resp Response) {
+	info, err := ParseTorrentInfo(resp.InfoHash, resp.MetadataInfo)
+	if err != nil {
+		dht.Logger.Debug("invalid metadata info", F("ip", resp.IP), F("err", err))
+		return
+	}
+
+	dht.publish(EventMetadataReceived, func() Event {
+		return MetadataReceived{
+			InfoHash: InfoHash(resp.InfoHash),
+			IP:       resp.IP,
+			Port:     resp.Port,
+			Name:     info.Name,
+			Size:     info.Length,
+			Files:    info.Files,
+			Info:     info,
+			Metadata: resp.MetadataInfo,
+			Time:     time.Now(),
+			Geo:      dht.geo(net.ParseIP(resp.IP)),
+		}
+	})
+}
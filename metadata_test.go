@@ -0,0 +1,46 @@
+package dhtlistener
+
+import (
+	"crypto/sha1"
+	"testing"
+)
+
+func TestParseTorrentInfo(t *testing.T) {
+	single := []byte("d6:lengthi42e4:name5:a.txt12:piece lengthi16384e6:pieces0:e")
+	sum := sha1.Sum(single)
+
+	info, err := ParseTorrentInfo(sum[:], single)
+	if err != nil || info.Name != "a.txt" || info.Length != 42 ||
+		info.PieceLength != 16384 || len(info.Files) != 1 {
+		t.Fatal(info, err)
+	}
+
+	if _, err = ParseTorrentInfo(make([]byte, 20), single); err == nil {
+		t.Fatal("info hash mismatch accepted")
+	}
+
+	multi := []byte("d5:filesld6:lengthi1e4:pathl1:a1:beed6:lengthi2e4:pathl1:ceee" +
+		"4:name3:dir12:piece lengthi16384e6:pieces0:e")
+	info, err = parseTorrentInfo(multi)
+	if err != nil || info.Name != "dir" || info.Length != 3 || len(info.Files) != 2 ||
+		len(info.Files[0].Path) != 2 || info.Files[1].Path[0] != "c" {
+		t.Fatal(info, err)
+	}
+
+	if _, err = parseTorrentInfo([]byte("d4:name3:dir12:piece lengthi1e6:pieces0:e")); err == nil {
+		t.Fatal("info without length accepted")
+	}
+}
+
+func TestTorrent(t *testing.T) {
+	info := &TorrentInfo{Raw: []byte("d4:name1:ae")}
+
+	if s := string(info.Torrent()); s != "d4:infod4:name1:aee" {
+		t.Fatal(s)
+	}
+
+	out := "d8:announce5:udp:/13:announce-listll5:udp:/el5:udp:xee4:infod4:name1:aee"
+	if s := string(info.Torrent("udp:/", "udp:x")); s != out {
+		t.Fatal(s)
+	}
+}
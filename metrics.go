@@ -0,0 +1,364 @@
+package dhtlistener
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// counterVec represents a group of counters partitioned by a label.
+type counterVec struct {
+	sync.RWMutex
+	values map[string]*uint64
+}
+
+// newCounterVec returns a new counterVec pointer.
+func newCounterVec() *counterVec {
+	return &counterVec{
+		values: make(map[string]*uint64),
+	}
+}
+
+// Add adds delta to the counter labeled label.
+func (cv *counterVec) Add(label string, delta uint64) {
+	cv.RLock()
+	v, ok := cv.values[label]
+	cv.RUnlock()
+
+	if !ok {
+		cv.Lock()
+		if v, ok = cv.values[label]; !ok {
+			v = new(uint64)
+			cv.values[label] = v
+		}
+		cv.Unlock()
+	}
+
+	atomic.AddUint64(v, delta)
+}
+
+// Inc increases the counter labeled label by one.
+func (cv *counterVec) Inc(label string) {
+	cv.Add(label, 1)
+}
+
+// Get returns the value of the counter labeled label.
+func (cv *counterVec) Get(label string) uint64 {
+	cv.RLock()
+	defer cv.RUnlock()
+
+	if v, ok := cv.values[label]; ok {
+		return atomic.LoadUint64(v)
+	}
+	return 0
+}
+
+// Snapshot returns the current values of all counters.
+func (cv *counterVec) Snapshot() map[string]uint64 {
+	cv.RLock()
+	defer cv.RUnlock()
+
+	ret := make(map[string]uint64, len(cv.values))
+	for k, v := range cv.values {
+		ret[k] = atomic.LoadUint64(v)
+	}
+	return ret
+}
+
+// histogram counts observations into cumulative buckets.
+type histogram struct {
+	sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// newHistogram returns a histogram with the given upper bounds, which
+// should be in increasing order.
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+// Observe adds an observation.
+func (h *histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// metrics holds the runtime counters of a DHT.
+type metrics struct {
+	packetsIn        *counterVec // message type : packets
+	packetsOut       *counterVec // message type : packets
+	clients          *counterVec // client name : packets in
+	clientsOut       *counterVec // client name : packets out
+	responses        *counterVec // query type : responses
+	timeouts         *counterVec // query type : timeouts
+	bytesIn          uint64
+	bytesOut         uint64
+	lastIn           int64 // unix nano of the last packet received
+	lastOut          int64 // unix nano of the last packet sent
+	lastQuery        int64 // unix nano of the last query received
+	transStarted     uint64
+	transTimeout     uint64
+	worksDropped     uint64
+	utpDropped       uint64     // uTP packets dropped by the full queue
+	spoofed          uint64     // responses not matching their query
+	transactionTimes *histogram // seconds
+	started          time.Time  // set once the dht runs
+}
+
+// newMetrics returns a new metrics pointer.
+func newMetrics() *metrics {
+	return &metrics{
+		packetsIn:  newCounterVec(),
+		packetsOut: newCounterVec(),
+		clients:    newCounterVec(),
+		clientsOut: newCounterVec(),
+		responses:  newCounterVec(),
+		timeouts:   newCounterVec(),
+		transactionTimes: newHistogram(
+			0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15, 30),
+	}
+}
+
+// messageType returns the metric label of a krpc message of type y, it's
+// the query type q for queries, "response" or "error" otherwise.
+func messageType(y, q string) string {
+	switch y {
+	case "q":
+		switch q {
+		case pingType, findNodeType, getPeersType, announcePeerType, sampleInfoHashesType,
+			getType, putType:
+			return q
+		}
+		return "unknown"
+	case "r":
+		return "response"
+	case "e":
+		return "error"
+	default:
+		return "invalid"
+	}
+}
+
+// promWriter writes metrics in the Prometheus text exposition format.
+type promWriter struct {
+	*bufio.Writer
+}
+
+func (w promWriter) header(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (w promWriter) value(name string, v interface{}) {
+	fmt.Fprintf(w, "%s %v\n", name, v)
+}
+
+func (w promWriter) labeled(name, label string, vals map[string]uint64) {
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, vals[k])
+	}
+}
+
+func (w promWriter) histogram(name string, h *histogram) {
+	h.Lock()
+	defer h.Unlock()
+
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
+
+// writeMetrics writes all metrics of dht to w.
+func (dht *DHT) writeMetrics(w promWriter) {
+	m := dht.metrics
+
+	w.header("dht_packets_in_total", "counter", "Packets received by message type.")
+	w.labeled("dht_packets_in_total", "type", m.packetsIn.Snapshot())
+
+	w.header("dht_packets_out_total", "counter", "Packets sent by message type.")
+	w.labeled("dht_packets_out_total", "type", m.packetsOut.Snapshot())
+
+	w.header("dht_packets_in_by_client_total", "counter", "Packets received by client.")
+	w.labeled("dht_packets_in_by_client_total", "client", m.clients.Snapshot())
+
+	w.header("dht_packets_out_by_client_total", "counter", "Packets sent by client.")
+	w.labeled("dht_packets_out_by_client_total", "client", m.clientsOut.Snapshot())
+
+	w.header("dht_bytes_in_total", "counter", "Bytes received.")
+	w.value("dht_bytes_in_total", atomic.LoadUint64(&m.bytesIn))
+
+	w.header("dht_bytes_out_total", "counter", "Bytes sent.")
+	w.value("dht_bytes_out_total", atomic.LoadUint64(&m.bytesOut))
+
+	w.header("dht_responses_total", "counter", "Responses received by query type.")
+	w.labeled("dht_responses_total", "type", m.responses.Snapshot())
+
+	w.header("dht_timeouts_total", "counter", "Queries timed out by query type.")
+	w.labeled("dht_timeouts_total", "type", m.timeouts.Snapshot())
+
+	queries := dht.QueryStats()
+	types := make([]string, 0, len(queries))
+	for q := range queries {
+		types = append(types, q)
+	}
+	sort.Strings(types)
+	w.header("dht_query_success_ratio", "gauge", "Recent fraction of the transactions answered by query type.")
+	for _, q := range types {
+		fmt.Fprintf(w, "dht_query_success_ratio{type=%q} %g\n", q, queries[q].SuccessRate)
+	}
+	w.header("dht_query_tries", "gauge", "Times the next query is sent by query type.")
+	for _, q := range types {
+		fmt.Fprintf(w, "dht_query_tries{type=%q} %d\n", q, queries[q].Tries)
+	}
+
+	w.header("dht_transactions_started_total", "counter", "Transactions started.")
+	w.value("dht_transactions_started_total", atomic.LoadUint64(&m.transStarted))
+
+	w.header("dht_transactions_timeout_total", "counter", "Transactions timed out.")
+	w.value("dht_transactions_timeout_total", atomic.LoadUint64(&m.transTimeout))
+
+	w.header("dht_spoofed_responses_total", "counter", "Responses dropped because they didn't match their query.")
+	w.value("dht_spoofed_responses_total", dht.SpoofedResponses())
+
+	w.header("dht_works_dropped_total", "counter", "Packets dropped because the queue is full.")
+	w.value("dht_works_dropped_total", atomic.LoadUint64(&m.worksDropped))
+
+	w.header("dht_utp_dropped_total", "counter", "uTP packets dropped because the UTPConn queue is full.")
+	w.value("dht_utp_dropped_total", atomic.LoadUint64(&m.utpDropped))
+
+	v := dht.VerifyStats()
+	w.header("dht_peer_verifications_total", "counter", "Peer verifications by result.")
+	w.labeled("dht_peer_verifications_total", "result", map[string]uint64{
+		"verified": v.Verified,
+		"failed":   v.Failed,
+		"dropped":  v.Dropped,
+	})
+
+	w.header("dht_transaction_duration_seconds", "histogram", "Time until a transaction is answered.")
+	w.histogram("dht_transaction_duration_seconds", m.transactionTimes)
+
+	// the following are only available once the dht runs.
+	if !dht.initialized() {
+		return
+	}
+
+	w.header("dht_uptime_seconds", "gauge", "Time since the dht runs.")
+	w.value("dht_uptime_seconds", dht.now().Sub(m.started).Seconds())
+
+	w.header("dht_queries_throttled_total", "counter", "Queries dropped by the rate limits.")
+	w.value("dht_queries_throttled_total", dht.ThrottledQueries())
+	w.header("dht_callbacks_dropped_total", "counter", "Callbacks dropped because the callback queue was full.")
+	w.value("dht_callbacks_dropped_total", dht.DroppedCallbacks())
+	w.header("dht_callback_lag_seconds", "gauge", "Time the last callback waited in the callback queue.")
+	w.value("dht_callback_lag_seconds", dht.CallbackLag().Seconds())
+	w.header("dht_announces_throttled_total", "counter", "Announces rejected by the announce rate limit.")
+	w.value("dht_announces_throttled_total", dht.ThrottledAnnounces())
+
+	w.header("dht_packet_queue_length", "gauge", "Received packets waiting for workers.")
+	w.value("dht_packet_queue_length", dht.queue.len())
+
+	w.header("dht_query_queue_length", "gauge", "Queries waiting to be sent.")
+	w.value("dht_query_queue_length", len(dht.transacts.queryChan)+dht.transacts.sched.len())
+
+	w.header("dht_query_window", "gauge", "Max queries in flight after timeouts, 0 if not limited.")
+	w.value("dht_query_window", dht.QueryWindow())
+
+	w.header("dht_queries_dropped_total", "counter", "Queries dropped because the query queue is full.")
+	w.value("dht_queries_dropped_total", dht.DroppedQueries())
+
+	w.header("dht_transactions", "gauge", "Transactions requesting.")
+	w.value("dht_transactions", dht.transacts.len())
+
+	w.header("dht_transactions_peak", "gauge", "Max transactions requesting at once.")
+	w.value("dht_transactions_peak", dht.transacts.peakLen())
+
+	w.header("dht_queries_rejected_total", "counter", "Queries dropped because MaxTransactions are requesting.")
+	w.value("dht_queries_rejected_total", atomic.LoadUint64(&dht.transacts.rejected))
+
+	w.header("dht_peers_stored", "gauge", "Peers stored.")
+	w.value("dht_peers_stored", dht.peers.Count())
+
+	if pm, ok := dht.peers.(*peersManager); ok {
+		w.header("dht_infohashes_stored", "gauge", "Infohashes having peers stored.")
+		w.value("dht_infohashes_stored", pm.InfoHashes())
+
+		w.header("dht_peers_evicted_total", "counter", "Peers evicted by the per-infohash cap.")
+		w.value("dht_peers_evicted_total", pm.Evicted())
+	}
+
+	all := dht.rt.Buckets()
+	buckets, full := make(map[string]uint64), 0
+	for _, bucket := range all {
+		if n := bucket.Len(); n != 0 {
+			buckets[fmt.Sprintf("%03d", bucket.idx)] = uint64(n)
+		}
+		if bucket.Len() >= dht.K {
+			full++
+		}
+	}
+	w.header("dht_routing_table_nodes", "gauge", "Nodes in the routing table by bucket.")
+	w.labeled("dht_routing_table_nodes", "bucket", buckets)
+
+	coverage, depth := bucketCoverage(all)
+	w.header("dht_routing_table_buckets", "gauge", "Buckets of the routing table.")
+	w.value("dht_routing_table_buckets", len(all))
+	w.header("dht_routing_table_full_buckets", "gauge", "Buckets of the routing table holding K nodes.")
+	w.value("dht_routing_table_full_buckets", full)
+	w.header("dht_routing_table_depth", "gauge", "Depth of the bucket holding our id.")
+	w.value("dht_routing_table_depth", depth)
+	w.header("dht_keyspace_coverage", "gauge", "Fraction of the keyspace whose bucket holds nodes.")
+	w.value("dht_keyspace_coverage", coverage)
+}
+
+// bucketCoverage returns the fraction of the keyspace whose bucket holds
+// nodes, and the depth of the bucket holding our id, the only one whose
+// prefix length shared with our id is its depth.
+func bucketCoverage(buckets []*bucket) (coverage float64, depth int) {
+	for _, bucket := range buckets {
+		if bucket.Len() != 0 {
+			coverage += math.Ldexp(1, -bucket.depth)
+		}
+		if bucket.idx == bucket.depth {
+			depth = bucket.depth
+		}
+	}
+	return
+}
+
+// MetricsHandler returns a http.Handler which exposes the metrics of dht in
+// the Prometheus text format, mount it on your own mux.
+func (dht *DHT) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		w := promWriter{bufio.NewWriter(rw)}
+		dht.writeMetrics(w)
+		w.Flush()
+	})
+}
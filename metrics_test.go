@@ -0,0 +1,87 @@
+package dhtlistener
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	addr := client.LocalAddr().(*net.UDPAddr)
+
+	// a ping and an unknown query received, the ping answered.
+	for _, q := range []string{pingType, "vote"} {
+		data, _ := Marshal(makeQuery("aa", q, &PingArgs{ID: "abcdefghij0123456789"}))
+		handle(dht, packet{data: data, raddr: addr, recvTime: time.Now()})
+	}
+	dht.metrics.transactionTimes.Observe(0.3)
+
+	rec := httptest.NewRecorder()
+	dht.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+	for _, line := range []string{
+		`dht_packets_in_total{type="ping"} 1`,
+		`dht_packets_in_total{type="unknown"} 1`,
+		`dht_packets_out_total{type="response"} 1`,
+		`dht_transaction_duration_seconds_bucket{le="0.25"} 0`,
+		`dht_transaction_duration_seconds_bucket{le="0.5"} 1`,
+		`dht_transaction_duration_seconds_count 1`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatal(line, body)
+		}
+	}
+}
+
+func TestBucketCoverage(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.K = 1
+	dht.MaxIDsPerIP = 0
+	dht.init()
+	defer dht.conn.Close()
+
+	// the trie splits down to depth 4, the buckets above being empty.
+	for _, idx := range []int{3, 5} {
+		no, _ := newNode(dht.randomChildID(idx), "udp", "127.0.0.1:6881", time.Now())
+		if !dht.rt.Insert(no) {
+			t.Fatal("insert failed", idx)
+		}
+	}
+
+	coverage, depth := bucketCoverage(dht.rt.Buckets())
+	if coverage != 0.125 || depth != 4 {
+		t.Errorf("expected a coverage of 0.125 at depth 4, got %v at %d", coverage, depth)
+	}
+
+	rec := httptest.NewRecorder()
+	dht.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"dht_routing_table_buckets 5",
+		"dht_routing_table_full_buckets 2",
+		"dht_routing_table_depth 4",
+		"dht_keyspace_coverage 0.125",
+	} {
+		if !strings.Contains(body, line) {
+			t.Error(line, body)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package dhtlistener
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// mutableTorrent is the value of the BEP 46 items, see
+// http://www.bittorrent.org/beps/bep_0046.html.
+type mutableTorrent struct {
+	InfoHash string `bencode:"ih"`
+}
+
+// InfohashUpdate is a new version of a mutable torrent followed by
+// FollowMutableTorrent.
+type InfohashUpdate struct {
+	InfoHash InfoHash
+	Seq      int64
+	Time     time.Time
+}
+
+// MutableMagnet returns the magnet link of the mutable torrent of pubkey.
+func MutableMagnet(pubkey ed25519.PublicKey) string {
+	return "magnet:?xs=urn:btpk:" + hex.EncodeToString(pubkey)
+}
+
+// PublishMutableTorrent publishes infoHash, raw or hex encoded, as the
+// version seq of the mutable torrent of key, seq growing with every update.
+// It puts the BEP 46 item like PutItem, returning the number of nodes
+// storing it, then republishes it until the next version.
+func (dht *DHT) PublishMutableTorrent(key ed25519.PrivateKey, infoHash string, seq int64) (int, error) {
+	infoHash, err := rawInfoHash(infoHash)
+	if err != nil {
+		return 0, err
+	}
+	it, err := NewMutableItem(key, "", seq, &mutableTorrent{infoHash})
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), itemLookupTime*2)
+	defer cancel()
+	n, err := dht.PutItem(ctx, it)
+	if err != nil {
+		return 0, err
+	}
+	return n, dht.Republish(it)
+}
+
+// followInterval returns how often the followed mutable torrents are looked
+// up.
+func (dht *DHT) followInterval() time.Duration {
+	if dht.FollowInterval > 0 {
+		return dht.FollowInterval
+	}
+	return time.Minute * 10
+}
+
+// FollowMutableTorrent looks up the mutable torrent of pubkey now and every
+// FollowInterval, and sends its new versions to the returned chan, which
+// keeps the latest one if it's not read. It's closed by
+// UnfollowMutableTorrent or Close. The dht must be running.
+func (dht *DHT) FollowMutableTorrent(pubkey ed25519.PublicKey) (<-chan InfohashUpdate, error) {
+	if len(pubkey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key")
+	}
+	if !dht.initialized() {
+		return nil, errNotRunning
+	}
+	if dht.Router {
+		return nil, errRouter
+	}
+
+	key := string(pubkey)
+	stop := make(chan struct{})
+	dht.followMu.Lock()
+	if _, ok := dht.follows[key]; ok {
+		dht.followMu.Unlock()
+		return nil, errors.New("already followed")
+	}
+	if dht.follows == nil {
+		dht.follows = make(map[string]chan struct{})
+	}
+	dht.follows[key] = stop
+	dht.followMu.Unlock()
+
+	updates := make(chan InfohashUpdate, 1)
+	dht.spawn(func() {
+		defer close(updates)
+
+		ticker := dht.Clock.NewTicker(dht.followInterval())
+		defer ticker.Stop()
+
+		last := int64(-1)
+		for {
+			if u, ok := dht.lookupMutableTorrent(pubkey); ok && u.Seq > last {
+				last = u.Seq
+				// the latest version replaces the unread one.
+				select {
+				case <-updates:
+				default:
+				}
+				updates <- u
+			}
+
+			select {
+			case <-ticker.C():
+			case <-stop:
+				return
+			case <-dht.done:
+				return
+			}
+		}
+	})
+	return updates, nil
+}
+
+// UnfollowMutableTorrent stops following the mutable torrent of pubkey. It
+// returns whether it was followed.
+func (dht *DHT) UnfollowMutableTorrent(pubkey ed25519.PublicKey) bool {
+	dht.followMu.Lock()
+	defer dht.followMu.Unlock()
+
+	stop, ok := dht.follows[string(pubkey)]
+	if ok {
+		close(stop)
+		delete(dht.follows, string(pubkey))
+	}
+	return ok
+}
+
+// lookupMutableTorrent returns the latest version of the mutable torrent of
+// pubkey, false if none is found.
+func (dht *DHT) lookupMutableTorrent(pubkey ed25519.PublicKey) (InfohashUpdate, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), itemLookupTime*2)
+	defer cancel()
+
+	it, err := dht.GetItem(ctx, MutableTarget(pubkey, ""), "")
+	if err != nil {
+		dht.Logger.Debug("mutable torrent lookup failed",
+			F("key", hex.EncodeToString(pubkey)), F("err", err))
+		return InfohashUpdate{}, false
+	}
+
+	var v mutableTorrent
+	if err := it.Value(&v); err != nil || len(v.InfoHash) != hash_size {
+		dht.Logger.Debug("invalid mutable torrent", F("key", hex.EncodeToString(pubkey)))
+		return InfohashUpdate{}, false
+	}
+	return InfohashUpdate{InfoHash(v.InfoHash), it.Seq, dht.now()}, true
+}
@@ -0,0 +1,111 @@
+package dhtlistener
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMutableTorrent(t *testing.T) {
+	mem := &memNet{}
+	addrA := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	addrB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+
+	a, err := New(WithTransport(mem.listen(addrA)), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(WithTransport(mem.listen(addrB)), WithBootstrapNodes(addrA.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+	b.Clock = clock // the lookups of b end by Advance
+	// shorter than the periodic tasks of b, which may drop a.
+	b.FollowInterval = 2 * itemLookupTime
+
+	for _, dht := range []*DHT{a, b} {
+		dht.rt = newRouteTable(dht) // before Run, read below
+		go dht.Run()
+		defer func(dht *DHT) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			dht.Close(ctx)
+		}(dht)
+	}
+	if !waitUntil(func() bool { return hasNode(b, addrA.String()) }) {
+		t.Fatal("b should join a")
+	}
+
+	pub, key, _ := ed25519.GenerateKey(nil)
+	target := MutableTarget(pub, "")
+	// lookedUp tells whether a answered the lookup of b.
+	lookedUp := func() bool {
+		b.itemLookups.Lock()
+		defer b.itemLookups.Unlock()
+		l := b.itemLookups.pending[target]
+		return l != nil && len(l.tokens) != 0
+	}
+
+	ih1, ih2 := GetRandString(20), GetRandString(20)
+	type result struct {
+		n   int
+		err error
+	}
+	published := make(chan result, 1)
+	go func() {
+		n, err := b.PublishMutableTorrent(key, ih1, 1)
+		published <- result{n, err}
+	}()
+	if !waitUntil(lookedUp) {
+		t.Fatal("b should look up a")
+	}
+	clock.Advance(itemLookupTime)
+	if r := <-published; r.n != 1 || r.err != nil {
+		t.Fatalf("expected ih1 published on a, got %d, %v", r.n, r.err)
+	}
+	if it := a.items.get(target); it == nil || it.Seq != 1 {
+		t.Fatalf("expected a to store seq 1, got %v", it)
+	}
+	if b.republished[target] == nil {
+		t.Error("expected b to republish ih1")
+	}
+
+	updates, err := b.FollowMutableTorrent(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func(ih string, seq int64) {
+		t.Helper()
+		if !waitUntil(lookedUp) {
+			t.Fatal("b should look up a")
+		}
+		clock.Advance(itemLookupTime)
+		select {
+		case u := <-updates:
+			if u.InfoHash.RawString() != ih || u.Seq != seq {
+				t.Errorf("expected seq %d, got %+v", seq, u)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected seq %d", seq)
+		}
+	}
+	next(ih1, 1)
+
+	it, _ := NewMutableItem(key, "", 2, &mutableTorrent{ih2})
+	a.items.put(it, nil, time.Now().Add(time.Hour), 10)
+	clock.Advance(b.followInterval() - itemLookupTime)
+	next(ih2, 2)
+
+	if !b.UnfollowMutableTorrent(pub) {
+		t.Error("expected pub followed")
+	}
+	if !waitUntil(func() bool {
+		_, ok := <-updates
+		return !ok
+	}) {
+		t.Error("expected the updates closed")
+	}
+}
@@ -0,0 +1,47 @@
+package nat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// defaultGateway returns the ipv4 default gateway read from /proc/net/route.
+func defaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseRoutes(f)
+}
+
+// parseRoutes returns the ipv4 default gateway of the routing table r, in
+// the format of /proc/net/route.
+func parseRoutes(r io.Reader) (net.IP, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ..., in little endian hex.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+		if !ip.IsUnspecified() {
+			return ip, nil
+		}
+	}
+	return nil, errNoGateway
+}
@@ -0,0 +1,22 @@
+package nat
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0000A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+eth0	00000000	0100A8C0	0003	0	0	0	00000000	0	0	0
+`
+	ip, err := parseRoutes(strings.NewReader(routes))
+	if err != nil || !ip.Equal(net.IPv4(192, 168, 0, 1)) {
+		t.Fatalf("expected 192.168.0.1, got %v, %v", ip, err)
+	}
+
+	if _, err := parseRoutes(strings.NewReader(strings.SplitN(routes, "\n", 3)[1])); err != errNoGateway {
+		t.Fatalf("expected errNoGateway, got %v", err)
+	}
+}
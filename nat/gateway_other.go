@@ -0,0 +1,13 @@
+//go:build !linux
+
+package nat
+
+import (
+	"net"
+)
+
+// defaultGateway is only implemented on Linux, use NewPMP with the gateway
+// ip elsewhere.
+func defaultGateway() (net.IP, error) {
+	return nil, errNoGateway
+}
@@ -0,0 +1,43 @@
+// Package nat maps ports of the local gateway with NAT-PMP or UPnP-IGD, so
+// a dht behind a consumer router is reachable. Its mappers implement
+// dhtlistener.PortMapper:
+//
+//	mapper, err := nat.Discover(ctx)
+//	if err == nil {
+//		d.PortMapper = mapper
+//	}
+package nat
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Mapper maps ports of a gateway.
+type Mapper interface {
+	// AddPortMapping maps the external port of the gateway to the internal
+	// port of this host for lifetime, and returns the external port the
+	// gateway picked. protocol is "udp" or "tcp".
+	AddPortMapping(protocol string, internal, external int, lifetime time.Duration) (int, error)
+	// DeletePortMapping removes a mapping made by AddPortMapping.
+	DeletePortMapping(protocol string, internal, external int) error
+	// ExternalIP returns the ip of the gateway on the internet.
+	ExternalIP() (net.IP, error)
+}
+
+var errNoGateway = errors.New("no default gateway")
+
+// Discover returns a Mapper of the local gateway, it tries NAT-PMP then
+// UPnP-IGD.
+func Discover(ctx context.Context) (Mapper, error) {
+	if gateway, err := defaultGateway(); err == nil {
+		pmp := NewPMP(gateway)
+		if _, err := pmp.ExternalIP(); err == nil {
+			return pmp, nil
+		}
+	}
+
+	return DiscoverUPnP(ctx)
+}
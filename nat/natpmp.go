@@ -0,0 +1,114 @@
+package nat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	pmpPort    = 5351
+	pmpTries   = 4
+	pmpTimeout = time.Millisecond * 250
+)
+
+var errPMPTimeout = errors.New("nat-pmp gateway does not respond")
+
+// PMP is a NAT-PMP (RFC 6886) client of a gateway.
+type PMP struct {
+	sync.Mutex // one request at a time
+	gateway    *net.UDPAddr
+}
+
+// NewPMP returns a new PMP pointer of the gateway ip.
+func NewPMP(gateway net.IP) *PMP {
+	return &PMP{gateway: &net.UDPAddr{IP: gateway, Port: pmpPort}}
+}
+
+// request sends msg and returns the response of the gateway, retrying with
+// doubling timeouts.
+func (p *PMP) request(msg []byte, size int) ([]byte, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	conn, err := net.DialUDP("udp4", nil, p.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf, timeout := make([]byte, 16), pmpTimeout
+	for i := 0; i < pmpTries; i++ {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(timeout)
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if n < size || buf[0] != 0 || buf[1] != msg[1]|0x80 {
+				continue
+			}
+
+			if code := binary.BigEndian.Uint16(buf[2:]); code != 0 {
+				return nil, fmt.Errorf("nat-pmp result code %d", code)
+			}
+			return buf[:n], nil
+		}
+		timeout *= 2
+	}
+	return nil, errPMPTimeout
+}
+
+// ExternalIP implements Mapper.
+func (p *PMP) ExternalIP() (net.IP, error) {
+	resp, err := p.request([]byte{0, 0}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+// pmpOp returns the opcode mapping protocol.
+func pmpOp(protocol string) (byte, error) {
+	switch protocol {
+	case "udp":
+		return 1, nil
+	case "tcp":
+		return 2, nil
+	}
+	return 0, errors.New("unknown protocol " + protocol)
+}
+
+// AddPortMapping implements Mapper.
+func (p *PMP) AddPortMapping(protocol string, internal, external int, lifetime time.Duration) (int, error) {
+	op, err := pmpOp(protocol)
+	if err != nil {
+		return 0, err
+	}
+
+	msg := make([]byte, 12)
+	msg[1] = op
+	binary.BigEndian.PutUint16(msg[4:], uint16(internal))
+	binary.BigEndian.PutUint16(msg[6:], uint16(external))
+	binary.BigEndian.PutUint32(msg[8:], uint32(lifetime/time.Second))
+
+	resp, err := p.request(msg, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(resp[10:])), nil
+}
+
+// DeletePortMapping implements Mapper.
+func (p *PMP) DeletePortMapping(protocol string, internal, external int) error {
+	_, err := p.AddPortMapping(protocol, internal, 0, 0)
+	return err
+}
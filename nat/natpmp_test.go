@@ -0,0 +1,85 @@
+package nat
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakePMP is a NAT-PMP gateway answering on a local port.
+type fakePMP struct {
+	conn *net.UDPConn
+	code uint32 // result code of the mappings, accessed atomically
+}
+
+func newFakePMP(t *testing.T) *fakePMP {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakePMP{conn: conn}
+}
+
+func (g *fakePMP) serve() {
+	buf := make([]byte, 16)
+	for {
+		n, raddr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 2 {
+			continue
+		}
+
+		resp := make([]byte, 16)
+		resp[1] = buf[1] | 0x80
+		switch op := buf[1]; {
+		case op == 0 && n == 2:
+			copy(resp[8:], []byte{203, 0, 113, 7})
+			g.conn.WriteToUDP(resp[:12], raddr)
+		case (op == 1 || op == 2) && n == 12:
+			binary.BigEndian.PutUint16(resp[2:], uint16(atomic.LoadUint32(&g.code)))
+			copy(resp[8:10], buf[4:6]) // internal port
+			external := binary.BigEndian.Uint16(buf[6:])
+			if external == 0 {
+				external = 40000
+			}
+			binary.BigEndian.PutUint16(resp[10:], external)
+			copy(resp[12:], buf[8:12]) // lifetime
+			g.conn.WriteToUDP(resp, raddr)
+		}
+	}
+}
+
+func TestPMP(t *testing.T) {
+	g := newFakePMP(t)
+	defer g.conn.Close()
+	go g.serve()
+
+	p := &PMP{gateway: g.conn.LocalAddr().(*net.UDPAddr)}
+
+	ip, err := p.ExternalIP()
+	if err != nil || !ip.Equal(net.IPv4(203, 0, 113, 7)) {
+		t.Fatalf("expected 203.0.113.7, got %v, %v", ip, err)
+	}
+
+	if port, err := p.AddPortMapping("udp", 6881, 0, time.Hour); err != nil || port != 40000 {
+		t.Fatalf("expected the port picked by the gateway, got %d, %v", port, err)
+	}
+	if port, err := p.AddPortMapping("udp", 6881, 6881, time.Hour); err != nil || port != 6881 {
+		t.Fatalf("expected the requested port, got %d, %v", port, err)
+	}
+	if err := p.DeletePortMapping("udp", 6881, 6881); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.AddPortMapping("sctp", 6881, 6881, time.Hour); err == nil {
+		t.Fatal("expected an unknown protocol to fail")
+	}
+
+	atomic.StoreUint32(&g.code, 2) // not authorized
+	if _, err := p.AddPortMapping("udp", 6881, 6881, time.Hour); err == nil {
+		t.Fatal("expected the result code to fail the mapping")
+	}
+}
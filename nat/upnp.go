@@ -0,0 +1,289 @@
+package nat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ssdpAddr    = "239.255.255.250:1900"
+	ssdpTimeout = time.Second * 2
+)
+
+// upnpServices are the service types which map ports, preferred first.
+var upnpServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+var errNoUPnP = errors.New("no upnp internet gateway found")
+
+// UPnP is a UPnP-IGD client of a gateway.
+type UPnP struct {
+	controlURL string
+	service    string
+	localIP    net.IP
+	client     *http.Client
+}
+
+// upnpDevice is a device of a UPnP device description.
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// find returns the control url of the service, "" if none.
+func (d *upnpDevice) find(service string) string {
+	for _, s := range d.Services {
+		if s.ServiceType == service {
+			return s.ControlURL
+		}
+	}
+	for i := range d.Devices {
+		if u := d.Devices[i].find(service); u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+// DiscoverUPnP searches an internet gateway with SSDP until ctx is done or
+// for 2 seconds.
+func DiscoverUPnP(ctx context.Context) (*UPnP, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	raddr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, st := range []string{
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	} {
+		msg := "M-SEARCH * HTTP/1.1\r\nHOST: " + ssdpAddr + "\r\n" +
+			"ST: " + st + "\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\n\r\n"
+		if _, err := conn.WriteToUDP([]byte(msg), raddr); err != nil {
+			return nil, err
+		}
+	}
+
+	deadline := time.Now().Add(ssdpTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, errNoUPnP
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		resp.Body.Close()
+
+		if u, err := newUPnP(ctx, location); err == nil {
+			return u, nil
+		}
+	}
+}
+
+// newUPnP fetches the device description at location and returns a UPnP
+// pointer of its port mapping service.
+func newUPnP(ctx context.Context, location string) (*UPnP, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: time.Second * 5}
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root); err != nil {
+		return nil, err
+	}
+	if root.URLBase != "" {
+		if b, err := url.Parse(root.URLBase); err == nil {
+			base = b
+		}
+	}
+
+	for _, service := range upnpServices {
+		control := root.Device.find(service)
+		if control == "" {
+			continue
+		}
+
+		u, err := base.Parse(control)
+		if err != nil {
+			return nil, err
+		}
+
+		// the local ip is the one routing to the gateway.
+		conn, err := net.Dial("udp4", net.JoinHostPort(u.Hostname(), "1"))
+		if err != nil {
+			return nil, err
+		}
+		localIP := conn.LocalAddr().(*net.UDPAddr).IP
+		conn.Close()
+
+		return &UPnP{
+			controlURL: u.String(),
+			service:    service,
+			localIP:    localIP,
+			client:     client,
+		}, nil
+	}
+	return nil, errNoUPnP
+}
+
+// soap calls action with args, which are name and value pairs, and decodes
+// the response into ret if not nil.
+func (u *UPnP) soap(action string, args []string, ret interface{}) error {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, u.service)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&body, "<%s>", args[i])
+		xml.EscapeText(&body, []byte(args[i+1]))
+		fmt.Fprintf(&body, "</%s>", args[i])
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+
+	req, err := http.NewRequest("POST", u.controlURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+u.service+"#"+action+`"`)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var fault struct {
+			Code int `xml:"Body>Fault>detail>UPnPError>errorCode"`
+		}
+		xml.Unmarshal(data, &fault)
+		return &upnpError{action, resp.StatusCode, fault.Code}
+	}
+
+	if ret == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, ret)
+}
+
+// upnpError is a failed soap call.
+type upnpError struct {
+	action string
+	status int
+	code   int // upnp error code, 0 if unknown
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("upnp %s failed, status %d, error %d", e.action, e.status, e.code)
+}
+
+// ExternalIP implements Mapper.
+func (u *UPnP) ExternalIP() (net.IP, error) {
+	var ret struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := u.soap("GetExternalIPAddress", nil, &ret); err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(ret.IP))
+	if ip == nil {
+		return nil, errors.New("invalid external ip " + ret.IP)
+	}
+	return ip, nil
+}
+
+// AddPortMapping implements Mapper. The external port is the internal one
+// if 0, gateways only supporting permanent leases get one.
+func (u *UPnP) AddPortMapping(protocol string, internal, external int, lifetime time.Duration) (int, error) {
+	if external == 0 {
+		external = internal
+	}
+
+	add := func(lease time.Duration) error {
+		return u.soap("AddPortMapping", []string{
+			"NewRemoteHost", "",
+			"NewExternalPort", strconv.Itoa(external),
+			"NewProtocol", strings.ToUpper(protocol),
+			"NewInternalPort", strconv.Itoa(internal),
+			"NewInternalClient", u.localIP.String(),
+			"NewEnabled", "1",
+			"NewPortMappingDescription", "dhtlistener",
+			"NewLeaseDuration", strconv.Itoa(int(lease / time.Second)),
+		}, nil)
+	}
+
+	err := add(lifetime)
+	// 725 is OnlyPermanentLeasesSupported.
+	if e, ok := err.(*upnpError); ok && e.code == 725 {
+		err = add(0)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return external, nil
+}
+
+// DeletePortMapping implements Mapper.
+func (u *UPnP) DeletePortMapping(protocol string, internal, external int) error {
+	return u.soap("DeletePortMapping", []string{
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(external),
+		"NewProtocol", strings.ToUpper(protocol),
+	}, nil)
+}
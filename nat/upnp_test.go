@@ -0,0 +1,135 @@
+package nat
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const upnpDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL>
+</service></serviceList>
+</device></deviceList>
+</device></deviceList>
+</device>
+</root>`
+
+const soapFault = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>
+<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">
+<errorCode>%d</errorCode></UPnPError></detail>
+</s:Fault></s:Body></s:Envelope>`
+
+// fakeIGD is a UPnP internet gateway which only supports permanent
+// leases.
+type fakeIGD struct {
+	sync.Mutex
+	actions []string // the soap actions called, with their body
+}
+
+func (g *fakeIGD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/desc.xml":
+		io.WriteString(w, upnpDescription)
+		return
+	case "/ctl/IPConn":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	action := r.Header.Get("SOAPAction")
+	g.Lock()
+	g.actions = append(g.actions, action+" "+string(body))
+	g.Unlock()
+
+	switch {
+	case strings.HasSuffix(action, `#GetExternalIPAddress"`):
+		io.WriteString(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+<NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>
+</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+	case strings.HasSuffix(action, `#AddPortMapping"`) &&
+		!strings.Contains(string(body), "<NewLeaseDuration>0<"):
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, soapFault, 725) // OnlyPermanentLeasesSupported
+	case strings.HasSuffix(action, `#AddPortMapping"`),
+		strings.HasSuffix(action, `#DeletePortMapping"`):
+		io.WriteString(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body/></s:Envelope>`)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, soapFault, 401) // Invalid Action
+	}
+}
+
+func TestUPnP(t *testing.T) {
+	g := &fakeIGD{}
+	srv := httptest.NewServer(g)
+	defer srv.Close()
+
+	u, err := newUPnP(context.Background(), srv.URL+"/desc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.controlURL != srv.URL+"/ctl/IPConn" || u.service != upnpServices[1] {
+		t.Fatalf("unexpected service %s at %s", u.service, u.controlURL)
+	}
+
+	ip, err := u.ExternalIP()
+	if err != nil || !ip.Equal(net.IPv4(203, 0, 113, 7)) {
+		t.Fatalf("expected 203.0.113.7, got %v, %v", ip, err)
+	}
+
+	// the lease is made permanent when the gateway requires it.
+	port, err := u.AddPortMapping("udp", 6881, 0, time.Hour)
+	if err != nil || port != 6881 {
+		t.Fatalf("expected port 6881, got %d, %v", port, err)
+	}
+	if err := u.DeletePortMapping("udp", 6881, port); err != nil {
+		t.Fatal(err)
+	}
+
+	g.Lock()
+	actions := g.actions
+	g.Unlock()
+	if len(actions) != 4 || !strings.Contains(actions[1], "<NewLeaseDuration>3600<") ||
+		!strings.Contains(actions[2], "<NewLeaseDuration>0<") ||
+		!strings.Contains(actions[2], "<NewProtocol>UDP<") {
+		t.Fatalf("unexpected soap calls %q", actions)
+	}
+
+	err = u.soap("GetStatusInfo", nil, nil)
+	if e, ok := err.(*upnpError); !ok || e.code != 401 || e.status != http.StatusInternalServerError {
+		t.Fatalf("expected the upnp error code, got %v", err)
+	}
+}
+
+func TestUPnPNoService(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `<?xml version="1.0"?><root><device></device></root>`)
+	}))
+	defer srv.Close()
+
+	if _, err := newUPnP(context.Background(), srv.URL); err != errNoUPnP {
+		t.Fatalf("expected errNoUPnP, got %v", err)
+	}
+}
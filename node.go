@@ -4,18 +4,42 @@ import (
 	"errors"
 	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	// nodeGood is a node which has responded to one of our queries, or has
+	// ever responded and sent us a query, within the expire time.
+	nodeGood = iota
+	// nodeQuestionable is a node which has been silent for the expire time.
+	nodeQuestionable
+	// nodeBad is a node which failed to respond to multiple queries in a row.
+	nodeBad
+)
+
+// nodeMaxFailures is the number of failed queries in a row which makes a
+// node bad.
+const nodeMaxFailures = 2
+
 // node represents a DHT node.
 type node struct {
-	id             *hashid
+	sync.RWMutex
+	id             *HashID
 	addr           *net.UDPAddr
 	lastActiveTime time.Time
+	lastQuery      time.Time     // last time the node queried us
+	lastResponse   time.Time     // last time the node responded to our query
+	failures       int           // failed queries in a row
+	srtt           time.Duration // smoothed round-trip time, 0 if unknown
+	rttvar         time.Duration // round-trip time variation
+	queries        int           // queries we sent
+	responses      int           // responses to our queries
+	created        time.Time     // when the node was first seen
 }
 
-// newNode returns a node pointer.
-func newNode(id, network, address string) (*node, error) {
+// newNode returns a node pointer first seen at now.
+func newNode(id, network, address string, now time.Time) (*node, error) {
 	if len(id) != 20 {
 		return nil, errors.New("node id should be a 20-length string")
 	}
@@ -25,16 +49,22 @@ func newNode(id, network, address string) (*node, error) {
 		return nil, err
 	}
 
-	return &node{newHashId(id), addr, time.Now()}, nil
+	return &node{id: newHashId(id), addr: addr, lastActiveTime: now, created: now}, nil
 }
 
-func newRandomNodeFromUdpAddr(addr *net.UDPAddr) *node {
-	return &node{newHashId(GetRandString(20)), addr, time.Now()}
+func newRandomNodeFromUdpAddr(addr *net.UDPAddr, now time.Time) *node {
+	return &node{
+		id:             newHashId(GetRandString(20)),
+		addr:           addr,
+		lastActiveTime: now,
+		created:        now,
+	}
 }
 
-// newNodeFromCompactInfo parses compactNodeInfo and returns a node pointer.
+// newNodeFromCompactInfo parses compactNodeInfo and returns a node pointer
+// first seen at now.
 func newNodeFromCompactInfo(
-	compactNodeInfo string) (*node, error) {
+	compactNodeInfo string, now time.Time) (*node, error) {
 
 	if len(compactNodeInfo) != 26 {
 		return nil, errors.New("compactNodeInfo should be a 26-length string")
@@ -43,13 +73,22 @@ func newNodeFromCompactInfo(
 	id := compactNodeInfo[:20]
 	ip, port, _ := decodeCompactIPPortInfo(compactNodeInfo[20:])
 
-	return newNode(id, "udp", genAddress(ip.String(), port))
+	return newNode(id, "udp", genAddress(ip.String(), port), now)
+}
+
+// address returns the address of node, which update may change.
+func (node *node) address() *net.UDPAddr {
+	node.RLock()
+	defer node.RUnlock()
+
+	return node.addr
 }
 
 // CompactIPPortInfo returns "Compact IP-address/port info".
 // See http://www.bittorrent.org/beps/bep_0005.html.
 func (node *node) CompactIPPortInfo() string {
-	info, _ := encodeCompactIPPortInfo(node.addr.IP, node.addr.Port)
+	addr := node.address()
+	info, _ := encodeCompactIPPortInfo(addr.IP, addr.Port)
 	return info
 }
 
@@ -61,29 +100,93 @@ func (node *node) CompactNodeInfo() string {
 	}, "")
 }
 
-type sortNodeByTime []*node
+// heardQuery records that the node has sent us a query at now.
+func (node *node) heardQuery(now time.Time) {
+	node.Lock()
+	defer node.Unlock()
 
-func (st sortNodeByTime) Len() int {
-	return len(st)
+	node.lastQuery = now
+	node.lastActiveTime = node.lastQuery
 }
 
-func (st sortNodeByTime) Swap(i, j int) {
-	st[i], st[j] = st[j], st[i]
+// heardResponse records that the node has responded to our query at now.
+func (node *node) heardResponse(now time.Time) {
+	node.Lock()
+	defer node.Unlock()
+
+	node.lastResponse = now
+	node.lastActiveTime = node.lastResponse
+	node.failures = 0
 }
-func (st sortNodeByTime) Less(i, j int) bool {
-	return st[i].lastActiveTime.Before(st[j].lastActiveTime)
+
+// fail records a failed query and returns the failures in a row.
+func (node *node) fail() int {
+	node.Lock()
+	defer node.Unlock()
+
+	node.failures++
+	return node.failures
 }
 
-type sortNodeById []*node
+// update merges the activity of other, which has the same id, into node.
+func (node *node) update(other *node) {
+	other.RLock()
+	addr, lastQuery, lastResponse := other.addr, other.lastQuery, other.lastResponse
+	srtt, rttvar, created := other.srtt, other.rttvar, other.created
+	other.RUnlock()
 
-func (st sortNodeById) Len() int {
+	node.Lock()
+	defer node.Unlock()
+
+	node.addr = addr
+	if node.srtt == 0 {
+		node.srtt, node.rttvar = srtt, rttvar
+	}
+	if created.Before(node.created) {
+		node.created = created
+	}
+	if lastQuery.After(node.lastQuery) {
+		node.lastQuery = lastQuery
+	}
+	if lastResponse.After(node.lastResponse) {
+		node.lastResponse = lastResponse
+		node.failures = 0
+	}
+	if node.lastQuery.After(node.lastActiveTime) {
+		node.lastActiveTime = node.lastQuery
+	}
+	if node.lastResponse.After(node.lastActiveTime) {
+		node.lastActiveTime = node.lastResponse
+	}
+}
+
+// state returns one of nodeGood, nodeQuestionable and nodeBad at now.
+// See http://www.bittorrent.org/beps/bep_0005.html.
+func (node *node) state(now time.Time, expire time.Duration) int {
+	node.RLock()
+	defer node.RUnlock()
+
+	switch {
+	case node.failures >= nodeMaxFailures:
+		return nodeBad
+	case now.Sub(node.lastResponse) < expire:
+		return nodeGood
+	case !node.lastResponse.IsZero() && now.Sub(node.lastQuery) < expire:
+		return nodeGood
+	default:
+		return nodeQuestionable
+	}
+}
+
+type sortNodeByTime []*node
+
+func (st sortNodeByTime) Len() int {
 	return len(st)
 }
 
-func (st sortNodeById) Swap(i, j int) {
+func (st sortNodeByTime) Swap(i, j int) {
 	st[i], st[j] = st[j], st[i]
 }
-
-func (st sortNodeById) Less(i, j int) bool {
-	return st[i].id.Compare(st[j].id, st[i].id.len) == -1
+func (st sortNodeByTime) Less(i, j int) bool {
+	return st[i].lastActiveTime.Before(st[j].lastActiveTime)
 }
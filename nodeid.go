@@ -0,0 +1,225 @@
+package dhtlistener
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+)
+
+var errNodeID = errors.New("node id should be 40 hex digits")
+
+// parseNodeID returns the raw node id of the hex encoded s.
+func parseNodeID(s string) (string, error) {
+	id, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(id) != hash_size {
+		return "", errNodeID
+	}
+	return string(id), nil
+}
+
+// ID returns our hex encoded node id. It changes when SecureID makes it BEP
+// 42 compliant or when it's rotated, see IDRotateInterval.
+func (dht *DHT) ID() string {
+	return hex.EncodeToString([]byte(dht.self().RawString()))
+}
+
+// self returns our node id.
+func (dht *DHT) self() *HashID {
+	dht.idMu.RLock()
+	defer dht.idMu.RUnlock()
+
+	return dht.me.id
+}
+
+// setID replaces our node id by the raw id and remakes the virtual ids.
+func (dht *DHT) setID(id string) {
+	dht.idMu.Lock()
+	defer dht.idMu.Unlock()
+
+	dht.me.id = newHashId(id)
+	dht.initIDs()
+}
+
+// initID sets our node id at startup: NodeID, else the one of NodeIDFile,
+// else the random one, which is then saved to NodeIDFile.
+func (dht *DHT) initID() {
+	id := dht.me.id.RawString()
+	switch {
+	case dht.NodeID != "":
+		var err error
+		if id, err = parseNodeID(dht.NodeID); err != nil {
+			dht.Logger.Warn("invalid node id, a random one is used", F("id", dht.NodeID))
+			id = dht.me.id.RawString()
+		}
+	case dht.NodeIDFile != "":
+		data, err := os.ReadFile(dht.NodeIDFile)
+		if err == nil {
+			if saved, err := parseNodeID(string(data)); err == nil {
+				id = saved
+			} else {
+				dht.Logger.Warn("invalid node id file, a random id is used",
+					F("path", dht.NodeIDFile))
+			}
+		} else if !os.IsNotExist(err) {
+			dht.Logger.Warn("read node id failed", F("path", dht.NodeIDFile), F("err", err))
+		}
+	}
+
+	dht.setID(id)
+	dht.saveID()
+}
+
+// saveID writes our node id to NodeIDFile, if set.
+func (dht *DHT) saveID() {
+	if dht.NodeIDFile == "" {
+		return
+	}
+
+	tmp := dht.NodeIDFile + ".tmp"
+	err := os.WriteFile(tmp, []byte(dht.ID()+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(tmp, dht.NodeIDFile)
+	}
+	if err != nil {
+		dht.Logger.Warn("save node id failed", F("path", dht.NodeIDFile), F("err", err))
+	}
+}
+
+// changeID makes the raw id our node id at runtime. The routing table is
+// reshaped around it, keeping its nodes, and the nodes close to it are
+// looked up.
+func (dht *DHT) changeID(id string) {
+	dht.setID(id)
+	dht.saveID()
+	if rt, ok := dht.rt.(*routetable); ok {
+		rt.rebuild()
+	}
+
+	dht.lookupSelf(dht.self().RawString())
+	dht.Logger.Info("node id changed", F("id", dht.ID()))
+}
+
+// lookupSelf sends find_node queries for target to the closest nodes we
+// know, so that they learn the id we use for target. It does nothing
+// before Run and in router mode.
+func (dht *DHT) lookupSelf(target string) {
+	if !dht.initialized() || dht.Router {
+		return
+	}
+	for _, no := range dht.rt.FindClosest(newHashId(target), dht.K) {
+		dht.transacts.findNode(no, target)
+	}
+}
+
+// rotateID replaces our node id by a new random one, BEP 42 compliant for
+// our external ip if SecureID.
+func (dht *DHT) rotateID() {
+	id := GetRandString(hash_size)
+	if dht.SecureID {
+		ip := dht.ExternalIP
+		if ext := dht.ExternalAddr(); ip == nil && ext != nil {
+			ip = ext.IP
+		}
+		if ip != nil {
+			id = bep42ID(ip)
+		} else {
+			dht.Logger.Warn("external ip unknown, node id is not BEP 42 compliant")
+		}
+	}
+	dht.changeID(id)
+}
+
+// nearID returns a random raw id sharing its first bits bits with the raw
+// target.
+func nearID(target string, bits int) string {
+	id := newHashId(GetRandString(hash_size))
+	tar := newHashId(target)
+	for i := 0; i < bits; i++ {
+		if tar.Bit(i) == 1 {
+			id.Set(i)
+		} else {
+			id.UnSet(i)
+		}
+	}
+	return id.RawString()
+}
+
+// parseTarget returns the raw info hash of s, raw or hex encoded, checking
+// that bits is a valid prefix length.
+func parseTarget(s string, bits int) (string, error) {
+	s, err := rawInfoHash(s)
+	if err != nil {
+		return "", err
+	}
+	if bits <= 0 || bits >= hash_size*8 {
+		return "", errors.New("prefix length should be in [1, 159]")
+	}
+	return s, nil
+}
+
+// MoveNear replaces our node id by a random one sharing its first bits bits
+// with infoHash, raw or hex encoded, so that we join the closest nodes of
+// infoHash and receive its announces. 20 bits are usually enough on the
+// main network. The id isn't BEP 42 compliant, and it's lost on the next
+// rotation, see IDRotateInterval.
+func (dht *DHT) MoveNear(infoHash string, bits int) error {
+	target, err := parseTarget(infoHash, bits)
+	if err != nil {
+		return err
+	}
+	dht.changeID(nearID(target, bits))
+	dht.lookupSelf(target)
+	return nil
+}
+
+// AddVirtualIDNear adds a virtual id sharing its first bits bits with
+// infoHash, raw or hex encoded, like MoveNear but keeping our node id: the
+// queries about infoHash are sent and answered with the virtual id. It
+// returns the hex encoded virtual id, which is kept across rotations until
+// RemoveVirtualID.
+func (dht *DHT) AddVirtualIDNear(infoHash string, bits int) (string, error) {
+	target, err := parseTarget(infoHash, bits)
+	if err != nil {
+		return "", err
+	}
+	id := newHashId(nearID(target, bits))
+
+	dht.idMu.Lock()
+	dht.targetIDs = append(dht.targetIDs, id)
+	if dht.ids != nil { // made by init otherwise
+		dht.ids = append(dht.ids[:len(dht.ids):len(dht.ids)], id)
+	}
+	dht.idMu.Unlock()
+
+	dht.lookupSelf(target)
+	return hex.EncodeToString([]byte(id.RawString())), nil
+}
+
+// RemoveVirtualID removes the hex encoded virtual id added by
+// AddVirtualIDNear. It returns whether it was found.
+func (dht *DHT) RemoveVirtualID(id string) bool {
+	raw, err := parseNodeID(id)
+	if err != nil {
+		return false
+	}
+
+	dht.idMu.Lock()
+	defer dht.idMu.Unlock()
+
+	found := false
+	for i, tid := range dht.targetIDs {
+		if tid.RawString() == raw {
+			dht.targetIDs = append(dht.targetIDs[:i:i], dht.targetIDs[i+1:]...)
+			found = true
+			break
+		}
+	}
+	for i, vid := range dht.ids {
+		if found && i > 0 && vid.RawString() == raw {
+			dht.ids = append(dht.ids[:i:i], dht.ids[i+1:]...)
+			break
+		}
+	}
+	return found
+}
@@ -0,0 +1,146 @@
+package dhtlistener
+
+import (
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNodeIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node_id")
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		dht, err := New(WithAddr("127.0.0.1:0"), WithNodeIDFile(path), WithBootstrapNodes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		dht.init()
+		dht.conn.Close()
+		ids = append(ids, dht.ID())
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("expected the node id to be kept, got %s then %s", ids[0], ids[1])
+	}
+	if data, err := os.ReadFile(path); err != nil || strings.TrimSpace(string(data)) != ids[0] {
+		t.Errorf("expected the node id saved, got %q, %v", data, err)
+	}
+
+	id := hex.EncodeToString([]byte(GetRandString(20)))
+	dht, err := New(WithAddr("127.0.0.1:0"), WithNodeID(id), WithNodeIDFile(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dht.init()
+	dht.conn.Close()
+	if dht.ID() != id {
+		t.Errorf("expected the node id %s, got %s", id, dht.ID())
+	}
+	if data, _ := os.ReadFile(path); strings.TrimSpace(string(data)) != id {
+		t.Errorf("expected the node id %s saved, got %q", id, data)
+	}
+
+	if _, err := New(WithNodeID("abc")); err == nil {
+		t.Error("expected an invalid node id to fail")
+	}
+}
+
+func TestRotateID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node_id")
+	dht, err := New(WithAddr("127.0.0.1:0"), WithNodeIDFile(path), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dht.SecureID = true
+	dht.ExternalIP = net.IPv4(124, 31, 75, 21)
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+
+	for i := 0; i < 64; i++ {
+		no, err := newNode(GetRandString(20), "udp", "127.0.0.1:6881", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		dht.rt.Insert(no)
+	}
+	n := dht.rt.Len()
+
+	old := dht.ID()
+	dht.rotateID()
+	if dht.ID() == old {
+		t.Fatal("expected a new node id")
+	}
+	if !bep42Valid(dht.self().RawString(), dht.ExternalIP) {
+		t.Error("expected a BEP 42 compliant node id")
+	}
+	if data, _ := os.ReadFile(path); strings.TrimSpace(string(data)) != dht.ID() {
+		t.Errorf("expected the new node id saved, got %q", data)
+	}
+	if dht.idFor("") != dht.self().RawString() || !dht.isSelf(dht.self().RawString()) {
+		t.Error("expected the new node id to be used")
+	}
+
+	// the buckets close to the new id may hold fewer nodes.
+	if l := dht.rt.Len(); l < n/2 {
+		t.Errorf("expected the routing table to be kept, %d nodes of %d", l, n)
+	}
+	me := dht.self()
+	for _, b := range dht.rt.Buckets() {
+		b.Foreach(func(v interface{}) bool {
+			if l := v.(*node).id.Xor(me).PrefixLen(); l < b.idx {
+				t.Errorf("node of prefix length %d in bucket %d", l, b.idx)
+			}
+			return true
+		})
+	}
+}
+
+func TestNearID(t *testing.T) {
+	dht, err := New(WithAddr("127.0.0.1:0"), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+
+	infoHash := GetRandString(20)
+	if err := dht.MoveNear(infoHash, 0); err == nil {
+		t.Error("expected an invalid prefix length to fail")
+	}
+	if err := dht.MoveNear(hex.EncodeToString([]byte(infoHash)), 24); err != nil {
+		t.Fatal(err)
+	}
+	if l := dht.self().Xor(newHashId(infoHash)).PrefixLen(); l < 24 {
+		t.Errorf("expected our id to share 24 bits with the target, got %d", l)
+	}
+
+	other := GetRandString(20)
+	id, err := dht.AddVirtualIDNear(other, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := parseNodeID(id)
+	if dht.idFor(other) != raw || !dht.isSelf(raw) {
+		t.Error("expected the virtual id to be used for its target")
+	}
+	if dht.idFor(infoHash) != dht.self().RawString() {
+		t.Error("expected our id to be used for the other targets")
+	}
+	if l := newHashId(raw).Xor(newHashId(other)).PrefixLen(); l < 30 {
+		t.Errorf("expected the virtual id to share 30 bits with the target, got %d", l)
+	}
+
+	dht.rotateID()
+	if !dht.isSelf(raw) {
+		t.Error("expected the virtual id to be kept across rotations")
+	}
+	if !dht.RemoveVirtualID(id) || dht.isSelf(raw) || dht.RemoveVirtualID(id) {
+		t.Error("expected the virtual id to be removed once")
+	}
+}
@@ -0,0 +1,77 @@
+// Package oteltrace implements a dhtlistener.Tracer with OpenTelemetry, so
+// the lookups, transactions and metadata fetches of a DHT show up in the
+// traces, with their target, retries, outcome and round-trip time.
+//
+//	dht.Tracer = oteltrace.New(otel.GetTracerProvider())
+package oteltrace
+
+import (
+	"context"
+	"fmt"
+	"github.com/2qif49lt/dhtlistener"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// instrumentation is the name of the tracer.
+const instrumentation = "github.com/2qif49lt/dhtlistener"
+
+// Tracer is a dhtlistener.Tracer starting OpenTelemetry spans.
+type Tracer struct {
+	t trace.Tracer
+}
+
+// New returns a Tracer starting the spans with a tracer of tp.
+func New(tp trace.TracerProvider) *Tracer {
+	return &Tracer{tp.Tracer(instrumentation)}
+}
+
+// Start implements dhtlistener.Tracer.
+func (t *Tracer) Start(ctx context.Context, name string, fields ...dhtlistener.Field) (context.Context, dhtlistener.Span) {
+	ctx, s := t.t.Start(ctx, name, trace.WithAttributes(attributes(fields)...))
+	return ctx, span{s}
+}
+
+// span is a dhtlistener.Span of an OpenTelemetry span.
+type span struct {
+	s trace.Span
+}
+
+func (s span) SetFields(fields ...dhtlistener.Field) {
+	s.s.SetAttributes(attributes(fields)...)
+}
+
+func (s span) End(err error) {
+	if err != nil {
+		s.s.RecordError(err)
+		s.s.SetStatus(codes.Error, err.Error())
+	}
+	s.s.End()
+}
+
+// attributes returns the attributes of fields, the durations are in
+// milliseconds and the values of other types are formatted.
+func attributes(fields []dhtlistener.Field) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(fields))
+	for _, f := range fields {
+		switch v := f.Value.(type) {
+		case string:
+			attrs = append(attrs, attribute.String(f.Key, v))
+		case int:
+			attrs = append(attrs, attribute.Int(f.Key, v))
+		case int64:
+			attrs = append(attrs, attribute.Int64(f.Key, v))
+		case bool:
+			attrs = append(attrs, attribute.Bool(f.Key, v))
+		case float64:
+			attrs = append(attrs, attribute.Float64(f.Key, v))
+		case time.Duration:
+			attrs = append(attrs, attribute.Float64(f.Key+"_ms", float64(v)/float64(time.Millisecond)))
+		default:
+			attrs = append(attrs, attribute.String(f.Key, fmt.Sprint(v)))
+		}
+	}
+	return attrs
+}
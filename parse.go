@@ -0,0 +1,151 @@
+package dhtlistener
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// The ParseModes, how the values of received messages which don't conform
+// to krpc are handled.
+const (
+	// ParseLenient coerces the numbers sent as strings or of another width,
+	// skips the malformed items of lists and continues.
+	ParseLenient = iota
+	// ParseStrict rejects the messages holding such values.
+	ParseStrict
+)
+
+// toInt returns v as an int. Integers of any type are converted, numeric
+// strings too unless strict.
+func toInt(v interface{}, strict bool) (int, bool) {
+	rv := reflect.ValueOf(v)
+	switch {
+	case !rv.IsValid():
+	case rv.Kind() >= reflect.Int && rv.Kind() <= reflect.Int64:
+		n := rv.Int()
+		if int64(int(n)) == n {
+			return int(n), true
+		}
+	case rv.Kind() >= reflect.Uint && rv.Kind() <= reflect.Uint64:
+		n := rv.Uint()
+		if n <= uint64(^uint(0)>>1) {
+			return int(n), true
+		}
+	case rv.Kind() == reflect.String && !strict:
+		if n, err := strconv.Atoi(rv.String()); err == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// parseKey checks the key in dict data. `t` is type of the keyed value.
+// It's one of "int", "string", "map", "list". The integers of another type
+// are stored back as ints.
+func parseKey(data map[string]interface{}, key string, t string) error {
+	val, ok := data[key]
+	if !ok {
+		return errors.New("lack of key")
+	}
+
+	switch t {
+	case "string":
+		_, ok = val.(string)
+	case "int":
+		var n int
+		if n, ok = toInt(val, true); ok {
+			data[key] = n
+		}
+	case "map":
+		_, ok = val.(map[string]interface{})
+	case "list":
+		_, ok = val.([]interface{})
+	default:
+		return fmt.Errorf("unknown key type %q", t)
+	}
+
+	if !ok {
+		return errors.New("invalid key type")
+	}
+
+	return nil
+}
+
+// parseKeys parses keys. It just wraps parseKey.
+func parseKeys(data map[string]interface{}, pairs [][]string) error {
+	for _, args := range pairs {
+		key, t := args[0], args[1]
+		if err := parseKey(data, key, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// strict returns whether dht rejects the nonconforming messages.
+func (dht *DHT) strict() bool {
+	return dht.ParseMode == ParseStrict
+}
+
+// decodeBody decodes the arguments or the response data into the struct
+// pointed to by v. In lenient mode, a body which doesn't fit v is decoded
+// again with coercions, see coerce.
+func (dht *DHT) decodeBody(data RawMessage, v interface{}) error {
+	err := Unmarshal(data, v)
+	if err == nil || dht.strict() {
+		return err
+	}
+
+	var m map[string]interface{}
+	if Unmarshal(data, &m) != nil {
+		return err
+	}
+	return coerce(m, reflect.ValueOf(v).Elem())
+}
+
+// coerce sets the fields of the struct rv to the values of m under their
+// bencode names. Numbers are converted by toInt, the items of a string list
+// which are not strings are skipped, values of other types are errors.
+func coerce(m map[string]interface{}, rv reflect.Value) error {
+	for key, val := range m {
+		_, name, ok := findStructFieldName(rv, key)
+		if !ok {
+			continue
+		}
+		f := rv.FieldByName(name)
+
+		switch {
+		case f.Kind() >= reflect.Int && f.Kind() <= reflect.Int64:
+			n, ok := toInt(val, false)
+			if !ok || f.OverflowInt(int64(n)) {
+				return fmt.Errorf("%s: expect an int", key)
+			}
+			f.SetInt(int64(n))
+		case f.Kind() == reflect.String:
+			s, ok := val.(string)
+			if !ok {
+				return fmt.Errorf("%s: expect a string", key)
+			}
+			f.SetString(s)
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+			list, ok := val.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s: expect a list", key)
+			}
+			strs := reflect.MakeSlice(f.Type(), 0, len(list))
+			for _, item := range list {
+				if s, ok := item.(string); ok {
+					strs = reflect.Append(strs, reflect.ValueOf(s))
+				}
+			}
+			f.Set(strs)
+		case f.Kind() == reflect.Interface:
+			f.Set(reflect.ValueOf(val))
+		default:
+			return fmt.Errorf("%s: cannot coerce into %s", key, f.Kind())
+		}
+	}
+	return nil
+}
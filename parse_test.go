@@ -0,0 +1,90 @@
+package dhtlistener
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	data := map[string]interface{}{"a": int64(7), "b": "x", "c": uint8(3)}
+
+	if err := parseKey(data, "a", "float"); err == nil {
+		t.Error("expected an error for an unknown type")
+	}
+	if err := parseKeys(data, [][]string{{"a", "int"}, {"c", "int"}}); err != nil {
+		t.Fatal(err)
+	}
+	if data["a"].(int) != 7 || data["c"].(int) != 3 {
+		t.Errorf("expected the ints stored back, got %v", data)
+	}
+	if err := parseKey(data, "b", "int"); err == nil {
+		t.Error("a string is not an int")
+	}
+}
+
+func TestToInt(t *testing.T) {
+	for _, c := range []struct {
+		v      interface{}
+		strict bool
+		n      int
+		ok     bool
+	}{
+		{int32(-5), true, -5, true},
+		{uint64(6881), true, 6881, true},
+		{uint64(1 << 63), false, 0, false},
+		{"6881", false, 6881, true},
+		{"6881", true, 0, false},
+		{"x", false, 0, false},
+		{nil, false, 0, false},
+	} {
+		if n, ok := toInt(c.v, c.strict); n != c.n || ok != c.ok {
+			t.Errorf("toInt(%#v, %v): expected %d %v, got %d %v", c.v, c.strict, c.n, c.ok, n, ok)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	dht := &DHT{}
+	body := RawMessage("d2:id20:abcdefghij01234567894:porti6881e12:implied_port1:1e")
+
+	var a AnnouncePeerArgs
+	if err := dht.decodeBody(body, &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Port != 6881 || a.ImpliedPort != 1 || a.ID != "abcdefghij0123456789" {
+		t.Errorf("expected the port coerced, got %+v", a)
+	}
+
+	dht.ParseMode = ParseStrict
+	if err := dht.decodeBody(body, &AnnouncePeerArgs{}); err == nil {
+		t.Error("strict mode should reject a string port")
+	}
+
+	dht.ParseMode = ParseLenient
+	var r GetPeersResponse
+	if err := dht.decodeBody(RawMessage("d5:token1:x6:valuesl6:abcdefi1eee"), &r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Values) != 1 || r.Values[0] != "abcdef" {
+		t.Errorf("expected the int value skipped, got %q", r.Values)
+	}
+}
+
+func TestParseModeNoTransactionID(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	var last error
+	dht.OnError = func(err error, addr *net.UDPAddr) { last = err }
+	dht.ParseMode = ParseStrict
+	dht.init()
+	defer dht.conn.Close()
+
+	data := []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:y1:qe")
+	handle(dht, packet{data: data, raddr: &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}})
+	if !errors.Is(last, ErrProtocol) {
+		t.Errorf("expected a protocol error, got %v", last)
+	}
+}
@@ -0,0 +1,143 @@
+package dhtlistener
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPassive(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.Passive = true
+	dht.init()
+	defer dht.Close(context.Background())
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	addr := client.LocalAddr().(*net.UDPAddr)
+
+	// find_node is answered to stay routable.
+	msg := &rawMessage{T: "aa", Y: "q", Q: findNodeType}
+	msg.A, _ = Marshal(&FindNodeArgs{ID: "abcdefghij0123456789", Target: "mnopqrstuvwxyz123456"})
+	if !handleRequest(dht, addr, msg) {
+		t.Fatal("find_node should be handled")
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := &rawMessage{}
+	if err := Unmarshal(buf[:n], resp); err != nil || resp.Y != "r" || resp.T != "aa" {
+		t.Fatalf("unexpected response %q, %v", buf[:n], err)
+	}
+
+	// announced peers are reported but not stored.
+	events := dht.Subscribe(EventPeerAnnounced)
+	msg = &rawMessage{T: "ab", Y: "q", Q: announcePeerType}
+	msg.A, _ = Marshal(&AnnouncePeerArgs{
+		ID:       "abcdefghij0123456789",
+		InfoHash: "mnopqrstuvwxyz123456",
+		Port:     6881,
+		Token:    dht.tokens.getToken(addr),
+	})
+	if !handleRequest(dht, addr, msg) {
+		t.Fatal("announce_peer should be handled")
+	}
+
+	select {
+	case <-events:
+	default:
+		t.Fatal("expected a PeerAnnounced event")
+	}
+	if dht.peers.Count() != 0 {
+		t.Fatal("peers should not be stored")
+	}
+
+	if _, err := dht.GetPeers("mnopqrstuvwxyz123456"); err != errPassive {
+		t.Fatal("expected errPassive, got", err)
+	}
+}
+
+func TestNotPassive(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.Close(context.Background())
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	addr := client.LocalAddr().(*net.UDPAddr)
+
+	// unlike the original listener, find_node is answered.
+	msg := &rawMessage{T: "aa", Y: "q", Q: findNodeType}
+	msg.A, _ = Marshal(&FindNodeArgs{ID: "abcdefghij0123456789", Target: "mnopqrstuvwxyz123456"})
+	if !handleRequest(dht, addr, msg) {
+		t.Fatal("find_node should be handled")
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &rawMessage{}
+	if err := Unmarshal(buf[:n], resp); err != nil || resp.Y != "r" || resp.T != "aa" {
+		t.Fatalf("unexpected response %q, %v", buf[:n], err)
+	}
+
+	// and the announced peers are stored.
+	msg = &rawMessage{T: "ab", Y: "q", Q: announcePeerType}
+	msg.A, _ = Marshal(&AnnouncePeerArgs{
+		ID:       "abcdefghij0123456789",
+		InfoHash: "mnopqrstuvwxyz123456",
+		Port:     6881,
+		Token:    dht.tokens.getToken(addr),
+	})
+	if !handleRequest(dht, addr, msg) {
+		t.Fatal("announce_peer should be handled")
+	}
+	if dht.peers.Count() != 1 {
+		t.Fatalf("expected the peer stored, got %d", dht.peers.Count())
+	}
+
+	// and returned to get_peers.
+	msg = &rawMessage{T: "ac", Y: "q", Q: getPeersType}
+	msg.A, _ = Marshal(&GetPeersArgs{ID: "abcdefghij0123456789", InfoHash: "mnopqrstuvwxyz123456"})
+	if !handleRequest(dht, addr, msg) {
+		t.Fatal("get_peers should be handled")
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err = client.ReadFromUDP(buf); err != nil {
+		t.Fatal(err)
+	}
+	resp = &rawMessage{}
+	var r GetPeersResponse
+	if err := Unmarshal(buf[:n], resp); err != nil || resp.T != "ac" || Unmarshal(resp.R, &r) != nil {
+		t.Fatalf("unexpected response %q, %v", buf[:n], err)
+	}
+	if r.Token == "" || len(r.Values) != 1 || r.Nodes != "" {
+		t.Fatalf("expected the token and the peer, got %+v", r)
+	}
+	p, err := newPeerFromCompactIPPortInfo(r.Values[0], "")
+	if err != nil || !p.IP.Equal(addr.IP) || p.Port != 6881 {
+		t.Errorf("unexpected peer %v, %v", p, err)
+	}
+}
@@ -2,25 +2,43 @@ package dhtlistener
 
 import (
 	"net"
-	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Peer represents a peer contact.
 type Peer struct {
-	IP    net.IP
-	Port  int
-	token string
+	IP       net.IP
+	Port     int
+	LastSeen time.Time // when the peer was announced or reported
+	token    string
+	state    int32 // verification state, accessed atomically
 }
 
 // newPeer returns a new peer pointer.
 func newPeer(ip net.IP, port int, token string) *Peer {
 	return &Peer{
-		IP:    ip,
-		Port:  port,
-		token: token,
+		IP:       ip,
+		Port:     port,
+		LastSeen: time.Now(),
+		token:    token,
 	}
 }
 
+// PeerStore stores the peers of infohashes. Implementations must be safe for
+// concurrent use. The default store keeps the peers in memory.
+type PeerStore interface {
+	// Insert adds a peer of infoHash.
+	Insert(infoHash InfoHash, peer *Peer)
+	// GetPeers returns at most size peers of infoHash, the recent ones first.
+	GetPeers(infoHash InfoHash, size int) []*Peer
+	// Expire removes the peers last seen before deadline and returns how
+	// many are removed.
+	Expire(deadline time.Time) int
+	// Count returns how many peers are stored.
+	Count() int
+}
+
 // newPeerFromCompactIPPortInfo create a peer pointer by compact ip/port info.
 func newPeerFromCompactIPPortInfo(compactInfo, token string) (*Peer, error) {
 	ip, port, err := decodeCompactIPPortInfo(compactInfo)
@@ -38,11 +56,53 @@ func (p *Peer) CompactIPPortInfo() string {
 	return info
 }
 
-// peersManager represents a proxy that manipulates peers.
+// expirePeers drops the peers which are not seen during the last PeerTTL
+// from the store, it checks every minute or PeerTTL if it's shorter. The
+// peers never expire if PeerTTL isn't positive.
+func (dht *DHT) expirePeers() {
+	if dht.PeerTTL <= 0 {
+		return
+	}
+
+	interval := time.Minute
+	if dht.PeerTTL < interval {
+		interval = dht.PeerTTL
+	}
+
+	dht.every(interval, func() {
+		if n := dht.peers.Expire(dht.now().Add(-dht.PeerTTL)); n != 0 {
+			dht.Logger.Debug("peers expired", F("count", n))
+		}
+	})
+}
+
+// PeerRanger is implemented by the PeerStores which can enumerate their
+// peers, as the in-memory store does.
+type PeerRanger interface {
+	// Range calls f for every peer until f returns false.
+	Range(f func(infoHash InfoHash, peer *Peer) bool)
+}
+
+// CopyPeers copies all peers of src into dst and returns how many are
+// copied. It's the migration path between stores, e.g. from the in-memory
+// store to a persistent one.
+func CopyPeers(dst PeerStore, src PeerRanger) int {
+	n := 0
+	src.Range(func(infoHash InfoHash, peer *Peer) bool {
+		dst.Insert(infoHash, peer)
+		n++
+		return true
+	})
+	return n
+}
+
+// peersManager represents a proxy that manipulates peers, it's the default
+// in-memory PeerStore. Every infohash keeps at most MaxPeersPerInfoHash
+// peers, if positive, the least recently announced ones are evicted first.
 type peersManager struct {
-	sync.RWMutex
-	table *syncMap // hashinfo:peer
-	dht   *DHT
+	table   *syncMap // hashinfo:*keylist(address:*Peer)
+	evicted uint64   // accessed atomically
+	dht     *DHT
 }
 
 // newPeersManager returns a new peersManager.
@@ -53,38 +113,119 @@ func newPeersManager(dht *DHT) *peersManager {
 	}
 }
 
-// Insert adds a peer into peersManager.
-func (pm *peersManager) Insert(infoHash string, peer *Peer) {
-	pm.Lock()
-	if _, ok := pm.table.Get(infoHash); !ok {
-		pm.table.Set(infoHash, newSyncList())
-	}
-	pm.Unlock()
+// peerKey returns the key of a peer in its infohash's list.
+func peerKey(peer *Peer) string {
+	return genAddress(peer.IP.String(), peer.Port)
+}
 
-	v, _ := pm.table.Get(infoHash)
-	queue := v.(*syncList)
+// Insert adds a peer into peersManager. A known peer is moved to the most
+// recent position.
+func (pm *peersManager) Insert(infoHash InfoHash, peer *Peer) {
+	pm.table.Update(string(infoHash), func(v interface{}, ok bool) interface{} {
+		if !ok {
+			v = newKeyList()
+		}
+		queue := v.(*keylist)
 
-	queue.PushBack(peer)
-	if queue.Len() > pm.dht.K {
-		queue.RemoveFront()
-	}
+		if old, ok := queue.Get(peerKey(peer)); ok && old != peer {
+			atomic.StoreInt32(&peer.state, atomic.LoadInt32(&old.(*Peer).state))
+		}
+		queue.Push(peerKey(peer), peer)
+		for max := pm.dht.MaxPeersPerInfoHash; max > 0 && queue.Len() > max; {
+			queue.Remove(peerKey(queue.Front().(*Peer)))
+			atomic.AddUint64(&pm.evicted, 1)
+		}
+		return queue
+	})
 }
 
-// GetPeers returns size-length peers who announces having infoHash.
-func (pm *peersManager) GetPeers(infoHash string, size int) []*Peer {
+// GetPeers returns size-length peers who announces having infoHash, the
+// recent ones first.
+func (pm *peersManager) GetPeers(infoHash InfoHash, size int) []*Peer {
 	peers := make([]*Peer, 0, size)
 
-	v, ok := pm.table.Get(infoHash)
+	v, ok := pm.table.Get(string(infoHash))
 	if !ok {
 		return peers
 	}
 
-	for e := range v.(*syncList).Iter() {
+	queue := v.(*keylist).syncList
+	queue.RLock()
+	for e := queue.lst.Back(); e != nil && len(peers) < size; e = e.Prev() {
 		peers = append(peers, e.Value.(*Peer))
 	}
+	queue.RUnlock()
 
-	if len(peers) > size {
-		peers = peers[len(peers)-size:]
-	}
 	return peers
 }
+
+// Expire removes the peers last seen before deadline and the infohashes
+// left without peers.
+func (pm *peersManager) Expire(deadline time.Time) int {
+	removed := 0
+	for _, item := range pm.table.Items() {
+		pm.table.Update(item.key, func(v interface{}, ok bool) interface{} {
+			if !ok {
+				return nil
+			}
+			queue := v.(*keylist)
+
+			expired := make([]string, 0)
+			queue.Foreach(func(v interface{}) bool {
+				if peer := v.(*Peer); peer.LastSeen.Before(deadline) {
+					expired = append(expired, peerKey(peer))
+				}
+				return true
+			})
+
+			for _, key := range expired {
+				queue.Remove(key)
+			}
+			removed += len(expired)
+
+			if queue.Len() == 0 {
+				return nil
+			}
+			return queue
+		})
+	}
+	return removed
+}
+
+// Count returns how many peers are stored.
+func (pm *peersManager) Count() int {
+	ret := 0
+	pm.table.Range(func(_ string, v interface{}) bool {
+		ret += v.(*keylist).Len()
+		return true
+	})
+	return ret
+}
+
+// InfoHashes returns how many infohashes have peers stored.
+func (pm *peersManager) InfoHashes() int {
+	return pm.table.Len()
+}
+
+// Evicted returns how many peers have been evicted because their infohash
+// reached MaxPeersPerInfoHash.
+func (pm *peersManager) Evicted() uint64 {
+	return atomic.LoadUint64(&pm.evicted)
+}
+
+// Range calls f for every peer until f returns false.
+func (pm *peersManager) Range(f func(infoHash InfoHash, peer *Peer) bool) {
+	for _, item := range pm.table.Items() {
+		peers := make([]*Peer, 0)
+		item.val.(*keylist).Foreach(func(v interface{}) bool {
+			peers = append(peers, v.(*Peer))
+			return true
+		})
+
+		for _, peer := range peers {
+			if !f(InfoHash(item.key), peer) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package dhtlistener
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeersManagerExpire(t *testing.T) {
+	var pm PeerStore = newPeersManager(&DHT{K: 8, MaxPeersPerInfoHash: 2})
+
+	old := newPeer(net.IPv4(1, 1, 1, 1), 1, "")
+	old.LastSeen = time.Now().Add(-time.Hour)
+	pm.Insert("a", old)
+	pm.Insert("a", newPeer(net.IPv4(2, 2, 2, 2), 2, ""))
+	pm.Insert("b", old)
+
+	if peers := pm.GetPeers("a", 8); len(peers) != 2 || peers[0].Port != 2 {
+		t.Fatal(peers)
+	}
+
+	if n := pm.Expire(time.Now().Add(-time.Minute)); n != 2 {
+		t.Fatal(n)
+	}
+	if pm.Count() != 1 || len(pm.GetPeers("b", 8)) != 0 {
+		t.Fatal(pm.Count())
+	}
+}
+
+func TestPeersManagerEvict(t *testing.T) {
+	pm := newPeersManager(&DHT{K: 8, MaxPeersPerInfoHash: 2})
+
+	for _, port := range []int{1, 2, 1, 3} {
+		pm.Insert("a", newPeer(net.IPv4(1, 1, 1, 1), port, ""))
+	}
+
+	peers := pm.GetPeers("a", 8)
+	if len(peers) != 2 || peers[0].Port != 3 || peers[1].Port != 1 {
+		t.Fatal(peers)
+	}
+	if pm.Evicted() != 1 || pm.InfoHashes() != 1 {
+		t.Fatal(pm.Evicted(), pm.InfoHashes())
+	}
+
+	// no limit.
+	pm = newPeersManager(&DHT{K: 8})
+	for port := 1; port <= 3; port++ {
+		pm.Insert("a", newPeer(net.IPv4(1, 1, 1, 1), port, ""))
+	}
+	if pm.Count() != 3 || pm.Evicted() != 0 {
+		t.Fatal(pm.Count(), pm.Evicted())
+	}
+}
+
+func TestExpirePeersDisabled(t *testing.T) {
+	dht := &DHT{Clock: systemClock{}, done: make(chan struct{})}
+	defer close(dht.done)
+
+	// returns at once instead of ticking every 0s.
+	dht.expirePeers()
+}
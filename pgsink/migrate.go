@@ -0,0 +1,117 @@
+package pgsink
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// migrationLock is the key of the advisory lock taken while migrating, so
+// several instances starting together don't race.
+const migrationLock = 0x64687473696e6b // "dhtsink"
+
+// migration is a schema change, its files are named "NNNN_name.sql".
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations returns the embedded migrations ordered by version.
+func loadMigrations() ([]migration, error) {
+	entries, err := migrations.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]migration, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		i := strings.IndexByte(name, '_')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid migration name %q", name)
+		}
+		version, err := strconv.Atoi(name[:i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration name %q", name)
+		}
+
+		data, err := migrations.ReadFile("migrations/" + name)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, migration{version, name, string(data)})
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].version < ret[j].version })
+	return ret, nil
+}
+
+// Migrate applies the migrations db lacks, each in a transaction. New
+// calls it.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	ms, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	// the lock is held by a session, so everything runs on one connection.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLock); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLock)
+
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return err
+	}
+
+	var current int
+	if err := conn.QueryRowContext(ctx,
+		"SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return err
+	}
+
+	for _, m := range ms {
+		if m.version <= current {
+			continue
+		}
+		if err := apply(ctx, conn, m); err != nil {
+			return fmt.Errorf("migration %s: %v", m.name, err)
+		}
+	}
+	return nil
+}
+
+// apply runs m and records it.
+func apply(ctx context.Context, conn *sql.Conn, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO schema_migrations (version) VALUES ($1)", m.version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
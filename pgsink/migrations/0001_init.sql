@@ -0,0 +1,26 @@
+CREATE TABLE infohashes (
+	info_hash  BYTEA PRIMARY KEY,
+	first_seen TIMESTAMPTZ NOT NULL,
+	last_seen  TIMESTAMPTZ NOT NULL,
+	name       TEXT,
+	size       BIGINT,
+	metadata   BYTEA -- the bencoded info dictionary
+);
+
+CREATE TABLE peer_sightings (
+	id        BIGSERIAL PRIMARY KEY,
+	info_hash BYTEA NOT NULL REFERENCES infohashes ON DELETE CASCADE,
+	event     TEXT NOT NULL, -- announce or get_peers
+	ip        INET NOT NULL,
+	port      INTEGER NOT NULL,
+	seen_at   TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX peer_sightings_info_hash_seen_at ON peer_sightings (info_hash, seen_at);
+
+CREATE TABLE files (
+	info_hash BYTEA NOT NULL REFERENCES infohashes ON DELETE CASCADE,
+	path      TEXT NOT NULL,
+	length    BIGINT NOT NULL,
+	PRIMARY KEY (info_hash, path)
+);
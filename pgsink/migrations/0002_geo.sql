@@ -0,0 +1,4 @@
+ALTER TABLE peer_sightings
+	ADD COLUMN country TEXT,
+	ADD COLUMN city    TEXT,
+	ADD COLUMN asn     BIGINT;
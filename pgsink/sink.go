@@ -0,0 +1,249 @@
+// Package pgsink implements a dhtlistener.Sink storing the discovered
+// infohashes, the peer sightings and the fetched metadata into PostgreSQL,
+// so an indexer gets a queryable store out of the box.
+//
+// It uses database/sql, register a driver such as github.com/lib/pq or
+// github.com/jackc/pgx/v5/stdlib in your program. The schema is created and
+// upgraded by embedded migrations, see the migrations directory.
+package pgsink
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/2qif49lt/dhtlistener"
+	"strings"
+	"time"
+)
+
+// maxRows bounds the rows of an insert, postgres accepts up to 65535
+// parameters per statement.
+const maxRows = 1000
+
+// sighting is a pending row of peer_sightings.
+type sighting struct {
+	infoHash string
+	event    string
+	ip       string
+	port     int
+	time     time.Time
+	geo      *dhtlistener.GeoInfo
+}
+
+// seen is the first and last sighting of an infohash in a batch.
+type seen struct {
+	first, last time.Time
+}
+
+// Sink is a dhtlistener.Sink writing the get_peers, announce and metadata
+// events to postgres. The rows are batched until BatchSize or the periodic
+// Flush of dhtlistener.AddSink, then inserted in one transaction.
+type Sink struct {
+	db           *sql.DB
+	batchSize    int
+	writeTimeout time.Duration
+	sightings    []sighting
+	infoHashes   map[string]seen
+	metadata     []dhtlistener.MetadataReceived
+}
+
+// Options holds the settings of a Sink.
+type Options struct {
+	// BatchSize is the max number of events per transaction, 256 by
+	// default.
+	BatchSize int
+	// WriteTimeout bounds a transaction, 10 seconds by default.
+	WriteTimeout time.Duration
+}
+
+// New migrates db and returns a Sink writing to it. opts may be nil. db is
+// not closed by the Sink.
+//
+//	db, err := sql.Open("postgres", "postgres://localhost/dht")
+//	...
+//	sink, err := pgsink.New(ctx, db, nil)
+//	...
+//	dht.AddSink(sink, dhtlistener.EventPeerAnnounced, dhtlistener.EventMetadataReceived)
+func New(ctx context.Context, db *sql.DB, opts *Options) (*Sink, error) {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 256
+	}
+	if o.WriteTimeout <= 0 {
+		o.WriteTimeout = time.Second * 10
+	}
+
+	if err := Migrate(ctx, db); err != nil {
+		return nil, err
+	}
+
+	return &Sink{
+		db:           db,
+		batchSize:    o.BatchSize,
+		writeTimeout: o.WriteTimeout,
+		infoHashes:   make(map[string]seen),
+	}, nil
+}
+
+// see records a sighting of infoHash at t.
+func (s *Sink) see(infoHash string, t time.Time) {
+	sn, ok := s.infoHashes[infoHash]
+	if !ok || t.Before(sn.first) {
+		sn.first = t
+	}
+	if t.After(sn.last) {
+		sn.last = t
+	}
+	s.infoHashes[infoHash] = sn
+}
+
+// Write implements dhtlistener.Sink, it ignores the other events.
+func (s *Sink) Write(e dhtlistener.Event) error {
+	switch e := e.(type) {
+	case dhtlistener.PeerAnnounced:
+		s.sightings = append(s.sightings, sighting{e.InfoHash.RawString(), "announce", e.IP, e.Port, e.Time, e.Geo})
+		s.see(e.InfoHash.RawString(), e.Time)
+	case dhtlistener.GetPeersSeen:
+		s.sightings = append(s.sightings, sighting{e.InfoHash.RawString(), "get_peers", e.IP, e.Port, e.Time, e.Geo})
+		s.see(e.InfoHash.RawString(), e.Time)
+	case dhtlistener.MetadataReceived:
+		s.metadata = append(s.metadata, e)
+		s.see(e.InfoHash.RawString(), e.Time)
+	default:
+		return nil
+	}
+
+	if len(s.sightings)+len(s.metadata) >= s.batchSize {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Flush inserts the batched rows, they are dropped if it fails.
+func (s *Sink) Flush() error {
+	if len(s.infoHashes) == 0 {
+		return nil
+	}
+	defer s.reset()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.writeTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.insertInfoHashes(ctx, tx); err != nil {
+		return err
+	}
+	if err := s.insertSightings(ctx, tx); err != nil {
+		return err
+	}
+	if err := s.insertMetadata(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// reset empties the batch.
+func (s *Sink) reset() {
+	s.sightings = s.sightings[:0]
+	s.metadata = s.metadata[:0]
+	s.infoHashes = make(map[string]seen)
+}
+
+// insert inserts rows of cols into table by statements of maxRows rows,
+// suffix is appended to the statements.
+func insert(ctx context.Context, tx *sql.Tx, table string, cols []string, suffix string, rows [][]interface{}) error {
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > maxRows {
+			n = maxRows
+		}
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "INSERT INTO %s (%s) VALUES ", table, strings.Join(cols, ", "))
+
+		args := make([]interface{}, 0, n*len(cols))
+		for i, row := range rows[:n] {
+			if i != 0 {
+				b.WriteString(", ")
+			}
+			b.WriteByte('(')
+			for j, v := range row {
+				if j != 0 {
+					b.WriteString(", ")
+				}
+				args = append(args, v)
+				fmt.Fprintf(&b, "$%d", len(args))
+			}
+			b.WriteByte(')')
+		}
+		b.WriteString(suffix)
+
+		if _, err := tx.ExecContext(ctx, b.String(), args...); err != nil {
+			return fmt.Errorf("insert into %s: %v", table, err)
+		}
+		rows = rows[n:]
+	}
+	return nil
+}
+
+func (s *Sink) insertInfoHashes(ctx context.Context, tx *sql.Tx) error {
+	rows := make([][]interface{}, 0, len(s.infoHashes))
+	for infoHash, sn := range s.infoHashes {
+		rows = append(rows, []interface{}{[]byte(infoHash), sn.first, sn.last})
+	}
+
+	return insert(ctx, tx, "infohashes", []string{"info_hash", "first_seen", "last_seen"},
+		` ON CONFLICT (info_hash) DO UPDATE SET
+			first_seen = LEAST(infohashes.first_seen, EXCLUDED.first_seen),
+			last_seen = GREATEST(infohashes.last_seen, EXCLUDED.last_seen)`, rows)
+}
+
+func (s *Sink) insertSightings(ctx context.Context, tx *sql.Tx) error {
+	rows := make([][]interface{}, 0, len(s.sightings))
+	for _, st := range s.sightings {
+		var country, city sql.NullString
+		var asn sql.NullInt64
+		if g := st.geo; g != nil {
+			country = sql.NullString{String: g.Country, Valid: g.Country != ""}
+			city = sql.NullString{String: g.City, Valid: g.City != ""}
+			asn = sql.NullInt64{Int64: int64(g.ASN), Valid: g.ASN != 0}
+		}
+
+		rows = append(rows, []interface{}{[]byte(st.infoHash), st.event, st.ip, st.port, st.time,
+			country, city, asn})
+	}
+
+	return insert(ctx, tx, "peer_sightings",
+		[]string{"info_hash", "event", "ip", "port", "seen_at", "country", "city", "asn"}, "", rows)
+}
+
+func (s *Sink) insertMetadata(ctx context.Context, tx *sql.Tx) error {
+	var files [][]interface{}
+	for _, m := range s.metadata {
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE infohashes SET name = $2, size = $3, metadata = $4 WHERE info_hash = $1",
+			[]byte(m.InfoHash), m.Name, m.Size, m.Metadata); err != nil {
+			return fmt.Errorf("update infohashes: %v", err)
+		}
+
+		for _, f := range m.Files {
+			files = append(files, []interface{}{[]byte(m.InfoHash), strings.Join(f.Path, "/"), f.Length})
+		}
+	}
+
+	return insert(ctx, tx, "files", []string{"info_hash", "path", "length"},
+		" ON CONFLICT DO NOTHING", files)
+}
+
+// Close implements dhtlistener.Sink, it flushes the batched rows.
+func (s *Sink) Close() error {
+	return s.Flush()
+}
@@ -0,0 +1,307 @@
+package pgsink
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/2qif49lt/dhtlistener"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeExec is a statement run on a fakeDB.
+type fakeExec struct {
+	query string
+	args  []driver.Value
+}
+
+// fakeDB is a database/sql driver recording the statements, its
+// schema_migrations version is version. The statements containing fail
+// fail.
+type fakeDB struct {
+	sync.Mutex
+	execs     []fakeExec
+	version   int64
+	fail      string
+	commits   int
+	rollbacks int
+}
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) { return &fakeConn{db}, nil }
+func (db *fakeDB) Driver() driver.Driver                        { return nil }
+
+// queries returns the statements run containing s.
+func (db *fakeDB) queries(s string) []fakeExec {
+	db.Lock()
+	defer db.Unlock()
+
+	var ret []fakeExec
+	for _, e := range db.execs {
+		if strings.Contains(e.query, s) {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+func (db *fakeDB) run(query string, args []driver.Value) error {
+	db.Lock()
+	defer db.Unlock()
+
+	db.execs = append(db.execs, fakeExec{query, args})
+	if db.fail != "" && strings.Contains(query, db.fail) {
+		return errors.New("fake failure")
+	}
+	return nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{c.db, query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return &fakeTx{c.db}, nil }
+
+type fakeTx struct{ db *fakeDB }
+
+func (tx *fakeTx) Commit() error {
+	tx.db.Lock()
+	defer tx.db.Unlock()
+	tx.db.commits++
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.db.Lock()
+	defer tx.db.Unlock()
+	tx.db.rollbacks++
+	return nil
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := s.db.run(s.query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.db.run(s.query, args); err != nil {
+		return nil, err
+	}
+	rows := &fakeRows{}
+	if strings.Contains(s.query, "MAX(version)") {
+		s.db.Lock()
+		rows.values = []driver.Value{s.db.version}
+		s.db.Unlock()
+	}
+	return rows, nil
+}
+
+// fakeRows is a single row of values, none if nil.
+type fakeRows struct {
+	values []driver.Value
+	done   bool
+}
+
+func (r *fakeRows) Columns() []string {
+	return make([]string, len(r.values))
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done || r.values == nil {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.values)
+	return nil
+}
+
+func TestMigrate(t *testing.T) {
+	ms, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range ms {
+		if m.version != i+1 || m.sql == "" {
+			t.Fatalf("unexpected migration %d %s", m.version, m.name)
+		}
+	}
+
+	fake := &fakeDB{}
+	db := sql.OpenDB(fake)
+	defer db.Close()
+
+	if err := Migrate(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	applied := fake.queries("INSERT INTO schema_migrations")
+	if len(applied) != len(ms) || fake.commits != len(ms) {
+		t.Fatalf("expected %d migrations applied, got %v", len(ms), applied)
+	}
+	for i, e := range applied {
+		if e.args[0] != int64(i+1) {
+			t.Errorf("unexpected version %v", e.args[0])
+		}
+	}
+	if len(fake.queries("pg_advisory_lock")) != 1 || len(fake.queries("pg_advisory_unlock")) != 1 {
+		t.Error("expected the migrations locked")
+	}
+
+	// the migrations applied already are skipped.
+	fake.version = int64(len(ms))
+	if err := Migrate(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.queries("INSERT INTO schema_migrations")) != len(ms) {
+		t.Error("expected no migration applied again")
+	}
+
+	// a failed migration isn't recorded.
+	fake.version, fake.fail = 0, "CREATE TABLE infohashes"
+	if err := Migrate(context.Background(), db); err == nil || !strings.Contains(err.Error(), "0001_init.sql") {
+		t.Fatalf("expected the first migration to fail, got %v", err)
+	}
+	if len(fake.queries("INSERT INTO schema_migrations")) != len(ms) {
+		t.Error("expected the failed migration not recorded")
+	}
+}
+
+func TestSink(t *testing.T) {
+	fake := &fakeDB{version: 1 << 20}
+	db := sql.OpenDB(fake)
+	defer db.Close()
+
+	s, err := New(context.Background(), db, &Options{BatchSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t1 := time.Unix(1700000000, 0).UTC()
+	t2 := t1.Add(time.Minute)
+	geo := &dhtlistener.GeoInfo{Country: "FR", ASN: 3215}
+	for _, e := range []dhtlistener.Event{
+		dhtlistener.GetPeersSeen{InfoHash: "mnopqrstuvwxyz123456", IP: "1.2.3.4", Port: 1, Time: t2},
+		dhtlistener.NodeAdded{ID: "node"}, // ignored
+		dhtlistener.PeerAnnounced{InfoHash: "mnopqrstuvwxyz123456", IP: "5.6.7.8", Port: 2, Time: t1, Geo: geo},
+		dhtlistener.PeerAnnounced{InfoHash: "abcdefghijklmnopqrst", IP: "5.6.7.8", Port: 2, Time: t1},
+	} {
+		if err := s.Write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fake.queries("INSERT INTO")) != 0 {
+		t.Fatal("expected the events batched")
+	}
+
+	err = s.Write(dhtlistener.MetadataReceived{
+		InfoHash: "mnopqrstuvwxyz123456", Name: "a", Size: 3, Time: t2,
+		Files: []dhtlistener.File{{Path: []string{"a", "b"}, Length: 1}, {Path: []string{"c"}, Length: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infoHashes := fake.queries("INSERT INTO infohashes")
+	if len(infoHashes) != 1 || len(infoHashes[0].args) != 6 ||
+		!strings.Contains(infoHashes[0].query, "ON CONFLICT (info_hash)") {
+		t.Fatalf("unexpected infohashes insert %v", infoHashes)
+	}
+	for i := 0; i < 6; i += 3 {
+		args := infoHashes[0].args[i:]
+		if string(args[0].([]byte)) == "mnopqrstuvwxyz123456" &&
+			(!args[1].(time.Time).Equal(t1) || !args[2].(time.Time).Equal(t2)) {
+			t.Errorf("unexpected first and last sightings %v", args)
+		}
+	}
+
+	sightings := fake.queries("INSERT INTO peer_sightings")
+	if len(sightings) != 1 || len(sightings[0].args) != 3*8 {
+		t.Fatalf("unexpected sightings insert %v", sightings)
+	}
+	if args := sightings[0].args; args[1] != "get_peers" || args[5] != nil ||
+		args[9] != "announce" || args[13] != "FR" || args[14] != nil || args[15] != int64(3215) {
+		t.Errorf("unexpected sightings %v", args)
+	}
+
+	if len(fake.queries("UPDATE infohashes")) != 1 {
+		t.Error("expected the metadata stored")
+	}
+	if files := fake.queries("INSERT INTO files"); len(files) != 1 || files[0].args[1] != "a/b" {
+		t.Errorf("unexpected files insert %v", files)
+	}
+	if fake.commits != 1 {
+		t.Errorf("expected a transaction, got %d", fake.commits)
+	}
+
+	if err := s.Close(); err != nil || fake.commits != 1 {
+		t.Error("expected nothing left to flush")
+	}
+}
+
+func TestSinkFailure(t *testing.T) {
+	fake := &fakeDB{version: 1 << 20}
+	db := sql.OpenDB(fake)
+	defer db.Close()
+
+	s, err := New(context.Background(), db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.fail = "INSERT INTO peer_sightings"
+	s.Write(dhtlistener.PeerAnnounced{InfoHash: "mnopqrstuvwxyz123456", IP: "1.2.3.4", Port: 1})
+	if err := s.Flush(); err == nil {
+		t.Fatal("expected the insert to fail")
+	}
+	if fake.commits != 0 || fake.rollbacks != 1 {
+		t.Errorf("expected a rollback, got %d commits %d rollbacks", fake.commits, fake.rollbacks)
+	}
+
+	// the failed batch is dropped.
+	fake.fail = ""
+	if err := s.Flush(); err != nil || len(fake.queries("INSERT INTO infohashes")) != 1 {
+		t.Error("expected the failed batch dropped")
+	}
+}
+
+func TestInsertRows(t *testing.T) {
+	fake := &fakeDB{}
+	db := sql.OpenDB(fake)
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	rows := make([][]interface{}, maxRows*2+1)
+	for i := range rows {
+		rows[i] = []interface{}{i, "x"}
+	}
+	if err := insert(context.Background(), tx, "t", []string{"a", "b"}, " ON CONFLICT DO NOTHING", rows); err != nil {
+		t.Fatal(err)
+	}
+
+	execs := fake.queries("INSERT INTO t")
+	if len(execs) != 3 || len(execs[0].args) != maxRows*2 || len(execs[2].args) != 2 {
+		t.Fatalf("expected 3 statements of at most %d rows", maxRows)
+	}
+	if q := execs[2].query; q != "INSERT INTO t (a, b) VALUES ($1, $2) ON CONFLICT DO NOTHING" {
+		t.Errorf("unexpected statement %q", q)
+	}
+}
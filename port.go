@@ -0,0 +1,68 @@
+package dhtlistener
+
+import (
+	"errors"
+	"net"
+)
+
+// The ImpliedPortPolicies, how the implied_port flag of the announce_peer
+// queries is handled.
+const (
+	// ImpliedPortHonor announces the source port of the query, as BEP 5
+	// asks.
+	ImpliedPortHonor = iota
+	// ImpliedPortIgnore announces the port argument as if the flag wasn't
+	// set.
+	ImpliedPortIgnore
+	// ImpliedPortReject rejects the queries setting the flag.
+	ImpliedPortReject
+)
+
+var impliedPortPolicies = map[string]int{
+	"honor":  ImpliedPortHonor,
+	"ignore": ImpliedPortIgnore,
+	"reject": ImpliedPortReject,
+}
+
+// parseImpliedPortPolicy returns the ImpliedPortPolicy named s.
+func parseImpliedPortPolicy(s string) (int, error) {
+	p, ok := impliedPortPolicies[s]
+	if !ok {
+		return 0, errors.New("unknown implied port policy " + s)
+	}
+	return p, nil
+}
+
+// minAnnouncePort returns the lowest port accepted from the announce_peer
+// queries.
+func (dht *DHT) minAnnouncePort() int {
+	if dht.MinAnnouncePort > 0 {
+		return dht.MinAnnouncePort
+	}
+	return 1
+}
+
+// announcedPort returns the peer port of the announce_peer query a of addr,
+// or why it's rejected.
+func (dht *DHT) announcedPort(addr *net.UDPAddr, a *AnnouncePeerArgs) (int, error) {
+	if a.ImpliedPort != 0 && a.ImpliedPort != 1 && dht.strict() {
+		return 0, errors.New("invalid implied_port")
+	}
+
+	port := a.Port
+	if a.ImpliedPort != 0 {
+		switch dht.ImpliedPortPolicy {
+		case ImpliedPortHonor:
+			port = addr.Port
+		case ImpliedPortReject:
+			return 0, errors.New("implied_port not accepted")
+		}
+	} else if dht.MatchAnnouncePort && port != addr.Port {
+		return 0, errors.New("port is not the source port")
+	}
+
+	if port < dht.minAnnouncePort() || port > 65535 {
+		return 0, errors.New("invalid port")
+	}
+	return port, nil
+}
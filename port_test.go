@@ -0,0 +1,51 @@
+package dhtlistener
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAnnouncedPort(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+
+	for _, c := range []struct {
+		minPort, policy, parseMode int
+		match                      bool
+		implied, port              int
+		want                       int // 0 if rejected
+	}{
+		{0, ImpliedPortHonor, ParseLenient, false, 0, 51413, 51413},
+		{0, ImpliedPortHonor, ParseLenient, false, 0, 0, 0},
+		{0, ImpliedPortHonor, ParseLenient, false, 0, 65536, 0},
+		{0, ImpliedPortHonor, ParseLenient, false, 1, 0, 6881},
+		{0, ImpliedPortHonor, ParseLenient, false, 2, 0, 6881},
+		{0, ImpliedPortHonor, ParseStrict, false, 2, 0, 0},
+		{0, ImpliedPortIgnore, ParseLenient, false, 1, 51413, 51413},
+		{0, ImpliedPortIgnore, ParseLenient, false, 1, 0, 0},
+		{0, ImpliedPortReject, ParseLenient, false, 1, 51413, 0},
+		{0, ImpliedPortReject, ParseLenient, false, 0, 51413, 51413},
+		{1024, ImpliedPortHonor, ParseLenient, false, 0, 80, 0},
+		{1024, ImpliedPortHonor, ParseLenient, false, 0, 1024, 1024},
+		{7000, ImpliedPortHonor, ParseLenient, false, 1, 7000, 0},
+		{0, ImpliedPortHonor, ParseLenient, true, 0, 51413, 0},
+		{0, ImpliedPortHonor, ParseLenient, true, 0, 6881, 6881},
+		{0, ImpliedPortIgnore, ParseLenient, true, 1, 51413, 51413},
+	} {
+		dht := &DHT{MinAnnouncePort: c.minPort, ImpliedPortPolicy: c.policy, MatchAnnouncePort: c.match,
+			ParseMode: c.parseMode}
+		port, err := dht.announcedPort(addr, &AnnouncePeerArgs{ImpliedPort: c.implied, Port: c.port})
+		if c.want == 0 && err == nil || c.want != 0 && (err != nil || port != c.want) {
+			t.Errorf("%+v: got %d, %v", c, port, err)
+		}
+	}
+}
+
+func TestParseImpliedPortPolicy(t *testing.T) {
+	if p, err := parseImpliedPortPolicy("reject"); err != nil || p != ImpliedPortReject {
+		t.Errorf("expected ImpliedPortReject, got %d, %v", p, err)
+	}
+	c := &Config{ImpliedPortPolicy: "drop"}
+	if err := c.Validate(); err == nil {
+		t.Error("expected an unknown policy to be invalid")
+	}
+}
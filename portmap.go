@@ -0,0 +1,62 @@
+package dhtlistener
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// PortMapper maps a port of the gateway to a local one, see the nat
+// package for NAT-PMP and UPnP-IGD implementations.
+type PortMapper interface {
+	// AddPortMapping maps the external port to the internal one for
+	// lifetime and returns the external port actually mapped.
+	AddPortMapping(protocol string, internal, external int, lifetime time.Duration) (int, error)
+	// DeletePortMapping removes a mapping made by AddPortMapping.
+	DeletePortMapping(protocol string, internal, external int) error
+}
+
+// localPort returns the port of our socket.
+func (dht *DHT) localPort() int {
+	return dht.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// mapPort maps our port on the gateway, then renews the mapping every half
+// PortMapLifetime until the dht is closed.
+func (dht *DHT) mapPort() {
+	internal := dht.localPort()
+
+	renew := func() {
+		external, err := dht.PortMapper.AddPortMapping(
+			"udp", internal, internal, dht.PortMapLifetime)
+		if err != nil {
+			dht.Logger.Warn("port mapping failed", F("port", internal), F("err", err))
+			return
+		}
+
+		if old := atomic.SwapInt32(&dht.mappedPort, int32(external)); old != int32(external) {
+			dht.Logger.Info("port mapped", F("internal", internal), F("external", external))
+		}
+	}
+
+	renew()
+	dht.every(dht.PortMapLifetime/2, renew)
+}
+
+// unmapPort removes the mapping of mapPort, if any.
+func (dht *DHT) unmapPort() {
+	external := atomic.SwapInt32(&dht.mappedPort, 0)
+	if dht.PortMapper == nil || external == 0 {
+		return
+	}
+
+	if err := dht.PortMapper.DeletePortMapping("udp", dht.localPort(), int(external)); err != nil {
+		dht.Logger.Warn("port unmapping failed", F("port", external), F("err", err))
+	}
+}
+
+// MappedPort returns the external port mapped on the gateway by PortMapper,
+// 0 if none.
+func (dht *DHT) MappedPort() int {
+	return int(atomic.LoadInt32(&dht.mappedPort))
+}
@@ -0,0 +1,66 @@
+package dhtlistener
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeMapper struct {
+	sync.Mutex
+	added   int
+	deleted []int
+}
+
+func (m *fakeMapper) AddPortMapping(protocol string, internal, external int, lifetime time.Duration) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.added++
+	return 40000, nil
+}
+
+func (m *fakeMapper) DeletePortMapping(protocol string, internal, external int) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.deleted = append(m.deleted, external)
+	return nil
+}
+
+func TestPortMapping(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.EntranceAddrs = nil
+	dht.PortMapLifetime = 40 * time.Millisecond
+
+	mapper := &fakeMapper{}
+	dht.PortMapper = mapper
+
+	go dht.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	if dht.MappedPort() != 40000 {
+		t.Fatal("expected port 40000 to be mapped, got", dht.MappedPort())
+	}
+
+	if err := dht.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mapper.Lock()
+	defer mapper.Unlock()
+
+	if mapper.added < 2 {
+		t.Fatal("expected the mapping to be renewed, added", mapper.added)
+	}
+	if len(mapper.deleted) != 1 || mapper.deleted[0] != 40000 {
+		t.Fatal("expected the mapping to be deleted once, got", mapper.deleted)
+	}
+	if dht.MappedPort() != 0 {
+		t.Fatal("expected no mapped port once closed")
+	}
+}
@@ -0,0 +1,161 @@
+package dhtlistener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// QueryHandler answers a custom query of addr whose arguments are args. It
+// returns the response, whose "id" defaults to ours, or an error sent as a
+// krpc error, 201 unless it's a *KRPCError.
+type QueryHandler func(addr *net.UDPAddr, args map[string]interface{}) (map[string]interface{}, error)
+
+// KRPCError is a krpc error returned by a QueryHandler, or received by
+// Query.
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("error %d: %s", e.Code, e.Message)
+}
+
+// RegisterQueryHandler makes h answer the queries of type method instead
+// of the 204 "Method Unknown" error, a nil h removes it. The built-in
+// queries can't be replaced. It may be called while the dht runs.
+func (dht *DHT) RegisterQueryHandler(method string, h QueryHandler) error {
+	switch method {
+	case pingType, findNodeType, getPeersType, announcePeerType, getType, putType:
+		return errors.New("built-in query " + method)
+	}
+
+	dht.queryMu.Lock()
+	defer dht.queryMu.Unlock()
+
+	if h == nil {
+		delete(dht.queryHandlers, method)
+		return nil
+	}
+	if dht.queryHandlers == nil {
+		dht.queryHandlers = make(map[string]QueryHandler)
+	}
+	dht.queryHandlers[method] = h
+	return nil
+}
+
+// queryHandler returns the handler of the queries of type q, nil if none.
+func (dht *DHT) queryHandler(q string) QueryHandler {
+	dht.queryMu.RLock()
+	defer dht.queryMu.RUnlock()
+
+	return dht.queryHandlers[q]
+}
+
+// answerQuery sends the response of h to the custom query msg of addr,
+// args are its decoded arguments.
+func answerQuery(dht *DHT, addr *net.UDPAddr, msg *rawMessage, h QueryHandler, args map[string]interface{}) {
+	r, err := h(addr, args)
+	if err != nil {
+		var ke *KRPCError
+		if errors.As(err, &ke) {
+			send(dht, addr, makeError(msg.T, ke.Code, ke.Message))
+		} else {
+			send(dht, addr, makeError(msg.T, genericError, err.Error()))
+		}
+		return
+	}
+
+	if r == nil {
+		r = make(map[string]interface{})
+	}
+	if _, ok := r["id"]; !ok {
+		id, _ := args["id"].(string)
+		r["id"] = dht.idFor(id)
+	}
+	send(dht, addr, makeResponse(msg.T, r))
+}
+
+var (
+	errNotRunning   = errors.New("dht not running")
+	errQueryDropped = errors.New("query dropped")
+	errQueryBusy    = errors.New("same query in flight")
+)
+
+// queryReply is the outcome of a query sent by Query.
+type queryReply struct {
+	r   map[string]interface{}
+	err error
+}
+
+// reply passes the outcome of q to its Query caller, if any.
+func (q *query) reply(r map[string]interface{}, err error) {
+	if q.replies == nil {
+		return
+	}
+	select {
+	case q.replies <- queryReply{r, err}:
+	default:
+	}
+}
+
+// Query sends the custom query method with args to addr, through the
+// transactions like the built-in queries, and waits for its response. args
+// gets our "id" unless it has one. The error is a *KRPCError sent back, an
+// *Error of kind ErrTimeout or ErrSend, or the one of ctx. The dht must be
+// running.
+func (dht *DHT) Query(ctx context.Context, addr *net.UDPAddr, method string,
+	args map[string]interface{}) (map[string]interface{}, error) {
+
+	a := make(map[string]interface{}, len(args)+1)
+	for k, v := range args {
+		a[k] = v
+	}
+	if _, ok := a["id"]; !ok {
+		a["id"] = dht.idFor("")
+	}
+	return dht.sendWait(ctx, &node{addr: addr}, method, a)
+}
+
+// sendWait sends the query method with the arguments a to no and waits for
+// its response, like Query. The response is nil for the built-in queries,
+// only the success is reported, but for ping and find_node whose "id" and
+// "nodes" are passed.
+func (dht *DHT) sendWait(ctx context.Context, no *node, method string,
+	a interface{}) (map[string]interface{}, error) {
+
+	if !dht.initialized() {
+		return nil, errNotRunning
+	}
+	tm := dht.transacts
+	if ip := no.address().IP; dht.Blocklist.Blocked(ip) || dht.bans.banned(ip, dht.now()) {
+		return nil, errors.New("address blocked")
+	}
+	if tm.full() {
+		atomic.AddUint64(&tm.rejected, 1)
+		return nil, errQueryDropped
+	}
+
+	replies := make(chan queryReply, 1)
+	q := &query{
+		tar:     no,
+		msg:     makeQuery(tm.genTransID(), method, a),
+		replies: replies,
+		ctx:     ctx,
+	}
+	if tm.enqueue(q) {
+		atomic.AddUint64(&tm.dropped, 1)
+	}
+
+	select {
+	case rep := <-replies:
+		return rep.r, rep.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-dht.done:
+		return nil, errClosed
+	}
+}
@@ -0,0 +1,169 @@
+package dhtlistener
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRegisterQueryHandler(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.LocalAddr().(*net.UDPAddr)
+
+	// query sends a query of type q to dht and returns its reply.
+	query := func(q string) map[string]interface{} {
+		data, _ := Marshal(makeQuery("aa", q, map[string]interface{}{
+			"id":  GetRandString(20),
+			"arg": "x",
+		}))
+		handle(dht, packet{data: data, raddr: addr})
+
+		buf := make([]byte, 1500)
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := l.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("%s: no reply: %v", q, err)
+		}
+		var reply map[string]interface{}
+		if err := Unmarshal(buf[:n], &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	reply := query("vote")
+	if e, ok := reply["e"].([]interface{}); !ok || len(e) != 2 || e[0] != unknownError {
+		t.Errorf("expected a 204 error, got %v", reply)
+	}
+
+	if err := dht.RegisterQueryHandler(pingType, nil); err == nil {
+		t.Error("expected built-in queries not to be replaced")
+	}
+
+	dht.RegisterQueryHandler("vote", func(addr *net.UDPAddr, args map[string]interface{}) (map[string]interface{}, error) {
+		if args["arg"] != "x" {
+			return nil, errors.New("bad arg")
+		}
+		return map[string]interface{}{"v": 1}, nil
+	})
+	reply = query("vote")
+	r, ok := reply["r"].(map[string]interface{})
+	if !ok || r["v"] != 1 || r["id"] != dht.me.id.RawString() {
+		t.Errorf("expected a response, got %v", reply)
+	}
+
+	dht.RegisterQueryHandler("vote", func(addr *net.UDPAddr, args map[string]interface{}) (map[string]interface{}, error) {
+		return nil, &KRPCError{Code: 202, Message: "busy"}
+	})
+	reply = query("vote")
+	if e, ok := reply["e"].([]interface{}); !ok || len(e) != 2 || e[0] != 202 || e[1] != "busy" {
+		t.Errorf("expected a 202 error, got %v", reply)
+	}
+
+	dht.RegisterQueryHandler("vote", nil)
+	reply = query("vote")
+	if e, ok := reply["e"].([]interface{}); !ok || e[0] != unknownError {
+		t.Errorf("expected a 204 error once removed, got %v", reply)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	mem := &memNet{}
+	addrA := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	addrB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+
+	a, err := New(WithTransport(mem.listen(addrA)), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(WithTransport(mem.listen(addrB)), WithBootstrapNodes(addrA.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.RegisterQueryHandler("echo", func(addr *net.UDPAddr, args map[string]interface{}) (map[string]interface{}, error) {
+		if _, ok := args["fail"]; ok {
+			return nil, &KRPCError{Code: 202, Message: "failed"}
+		}
+		return map[string]interface{}{"echo": args["msg"]}, nil
+	})
+
+	for _, dht := range []*DHT{a, b} {
+		dht.rt = newRouteTable(dht) // before Run, read below
+		go dht.Run()
+		defer func(dht *DHT) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			dht.Close(ctx)
+		}(dht)
+	}
+	if !waitUntil(func() bool { return hasNode(b, addrA.String()) }) {
+		t.Fatal("b should join a")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r, err := b.Query(ctx, addrA, "echo", map[string]interface{}{"msg": "hi"})
+	if err != nil || r["echo"] != "hi" || r["id"] != a.me.id.RawString() {
+		t.Errorf("expected the echo of a, got %v, %v", r, err)
+	}
+
+	var ke *KRPCError
+	_, err = b.Query(ctx, addrA, "echo", map[string]interface{}{"fail": 1})
+	if !errors.As(err, &ke) || ke.Code != 202 {
+		t.Errorf("expected a 202 error, got %v", err)
+	}
+
+	_, err = b.Query(ctx, addrA, "unknown", nil)
+	if !errors.As(err, &ke) || ke.Code != unknownError {
+		t.Errorf("expected a 204 error, got %v", err)
+	}
+}
+
+func TestQueryStarting(t *testing.T) {
+	dht, err := New(WithAddr("127.0.0.1:0"), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	if _, err := dht.Query(context.Background(), addr, "vote", nil); err != errNotRunning {
+		t.Fatalf("expected errNotRunning, got %v", err)
+	}
+
+	// the queries are sent while Run initializes the dht.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			dht.Query(ctx, addr, "vote", nil)
+			cancel()
+			select {
+			case <-dht.Started():
+				return
+			default:
+			}
+		}
+	}()
+
+	go dht.Run()
+	<-done
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dht.Close(ctx)
+}
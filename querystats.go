@@ -0,0 +1,151 @@
+package dhtlistener
+
+import (
+	"sync"
+)
+
+const (
+	// queryStatsWeight is the weight of an outcome in the recent rates of
+	// a query type.
+	queryStatsWeight = 0.05
+	// minRetryRate is the recent rate of retransmitted queries answered
+	// under which AdaptiveTries stops retransmitting.
+	minRetryRate = 0.05
+	// retryProbe is how often, every retryProbe transactions, a query type
+	// retransmitting rarely answered is sent Try times anyway, to measure
+	// its rate again.
+	retryProbe = 10
+)
+
+// queryTypes are the types of the queries sent, whose tries QueryTries
+// sets.
+var queryTypes = map[string]bool{
+	pingType:             true,
+	findNodeType:         true,
+	getPeersType:         true,
+	announcePeerType:     true,
+	getType:              true,
+	putType:              true,
+	sampleInfoHashesType: true,
+}
+
+// QueryStats counts the transactions of a query type.
+type QueryStats struct {
+	Transactions uint64  `json:"transactions"` // finished
+	Answered     uint64  `json:"answered"`
+	TimedOut     uint64  `json:"timed_out"`
+	Retried      uint64  `json:"retried"`       // sent several times
+	RetryAnswers uint64  `json:"retry_answers"` // answered once retried
+	SuccessRate  float64 `json:"success_rate"`  // recent, in [0, 1]
+	RetryRate    float64 `json:"retry_rate"`    // recent retried ones answered
+	Tries        int     `json:"tries"`         // of the next transaction
+}
+
+// QueryTypeStats are the QueryStats by query type.
+type QueryTypeStats map[string]QueryStats
+
+// queryTypeStats is the state of a query type.
+type queryTypeStats struct {
+	QueryStats
+	started uint64 // transactions started
+}
+
+// queryStats tracks the outcome of the transactions by query type.
+type queryStats struct {
+	sync.Mutex
+	types map[string]*queryTypeStats
+}
+
+// newQueryStats returns a new queryStats pointer.
+func newQueryStats() *queryStats {
+	return &queryStats{types: make(map[string]*queryTypeStats)}
+}
+
+// get returns the state of the query type q, the caller holds the lock.
+func (qs *queryStats) get(q string) *queryTypeStats {
+	s, ok := qs.types[q]
+	if !ok {
+		s = &queryTypeStats{QueryStats: QueryStats{SuccessRate: 1, RetryRate: 1}}
+		qs.types[q] = s
+	}
+	return s
+}
+
+// ewma moves the recent rate toward v.
+func ewma(rate, v float64) float64 {
+	return rate + queryStatsWeight*(v-rate)
+}
+
+// finish records the outcome of a transaction of q sent tries times.
+func (qs *queryStats) finish(q string, tries int, answered bool) {
+	qs.Lock()
+	defer qs.Unlock()
+
+	s, v := qs.get(q), 0.0
+	if answered {
+		v = 1
+	}
+
+	s.Transactions++
+	if answered {
+		s.Answered++
+	} else {
+		s.TimedOut++
+	}
+	s.SuccessRate = ewma(s.SuccessRate, v)
+
+	if tries > 1 {
+		s.Retried++
+		if answered {
+			s.RetryAnswers++
+		}
+		s.RetryRate = ewma(s.RetryRate, v)
+	}
+}
+
+// tries returns how many times a query of type q is sent: its QueryTries,
+// else Try. With AdaptiveTries, the query is sent once while few retried
+// ones are answered.
+func (dht *DHT) tries(q string) int {
+	tries := dht.Try
+	if n, ok := dht.QueryTries[q]; ok && n > 0 {
+		tries = n
+	}
+	if !dht.AdaptiveTries || tries <= 1 {
+		return tries
+	}
+
+	dht.queryStats.Lock()
+	defer dht.queryStats.Unlock()
+
+	s := dht.queryStats.get(q)
+	s.started++
+	if s.RetryRate < minRetryRate && s.started%retryProbe != 0 {
+		return 1
+	}
+	return tries
+}
+
+// QueryStats returns the outcome of the transactions by query type.
+func (dht *DHT) QueryStats() QueryTypeStats {
+	qs := dht.queryStats
+	if qs == nil {
+		return nil
+	}
+	qs.Lock()
+	defer qs.Unlock()
+
+	ret := make(QueryTypeStats, len(qs.types))
+	for q, s := range qs.types {
+		stats := s.QueryStats
+		stats.Tries = dht.Try
+		if n, ok := dht.QueryTries[q]; ok && n > 0 {
+			stats.Tries = n
+		}
+		if dht.AdaptiveTries && stats.Tries > 1 && s.RetryRate < minRetryRate {
+			stats.Tries = 1
+		}
+		ret[q] = stats
+	}
+	return ret
+}
@@ -0,0 +1,86 @@
+package dhtlistener
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQueryTries(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	dht.QueryTries = map[string]int{pingType: 1, getPeersType: 4}
+	if dht.tries(pingType) != 1 || dht.tries(getPeersType) != 4 || dht.tries(findNodeType) != dht.Try {
+		t.Error("expected the tries of the query type")
+	}
+
+	// retried get_peers are never answered.
+	dht.AdaptiveTries = true
+	for i := 0; i < 100; i++ {
+		dht.queryStats.finish(getPeersType, 4, false)
+	}
+	once := 0
+	for i := 0; i < 100; i++ {
+		if dht.tries(getPeersType) == 1 {
+			once++
+		}
+	}
+	if once != 90 {
+		t.Errorf("expected 90 get_peers sent once, got %d", once)
+	}
+	if dht.tries(findNodeType) != dht.Try {
+		t.Error("expected find_node to be retried")
+	}
+
+	s := dht.QueryStats()[getPeersType]
+	if s.Transactions != 100 || s.TimedOut != 100 || s.Retried != 100 || s.Tries != 1 ||
+		s.SuccessRate >= minRetryRate || s.RetryRate >= minRetryRate {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestQueryStats(t *testing.T) {
+	mem := &memNet{}
+	addrA := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	addrB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+
+	a, err := New(WithTransport(mem.listen(addrA)), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(WithTransport(mem.listen(addrB)), WithBootstrapNodes(addrA.String()),
+		WithQueryTries(pingType, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.QueryTimeout, b.MinQueryTimeout = 50*time.Millisecond, 50*time.Millisecond
+
+	for _, dht := range []*DHT{a, b} {
+		dht.rt = newRouteTable(dht) // before Run, read below
+		go dht.Run()
+		defer func(dht *DHT) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			dht.Close(ctx)
+		}(dht)
+	}
+
+	if !waitUntil(func() bool { return hasNode(b, addrA.String()) }) {
+		t.Fatal("b should join a")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := b.Ping(ctx, addrA); err != nil {
+		t.Fatal(err)
+	}
+	unknown := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 6881}
+	if _, err := b.Ping(ctx, unknown); err == nil {
+		t.Fatal("expected an unanswered ping to fail")
+	}
+
+	s := b.Stats().Queries[pingType]
+	if s.Answered == 0 || s.TimedOut != 1 || s.Retried != 0 || s.Tries != 1 || s.SuccessRate >= 1 {
+		t.Errorf("unexpected ping stats %+v", s)
+	}
+}
@@ -0,0 +1,166 @@
+package dhtlistener
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// packetQueue is a bounded ring buffer of received packets, consumed by a
+// fixed pool of workers. When it's full, its policy applies:
+//
+//   - DropNewest discards the packet being pushed.
+//   - DropOldest discards the oldest queued packet to make room.
+//   - Block waits for room, the kernel socket buffer absorbs the overflow
+//     and drops packets once it's full.
+type packetQueue struct {
+	sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	buf      []packet
+	head     int
+	size     int
+	policy   int
+	closed   bool
+}
+
+// newPacketQueue returns a new packetQueue pointer holding at most size
+// packets.
+func newPacketQueue(size, policy int) *packetQueue {
+	if size < 1 {
+		size = 1
+	}
+
+	q := &packetQueue{
+		buf:    make([]packet, size),
+		policy: policy,
+	}
+	q.notEmpty = sync.NewCond(q)
+	q.notFull = sync.NewCond(q)
+	return q
+}
+
+// push adds pkt to the queue. It returns the packet dropped by the policy,
+// if any.
+func (q *packetQueue) push(pkt packet) (dropped packet, ok bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	for q.policy == Block && q.size == len(q.buf) && !q.closed {
+		q.notFull.Wait()
+	}
+
+	switch {
+	case q.closed:
+		return pkt, true
+	case q.size < len(q.buf):
+		q.buf[(q.head+q.size)%len(q.buf)] = pkt
+		q.size++
+	case q.policy == DropOldest:
+		dropped, ok = q.buf[q.head], true
+		q.buf[q.head] = pkt
+		q.head = (q.head + 1) % len(q.buf)
+	default:
+		return pkt, true
+	}
+
+	q.notEmpty.Signal()
+	return
+}
+
+// pop removes and returns the oldest packet, it waits until there's one. It
+// returns false once the queue is closed.
+func (q *packetQueue) pop() (packet, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	for q.size == 0 && !q.closed {
+		q.notEmpty.Wait()
+	}
+	if q.closed {
+		return packet{}, false
+	}
+
+	pkt := q.buf[q.head]
+	q.buf[q.head] = packet{}
+	q.head = (q.head + 1) % len(q.buf)
+	q.size--
+
+	q.notFull.Signal()
+	return pkt, true
+}
+
+// popUntil is pop giving up at deadline.
+func (q *packetQueue) popUntil(deadline time.Time) (packet, bool) {
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		q.Lock()
+		q.notEmpty.Broadcast()
+		q.Unlock()
+	})
+	defer timer.Stop()
+
+	q.Lock()
+	for q.size == 0 && !q.closed && time.Now().Before(deadline) {
+		q.notEmpty.Wait()
+	}
+	empty := q.size == 0
+	q.Unlock()
+
+	if empty {
+		return packet{}, false
+	}
+	return q.pop()
+}
+
+// len returns how many packets are queued.
+func (q *packetQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.size
+}
+
+// close wakes up the workers and the blocked readers, the queued packets
+// are released.
+func (q *packetQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+
+	for ; q.size > 0; q.size-- {
+		q.buf[q.head].release()
+		q.buf[q.head] = packet{}
+		q.head = (q.head + 1) % len(q.buf)
+	}
+
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// enqueue queues pkt for the workers, counting the packets dropped by the
+// queue policy.
+func (dht *DHT) enqueue(pkt packet) {
+	if dropped, ok := dht.queue.push(pkt); ok {
+		dropped.release()
+		atomic.AddUint64(&dht.metrics.worksDropped, 1)
+		dht.Logger.Debug("packet dropped, queue full", F("addr", dropped.raddr))
+	}
+}
+
+// work handles the queued packets until the queue is closed.
+func (dht *DHT) work() {
+	for pkt, ok := dht.queue.pop(); ok; pkt, ok = dht.queue.pop() {
+		handle(dht, pkt)
+		pkt.release()
+	}
+}
+
+// DroppedPackets returns how many received packets have been dropped
+// because the queue was full.
+func (dht *DHT) DroppedPackets() uint64 {
+	return atomic.LoadUint64(&dht.metrics.worksDropped)
+}
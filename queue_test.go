@@ -0,0 +1,74 @@
+package dhtlistener
+
+import (
+	"testing"
+	"time"
+)
+
+func pkts(q *packetQueue) []int {
+	ret := make([]int, 0, q.len())
+	for q.len() != 0 {
+		pkt, _ := q.pop()
+		ret = append(ret, len(pkt.data))
+	}
+	return ret
+}
+
+func TestPacketQueueDrop(t *testing.T) {
+	for _, c := range []struct {
+		policy   int
+		dropped  int
+		expected []int
+	}{
+		{DropNewest, 3, []int{1, 2}},
+		{DropOldest, 1, []int{2, 3}},
+	} {
+		q := newPacketQueue(2, c.policy)
+		for i := 1; i <= 3; i++ {
+			dropped, ok := q.push(packet{data: make([]byte, i)})
+			if ok != (i == 3) {
+				t.Fatalf("policy %d: unexpected drop of packet %d", c.policy, i)
+			}
+			if ok && len(dropped.data) != c.dropped {
+				t.Fatalf("policy %d: dropped %d", c.policy, len(dropped.data))
+			}
+		}
+
+		got := pkts(q)
+		if len(got) != 2 || got[0] != c.expected[0] || got[1] != c.expected[1] {
+			t.Fatalf("policy %d: expected %v, got %v", c.policy, c.expected, got)
+		}
+	}
+}
+
+func TestPacketQueueBlock(t *testing.T) {
+	q := newPacketQueue(1, Block)
+	q.push(packet{data: make([]byte, 1)})
+
+	pushed := make(chan bool)
+	go func() {
+		_, dropped := q.push(packet{data: make([]byte, 2)})
+		pushed <- !dropped
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("push should block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if pkt, _ := q.pop(); len(pkt.data) != 1 {
+		t.Fatal("expected the first packet")
+	}
+	if !<-pushed {
+		t.Fatal("expected the second packet to be queued")
+	}
+
+	q.close()
+	if _, ok := q.pop(); ok {
+		t.Fatal("pop should fail once the queue is closed")
+	}
+	if _, dropped := q.push(packet{}); !dropped {
+		t.Fatal("push should drop once the queue is closed")
+	}
+}
@@ -0,0 +1,224 @@
+package dhtlistener
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket refills rate tokens per second up to burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last call.
+func (tb *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if tb.last.IsZero() {
+		tb.tokens = burst
+	} else if now.After(tb.last) {
+		tb.tokens += now.Sub(tb.last).Seconds() * rate
+		if tb.tokens > burst {
+			tb.tokens = burst
+		}
+	}
+	tb.last = now
+}
+
+// take takes n tokens if available. A rate of 0 means no limit.
+func (tb *tokenBucket) take(now time.Time, n, rate, burst float64) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	tb.refill(now, rate, burst)
+	if tb.tokens < n {
+		return false
+	}
+	tb.tokens -= n
+	return true
+}
+
+// reserve takes n tokens, going into debt if needed, and returns how long
+// to wait until the debt is paid. A rate of 0 means no limit.
+func (tb *tokenBucket) reserve(now time.Time, n, rate, burst float64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+
+	tb.refill(now, rate, burst)
+	tb.tokens -= n
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / rate * float64(time.Second))
+}
+
+// full returns whether the bucket would be refilled at now.
+func (tb *tokenBucket) full(now time.Time, rate, burst float64) bool {
+	return tb.tokens+now.Sub(tb.last).Seconds()*rate >= burst
+}
+
+// maxLimitedIPs bounds the buckets of an ipLimiter.
+const maxLimitedIPs = 1 << 16
+
+// ipLimiter limits the queries per source ip, and overall.
+type ipLimiter struct {
+	sync.Mutex
+	rate        float64
+	burst       float64
+	globalRate  float64
+	globalBurst float64
+	global      tokenBucket
+	buckets     map[string]*tokenBucket // ip : bucket
+	throttled   uint64                  // accessed atomically
+}
+
+// newIPLimiter returns a new ipLimiter pointer.
+func newIPLimiter(rate float64, burst int, globalRate float64, globalBurst int) *ipLimiter {
+	l := &ipLimiter{buckets: make(map[string]*tokenBucket)}
+	l.setRate(rate, burst, globalRate, globalBurst)
+	return l
+}
+
+// burstOf returns burst, or a second of rate but at least 1 if it's 0.
+func burstOf(rate float64, burst int) float64 {
+	if burst > 0 {
+		return float64(burst)
+	}
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// setRate changes the limits, 0 rates mean no limit.
+func (l *ipLimiter) setRate(rate float64, burst int, globalRate float64, globalBurst int) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.rate, l.burst = rate, burstOf(rate, burst)
+	l.globalRate, l.globalBurst = globalRate, burstOf(globalRate, globalBurst)
+}
+
+// allow returns whether a query from ip is allowed.
+func (l *ipLimiter) allow(ip net.IP) bool {
+	now := time.Now()
+	key := string(ip)
+
+	l.Lock()
+	defer l.Unlock()
+
+	tb, ok := l.buckets[key]
+	if !ok && l.rate > 0 {
+		if len(l.buckets) >= maxLimitedIPs {
+			l.sweep(now)
+		}
+		tb = &tokenBucket{}
+		l.buckets[key] = tb
+	}
+
+	if (tb != nil && !tb.take(now, 1, l.rate, l.burst)) ||
+		!l.global.take(now, 1, l.globalRate, l.globalBurst) {
+
+		atomic.AddUint64(&l.throttled, 1)
+		return false
+	}
+	return true
+}
+
+// sweep forgets the ips whose bucket is full, or all of them if none is.
+func (l *ipLimiter) sweep(now time.Time) {
+	for key, tb := range l.buckets {
+		if tb.full(now, l.rate, l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+
+	if len(l.buckets) >= maxLimitedIPs {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+}
+
+// allowQuery returns whether the query from addr is allowed by the rate
+// limits, replying an error to the throttled ones if ReplyThrottled is set.
+func (dht *DHT) allowQuery(addr *net.UDPAddr, t string) bool {
+	if dht.limiter == nil || dht.limiter.allow(addr.IP) {
+		return true
+	}
+
+	dht.Logger.Debug("query throttled", F("addr", addr))
+	if dht.ReplyThrottled {
+		send(dht, addr, makeError(t, genericError, "rate limited"))
+	}
+	return false
+}
+
+// ThrottledQueries returns how many queries have been dropped by the rate
+// limits.
+func (dht *DHT) ThrottledQueries() uint64 {
+	if !dht.initialized() {
+		return 0
+	}
+	return atomic.LoadUint64(&dht.limiter.throttled)
+}
+
+// pacer paces the outgoing packets to a packet and a byte rate, allowing
+// bursts of a second.
+type pacer struct {
+	sync.Mutex
+	packetRate float64
+	byteRate   float64
+	packets    tokenBucket
+	bytes      tokenBucket
+}
+
+// setRate sets the rates, 0 means no limit.
+func (p *pacer) setRate(packets, bytes float64) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.packetRate, p.byteRate = packets, bytes
+	p.packets, p.bytes = tokenBucket{}, tokenBucket{}
+}
+
+// reserve reserves sending a packet of size bytes, and returns how long to
+// wait before sending it.
+func (p *pacer) reserve(size int) time.Duration {
+	now := time.Now()
+
+	p.Lock()
+	defer p.Unlock()
+
+	d := p.packets.reserve(now, 1, p.packetRate, p.packetRate)
+	if bd := p.bytes.reserve(now, float64(size), p.byteRate, p.byteRate); bd > d {
+		d = bd
+	}
+	return d
+}
+
+// pace waits until a packet of size bytes may be sent, it returns false if
+// the dht is closed meanwhile.
+func (dht *DHT) pace(size int) bool {
+	d := dht.pacer.reserve(size)
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-dht.done:
+		return false
+	}
+}
+
+// SetSendRate changes the limits of the outgoing packets per second and
+// bytes per second at runtime, 0 means no limit.
+func (dht *DHT) SetSendRate(packets, bytes float64) {
+	dht.pacer.setRate(packets, bytes)
+}
@@ -0,0 +1,70 @@
+package dhtlistener
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := &tokenBucket{}
+
+	for i := 0; i < 3; i++ {
+		if !tb.take(now, 1, 1, 3) {
+			t.Fatalf("take %d should succeed within the burst", i)
+		}
+	}
+	if tb.take(now, 1, 1, 3) {
+		t.Fatal("take should fail once the burst is spent")
+	}
+	if !tb.take(now.Add(time.Second), 1, 1, 3) {
+		t.Fatal("take should succeed after a refill")
+	}
+	if !tb.take(now, 100, 0, 0) {
+		t.Fatal("a zero rate should not limit")
+	}
+}
+
+func TestIPLimiter(t *testing.T) {
+	a, b := net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8)
+
+	l := newIPLimiter(1, 2, 0, 0)
+	if !l.allow(a) || !l.allow(a) || l.allow(a) {
+		t.Fatal("expected the third query of a to be throttled")
+	}
+	if !l.allow(b) {
+		t.Fatal("b should not be throttled by a")
+	}
+	if l.throttled != 1 {
+		t.Fatal("expected 1 throttled, got", l.throttled)
+	}
+
+	l = newIPLimiter(0, 0, 1, 2)
+	if !l.allow(a) || !l.allow(b) || l.allow(a) {
+		t.Fatal("expected the global cap to throttle")
+	}
+}
+
+func TestPacer(t *testing.T) {
+	p := &pacer{}
+	if p.reserve(1000) != 0 {
+		t.Fatal("a pacer without rate should not wait")
+	}
+
+	p.setRate(2, 0)
+	if p.reserve(100) != 0 || p.reserve(100) != 0 {
+		t.Fatal("expected a burst of 2 packets")
+	}
+	if d := p.reserve(100); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatal("expected to wait about 500ms, got", d)
+	}
+
+	p.setRate(0, 1000)
+	if p.reserve(1000) != 0 {
+		t.Fatal("expected a burst of 1000 bytes")
+	}
+	if d := p.reserve(500); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatal("expected to wait about 500ms, got", d)
+	}
+}
@@ -0,0 +1,91 @@
+package dhtlistener
+
+import (
+	"net"
+	"sync"
+)
+
+// packetSize is the size of the receive buffers, krpc messages are much
+// smaller.
+const packetSize = 8192
+
+// packetBuffers holds the buffers packets are received into.
+var packetBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, packetSize)
+		return &buf
+	},
+}
+
+// release gives the buffer of pkt back once it's handled.
+func (pkt packet) release() {
+	if pkt.buf != nil {
+		packetBuffers.Put(pkt.buf)
+	}
+}
+
+// packetReader reads the packets of a transport, they are stamped with
+// their receive time by readLoop.
+type packetReader interface {
+	// read reads the next packets, it blocks until one is available.
+	read() ([]packet, error)
+}
+
+// newPacketReader returns a packetReader of conn reading at most batch
+// packets at a time, batches are only read from a *net.UDPConn.
+func newPacketReader(conn Transport, batch int) (packetReader, error) {
+	if udp, ok := conn.(*net.UDPConn); ok {
+		return newUDPReader(udp, batch)
+	}
+	return newTransportReader(conn), nil
+}
+
+// transportReader reads one packet at a time.
+type transportReader struct {
+	conn Transport
+	pkts []packet
+}
+
+// newTransportReader returns a new transportReader pointer.
+func newTransportReader(conn Transport) *transportReader {
+	return &transportReader{conn: conn, pkts: make([]packet, 0, 1)}
+}
+
+func (r *transportReader) read() ([]packet, error) {
+	buf := packetBuffers.Get().(*[]byte)
+
+	n, raddr, err := r.conn.ReadFromUDP(*buf)
+	if err != nil {
+		packetBuffers.Put(buf)
+		return nil, err
+	}
+
+	r.pkts = append(r.pkts[:0], packet{data: (*buf)[:n], raddr: raddr, buf: buf})
+	return r.pkts, nil
+}
+
+// readLoop reads the packets of conn and queues them.
+func (dht *DHT) readLoop(conn Transport) {
+	r, err := newPacketReader(conn, dht.ReadBatchSize)
+	if err != nil {
+		dht.Logger.Error("read udp failed", F("err", err))
+		return
+	}
+
+	for {
+		pkts, err := r.read()
+		if err != nil {
+			if dht.closed() {
+				return
+			}
+			dht.Logger.Warn("read udp failed", F("err", err))
+			continue
+		}
+
+		now := dht.now()
+		for _, pkt := range pkts {
+			pkt.recvTime = now
+			dht.enqueue(pkt)
+		}
+	}
+}
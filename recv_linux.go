@@ -0,0 +1,124 @@
+package dhtlistener
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr is the struct mmsghdr of recvmmsg(2).
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// mmsgReader reads batches of packets with a single recvmmsg(2).
+type mmsgReader struct {
+	conn  syscall.RawConn
+	bufs  []*[]byte
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrAny
+	pkts  []packet
+}
+
+// newUDPReader returns a new mmsgReader reading at most batch packets of
+// conn at a time.
+func newUDPReader(conn *net.UDPConn, batch int) (packetReader, error) {
+	if batch < 1 {
+		batch = 1
+	}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &mmsgReader{
+		conn:  rc,
+		bufs:  make([]*[]byte, batch),
+		hdrs:  make([]mmsghdr, batch),
+		iovs:  make([]syscall.Iovec, batch),
+		names: make([]syscall.RawSockaddrAny, batch),
+		pkts:  make([]packet, 0, batch),
+	}
+	for i := range r.hdrs {
+		r.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&r.names[i]))
+		r.hdrs[i].hdr.Iov = &r.iovs[i]
+		r.hdrs[i].hdr.Iovlen = 1
+	}
+	return r, nil
+}
+
+// read reads the next batch of packets, it blocks until one is available.
+func (r *mmsgReader) read() ([]packet, error) {
+	for i := range r.hdrs {
+		if r.bufs[i] == nil {
+			buf := packetBuffers.Get().(*[]byte)
+			r.bufs[i] = buf
+			r.iovs[i].Base = &(*buf)[0]
+			r.iovs[i].SetLen(len(*buf))
+		}
+		r.hdrs[i].hdr.Namelen = syscall.SizeofSockaddrAny
+		r.hdrs[i].hdr.Flags = 0
+		r.hdrs[i].len = 0
+	}
+
+	var (
+		n     int
+		errno syscall.Errno
+	)
+	err := r.conn.Read(func(fd uintptr) bool {
+		m, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd,
+			uintptr(unsafe.Pointer(&r.hdrs[0])), uintptr(len(r.hdrs)), 0, 0, 0)
+		if e == syscall.EAGAIN {
+			return false
+		}
+		n, errno = int(m), e
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+
+	r.pkts = r.pkts[:0]
+	for i := 0; i < n; i++ {
+		buf := r.bufs[i]
+		r.bufs[i] = nil
+
+		// a packet larger than the buffer is truncated, it's not a krpc
+		// message anyway.
+		raddr := sockaddrToUDP(&r.names[i])
+		if raddr == nil || r.hdrs[i].hdr.Flags&syscall.MSG_TRUNC != 0 {
+			packetBuffers.Put(buf)
+			continue
+		}
+		r.pkts = append(r.pkts, packet{data: (*buf)[:r.hdrs[i].len], raddr: raddr, buf: buf})
+	}
+	return r.pkts, nil
+}
+
+// sockaddrToUDP returns the udp address of rsa, or nil if it's not an inet
+// one.
+func sockaddrToUDP(rsa *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, sa.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: int(p[0])<<8 | int(p[1])}
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: int(p[0])<<8 | int(p[1])}
+	}
+	return nil
+}
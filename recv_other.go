@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package dhtlistener
+
+import "net"
+
+// newUDPReader returns a packetReader of conn reading one packet at a time,
+// batch is ignored.
+func newUDPReader(conn *net.UDPConn, batch int) (packetReader, error) {
+	return newTransportReader(conn), nil
+}
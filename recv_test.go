@@ -0,0 +1,147 @@
+package dhtlistener
+
+import (
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestPacketReader(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	r, err := newPacketReader(conn, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := []string{"d1:y1:qe", "d1:y1:re", "d1:y1:ee"}
+	for _, s := range sent {
+		if _, err := client.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := make([]string, 0, len(sent))
+	for len(received) < len(sent) {
+		pkts, err := r.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, pkt := range pkts {
+			if pkt.raddr.String() != client.LocalAddr().String() {
+				t.Fatalf("expected %v, got %v", client.LocalAddr(), pkt.raddr)
+			}
+			received = append(received, string(pkt.data))
+			pkt.release()
+		}
+	}
+
+	for i := range sent {
+		if sent[i] != received[i] {
+			t.Fatalf("expected %q, got %q", sent[i], received[i])
+		}
+	}
+}
+
+func TestPacketWriter(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	w, err := newPacketWriter(conn, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent writes are batched.
+	const n = 20
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			errs <- w.write([]byte("d1:y1:qe"), peer.LocalAddr().(*net.UDPAddr))
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, 64)
+	for i := 0; i < n; i++ {
+		m, raddr, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:m]) != "d1:y1:qe" || raddr.String() != conn.LocalAddr().String() {
+			t.Fatalf("unexpected packet %q from %v", buf[:m], raddr)
+		}
+	}
+
+	if err := w.write([]byte("d1:y1:qe"), &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}); err == nil {
+		t.Error("expected an ipv6 address rejected by an ipv4 socket")
+	}
+}
+
+func TestPacketReaderTruncated(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("truncated packets are only dropped on linux")
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	r, err := newPacketReader(conn, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Write(make([]byte, packetSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("d1:y1:qe")); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		pkts, err := r.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pkts) == 0 {
+			continue
+		}
+		if len(pkts) != 1 || string(pkts[0].data) != "d1:y1:qe" {
+			t.Fatalf("expected the truncated packet dropped, got %d packets", len(pkts))
+		}
+		return
+	}
+}
@@ -0,0 +1,291 @@
+// Package redisstore implements a dhtlistener.PeerStore backed by Redis, so
+// several dhtlistener instances can share one view of announced peers.
+//
+// The peers of an infohash are kept in a sorted set scored by the unix time
+// in milliseconds they were last seen, which a float64 score holds exactly.
+// Every write refreshes the key's TTL, so abandoned infohashes expire by
+// themselves.
+package redisstore
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/2qif49lt/dhtlistener"
+	"github.com/redis/go-redis/v9"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// insert represents a pending write.
+type insert struct {
+	key    string
+	member string
+	score  float64
+}
+
+// Store is a PeerStore backed by Redis. Inserts are buffered and written
+// with pipelines for throughput.
+type Store struct {
+	client    redis.UniversalClient
+	prefix    string
+	ttl       time.Duration
+	batchSize int
+	inserts   chan insert
+	done      chan struct{}
+	wg        sync.WaitGroup
+	dropped   uint64 // accessed atomically
+	errors    uint64 // accessed atomically
+	count     int64  // peers stored, accessed atomically
+	// OnError is called with the errors which can't be returned. It may be
+	// nil.
+	OnError func(error)
+}
+
+// Options holds the settings of a Store.
+type Options struct {
+	// Prefix is prepended to all keys, "dht:peers:" by default.
+	Prefix string
+	// TTL is the expiry of an infohash's key, 30 minutes by default.
+	TTL time.Duration
+	// BatchSize is the max number of inserts per pipeline, 256 by default.
+	BatchSize int
+	// FlushInterval is the max delay of an insert, 100ms by default.
+	FlushInterval time.Duration
+	// QueueSize is the max number of pending inserts, 8192 by default.
+	// Inserts are dropped when the queue is full.
+	QueueSize int
+}
+
+// New returns a Store using client. opts may be nil.
+func New(client redis.UniversalClient, opts *Options) *Store {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Prefix == "" {
+		o.Prefix = "dht:peers:"
+	}
+	if o.TTL <= 0 {
+		o.TTL = time.Minute * 30
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 256
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = time.Millisecond * 100
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = 8192
+	}
+
+	s := &Store{
+		client:    client,
+		prefix:    o.Prefix,
+		ttl:       o.TTL,
+		batchSize: o.BatchSize,
+		inserts:   make(chan insert, o.QueueSize),
+		done:      make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.flushLoop(o.FlushInterval)
+	return s
+}
+
+// Close flushes the pending inserts and stops the store, the client is not
+// closed.
+func (s *Store) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return nil
+}
+
+// Dropped returns how many inserts were dropped because the queue was full.
+func (s *Store) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Errors returns how many errors occurred.
+func (s *Store) Errors() uint64 {
+	return atomic.LoadUint64(&s.errors)
+}
+
+func (s *Store) fail(err error) {
+	atomic.AddUint64(&s.errors, 1)
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+func (s *Store) key(infoHash dhtlistener.InfoHash) string {
+	return s.prefix + infoHash.Hex()
+}
+
+// encodePeer returns the compact ip/port info of the peer.
+func encodePeer(ip net.IP, port int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	member := make([]byte, len(ip)+2)
+	copy(member, ip)
+	binary.BigEndian.PutUint16(member[len(ip):], uint16(port))
+	return string(member)
+}
+
+// decodePeer parses the compact ip/port info and the last seen time.
+func decodePeer(member string, score float64) (*dhtlistener.Peer, bool) {
+	if len(member) != 6 && len(member) != 18 {
+		return nil, false
+	}
+
+	return &dhtlistener.Peer{
+		IP:       net.IP(member[:len(member)-2]),
+		Port:     int(binary.BigEndian.Uint16([]byte(member[len(member)-2:]))),
+		LastSeen: time.UnixMilli(int64(score)),
+	}, true
+}
+
+// Insert queues a peer of infoHash, it never blocks.
+func (s *Store) Insert(infoHash dhtlistener.InfoHash, peer *dhtlistener.Peer) {
+	select {
+	case s.inserts <- insert{
+		key:    s.key(infoHash),
+		member: encodePeer(peer.IP, peer.Port),
+		score:  float64(peer.LastSeen.UnixMilli()),
+	}:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// flushLoop writes the queued inserts in batches.
+func (s *Store) flushLoop(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]insert, 0, s.batchSize)
+	for {
+		select {
+		case in := <-s.inserts:
+			batch = append(batch, in)
+			if len(batch) >= s.batchSize {
+				s.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			s.flush(batch)
+			batch = batch[:0]
+		case <-s.done:
+			for {
+				select {
+				case in := <-s.inserts:
+					batch = append(batch, in)
+				default:
+					s.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush writes batch with one pipeline.
+func (s *Store) flush(batch []insert) {
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	pipe := s.client.Pipeline()
+	added := make([]*redis.IntCmd, len(batch))
+	for i, in := range batch {
+		added[i] = pipe.ZAdd(ctx, in.key, redis.Z{Score: in.score, Member: in.member})
+		pipe.Expire(ctx, in.key, s.ttl)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		s.fail(err)
+	}
+	for _, cmd := range added {
+		atomic.AddInt64(&s.count, cmd.Val())
+	}
+}
+
+// GetPeers returns at most size peers of infoHash, the recent ones first.
+func (s *Store) GetPeers(infoHash dhtlistener.InfoHash, size int) []*dhtlistener.Peer {
+	peers := make([]*dhtlistener.Peer, 0, size)
+	if size <= 0 {
+		return peers
+	}
+
+	zs, err := s.client.ZRevRangeWithScores(
+		context.Background(), s.key(infoHash), 0, int64(size-1)).Result()
+	if err != nil {
+		s.fail(err)
+		return peers
+	}
+
+	for _, z := range zs {
+		member, _ := z.Member.(string)
+		if p, ok := decodePeer(member, z.Score); ok {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// scan calls f with every key of the store.
+func (s *Store) scan(ctx context.Context, f func(key string)) error {
+	var cursor uint64
+	for {
+		keys, next, err := s.client.Scan(ctx, cursor, s.prefix+"*", 512).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			f(key)
+		}
+
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// Expire removes the peers last seen before deadline. Empty sorted sets are
+// removed by Redis itself. The count of the peers is recomputed meanwhile.
+func (s *Store) Expire(deadline time.Time) int {
+	ctx := context.Background()
+	max := "(" + strconv.FormatInt(deadline.UnixMilli(), 10)
+	removed, count := 0, int64(0)
+
+	err := s.scan(ctx, func(key string) {
+		n, err := s.client.ZRemRangeByScore(ctx, key, "-inf", max).Result()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		removed += int(n)
+		count += s.client.ZCard(ctx, key).Val()
+	})
+	if err != nil {
+		s.fail(err)
+		return removed
+	}
+	atomic.StoreInt64(&s.count, count)
+	return removed
+}
+
+// Count returns how many peers are stored: the ones counted by the last
+// Expire, which scans all keys, plus the ones inserted by this Store
+// since. It doesn't query Redis.
+func (s *Store) Count() int {
+	return int(atomic.LoadInt64(&s.count))
+}
@@ -0,0 +1,55 @@
+//go:build integration
+// +build integration
+
+// The integration tests need a Redis server at REDIS_ADDR, run them with
+// "go test -tags integration".
+
+package redisstore
+
+import (
+	"context"
+	"github.com/2qif49lt/dhtlistener"
+	"github.com/redis/go-redis/v9"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	defer client.Close()
+
+	prefix := "dhtlistener:test:" + time.Now().Format("150405.000") + ":"
+	s := New(client, &Options{Prefix: prefix, FlushInterval: time.Millisecond * 10})
+	defer func() {
+		keys, _ := client.Keys(context.Background(), prefix+"*").Result()
+		if len(keys) != 0 {
+			client.Del(context.Background(), keys...)
+		}
+	}()
+
+	now := time.Now()
+	s.Insert("infohash-aaaaaaaaaaa", &dhtlistener.Peer{IP: net.IPv4(1, 2, 3, 4), Port: 1, LastSeen: now.Add(-time.Hour)})
+	s.Insert("infohash-aaaaaaaaaaa", &dhtlistener.Peer{IP: net.IPv4(5, 6, 7, 8), Port: 2, LastSeen: now})
+	s.Insert("infohash-aaaaaaaaaaa", &dhtlistener.Peer{IP: net.IPv4(5, 6, 7, 8), Port: 2, LastSeen: now})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	peers := s.GetPeers("infohash-aaaaaaaaaaa", 8)
+	if len(peers) != 2 || peers[0].Port != 2 || !peers[0].LastSeen.Equal(now.Truncate(time.Millisecond)) {
+		t.Fatalf("expected the recent peer first, got %+v", peers)
+	}
+	if s.Count() != 2 {
+		t.Fatalf("expected 2 peers, got %d", s.Count())
+	}
+
+	if n := s.Expire(now.Add(-time.Minute)); n != 1 || s.Count() != 1 || s.Errors() != 0 {
+		t.Errorf("expected 1 peer expired, got %d and %d left", n, s.Count())
+	}
+}
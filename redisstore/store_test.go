@@ -0,0 +1,21 @@
+package redisstore
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerMember(t *testing.T) {
+	seen := time.UnixMilli(1700000000123)
+	for _, ip := range []net.IP{net.IPv4(1, 2, 3, 4), net.ParseIP("2001:db8::1")} {
+		p, ok := decodePeer(encodePeer(ip, 6881), float64(seen.UnixMilli()))
+		if !ok || !p.IP.Equal(ip) || p.Port != 6881 || !p.LastSeen.Equal(seen) {
+			t.Errorf("unexpected peer %+v", p)
+		}
+	}
+
+	if _, ok := decodePeer("abc", 0); ok {
+		t.Error("expected an invalid member rejected")
+	}
+}
@@ -0,0 +1,280 @@
+package dhtlistener
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// configFile is the file form of a Config, its durations are strings like
+// "15s".
+type configFile struct {
+	Addr                 string   `json:"addr" yaml:"addr"`
+	Proxy                string   `json:"proxy" yaml:"proxy"`
+	K                    int      `json:"k" yaml:"k"`
+	Try                  int      `json:"try" yaml:"try"`
+	AdaptiveTries        bool     `json:"adaptive_tries" yaml:"adaptive_tries"`
+	QueryTimeout         string   `json:"query_timeout" yaml:"query_timeout"`
+	BootstrapNodes       []string `json:"bootstrap_nodes" yaml:"bootstrap_nodes"`
+	Workers              int      `json:"workers" yaml:"workers"`
+	QueueSize            int      `json:"queue_size" yaml:"queue_size"`
+	QueryQueueSize       int      `json:"query_queue_size" yaml:"query_queue_size"`
+	CallbackWorkers      int      `json:"callback_workers" yaml:"callback_workers"`
+	CallbackQueueSize    int      `json:"callback_queue_size" yaml:"callback_queue_size"`
+	CallbackDropPolicy   string   `json:"callback_drop_policy" yaml:"callback_drop_policy"`
+	MaxTransactions      int      `json:"max_transactions" yaml:"max_transactions"`
+	MaxSubnetQueries     int      `json:"max_subnet_queries" yaml:"max_subnet_queries"`
+	CongestionRate       float64  `json:"congestion_rate" yaml:"congestion_rate"`
+	QueryDedupePolicy    string   `json:"query_dedupe_policy" yaml:"query_dedupe_policy"`
+	Version              string   `json:"version" yaml:"version"`
+	NodeID               string   `json:"node_id" yaml:"node_id"`
+	NodeIDFile           string   `json:"node_id_file" yaml:"node_id_file"`
+	TokenFile            string   `json:"token_file" yaml:"token_file"`
+	IDRotateInterval     string   `json:"id_rotate_interval" yaml:"id_rotate_interval"`
+	Router               bool     `json:"router" yaml:"router"`
+	RouterMaxNodes       int      `json:"router_max_nodes" yaml:"router_max_nodes"`
+	LSD                  bool     `json:"lsd" yaml:"lsd"`
+	HealthMinNodes       int      `json:"health_min_nodes" yaml:"health_min_nodes"`
+	HealthWindow         string   `json:"health_window" yaml:"health_window"`
+	EventsOrigins        []string `json:"events_origins" yaml:"events_origins"`
+	MinAnnouncePort      int      `json:"min_announce_port" yaml:"min_announce_port"`
+	ImpliedPortPolicy    string   `json:"implied_port_policy" yaml:"implied_port_policy"`
+	MatchAnnouncePort    bool     `json:"match_announce_port" yaml:"match_announce_port"`
+	ReadBuffer           int      `json:"read_buffer" yaml:"read_buffer"`
+	WriteBuffer          int      `json:"write_buffer" yaml:"write_buffer"`
+	TOS                  int      `json:"tos" yaml:"tos"`
+	TTL                  int      `json:"ttl" yaml:"ttl"`
+	Shards               int      `json:"shards" yaml:"shards"`
+	QueryRateLimit       float64  `json:"query_rate_limit" yaml:"query_rate_limit"`
+	QueryBurst           int      `json:"query_burst" yaml:"query_burst"`
+	GlobalQueryRateLimit float64  `json:"global_query_rate_limit" yaml:"global_query_rate_limit"`
+	GlobalQueryBurst     int      `json:"global_query_burst" yaml:"global_query_burst"`
+	AnnounceRateLimit    float64  `json:"announce_rate_limit" yaml:"announce_rate_limit"`
+	AnnounceBurst        int      `json:"announce_burst" yaml:"announce_burst"`
+	SendRateLimit        float64  `json:"send_rate_limit" yaml:"send_rate_limit"`
+	SendByteRateLimit    float64  `json:"send_byte_rate_limit" yaml:"send_byte_rate_limit"`
+	LogLevel             string   `json:"log_level" yaml:"log_level"`
+	DisableCallbacks     bool     `json:"disable_callbacks" yaml:"disable_callbacks"`
+	Blocklist            []string `json:"blocklist" yaml:"blocklist"`
+	BlocklistFiles       []string `json:"blocklist_files" yaml:"blocklist_files"`
+
+	QueryTries map[string]int `json:"query_tries" yaml:"query_tries"` // by query type
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   = map[string]func([]byte, interface{}) error{
+		".json": json.Unmarshal,
+	}
+)
+
+// RegisterConfigFormat makes LoadConfig decode the files whose extension is
+// ext with unmarshal, which decodes into structs tagged like encoding/json
+// or gopkg.in/yaml. JSON is built in, import the yamlconfig package for
+// YAML.
+func RegisterConfigFormat(ext string, unmarshal func([]byte, interface{}) error) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+
+	formats[strings.ToLower(ext)] = unmarshal
+}
+
+// LoadConfig reads and validates the Config of the file at path, whose
+// format depends on its extension.
+func LoadConfig(path string) (Config, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+
+	formatsMu.RLock()
+	unmarshal, ok := formats[ext]
+	formatsMu.RUnlock()
+	if !ok {
+		return Config{}, errors.New("unknown config format " + ext)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var f configFile
+	if err := unmarshal(data, &f); err != nil {
+		return Config{}, err
+	}
+
+	c := Config{
+		Addr:                 f.Addr,
+		Proxy:                f.Proxy,
+		K:                    f.K,
+		Try:                  f.Try,
+		AdaptiveTries:        f.AdaptiveTries,
+		QueryTries:           f.QueryTries,
+		BootstrapNodes:       f.BootstrapNodes,
+		Workers:              f.Workers,
+		QueueSize:            f.QueueSize,
+		QueryQueueSize:       f.QueryQueueSize,
+		CallbackWorkers:      f.CallbackWorkers,
+		CallbackQueueSize:    f.CallbackQueueSize,
+		CallbackDropPolicy:   f.CallbackDropPolicy,
+		MaxTransactions:      f.MaxTransactions,
+		MaxSubnetQueries:     f.MaxSubnetQueries,
+		CongestionRate:       f.CongestionRate,
+		QueryDedupePolicy:    f.QueryDedupePolicy,
+		Version:              f.Version,
+		NodeID:               f.NodeID,
+		NodeIDFile:           f.NodeIDFile,
+		TokenFile:            f.TokenFile,
+		Router:               f.Router,
+		RouterMaxNodes:       f.RouterMaxNodes,
+		LSD:                  f.LSD,
+		HealthMinNodes:       f.HealthMinNodes,
+		EventsOrigins:        f.EventsOrigins,
+		MinAnnouncePort:      f.MinAnnouncePort,
+		ImpliedPortPolicy:    f.ImpliedPortPolicy,
+		MatchAnnouncePort:    f.MatchAnnouncePort,
+		ReadBuffer:           f.ReadBuffer,
+		WriteBuffer:          f.WriteBuffer,
+		TOS:                  f.TOS,
+		TTL:                  f.TTL,
+		Shards:               f.Shards,
+		QueryRateLimit:       f.QueryRateLimit,
+		QueryBurst:           f.QueryBurst,
+		GlobalQueryRateLimit: f.GlobalQueryRateLimit,
+		GlobalQueryBurst:     f.GlobalQueryBurst,
+		AnnounceRateLimit:    f.AnnounceRateLimit,
+		AnnounceBurst:        f.AnnounceBurst,
+		SendRateLimit:        f.SendRateLimit,
+		SendByteRateLimit:    f.SendByteRateLimit,
+		LogLevel:             f.LogLevel,
+		DisableCallbacks:     f.DisableCallbacks,
+		Blocklist:            f.Blocklist,
+		BlocklistFiles:       f.BlocklistFiles,
+	}
+	if f.QueryTimeout != "" {
+		if c.QueryTimeout, err = time.ParseDuration(f.QueryTimeout); err != nil {
+			return Config{}, err
+		}
+	}
+	if f.IDRotateInterval != "" {
+		if c.IDRotateInterval, err = time.ParseDuration(f.IDRotateInterval); err != nil {
+			return Config{}, err
+		}
+	}
+	if f.HealthWindow != "" {
+		if c.HealthWindow, err = time.ParseDuration(f.HealthWindow); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// WithConfigFile loads the configuration from the file at path, see
+// LoadConfig. New fails if it can't be loaded.
+func WithConfigFile(path string) Option {
+	return func(c *Config) {
+		loaded, err := LoadConfig(path)
+		if err != nil {
+			c.err = err
+			return
+		}
+		*c = loaded
+	}
+}
+
+// noLimit returns the rate of DHT for the rate of a Config.
+func noLimit(rate float64) float64 {
+	if rate < 0 {
+		return 0
+	}
+	return rate
+}
+
+// reload applies the runtime settings of c.
+func (dht *DHT) reload(c *Config) error {
+	if c.Blocklist != nil || c.BlocklistFiles != nil {
+		bl := NewBlocklist()
+		for _, s := range c.Blocklist {
+			if err := bl.Add(s); err != nil {
+				return err
+			}
+		}
+		for _, path := range c.BlocklistFiles {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			_, err = bl.Load(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		dht.Blocklist.replace(bl)
+	}
+
+	// the rate fields are read once, by init, the limiters are changed
+	// instead once the dht runs.
+	queryRate, globalRate := noLimit(c.QueryRateLimit), noLimit(c.GlobalQueryRateLimit)
+	announceRate := noLimit(c.AnnounceRateLimit)
+	sendRate, byteRate := noLimit(c.SendRateLimit), noLimit(c.SendByteRateLimit)
+	if dht.initialized() {
+		dht.limiter.setRate(queryRate, c.QueryBurst, globalRate, c.GlobalQueryBurst)
+		dht.announceLimits.setRate(announceRate, c.AnnounceBurst)
+		dht.SetSendRate(sendRate, byteRate)
+	} else {
+		dht.QueryRateLimit, dht.QueryBurst = queryRate, c.QueryBurst
+		dht.GlobalQueryRateLimit, dht.GlobalQueryBurst = globalRate, c.GlobalQueryBurst
+		dht.AnnounceRateLimit, dht.AnnounceBurst = announceRate, c.AnnounceBurst
+		dht.SendRateLimit, dht.SendByteRateLimit = sendRate, byteRate
+	}
+
+	var disabled int32
+	if c.DisableCallbacks {
+		disabled = 1
+	}
+	atomic.StoreInt32(&dht.callbacksOff, disabled)
+
+	if l, ok := dht.Logger.(*StdLogger); ok && c.LogLevel != "" {
+		level, _ := parseLevel(c.LogLevel)
+		l.SetLevel(level)
+	}
+	return nil
+}
+
+// Reload applies the runtime settings of c to the dht, that is the rate
+// limits, the log level, the callbacks toggle and the blocklist. The other
+// settings of c are ignored.
+func (dht *DHT) Reload(c Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if err := dht.reload(&c); err != nil {
+		return err
+	}
+
+	dht.Logger.Info("config reloaded")
+	return nil
+}
+
+// ReloadFile loads the Config of the file at path and reloads it, see
+// LoadConfig and Reload.
+func (dht *DHT) ReloadFile(path string) error {
+	c, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	return dht.Reload(c)
+}
+
+// callbacks returns whether OnGetPeers and OnAnnouncePeer are called.
+func (dht *DHT) callbacks() bool {
+	return atomic.LoadInt32(&dht.callbacksOff) == 0
+}
@@ -0,0 +1,131 @@
+package dhtlistener
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dht.json")
+	os.WriteFile(path, []byte(`{
+		"addr": "127.0.0.1:0",
+		"k": 16,
+		"query_timeout": "5s",
+		"bootstrap_nodes": [],
+		"query_rate_limit": -1,
+		"log_level": "warn",
+		"blocklist": ["10.0.0.0/8"],
+		"health_min_nodes": 4,
+		"health_window": "30s",
+		"callback_workers": 2,
+		"callback_drop_policy": "block",
+		"query_tries": {"ping": 1, "get_peers": 4}
+	}`), 0600)
+
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.K != 16 || c.QueryTimeout != 5*time.Second || c.Try != 2 ||
+		len(c.BootstrapNodes) != 0 || c.QueryRateLimit != -1 ||
+		c.HealthMinNodes != 4 || c.HealthWindow != 30*time.Second ||
+		c.CallbackWorkers != 2 || c.CallbackDropPolicy != "block" ||
+		c.QueryTries[pingType] != 1 || c.QueryTries[getPeersType] != 4 {
+		t.Fatalf("unexpected config %+v", c)
+	}
+
+	if _, err := LoadConfig(filepath.Join(dir, "dht.toml")); err == nil {
+		t.Fatal("expected an unknown format error")
+	}
+
+	os.WriteFile(path, []byte(`{"log_level": "loud"}`), 0600)
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected an invalid log level error")
+	}
+}
+
+func TestReload(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewStdLogger(&buf, LevelDebug)
+
+	dht, err := New(WithConfig(Config{
+		Addr:      "127.0.0.1:0",
+		Logger:    logger,
+		Blocklist: []string{"1.2.3.4"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dht.init()
+	defer dht.Close(context.Background())
+
+	if !dht.Blocklist.Blocked(net.IPv4(1, 2, 3, 4)) || dht.QueryRateLimit != 10 {
+		t.Fatal("config not applied")
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dht.json")
+	os.WriteFile(path, []byte(`{
+		"query_rate_limit": -1,
+		"send_rate_limit": 100,
+		"log_level": "error",
+		"disable_callbacks": true,
+		"blocklist": ["5.6.7.8"]
+	}`), 0600)
+
+	if err := dht.ReloadFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if dht.Blocklist.Blocked(net.IPv4(1, 2, 3, 4)) || !dht.Blocklist.Blocked(net.IPv4(5, 6, 7, 8)) {
+		t.Fatal("blocklist not reloaded")
+	}
+	if dht.limiter.rate != 0 || dht.pacer.packetRate != 100 {
+		t.Fatal("rate limits not reloaded")
+	}
+	if dht.callbacks() {
+		t.Fatal("callbacks should be disabled")
+	}
+	if logger.Level != LevelError {
+		t.Fatal("log level not reloaded")
+	}
+}
+
+func TestReloadRunning(t *testing.T) {
+	dht, err := New(WithAddr("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dht.init()
+	defer dht.Close(context.Background())
+
+	// the limits are read by the packet workers meanwhile.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+		for i := 0; i < 100; i++ {
+			dht.allowAnnounce(addr, "mnopqrstuvwxyz123456")
+			dht.limiter.allow(addr.IP)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err := dht.Reload(Config{AnnounceRateLimit: float64(i + 1), QueryRateLimit: float64(i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	dht.announceLimits.Lock()
+	rate := dht.announceLimits.rate
+	dht.announceLimits.Unlock()
+	if rate != 10 || dht.AnnounceRateLimit != DefaultConfig().AnnounceRateLimit {
+		t.Errorf("expected the limiter changed, not the field, got %g", rate)
+	}
+}
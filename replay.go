@@ -0,0 +1,150 @@
+package dhtlistener
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// ReadCapture reads the CapturedMessages of a capture file, see
+// StartCapture.
+func ReadCapture(r io.Reader) ([]CapturedMessage, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+
+	var msgs []CapturedMessage
+	for sc.Scan() {
+		var m CapturedMessage
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, sc.Err()
+}
+
+// Replay returns a new DHT, configured by opts like New, which handled the
+// captured msgs in order, so its state can be checked with RoutingTable,
+// PeerStore and the like. The messages received are handled as if they
+// came from the network at their capture time, the queries sent wait for
+// their captured responses. Nothing is sent, the rate limits are off and
+// the tokens of the announces are not checked since the capturing node gave
+// them. The DHT doesn't run, close it once done.
+func Replay(msgs []CapturedMessage, opts ...Option) (*DHT, error) {
+	clock := &replayClock{}
+	conn := &discardTransport{
+		addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881},
+		done: make(chan struct{}),
+	}
+
+	dht, err := New(append(opts, WithTransport(conn), WithBootstrapNodes())...)
+	if err != nil {
+		return nil, err
+	}
+	dht.Clock = clock
+	dht.QueryRateLimit, dht.GlobalQueryRateLimit = 0, 0
+	dht.replaying = true
+	dht.init()
+
+	for _, m := range msgs {
+		addr, err := net.ResolveUDPAddr("udp", m.Addr)
+		if err != nil {
+			return nil, err
+		}
+		clock.now = m.Time
+
+		switch m.Dir {
+		case "in":
+			handle(dht, packet{data: m.Data, raddr: addr, recvTime: m.Time})
+		case "out":
+			dht.replayQuery(addr, m.Data)
+		}
+	}
+	return dht, nil
+}
+
+// replayQuery starts the transaction of the query data sent to addr, if it
+// is one, without sending it.
+func (dht *DHT) replayQuery(addr *net.UDPAddr, data []byte) {
+	var msg rawMessage
+	if Unmarshal(data, &msg) != nil || msg.Y != "q" || len(msg.T) != 2 {
+		return
+	}
+
+	var args interface{}
+	switch msg.Q {
+	case pingType:
+		args = &PingArgs{}
+	case findNodeType:
+		args = &FindNodeArgs{}
+	case getPeersType:
+		args = &GetPeersArgs{}
+	case announcePeerType:
+		args = &AnnouncePeerArgs{}
+	case sampleInfoHashesType:
+		args = &SampleInfoHashesArgs{}
+	default:
+		args = &map[string]interface{}{}
+	}
+	if Unmarshal(msg.A, args) != nil {
+		return
+	}
+	if m, ok := args.(*map[string]interface{}); ok {
+		args = *m
+	}
+
+	tm := dht.transacts
+	if old := tm.getByTransID(msg.T); old != nil && tm.wheel.remove(old) {
+		tm.finish(old, false)
+	}
+
+	trans := tm.newTransaction(msg.T, &query{
+		tar: &node{addr: addr},
+		msg: makeQuery(msg.T, msg.Q, args),
+	})
+	if !tm.insert(trans) {
+		return
+	}
+	trans.start = dht.now()
+	trans.tries = 1
+	tm.wheel.add(trans, dht.QueryTimeout)
+}
+
+// replayClock is the Clock of a replay, it's at the time of the message
+// replayed.
+type replayClock struct {
+	systemClock
+	now time.Time
+}
+
+func (c *replayClock) Now() time.Time { return c.now }
+
+// discardTransport is a Transport dropping the packets sent and receiving
+// none.
+type discardTransport struct {
+	addr *net.UDPAddr
+	done chan struct{}
+}
+
+func (t *discardTransport) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	<-t.done
+	return 0, nil, errors.New("use of closed transport")
+}
+
+func (t *discardTransport) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	return len(b), nil
+}
+
+func (t *discardTransport) LocalAddr() net.Addr { return t.addr }
+
+func (t *discardTransport) Close() error {
+	select {
+	case <-t.done:
+	default:
+		close(t.done)
+	}
+	return nil
+}
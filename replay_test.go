@@ -0,0 +1,74 @@
+package dhtlistener
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	mem := &memNet{}
+	addrA := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	addrB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+
+	a, err := New(WithTransport(mem.listen(addrA)), WithBootstrapNodes(addrB.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(WithTransport(mem.listen(addrB)), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	if err := b.StartCapture(path, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dht := range []*DHT{b, a} {
+		dht.rt = newRouteTable(dht) // before Run, read below
+		go dht.Run()
+		defer func(dht *DHT) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			dht.Close(ctx)
+		}(dht)
+	}
+	if !waitUntil(func() bool { return hasNode(a, addrB.String()) && hasNode(b, addrA.String()) }) {
+		t.Fatal("a and b should know each other")
+	}
+
+	infoHash := GetRandString(20)
+	a.transacts.getPeers(context.Background(), &node{addr: addrB}, infoHash)
+	a.transacts.announcePeer(&node{addr: addrB}, infoHash, 6882, b.tokens.getToken(addrA))
+	if !waitUntil(func() bool { return len(b.peers.GetPeers(InfoHash(infoHash), 8)) == 1 }) {
+		t.Fatal("expected the peer stored by b")
+	}
+	b.StopCapture()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	msgs, err := ReadCapture(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Replay(msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close(context.Background())
+
+	if !hasNode(r, addrA.String()) {
+		t.Error("expected a in the replayed routing table")
+	}
+	peers := r.peers.GetPeers(InfoHash(infoHash), 8)
+	if len(peers) != 1 || peers[0].Port != 6882 || peers[0].LastSeen.Before(msgs[0].Time) {
+		t.Errorf("expected the announced peer replayed, got %v", peers)
+	}
+}
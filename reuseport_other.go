@@ -0,0 +1,15 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+// +build !linux mips mipsle mips64 mips64le
+
+package dhtlistener
+
+import (
+	"syscall"
+)
+
+const reusePortSupported = false
+
+// reusePort always fails, SO_REUSEPORT isn't supported here.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errReusePortUnsupported
+}
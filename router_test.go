@@ -0,0 +1,78 @@
+package dhtlistener
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRouterTable(t *testing.T) {
+	dht := &DHT{K: 8, me: &node{id: newHashId(GetRandString(20))}, Logger: nopLogger{},
+		NodeExpireTime: time.Minute * 15, Router: true, RouterMaxNodes: 500}
+	dht.rt = newRouteTable(dht)
+
+	nodes := make([]*node, 0, 2000)
+	for i := 0; i < cap(nodes); i++ {
+		no, err := newNode(GetRandString(20), "udp", "1.2.3.4:6881", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		no.heardQuery(time.Now())
+		nodes = append(nodes, no)
+		dht.rt.Insert(no)
+	}
+
+	// far more than K nodes per prefix length shared with our id.
+	if l := dht.rt.Len(); l != dht.RouterMaxNodes {
+		t.Fatalf("expected %d nodes, got %d", dht.RouterMaxNodes, l)
+	}
+
+	// the latest nodes evict the questionable ones.
+	last := nodes[len(nodes)-1]
+	if dht.rt.GetNode(last.id.RawString()) == nil {
+		t.Fatal("expected the latest node to be cached")
+	}
+	closest := dht.rt.FindClosest(last.id, dht.K)
+	if len(closest) != dht.K || closest[0] != last {
+		t.Errorf("expected the node itself first, got %d nodes", len(closest))
+	}
+}
+
+func TestRouter(t *testing.T) {
+	dht, err := New(WithAddr("127.0.0.1:0"), WithRouter(0), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+
+	if _, err := dht.GetPeers(GetRandString(20)); err != errRouter {
+		t.Errorf("expected lookups to be disabled, got %v", err)
+	}
+	if _, err := dht.Announce(GetRandString(20), 6881); err != errRouter {
+		t.Errorf("expected announces to be disabled, got %v", err)
+	}
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.LocalAddr().(*net.UDPAddr)
+
+	data, _ := Marshal(makeQuery("aa", findNodeType, &FindNodeArgs{
+		ID:     GetRandString(20),
+		Target: GetRandString(20),
+	}))
+	handle(dht, packet{data: data, raddr: addr})
+
+	buf := make([]byte, 1500)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := l.ReadFromUDP(buf); err != nil {
+		t.Fatalf("expected a find_node response: %v", err)
+	}
+	if dht.rt.Len() != 1 {
+		t.Errorf("expected the querying node cached, got %d nodes", dht.rt.Len())
+	}
+}
@@ -3,102 +3,443 @@ package dhtlistener
 import (
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// bucket is a k-bucket holding the nodes whose ids share the same prefix
+// length with ours, idx, or idx bits or more for the bucket of our id.
+type bucket struct {
+	*keylist              // rawstring:*node
+	idx          int      // prefix length shared with our id
+	depth        int      // of its trie leaf, it holds 2^-depth of the keyspace
+	lastChanged  int64    // unix nano, accessed atomically
+	replacements *keylist // rawstring:*node, most recently seen at back
+}
+
+func newBucket(idx int, now time.Time) *bucket {
+	return &bucket{
+		keylist:      newKeyList(),
+		idx:          idx,
+		lastChanged:  now.UnixNano(),
+		replacements: newKeyList(),
+	}
+}
+
+// addReplacement caches n to replace a bad node later, keeping at most size
+// nodes.
+func (b *bucket) addReplacement(n *node, size int) {
+	b.replacements.Push(n.id.RawString(), n)
+
+	for b.replacements.Len() > size {
+		if front, ok := b.replacements.Front().(*node); ok {
+			b.replacements.Remove(front.id.RawString())
+		}
+	}
+}
+
+// popReplacement removes and returns the best scoring node of the
+// replacement cache, the most recently seen one among equals, nil if it's
+// empty.
+func (b *bucket) popReplacement(now time.Time) *node {
+	var best *node
+	max := -1.0
+
+	b.replacements.Foreach(func(v interface{}) bool {
+		if score := v.(*node).score(now); score >= max {
+			best, max = v.(*node), score
+		}
+		return true
+	})
+	if best != nil {
+		b.replacements.Remove(best.id.RawString())
+	}
+	return best
+}
+
+// touch marks the bucket as changed at now.
+func (b *bucket) touch(now time.Time) {
+	atomic.StoreInt64(&b.lastChanged, now.UnixNano())
+}
+
+// LastChanged returns the last time a node was added or refreshed.
+func (b *bucket) LastChanged() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&b.lastChanged))
+}
+
+// routingTable is the routing table of a DHT, the default one is the trie
+// of routetable. Its implementations are safe for concurrent use. It's
+// unexported as the nodes are.
+type routingTable interface {
+	// Insert adds n, or merges its activity into the known node of its id,
+	// and returns whether it's a new node.
+	Insert(n *node) bool
+	// Remove removes the node whose id is id.
+	Remove(id *HashID)
+	// Fail records a failed query to the node whose id is id, which may be
+	// evicted.
+	Fail(id *HashID)
+	// FindClosest returns at most size nodes closest to target.
+	FindClosest(target *HashID, size int) []*node
+	// GetNode returns the node whose raw id is id, nil if it's unknown.
+	GetNode(id string) *node
+	// Len returns the number of nodes.
+	Len() int
+	// Buckets returns the buckets by increasing prefix length shared with
+	// our id.
+	Buckets() []*bucket
+}
+
+// trieNode is a node of the routing table trie. A leaf holds the bucket of
+// the ids starting with its prefix of depth bits, an inner node splits its
+// range by the bit at depth.
+type trieNode struct {
+	children [2]*trieNode
+	bucket   *bucket // leaves only
+	depth    int
+}
+
+// routetable is a binary trie over the node ids whose leaves are buckets.
+// Only the bucket holding our id splits once it's full, as Kademlia does, so
+// the table keeps K nodes per prefix length shared with our id. In router
+// mode every full bucket splits until the table holds RouterMaxNodes. The lock
+// guards the shape of the trie and the moves of nodes between buckets.
 type routetable struct {
-	dht     *DHT
-	buckets [hash_size * 8]*keylist // rawstring:*node
+	sync.RWMutex
+	dht   *DHT
+	root  *trieNode
+	count int // nodes in the buckets
 }
 
 func newRouteTable(dht *DHT) *routetable {
-	ret := &routetable{
-		dht: dht,
+	return &routetable{
+		dht:  dht,
+		root: &trieNode{bucket: newBucket(0, dht.now())},
 	}
+}
 
-	for idx := 0; idx != len(ret.buckets); idx++ {
-		ret.buckets[idx] = newKeyList()
+// leaf returns the leaf whose range holds id, the caller holds the lock.
+func (rt *routetable) leaf(id *HashID) *trieNode {
+	t := rt.root
+	for t.bucket == nil {
+		t = t.children[id.Bit(t.depth)]
 	}
+	return t
+}
 
+// split splits the full leaf t if it holds our id, or in router mode while
+// the table isn't full, the caller holds the lock. It returns whether t is
+// split.
+func (rt *routetable) split(t *trieNode) bool {
+	me := rt.dht.self()
+	mine := rt.leaf(me) == t
+	if t.depth >= hash_size*8-1 || !mine && !(rt.dht.Router && rt.count < rt.dht.routerMaxNodes()) {
+		return false
+	}
+
+	own := me.Bit(t.depth)
+	for bit := range t.children {
+		idx := t.bucket.idx // both halves share as many bits with our id
+		if mine {
+			idx = t.depth // the other half differs from our id at depth
+			if bit == own {
+				idx = t.depth + 1
+			}
+		}
+		t.children[bit] = &trieNode{bucket: newBucket(idx, rt.dht.now()), depth: t.depth + 1}
+		t.children[bit].bucket.lastChanged = atomic.LoadInt64(&t.bucket.lastChanged)
+		t.children[bit].bucket.depth = t.depth + 1
+	}
+
+	// the nodes keep their order, the most recently seen at back.
+	t.bucket.Foreach(func(v interface{}) bool {
+		no := v.(*node)
+		t.children[no.id.Bit(t.depth)].bucket.Push(no.id.RawString(), no)
+		return true
+	})
+	t.bucket.replacements.Foreach(func(v interface{}) bool {
+		no := v.(*node)
+		t.children[no.id.Bit(t.depth)].bucket.replacements.Push(no.id.RawString(), no)
+		return true
+	})
+	t.bucket = nil
+	return true
+}
+
+// rebuild reshapes the trie around our id once it has changed. The nodes
+// and replacements are kept as far as the new buckets hold them.
+func (rt *routetable) rebuild() {
+	rt.Lock()
+	defer rt.Unlock()
+
+	var nodes, replacements []*node
+	var walk func(t *trieNode)
+	walk = func(t *trieNode) {
+		if t.bucket == nil {
+			walk(t.children[0])
+			walk(t.children[1])
+			return
+		}
+		t.bucket.Foreach(func(v interface{}) bool {
+			nodes = append(nodes, v.(*node))
+			return true
+		})
+		t.bucket.replacements.Foreach(func(v interface{}) bool {
+			replacements = append(replacements, v.(*node))
+			return true
+		})
+	}
+	walk(rt.root)
+
+	rt.root = &trieNode{bucket: newBucket(0, rt.dht.now())}
+	rt.count = 0
+	for _, n := range nodes {
+		if rt.dht.isSelf(n.id.RawString()) {
+			continue
+		}
+		t := rt.leaf(n.id)
+		for t.bucket.Len() >= rt.dht.K && rt.split(t) {
+			t = rt.leaf(n.id)
+		}
+		if t.bucket.Len() < rt.dht.K {
+			t.bucket.Push(n.id.RawString(), n)
+			rt.count++
+		} else {
+			t.bucket.addReplacement(n, rt.dht.K)
+		}
+	}
+	for _, n := range replacements {
+		if !rt.dht.isSelf(n.id.RawString()) {
+			rt.leaf(n.id).bucket.addReplacement(n, rt.dht.K)
+		}
+	}
+}
+
+// Buckets returns the buckets by increasing prefix length shared with our
+// id.
+func (rt *routetable) Buckets() []*bucket {
+	rt.RLock()
+	defer rt.RUnlock()
+
+	ret := make([]*bucket, 0)
+	var walk func(t *trieNode)
+	walk = func(t *trieNode) {
+		if t.bucket != nil {
+			ret = append(ret, t.bucket)
+			return
+		}
+		walk(t.children[0])
+		walk(t.children[1])
+	}
+	walk(rt.root)
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].idx < ret[j].idx })
 	return ret
 }
 
-func (rt *routetable) FreshBucket(bucket *keylist) {
+// bucketOf returns the bucket whose range holds id.
+func (rt *routetable) bucketOf(id *HashID) *bucket {
+	rt.RLock()
+	defer rt.RUnlock()
+
+	return rt.leaf(id).bucket
+}
+
+// FreshBucket pings the nodes of the bucket which are not good.
+func (rt *routetable) FreshBucket(bucket *bucket) {
+	nodes := make([]*node, 0, bucket.Len())
+
 	bucket.Foreach(func(v interface{}) bool {
 		no := v.(*node)
-		rt.dht.transacts.ping(no)
+		if no.state(rt.dht.now(), rt.dht.NodeExpireTime) != nodeGood {
+			nodes = append(nodes, no)
+		}
 		return true
 	})
+
+	for _, no := range nodes {
+		rt.dht.transacts.ping(no)
+	}
 }
 
-func (rt *routetable) Insert(n *node) bool {
-	prefix_len := n.id.Xor(rt.dht.me.id).PrefixLen()
-	bucket := rt.buckets[prefix_len]
+// rtEvent is an event of the routing table, published once it's unlocked
+// so the subscribers can't stall it.
+type rtEvent struct {
+	t EventType
+	f func() Event
+}
 
-	if bucket.Has(n.id.RawString()) {
-		bucket.Remove(n.id.RawString())
-		bucket.Push(n.id.RawString(), n)
+// publishAll publishes events, the routing table must not be locked.
+func (rt *routetable) publishAll(events []rtEvent) {
+	for _, e := range events {
+		rt.dht.publish(e.t, e.f)
+	}
+}
+
+// Insert adds n to the routing table and returns whether it's a new node.
+// If the node is already in the table, its activity is merged into the
+// existing entry. If the bucket is full, n evicts the lowest scoring node
+// which failed a query, or is kept in the bucket's replacement cache while
+// the questionable nodes of the bucket are pinged.
+func (rt *routetable) Insert(n *node) bool {
+	if rt.dht.isSelf(n.id.RawString()) || rt.dht.Blocklist.Blocked(n.address().IP) {
 		return false
 	}
-	if bucket.Len() < rt.dht.K {
-		bucket.Push(n.id.RawString(), n)
-		return true
-	} else {
+
+	rt.Lock()
+	added, events := rt.insert(n)
+	rt.Unlock()
+
+	rt.publishAll(events)
+	return added
+}
+
+// insert is Insert, it returns the events to publish. The caller holds the
+// lock.
+func (rt *routetable) insert(n *node) (bool, []rtEvent) {
+	key := n.id.RawString()
+	t := rt.leaf(n.id)
+	if v, ok := t.bucket.Get(key); ok {
+		no := v.(*node)
+		no.update(n)
+		t.bucket.Push(key, no)
+		t.bucket.touch(rt.dht.now())
+		return false, nil
+	}
+	if rt.dht.tooManyIDs(n) {
+		return false, nil
+	}
+
+	for t.bucket.Len() >= rt.dht.K && rt.split(t) {
+		t = rt.leaf(n.id)
+	}
+	bucket := t.bucket
+
+	full := rt.dht.Router && rt.count >= rt.dht.routerMaxNodes()
+	if bucket.Len() < rt.dht.K && !full {
+		bucket.Push(key, n)
+		rt.count++
+		bucket.replacements.Remove(key)
+		bucket.touch(rt.dht.now())
+		rt.dht.Logger.Debug("node added", F("addr", n.address()), F("bucket", bucket.idx))
+		return true, []rtEvent{{EventNodeAdded, func() Event { return NodeAdded{key, n.address()} }}}
+	}
+
+	victim := bucket.victim(rt.dht.now())
+	if victim == nil && rt.dht.Router {
+		// nodes aren't pinged in router mode, the questionable ones make
+		// room.
+		if front, ok := bucket.Front().(*node); ok && front.state(rt.dht.now(), rt.dht.NodeExpireTime) != nodeGood {
+			victim = front
+		}
+	}
+	if victim != nil {
+		bucket.Remove(victim.id.RawString())
+		bucket.Push(key, n)
+		bucket.touch(rt.dht.now())
+		rt.dht.Logger.Debug("node replaced", F("addr", n.address()), F("evicted", victim.address()))
+		return true, []rtEvent{
+			{EventNodeRemoved, func() Event { return NodeRemoved{victim.id.RawString(), victim.address()} }},
+			{EventNodeAdded, func() Event { return NodeAdded{key, n.address()} }},
+		}
+	}
+
+	bucket.addReplacement(n, rt.dht.K)
+	if !rt.dht.Router {
 		go rt.FreshBucket(bucket)
 	}
-	return false
+	return false, nil
 }
 
-func (rt *routetable) getNode(h string) *node {
-	for _, v := range rt.buckets {
-		if n, exist := v.Get(h); exist {
-			if n.(*node).id.RawString() == h {
-				return n.(*node)
-			} else {
-				return nil
-			}
-		}
+// Fail records a failed query to the node whose id is tar. Once the node
+// turns bad it's evicted and replaced with the most recently seen node of
+// the replacement cache.
+func (rt *routetable) Fail(tar *HashID) {
+	rt.Lock()
+	events := rt.fail(tar)
+	rt.Unlock()
+
+	rt.publishAll(events)
+}
+
+// fail is Fail, it returns the events to publish. The caller holds the
+// lock.
+func (rt *routetable) fail(tar *HashID) []rtEvent {
+	bucket := rt.leaf(tar).bucket
+	key := tar.RawString()
+
+	v, ok := bucket.Get(key)
+	if !ok || v.(*node).fail() < nodeMaxFailures {
+		return nil
 	}
-	return nil
+
+	bucket.Remove(key)
+	rt.count--
+	rt.dht.Logger.Debug("node evicted", F("addr", v.(*node).address()))
+	events := []rtEvent{{EventNodeRemoved, func() Event {
+		return NodeRemoved{key, v.(*node).address()}
+	}}}
+
+	if no := bucket.popReplacement(rt.dht.now()); no != nil {
+		bucket.Push(no.id.RawString(), no)
+		rt.count++
+		rt.dht.Logger.Debug("node replaced", F("addr", no.address()))
+		events = append(events, rtEvent{EventNodeAdded, func() Event {
+			return NodeAdded{no.id.RawString(), no.address()}
+		}})
+	}
+	bucket.touch(rt.dht.now())
+	return events
 }
-func (rt *routetable) FindClosestNode(tar *hashid, size int) []*node {
-	ret := make([]*node, 0)
 
-	bucket_num := tar.Xor(rt.dht.me.id).PrefixLen()
-	bucket := rt.buckets[bucket_num]
+// GetNode implements routingTable.
+func (rt *routetable) GetNode(h string) *node {
+	if n, ok := rt.bucketOf(newHashId(h)).Get(h); ok {
+		return n.(*node)
+	}
+	return nil
+}
 
-	bucket.Foreach(func(it interface{}) bool {
-		n := it.(*node)
-		ret = append(ret, n)
-		return true
-	})
+// FindClosest returns at most size nodes closest to tar, the ones
+// sharing the same prefix with tar by descending score. It walks the trie
+// from the leaf of tar, the leaves are visited by increasing distance.
+func (rt *routetable) FindClosest(tar *HashID, size int) []*node {
+	ret := make([]*node, 0, size)
 
-	for i := 1; (bucket_num-i >= 0 || bucket_num+i < len(rt.buckets)) && len(ret) < size; i++ {
-		if bucket_num-i >= 0 {
-			bucket = rt.buckets[bucket_num-i]
-			bucket.Foreach(func(it interface{}) bool {
-				n := it.(*node)
-				ret = append(ret, n)
-				return true
-			})
+	var walk func(t *trieNode)
+	walk = func(t *trieNode) {
+		if len(ret) >= size {
+			return
 		}
-		if bucket_num+i < len(rt.buckets) {
-			bucket = rt.buckets[bucket_num+i]
-			bucket.Foreach(func(it interface{}) bool {
-				n := it.(*node)
-				ret = append(ret, n)
+		if t.bucket != nil {
+			t.bucket.Foreach(func(v interface{}) bool {
+				ret = append(ret, v.(*node))
 				return true
 			})
+			return
 		}
+
+		bit := tar.Bit(t.depth)
+		walk(t.children[bit])
+		walk(t.children[1-bit])
 	}
-	sort.Sort(sortNodeById(ret))
+
+	rt.RLock()
+	walk(rt.root)
+	rt.RUnlock()
+
+	sort.Sort(newSortNodeByScore(ret, tar, rt.dht.now()))
 	if len(ret) > size {
 		ret = ret[:size]
 	}
 	return ret
 }
 
-func (rt *routetable) GetClosestNodeCompactInfo(tar *hashid, size int) []string {
-	nodes := rt.FindClosestNode(tar, size)
+// closestNodeInfos returns the compact node infos of the size nodes closest
+// to tar.
+func (dht *DHT) closestNodeInfos(tar *HashID, size int) []string {
+	nodes := dht.rt.FindClosest(tar, size)
 	infos := make([]string, len(nodes))
 
 	for k, v := range nodes {
@@ -107,53 +448,98 @@ func (rt *routetable) GetClosestNodeCompactInfo(tar *hashid, size int) []string
 	return infos
 }
 
-func (rt *routetable) Remove(tar *hashid) {
-	bucket_num := tar.Xor(rt.dht.me.id).PrefixLen()
-	bucket := rt.buckets[bucket_num]
+// Remove implements routingTable.
+func (rt *routetable) Remove(tar *HashID) {
+	rt.Lock()
+	v := rt.leaf(tar).bucket.Remove(tar.RawString())
+	if v != nil {
+		rt.count--
+	}
+	rt.Unlock()
 
-	bucket.Remove(tar.RawString())
+	if v != nil {
+		rt.dht.publish(EventNodeRemoved, func() Event {
+			return NodeRemoved{tar.RawString(), v.(*node).address()}
+		})
+	}
 }
 
-func (rt *routetable) RandomChildID(idx int) string {
-	div, mod := idx/8, idx%8
+// randomChildID returns a random id which falls in the idx-th bucket, that is
+// it shares the first idx bits with our id and differs at the idx-th bit.
+func (dht *DHT) randomChildID(idx int) string {
+	div := idx / 8
+	me := dht.self()
 
-	ret := strings.Join([]string{rt.dht.me.id.RawString()[:div],
-		GetRandString(20 - div)}, "")
+	ret := strings.Join([]string{me.RawString()[:div],
+		GetRandString(hash_size - div)}, "")
 
 	id := newHashId(ret)
 
-	if mod != 0 {
-		for cur := div * 8; cur != idx; cur++ {
-			if rt.dht.me.id.Bit(cur) == 1 {
-				id.UnSet(cur)
-			} else {
-				id.Set(cur)
-			}
+	for cur := div * 8; cur != idx; cur++ {
+		if me.Bit(cur) == 1 {
+			id.Set(cur)
+		} else {
+			id.UnSet(cur)
 		}
 	}
 
-	if rt.dht.me.id.Bit(idx) == 1 {
-		id.Set(idx)
-	} else {
+	if me.Bit(idx) == 1 {
 		id.UnSet(idx)
+	} else {
+		id.Set(idx)
 	}
 	return id.RawString()
 }
-func (rt *routetable) Fresh() {
-	for idx, bucket := range rt.buckets {
+
+// refresh issues find_node for a random id in the range of every bucket
+// which has not changed during the last `interval`.
+func (dht *DHT) refresh(interval time.Duration) {
+	for _, bucket := range dht.rt.Buckets() {
+		if bucket.Len() == 0 || dht.now().Sub(bucket.LastChanged()) < interval {
+			continue
+		}
+
+		target := dht.randomChildID(bucket.idx)
+		for _, no := range dht.rt.FindClosest(newHashId(target), dht.K) {
+			dht.transacts.findNode(no, target)
+		}
+		bucket.touch(dht.now())
+	}
+}
+
+// keepAlive pings the nodes which have not been heard from during the last
+// `expire`, that is the questionable ones. Nodes failing to respond turn bad
+// and are replaced, see routingTable.Fail.
+func (dht *DHT) keepAlive(expire time.Duration) {
+	expired := make([]*node, 0)
+
+	for _, bucket := range dht.rt.Buckets() {
 		bucket.Foreach(func(it interface{}) bool {
 			no := it.(*node)
-			rt.dht.transacts.findNode(no, rt.RandomChildID(idx))
+			if no.state(dht.now(), expire) != nodeGood {
+				expired = append(expired, no)
+			}
 			return true
 		})
+	}
 
+	for _, no := range expired {
+		dht.transacts.ping(no)
 	}
 }
 
+// Len implements routingTable.
 func (rt *routetable) Len() int {
-	ret := 0
-	for _, bucket := range rt.buckets {
-		ret += bucket.Len()
+	rt.RLock()
+	defer rt.RUnlock()
+
+	return rt.count
+}
+
+// routerMaxNodes returns the max number of nodes cached in router mode.
+func (dht *DHT) routerMaxNodes() int {
+	if dht.RouterMaxNodes > 0 {
+		return dht.RouterMaxNodes
 	}
-	return ret
+	return 1 << 20
 }
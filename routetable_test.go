@@ -0,0 +1,268 @@
+package dhtlistener
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRandomChildID(t *testing.T) {
+	dht := &DHT{K: 8, me: &node{id: newHashId(GetRandString(20))}, Logger: nopLogger{}}
+
+	for _, idx := range []int{0, 1, 7, 8, 9, 63, 100, 158, 159} {
+		id := newHashId(dht.randomChildID(idx))
+		if l := id.Xor(dht.me.id).PrefixLen(); l != idx {
+			t.Fatal(idx, l)
+		}
+	}
+}
+
+func TestRouteTableReplacement(t *testing.T) {
+	dht := &DHT{K: 2, me: &node{id: newHashId(GetRandString(20))}, Logger: nopLogger{},
+		NodeExpireTime: time.Minute * 15}
+	dht.rt = newRouteTable(dht)
+	dht.transacts = newTransactionManager(dht)
+
+	nodes := make([]*node, 3)
+	for i := range nodes {
+		no, err := newNode(dht.randomChildID(5), "udp", "127.0.0.1:6881", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		no.heardResponse(time.Now())
+		nodes[i] = no
+	}
+
+	if !dht.rt.Insert(nodes[0]) || !dht.rt.Insert(nodes[1]) {
+		t.Fatal("insert into an empty bucket failed")
+	}
+	if dht.rt.Insert(nodes[2]) {
+		t.Fatal("insert into a full bucket succeeded")
+	}
+
+	for i := 0; i != nodeMaxFailures; i++ {
+		if dht.rt.GetNode(nodes[0].id.RawString()) == nil {
+			t.Fatal("node evicted too early", i)
+		}
+		dht.rt.Fail(nodes[0].id)
+	}
+
+	if dht.rt.GetNode(nodes[0].id.RawString()) != nil {
+		t.Fatal("bad node is not evicted")
+	}
+	if dht.rt.GetNode(nodes[2].id.RawString()) == nil {
+		t.Fatal("replacement node is not promoted")
+	}
+}
+
+func TestRouteTableTrie(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.K = 4
+	dht.MaxIDsPerIP = 0
+	dht.init()
+	defer dht.conn.Close()
+
+	nodes := make(map[string]*node)
+	for i := 0; i < 2000; i++ {
+		id := GetRandString(20)
+		if i%4 == 0 {
+			// ids close to ours, so that the trie splits deep.
+			id = dht.randomChildID(i % 40)
+		}
+		no, err := newNode(id, "udp", "127.0.0.1:6881", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dht.rt.Insert(no) {
+			nodes[id] = no
+		}
+	}
+
+	buckets := dht.rt.Buckets()
+	for i, b := range buckets {
+		if b.Len() > dht.K {
+			t.Fatalf("bucket %d holds %d nodes", b.idx, b.Len())
+		}
+		b.Foreach(func(v interface{}) bool {
+			l := v.(*node).id.Xor(dht.me.id).PrefixLen()
+			if l != b.idx && (i != len(buckets)-1 || l < b.idx) {
+				t.Fatalf("node of prefix length %d in bucket %d", l, b.idx)
+			}
+			return true
+		})
+	}
+	if n := dht.rt.Len(); n != len(nodes) || n < 10*dht.K {
+		t.Fatalf("expected %d nodes, got %d", len(nodes), n)
+	}
+
+	// the closest nodes are the ones sharing the longest prefix with the
+	// target.
+	for i := 0; i < 20; i++ {
+		tar := newHashId(GetRandString(20))
+		closest := dht.rt.FindClosest(tar, dht.K)
+		if len(closest) != dht.K {
+			t.Fatal("expected K nodes, got", len(closest))
+		}
+
+		min := closest[len(closest)-1].id.Xor(tar).PrefixLen()
+		for _, no := range nodes {
+			if l := no.id.Xor(tar).PrefixLen(); l > min {
+				found := false
+				for _, c := range closest {
+					found = found || c == no
+				}
+				if !found {
+					t.Fatalf("a node of prefix length %d is missing, the last one has %d", l, min)
+				}
+			}
+		}
+	}
+}
+
+// fakeTable is a routingTable answering the same nodes for every target.
+type fakeTable struct {
+	nodes    []*node
+	inserted []*node
+}
+
+func (f *fakeTable) Insert(n *node) bool {
+	f.inserted = append(f.inserted, n)
+	return true
+}
+
+func (f *fakeTable) Remove(id *HashID) {}
+func (f *fakeTable) Fail(id *HashID)   {}
+
+func (f *fakeTable) FindClosest(target *HashID, size int) []*node {
+	if len(f.nodes) > size {
+		return f.nodes[:size]
+	}
+	return f.nodes
+}
+
+func (f *fakeTable) GetNode(id string) *node { return nil }
+func (f *fakeTable) Len() int                { return len(f.nodes) }
+func (f *fakeTable) Buckets() []*bucket      { return nil }
+
+func TestRoutingTableFake(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+
+	no, _ := newNode(GetRandString(20), "udp", "10.0.0.1:6881", time.Now())
+	fake := &fakeTable{nodes: []*node{no}}
+	dht.rt = fake
+	dht.init()
+	defer dht.conn.Close()
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	data, _ := Marshal(makeQuery("aa", findNodeType, &FindNodeArgs{GetRandString(20), GetRandString(20)}))
+	handle(dht, packet{data: data, raddr: l.LocalAddr().(*net.UDPAddr), recvTime: time.Now()})
+
+	buf := make([]byte, 1024)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := l.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp struct {
+		R FindNodeResponse `bencode:"r"`
+	}
+	if err := Unmarshal(buf[:n], &resp); err != nil || resp.R.Nodes != no.CompactNodeInfo() {
+		t.Errorf("expected the node of the fake table, got %q %v", resp.R.Nodes, err)
+	}
+	if len(fake.inserted) != 1 {
+		t.Error("expected the querying node inserted, got", len(fake.inserted))
+	}
+}
+
+func TestRouteTablePublishUnlocked(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+	dht.EventBufferSize, dht.EventDropPolicy = 1, Block
+	events := dht.Subscribe(EventNodeAdded)
+
+	inserted := make(chan struct{})
+	go func() {
+		for i := 0; i < 2; i++ {
+			no, _ := newNode(GetRandString(20), "udp", "127.0.0.1:6881", time.Now())
+			dht.rt.Insert(no)
+		}
+		close(inserted)
+	}()
+
+	// the second event blocks its Insert, not the routing table.
+	ok := waitUntil(func() bool {
+		n := make(chan int, 1)
+		go func() { n <- dht.rt.Len() }()
+		select {
+		case l := <-n:
+			return l == 2
+		case <-time.After(time.Second):
+			t.Fatal("expected the routing table unlocked")
+		}
+		return false
+	})
+	if !ok {
+		t.Fatal("expected 2 nodes")
+	}
+	select {
+	case <-inserted:
+		t.Fatal("expected the second event to block")
+	default:
+	}
+
+	<-events
+	<-events
+	<-inserted
+}
+
+func TestRouteTableUpdateAddr(t *testing.T) {
+	dht := &DHT{K: 8, me: &node{id: newHashId(GetRandString(20))}, Logger: nopLogger{},
+		NodeExpireTime: time.Minute * 15}
+	dht.rt = newRouteTable(dht)
+	dht.transacts = newTransactionManager(dht)
+
+	id := dht.randomChildID(5)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for port := 6881; port < 6981; port++ {
+			no, err := newNode(id, "udp", genAddress("127.0.0.1", port), time.Now())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			dht.rt.Insert(no)
+		}
+	}()
+
+	// the node found is read while its address changes.
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		for _, no := range dht.rt.FindClosest(newHashId(id), 8) {
+			no.CompactNodeInfo()
+		}
+	}
+	if no := dht.rt.GetNode(id); no == nil || no.address().Port != 6980 {
+		t.Fatal("expected the address of the node updated")
+	}
+}
@@ -0,0 +1,224 @@
+package dhtlistener
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"time"
+)
+
+var errNoNodes = errors.New("no node to query")
+
+// nodeInfo returns the NodeInfo of no, which answered a query after rtt,
+// at now.
+func nodeInfo(no *node, rtt time.Duration, now time.Time) NodeInfo {
+	return NodeInfo{
+		ID:         no.id.Hex(),
+		Addr:       no.address().String(),
+		Good:       true,
+		LastActive: now,
+		RTT:        rtt.Seconds() * 1000,
+	}
+}
+
+// Ping sends a ping query to addr and waits for its response. It returns
+// the node answering, with the round-trip time of the query. The error is
+// the one of Query. The dht must be running.
+func (dht *DHT) Ping(ctx context.Context, addr *net.UDPAddr) (NodeInfo, error) {
+	start := dht.now()
+	r, err := dht.sendWait(ctx, &node{addr: addr}, pingType, &PingArgs{
+		ID: dht.idFor(""),
+	})
+	if err != nil {
+		return NodeInfo{}, err
+	}
+
+	id, _ := r["id"].(string)
+	no, err := newNode(id, addr.Network(), addr.String(), dht.now())
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	now := dht.now()
+	return nodeInfo(no, now.Sub(start), now), nil
+}
+
+// findNodeOn sends a find_node query of target to no and returns the nodes
+// it reports and the round-trip time of the query.
+func (dht *DHT) findNodeOn(ctx context.Context, no *node, target *HashID) ([]*node, time.Duration, error) {
+	start := dht.now()
+	r, err := dht.sendWait(ctx, no, findNodeType, &FindNodeArgs{
+		ID:     dht.idFor(target.RawString()),
+		Target: target.RawString(),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	rtt := dht.now().Sub(start)
+
+	compact, _ := r["nodes"].(string)
+	nodes := make([]*node, 0, len(compact)/26)
+	for i := 0; i+26 <= len(compact); i += 26 {
+		found, err := newNodeFromCompactInfo(compact[i:i+26], dht.now())
+		if err != nil || !dht.validAddr(found.address().IP, found.address().Port) {
+			continue
+		}
+		nodes = append(nodes, found)
+	}
+	return nodes, rtt, nil
+}
+
+// FindNode looks up the K nodes closest to target, like ClosestNodes, and
+// returns them, closest to target first, the routing table being updated
+// as usual. The error is the last one of the queries if none succeeded.
+func (dht *DHT) FindNode(ctx context.Context, target *HashID) ([]NodeInfo, error) {
+	if !target.valid() {
+		return nil, errHashIDSize
+	}
+	if dht.Passive {
+		return nil, errPassive
+	}
+	if dht.Router {
+		return nil, errRouter
+	}
+	if !dht.initialized() {
+		return nil, errNotRunning
+	}
+	return dht.closestNodes(ctx, target, dht.K)
+}
+
+const (
+	// lookupAlpha is the number of concurrent find_node queries of
+	// ClosestNodes.
+	lookupAlpha = 3
+	// busyRetry is how long ClosestNodes waits before querying again a
+	// node busy with another find_node of ours.
+	busyRetry = 100 * time.Millisecond
+)
+
+// findNodeWaiting is findNodeOn, but it waits for the end of another
+// find_node in flight to no rather than failing with errQueryBusy.
+func (dht *DHT) findNodeWaiting(ctx context.Context, no *node, target *HashID) ([]*node, time.Duration, error) {
+	for {
+		nodes, rtt, err := dht.findNodeOn(ctx, no, target)
+		if err != errQueryBusy {
+			return nodes, rtt, err
+		}
+
+		timer := dht.Clock.NewTimer(busyRetry)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, 0, ctx.Err()
+		case <-dht.done:
+			timer.Stop()
+			return nil, 0, errClosed
+		}
+	}
+}
+
+// ClosestNodes looks up the k nodes closest to target with find_node
+// queries, querying the closest nodes known until the k closest have
+// answered or failed, and returns the ones which answered, closest first,
+// with their round-trip time, but our own ids. The queries are canceled
+// with ctx. It returns nil in passive or router mode, if the dht doesn't
+// run or if target isn't a whole id.
+func (dht *DHT) ClosestNodes(ctx context.Context, target *HashID, k int) []NodeInfo {
+	if dht.Passive || dht.Router || !dht.initialized() || k <= 0 || !target.valid() {
+		return nil
+	}
+	ret, _ := dht.closestNodes(ctx, target, k)
+	return ret
+}
+
+// closestNodes runs the lookup of ClosestNodes, the error is errNoNodes if
+// no node is known, the last one of the queries if none answered.
+func (dht *DHT) closestNodes(ctx context.Context, target *HashID, k int) ([]NodeInfo, error) {
+
+	type candidate struct {
+		no              *node
+		id              *HashID // of no when added
+		queried, failed bool
+		rtt             time.Duration
+	}
+	type result struct {
+		c     *candidate
+		nodes []*node
+		rtt   time.Duration
+		err   error
+	}
+
+	var candidates []*candidate
+	seen := make(map[string]bool)
+	add := func(no *node) {
+		no.RLock()
+		id := no.id
+		no.RUnlock()
+
+		if !seen[id.RawString()] && !dht.isSelf(id.RawString()) {
+			seen[id.RawString()] = true
+			candidates = append(candidates, &candidate{no: no, id: id})
+		}
+	}
+	for _, no := range dht.rt.FindClosest(target, k) {
+		add(no)
+	}
+	if len(candidates) == 0 {
+		return nil, errNoNodes
+	}
+
+	var err error
+	results := make(chan result, lookupAlpha)
+	for inflight := 0; ; inflight-- {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return target.Closer(candidates[i].id, candidates[j].id)
+		})
+		closest := 0
+		for _, c := range candidates {
+			if closest >= k || inflight >= lookupAlpha {
+				break
+			}
+			if c.failed {
+				continue
+			}
+			closest++
+			if !c.queried {
+				c.queried = true
+				inflight++
+				go func(c *candidate) {
+					nodes, rtt, err := dht.findNodeWaiting(ctx, c.no, target)
+					results <- result{c, nodes, rtt, err}
+				}(c)
+			}
+		}
+		if inflight == 0 {
+			break
+		}
+
+		res := <-results
+		if res.err != nil {
+			res.c.failed, err = true, res.err
+			continue
+		}
+		res.c.rtt = res.rtt
+		for _, no := range res.nodes {
+			add(no)
+		}
+	}
+
+	var ret []NodeInfo
+	now := dht.now()
+	for _, c := range candidates {
+		if len(ret) == k {
+			break
+		}
+		if c.queried && !c.failed {
+			ret = append(ret, nodeInfo(c.no, c.rtt, now))
+		}
+	}
+	if len(ret) == 0 {
+		return nil, err
+	}
+	return ret, nil
+}
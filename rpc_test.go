@@ -0,0 +1,202 @@
+package dhtlistener
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNodeQueries(t *testing.T) {
+	mem := &memNet{}
+	addrA := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	addrB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	addrC := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 6881}
+
+	a, err := New(WithTransport(mem.listen(addrA)), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(WithTransport(mem.listen(addrB)), WithBootstrapNodes(addrA.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(WithTransport(mem.listen(addrC)), WithBootstrapNodes(addrA.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.AllowPrivateAddrs = true // reported by a
+
+	for _, dht := range []*DHT{a, b, c} {
+		dht.rt = newRouteTable(dht) // before Run, read below
+		go dht.Run()
+		defer func(dht *DHT) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			dht.Close(ctx)
+		}(dht)
+	}
+	if !waitUntil(func() bool { return hasNode(b, addrA.String()) && hasNode(a, addrC.String()) }) {
+		t.Fatal("b and c should join a")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	info, err := b.Ping(ctx, addrA)
+	if err != nil || info.ID != a.ID() || info.Addr != addrA.String() || !info.Good {
+		t.Errorf("expected a to answer, got %+v, %v", info, err)
+	}
+
+	nodes, err := b.FindNode(ctx, c.self())
+	if err != nil || len(nodes) == 0 || nodes[0].ID != c.ID() || nodes[0].Addr != addrC.String() {
+		t.Errorf("expected a to report c first, got %+v, %v", nodes, err)
+	}
+
+	closest := b.ClosestNodes(ctx, c.self(), 8)
+	if len(closest) != 2 || closest[0].ID != c.ID() || closest[1].ID != a.ID() || closest[0].RTT <= 0 {
+		t.Errorf("expected c then a, got %+v", closest)
+	}
+
+	if _, err := b.FindNode(ctx, &HashID{}); err != errHashIDSize || b.ClosestNodes(ctx, &HashID{}, 8) != nil {
+		t.Error("expected the zero HashID rejected")
+	}
+
+	// a reports b, which doesn't query itself.
+	for _, no := range b.ClosestNodes(ctx, b.self(), 8) {
+		if no.ID == b.ID() {
+			t.Error("expected our own id skipped")
+		}
+	}
+	canceled, stop := context.WithCancel(context.Background())
+	stop()
+	if closest := b.ClosestNodes(canceled, c.self(), 8); len(closest) != 0 {
+		t.Errorf("expected a canceled lookup, got %+v", closest)
+	}
+
+	unknown := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 4), Port: 6881}
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := b.Ping(ctx, unknown); err == nil {
+		t.Error("expected an unanswered ping to fail")
+	}
+}
+
+func TestPingShared(t *testing.T) {
+	mem := &memNet{}
+	addrA := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	addrB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+
+	a, err := New(WithTransport(mem.listen(addrA)), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := mem.listen(addrB) // answered below
+	go a.Run()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		a.Close(ctx)
+	}()
+	if !waitUntil(a.initialized) {
+		t.Fatal("a should run")
+	}
+
+	// a maintenance ping is in flight, Ping shares its response.
+	a.transacts.ping(&node{addr: addrB})
+	q := readQuery(t, b)
+	if q == nil {
+		t.Fatal("expected a ping sent")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := a.Ping(ctx, addrB)
+		errs <- err
+	}()
+	joined := waitUntil(func() bool {
+		a.transacts.RLock()
+		defer a.transacts.RUnlock()
+		trans := a.transacts.transactions[q.T]
+		return trans != nil && len(trans.joined) == 1
+	})
+	if !joined {
+		t.Fatal("expected Ping to join the maintenance ping")
+	}
+
+	data, _ := Marshal(makeResponse(q.T, &PingResponse{ID: GetRandString(20)}))
+	b.WriteToUDP(data, addrA)
+	if err := <-errs; err != nil {
+		t.Errorf("expected the ping answered, got %v", err)
+	}
+	if readQuery(t, b) != nil {
+		t.Error("expected a single ping sent")
+	}
+}
+
+func TestFindNodeBusy(t *testing.T) {
+	mem := &memNet{}
+	addrA := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	addrB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+
+	a, err := New(WithTransport(mem.listen(addrA)), WithBootstrapNodes(), WithQueryDedupePolicy("type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := mem.listen(addrB) // answered below
+	go a.Run()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		a.Close(ctx)
+	}()
+	if !waitUntil(a.initialized) {
+		t.Fatal("a should run")
+	}
+
+	// a find_node of another target is in flight, the lookup waits for it.
+	a.transacts.sendQuery(&node{addr: addrB}, findNodeType, &FindNodeArgs{
+		ID: a.idFor(""), Target: GetRandString(20),
+	})
+	q := readQuery(t, b)
+	if q == nil {
+		t.Fatal("expected a find_node sent")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := a.findNodeWaiting(ctx, &node{addr: addrB}, RandomHashID())
+		errs <- err
+	}()
+	time.Sleep(busyRetry / 2)
+
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			if q = readQuery(t, b); q == nil {
+				t.Fatal("expected the find_node sent once the other ends")
+			}
+		}
+		data, _ := Marshal(makeResponse(q.T, &FindNodeResponse{ID: GetRandString(20)}))
+		b.WriteToUDP(data, addrA)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("expected the find_node answered, got %v", err)
+	}
+}
+
+// readQuery returns the next query read by tr, nil if none within a second.
+func readQuery(t *testing.T, tr *memTransport) *rawMessage {
+	select {
+	case pkt := <-tr.in:
+		var q rawMessage
+		if err := Unmarshal(pkt.data, &q); err != nil {
+			t.Fatal(err)
+		}
+		return &q
+	case <-time.After(time.Second):
+		return nil
+	}
+}
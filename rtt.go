@@ -0,0 +1,101 @@
+package dhtlistener
+
+import (
+	"sort"
+	"time"
+)
+
+// rttGranularity is the clock granularity of the retransmission timeouts,
+// see RFC 6298.
+const rttGranularity = time.Millisecond * 10
+
+// observeRTT updates the smoothed round-trip time and its variance with a
+// sample, as RFC 6298 does.
+func (node *node) observeRTT(rtt time.Duration) {
+	node.Lock()
+	defer node.Unlock()
+
+	if node.srtt == 0 {
+		node.srtt, node.rttvar = rtt, rtt/2
+		return
+	}
+
+	delta := node.srtt - rtt
+	if delta < 0 {
+		delta = -delta
+	}
+	node.rttvar = (3*node.rttvar + delta) / 4
+	node.srtt = (7*node.srtt + rtt) / 8
+}
+
+// rtt returns the smoothed round-trip time of node, 0 if it's unknown.
+func (node *node) rtt() time.Duration {
+	node.RLock()
+	defer node.RUnlock()
+
+	return node.srtt
+}
+
+// timeout returns how long a response of node is waited for, its
+// retransmission timeout within [min, max], max if its rtt is unknown.
+func (node *node) timeout(min, max time.Duration) time.Duration {
+	node.RLock()
+	srtt, rttvar := node.srtt, node.rttvar
+	node.RUnlock()
+
+	if srtt == 0 {
+		return max
+	}
+
+	v := 4 * rttvar
+	if v < rttGranularity {
+		v = rttGranularity
+	}
+	return clampDuration(srtt+v, min, max)
+}
+
+// clampDuration returns d within [min, max].
+func clampDuration(d, min, max time.Duration) time.Duration {
+	if d > max {
+		d = max
+	}
+	if d < min {
+		d = min
+	}
+	return d
+}
+
+// lookupNodes returns at most size nodes to query for target: the fastest
+// ones among the 2*size closest, in the order of FindClosest. Nodes of
+// unknown rtt come after the measured ones.
+func (dht *DHT) lookupNodes(target *HashID, size int) []*node {
+	nodes := dht.rt.FindClosest(target, 2*size)
+	if len(nodes) <= size {
+		return nodes
+	}
+
+	rtts := make(map[*node]time.Duration, len(nodes))
+	for _, no := range nodes {
+		if rtts[no] = no.rtt(); rtts[no] == 0 {
+			rtts[no] = dht.QueryTimeout
+		}
+	}
+
+	fastest := append([]*node(nil), nodes...)
+	sort.SliceStable(fastest, func(i, j int) bool {
+		return rtts[fastest[i]] < rtts[fastest[j]]
+	})
+
+	keep := make(map[*node]bool, size)
+	for _, no := range fastest[:size] {
+		keep[no] = true
+	}
+
+	ret := nodes[:0]
+	for _, no := range nodes {
+		if keep[no] {
+			ret = append(ret, no)
+		}
+	}
+	return ret
+}
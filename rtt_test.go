@@ -0,0 +1,97 @@
+package dhtlistener
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestObserveRTT(t *testing.T) {
+	no := &node{}
+	if d := no.timeout(time.Millisecond*500, time.Second*15); d != time.Second*15 {
+		t.Error("expected the max timeout of an unknown rtt, got", d)
+	}
+
+	no.observeRTT(time.Millisecond * 100)
+	if no.srtt != time.Millisecond*100 || no.rttvar != time.Millisecond*50 {
+		t.Fatalf("unexpected first sample %v %v", no.srtt, no.rttvar)
+	}
+
+	no.observeRTT(time.Millisecond * 300)
+	if no.srtt != time.Millisecond*125 || no.rttvar != time.Microsecond*87500 {
+		t.Fatalf("unexpected second sample %v %v", no.srtt, no.rttvar)
+	}
+	if d := no.timeout(0, time.Second*15); d != time.Millisecond*475 {
+		t.Error("expected srtt+4*rttvar, got", d)
+	}
+	if d := no.timeout(time.Millisecond*500, time.Second*15); d != time.Millisecond*500 {
+		t.Error("expected the min timeout, got", d)
+	}
+	if d := no.timeout(0, time.Millisecond*200); d != time.Millisecond*200 {
+		t.Error("expected the max timeout, got", d)
+	}
+}
+
+func TestRespondRTT(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+
+	tar := newRandomNodeFromUdpAddr(dht.conn.LocalAddr().(*net.UDPAddr), time.Now())
+	start := time.Now()
+
+	trans := dht.transacts.newTransaction("aa", &query{tar: tar, msg: makeQuery("aa", pingType, &PingArgs{})})
+	trans.start, trans.tries = start, 1
+	dht.transacts.insert(trans)
+	dht.transacts.wheel.add(trans, time.Second)
+	if rtt := dht.transacts.respond(trans, start.Add(time.Millisecond*80), nil); rtt != time.Millisecond*80 || tar.rtt() != rtt {
+		t.Errorf("expected a rtt of 80ms, got %v, %v", rtt, tar.rtt())
+	}
+	if dht.transacts.respond(trans, time.Now(), nil) != 0 || dht.transacts.len() != 0 {
+		t.Error("expected the transaction finished once")
+	}
+
+	// Karn's algorithm: a resent query is not sampled.
+	trans = dht.transacts.newTransaction("ab", &query{tar: tar, msg: makeQuery("ab", pingType, &PingArgs{})})
+	trans.start, trans.tries = start, 2
+	dht.transacts.wheel.add(trans, time.Second)
+	if rtt := dht.transacts.respond(trans, start.Add(time.Second), nil); rtt != 0 || tar.rtt() != time.Millisecond*80 {
+		t.Errorf("unexpected sample of a resent query %v", rtt)
+	}
+}
+
+func TestLookupNodes(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+
+	nodes := make([]*node, 4)
+	for i := range nodes {
+		no, err := newNode(dht.randomChildID(5), "udp", fmt.Sprintf("127.0.0.%d:6881", i+1), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = no
+		dht.rt.Insert(no)
+	}
+	nodes[1].observeRTT(time.Millisecond * 50)
+	nodes[3].observeRTT(time.Millisecond * 20)
+	nodes[0].observeRTT(time.Second)
+
+	got := dht.lookupNodes(nodes[0].id, 2)
+	if len(got) != 2 {
+		t.Fatal("expected 2 nodes, got", len(got))
+	}
+	for _, no := range got {
+		if no != nodes[1] && no != nodes[3] {
+			t.Error("expected the fastest nodes, got", no.srtt)
+		}
+	}
+}
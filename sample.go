@@ -0,0 +1,235 @@
+package dhtlistener
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sampleInfoHashesType is the query of BEP 51, see
+// http://www.bittorrent.org/beps/bep_0051.html.
+const sampleInfoHashesType = "sample_infohashes"
+
+// maxSampleInterval is the max interval of BEP 51, in seconds.
+const maxSampleInterval = 21600
+
+// SampleInfoHashesArgs is the arguments of a sample_infohashes query.
+type SampleInfoHashesArgs struct {
+	ID     string `bencode:"id"`
+	Target string `bencode:"target"`
+}
+
+// SampleInfoHashesResponse is the response to a sample_infohashes query.
+type SampleInfoHashesResponse struct {
+	ID       string `bencode:"id"`
+	Interval int    `bencode:"interval"`
+	Nodes    string `bencode:"nodes"`
+	Num      int    `bencode:"num"`
+	Samples  string `bencode:"samples"`
+}
+
+// sampleInfoHashes sends sample_infohashes query to the chan.
+func (tm *transactionManager) sampleInfoHashes(no *node, target string) {
+	tm.sendQuery(no, sampleInfoHashesType, &SampleInfoHashesArgs{
+		ID:     tm.dht.idFor(target),
+		Target: target,
+	})
+}
+
+// SampleOptions configures SampleInfoHashes.
+type SampleOptions struct {
+	// Rate is the number of sample_infohashes queries sent per second.
+	Rate int
+	// Buffer is the buffer size of the infohash channel, new infohashes are
+	// dropped while it's full.
+	Buffer int
+}
+
+// Sampler enumerates the infohashes of the network, see SampleInfoHashes.
+type Sampler struct {
+	// C receives the new infohashes, it's closed once the sampler stops.
+	C <-chan string
+
+	out      chan string
+	frontier chan *node
+	seen     *dedupeCache
+	dropped  uint64 // accessed atomically
+
+	sync.Mutex
+	next map[string]time.Time // address : time it may be sampled again
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+var errSampling = errors.New("a sampler is already running")
+
+// SampleInfoHashes walks the keyspace with BEP 51 sample_infohashes queries
+// sent to the nodes learned from the previous responses, or to the routing
+// table nodes closest to random targets. It honors the interval returned by
+// each node and deduplicates the samples, the new ones are sent to the
+// sampler channel. Only one sampler runs at a time, the dht must be running.
+func (dht *DHT) SampleInfoHashes(opts SampleOptions) (*Sampler, error) {
+	if dht.Router {
+		return nil, errRouter
+	}
+	if opts.Rate < 1 {
+		opts.Rate = 1
+	}
+
+	out := make(chan string, opts.Buffer)
+	s := &Sampler{
+		C:        out,
+		out:      out,
+		frontier: make(chan *node, 1024),
+		seen:     newDedupeCache(time.Hour*24, 1<<20),
+		next:     make(map[string]time.Time),
+		stop:     make(chan struct{}),
+	}
+
+	dht.samplerMu.Lock()
+	defer dht.samplerMu.Unlock()
+
+	if dht.sampler != nil {
+		return nil, errSampling
+	}
+	dht.sampler = s
+
+	dht.spawn(func() {
+		defer func() {
+			dht.samplerMu.Lock()
+			dht.sampler = nil
+			dht.samplerMu.Unlock()
+
+			close(out)
+		}()
+		s.run(dht, opts.Rate)
+	})
+	return s, nil
+}
+
+// Stop stops the sampler.
+func (s *Sampler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// Dropped returns how many new infohashes have been dropped because the
+// channel was full.
+func (s *Sampler) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// ready returns whether the node at address may be sampled.
+func (s *Sampler) ready(address string, now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	t, ok := s.next[address]
+	return !ok || now.After(t)
+}
+
+// sweep forgets the nodes which may be sampled again.
+func (s *Sampler) sweep(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	for address, t := range s.next {
+		if now.After(t) {
+			delete(s.next, address)
+		}
+	}
+}
+
+// run sends rate queries per second until the sampler or the dht stops.
+func (s *Sampler) run(dht *DHT, rate int) {
+	ticker := dht.Clock.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+
+	swept := dht.now()
+	for {
+		select {
+		case <-ticker.C():
+		case <-s.stop:
+			return
+		case <-dht.done:
+			return
+		}
+
+		now := dht.now()
+		if now.Sub(swept) > time.Minute {
+			s.sweep(now)
+			swept = now
+		}
+
+		target := GetRandString(20)
+
+		var no *node
+		select {
+		case no = <-s.frontier:
+		default:
+			if closest := dht.rt.FindClosest(newHashId(target), 1); len(closest) != 0 {
+				no = closest[0]
+			}
+		}
+
+		if no != nil && s.ready(no.address().String(), now) {
+			dht.transacts.sampleInfoHashes(no, target)
+		}
+	}
+}
+
+// handle processes the response of the node at address.
+func (s *Sampler) handle(dht *DHT, address string, r *SampleInfoHashesResponse) {
+	interval := r.Interval
+	if interval < 0 {
+		interval = 0
+	} else if interval > maxSampleInterval {
+		interval = maxSampleInterval
+	}
+
+	s.Lock()
+	if len(s.next) < 1<<18 {
+		s.next[address] = dht.now().Add(time.Duration(interval) * time.Second)
+	}
+	s.Unlock()
+
+	for i := 0; i+20 <= len(r.Samples); i += 20 {
+		infoHash := r.Samples[i : i+20]
+		if s.seen.Seen(infoHash) {
+			continue
+		}
+
+		select {
+		case s.out <- infoHash:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+
+	for i := 0; i+26 <= len(r.Nodes); i += 26 {
+		no, err := newNodeFromCompactInfo(r.Nodes[i:i+26], dht.now())
+		if err != nil || !dht.validAddr(no.address().IP, no.address().Port) {
+			continue
+		}
+
+		dht.rt.Insert(no)
+		select {
+		case s.frontier <- no:
+		default:
+		}
+	}
+}
+
+// handleSamples hands a sample_infohashes response to the running sampler.
+func (dht *DHT) handleSamples(address string, r *SampleInfoHashesResponse) {
+	dht.samplerMu.Lock()
+	s := dht.sampler
+	dht.samplerMu.Unlock()
+
+	if s != nil {
+		s.handle(dht, address, r)
+	}
+}
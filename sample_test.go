@@ -0,0 +1,62 @@
+package dhtlistener
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSampler(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.Close(context.Background())
+
+	s, err := dht.SampleInfoHashes(SampleOptions{Rate: 10, Buffer: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dht.SampleInfoHashes(SampleOptions{}); err != errSampling {
+		t.Fatal("expected errSampling, got", err)
+	}
+
+	a, b := "abcdefghij0123456789", "mnopqrstuvwxyz123456"
+	dht.handleSamples("10.0.0.1:6881", &SampleInfoHashesResponse{
+		Interval: 60,
+		Samples:  a + b,
+	})
+	dht.handleSamples("10.0.0.2:6881", &SampleInfoHashesResponse{
+		Samples: b,
+	})
+
+	for _, expected := range []string{a, b} {
+		if infoHash := <-s.C; infoHash != expected {
+			t.Fatalf("expected %q, got %q", expected, infoHash)
+		}
+	}
+	select {
+	case infoHash := <-s.C:
+		t.Fatalf("unexpected duplicate %q", infoHash)
+	default:
+	}
+
+	now := time.Now()
+	if s.ready("10.0.0.1:6881", now) {
+		t.Fatal("the node should wait for its interval")
+	}
+	if !s.ready("10.0.0.2:6881", now.Add(time.Millisecond)) {
+		t.Fatal("the node without interval should be ready")
+	}
+
+	s.Stop()
+	select {
+	case _, ok := <-s.C:
+		if ok {
+			t.Fatal("unexpected infohash")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the channel should be closed once stopped")
+	}
+}
@@ -0,0 +1,284 @@
+package dhtlistener
+
+import (
+	"container/heap"
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// congestionWeight is the weight of a transaction outcome in the recent
+	// timeout rate of the scheduler.
+	congestionWeight = 0.05
+	// minWindow is the least number of queries in flight the scheduler
+	// slows down to.
+	minWindow = 8
+	// maxWindow bounds the window when MaxTransactions doesn't.
+	maxWindow = 1 << 16
+)
+
+// interactive returns whether q is part of a lookup waited for, a query
+// waiting for its response or one looking up infohashes or items, rather
+// than of the maintenance of the routing table or of a crawl.
+func (q *query) interactive() bool {
+	if q.replies != nil {
+		return true
+	}
+	switch q.msg.Q {
+	case pingType, findNodeType, sampleInfoHashesType:
+		return false
+	}
+	return true
+}
+
+// subnet returns the /24 of the IPv4 address ip, the /64 of an IPv6 one.
+func subnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4[:3])
+	}
+	if len(ip) == net.IPv6len {
+		return string(ip[:8])
+	}
+	return string(ip)
+}
+
+// scheduled is a query waiting in the scheduler.
+type scheduled struct {
+	q      *query
+	queue  *subnetQueue
+	queued time.Time
+	seq    uint64        // of its push
+	elem   *list.Element // in the order of the pushes
+}
+
+// subnetQueue holds the queries of a class to a subnet, oldest first.
+type subnetQueue struct {
+	class   int // the index of its queues and ready heap
+	subnet  string
+	queries []*scheduled
+	index   int // in the ready heap of its class, -1 if not in it
+}
+
+// readyQueues is a heap of subnetQueues by the age of their first query.
+type readyQueues []*subnetQueue
+
+func (h readyQueues) Len() int { return len(h) }
+
+func (h readyQueues) Less(i, j int) bool {
+	return h[i].queries[0].seq < h[j].queries[0].seq
+}
+
+func (h readyQueues) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *readyQueues) Push(x interface{}) {
+	sq := x.(*subnetQueue)
+	sq.index = len(*h)
+	*h = append(*h, sq)
+}
+
+func (h *readyQueues) Pop() interface{} {
+	old := *h
+	sq := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	sq.index = -1
+	return sq
+}
+
+// scheduler holds the queries read from the query chan until they can be
+// sent: the interactive ones first, while fewer than MaxSubnetQueries are
+// in flight to their destination subnet, and fewer than its window in
+// total. The window is halved when the recent timeout rate exceeds
+// CongestionRate, once per QueryTimeout at most, and grows by one
+// on every answer until it doesn't limit anymore.
+//
+// The queries of a class are queued by subnet, the subnets whose first
+// query is the oldest first. A subnet at MaxSubnetQueries leaves the heap
+// until one of its queries ends.
+type scheduler struct {
+	sync.Mutex
+	queues  [2]map[string]*subnetQueue // interactive and background queries
+	ready   [2]readyQueues             // the queues which can be sent to
+	order   *list.List                 // of the pushes, of *scheduled
+	seq     uint64                     // of the next push
+	subnets map[string]int             // queries in flight by subnet
+	active  int                        // queries in flight
+	window  int                        // max queries in flight, 0 if not limited
+	rate    float64                    // recent timeout rate
+	cut     time.Time                  // when the window was last halved
+	dht     *DHT
+}
+
+// newScheduler returns a new scheduler pointer.
+func newScheduler(dht *DHT) *scheduler {
+	return &scheduler{
+		queues:  [2]map[string]*subnetQueue{make(map[string]*subnetQueue), make(map[string]*subnetQueue)},
+		order:   list.New(),
+		subnets: make(map[string]int),
+		dht:     dht,
+	}
+}
+
+// len returns the number of queries waiting.
+func (s *scheduler) len() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.order.Len()
+}
+
+// push queues q.
+func (s *scheduler) push(q *query) {
+	s.Lock()
+	defer s.Unlock()
+
+	i := 1
+	if q.interactive() {
+		i = 0
+	}
+	key := subnet(q.tar.address().IP)
+	sq := s.queues[i][key]
+	if sq == nil {
+		sq = &subnetQueue{class: i, subnet: key, index: -1}
+		s.queues[i][key] = sq
+	}
+
+	e := &scheduled{q: q, queue: sq, queued: s.dht.now(), seq: s.seq}
+	s.seq++
+	e.elem = s.order.PushBack(e)
+	sq.queries = append(sq.queries, e)
+	if sq.index < 0 {
+		heap.Push(&s.ready[i], sq)
+	}
+}
+
+// remove removes e, the first query of its queue, and returns its query.
+// The caller holds the lock.
+func (s *scheduler) remove(e *scheduled) *query {
+	sq := e.queue
+	sq.queries[0] = nil
+	sq.queries = sq.queries[1:]
+	s.order.Remove(e.elem)
+
+	switch i := sq.class; {
+	case len(sq.queries) == 0:
+		delete(s.queues[i], sq.subnet)
+		if sq.index >= 0 {
+			heap.Remove(&s.ready[i], sq.index)
+		}
+	case sq.index >= 0:
+		heap.Fix(&s.ready[i], sq.index)
+	}
+	return e.q
+}
+
+// next removes and returns the first query which can be sent, nil if
+// none.
+func (s *scheduler) next() *query {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.window > 0 && s.active >= s.window {
+		return nil
+	}
+	max := s.dht.MaxSubnetQueries
+	for i := range s.ready {
+		for s.ready[i].Len() > 0 {
+			sq := s.ready[i][0]
+			if max > 0 && s.subnets[sq.subnet] >= max {
+				heap.Pop(&s.ready[i]) // back once a query ends, see done
+				continue
+			}
+			return s.remove(sq.queries[0])
+		}
+	}
+	return nil
+}
+
+// oldest removes and returns the oldest query, nil if none, or only if it
+// was pushed before deadline if it isn't zero.
+func (s *scheduler) oldest(deadline time.Time) *query {
+	s.Lock()
+	defer s.Unlock()
+
+	front := s.order.Front()
+	if front == nil {
+		return nil
+	}
+	e := front.Value.(*scheduled)
+	if !deadline.IsZero() && !e.queued.Before(deadline) {
+		return nil
+	}
+	return s.remove(e)
+}
+
+// start records the query sent to addr in flight.
+func (s *scheduler) start(addr *net.UDPAddr) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.active++
+	s.subnets[subnet(addr.IP)]++
+}
+
+// done records the end of the query sent to addr, successful or not, and
+// adjusts the window.
+func (s *scheduler) done(addr *net.UDPAddr, success bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.active--
+	key := subnet(addr.IP)
+	if s.subnets[key]--; s.subnets[key] <= 0 {
+		delete(s.subnets, key)
+	}
+	for i := range s.queues {
+		if sq := s.queues[i][key]; sq != nil && sq.index < 0 {
+			heap.Push(&s.ready[i], sq)
+		}
+	}
+
+	v := 1.0
+	if success {
+		v = 0
+	}
+	s.rate += congestionWeight * (v - s.rate)
+
+	limit := s.dht.MaxTransactions
+	if limit <= 0 {
+		limit = maxWindow
+	}
+	switch {
+	case !success && s.dht.CongestionRate > 0 && s.rate > s.dht.CongestionRate &&
+		s.dht.now().Sub(s.cut) >= s.dht.QueryTimeout:
+		if s.window = s.active / 2; s.window < minWindow {
+			s.window = minWindow
+		}
+		s.cut = s.dht.now()
+		s.dht.Logger.Debug("query window halved", F("window", s.window),
+			F("timeout_rate", s.rate))
+	case success && s.window > 0:
+		if s.window++; s.window >= limit {
+			s.window = 0
+		}
+	}
+}
+
+// QueryWindow returns the max number of queries in flight the scheduler
+// currently allows, 0 if it doesn't limit them.
+func (dht *DHT) QueryWindow() int {
+	if !dht.initialized() {
+		return 0
+	}
+
+	s := dht.transacts.sched
+	s.Lock()
+	defer s.Unlock()
+
+	return s.window
+}
@@ -0,0 +1,137 @@
+package dhtlistener
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	defer dht.conn.Close()
+	dht.MaxSubnetQueries = 1
+	s := newScheduler(dht)
+
+	queryTo := func(ip net.IP, q string) *query {
+		return &query{tar: &node{addr: &net.UDPAddr{IP: ip, Port: 6881}}, msg: makeQuery("aa", q, &PingArgs{})}
+	}
+	s.push(queryTo(net.IPv4(10, 0, 0, 1), pingType))
+	s.push(queryTo(net.IPv4(10, 0, 0, 2), getPeersType))
+	s.push(queryTo(net.IPv4(10, 0, 1, 1), findNodeType))
+
+	q := s.next()
+	if q == nil || q.msg.Q != getPeersType {
+		t.Fatal("expected the get_peers query first")
+	}
+	s.start(q.tar.addr)
+	if q = s.next(); q == nil || q.msg.Q != findNodeType {
+		t.Fatal("expected the ping to wait for its subnet")
+	}
+	s.start(q.tar.addr)
+	if s.next() != nil || s.len() != 1 {
+		t.Fatal("expected the ping to be queued")
+	}
+	s.done(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2)}, true)
+	if q = s.next(); q == nil || q.msg.Q != pingType {
+		t.Fatal("expected the ping once its subnet is free")
+	}
+	s.start(q.tar.addr)
+	s.done(q.tar.addr, true)
+	s.done(&net.UDPAddr{IP: net.IPv4(10, 0, 1, 1)}, true)
+
+	// timeouts spike with 100 queries in flight.
+	dht.MaxSubnetQueries, dht.CongestionRate = 0, 0.75
+	for i := 0; i < 100; i++ {
+		s.start(&net.UDPAddr{IP: net.IPv4(10, 1, byte(i), 1)})
+	}
+	for i := 0; i < 50 && s.window == 0; i++ {
+		s.done(&net.UDPAddr{IP: net.IPv4(10, 1, byte(i), 1)}, false)
+	}
+	window := s.window
+	if window < minWindow || window > 50 {
+		t.Fatalf("expected the window halved, got %d", window)
+	}
+	s.push(queryTo(net.IPv4(10, 2, 0, 1), getPeersType))
+	if s.next() != nil {
+		t.Error("expected the window to hold the query")
+	}
+	s.done(&net.UDPAddr{IP: net.IPv4(10, 1, 99, 1)}, true)
+	if s.window != window+1 {
+		t.Errorf("expected the window to grow, got %d", s.window)
+	}
+}
+
+func TestSchedulerOldest(t *testing.T) {
+	clock := newFakeClock()
+	dht := &DHT{MaxSubnetQueries: 1, Clock: clock}
+	s := newScheduler(dht)
+
+	queryTo := func(ip net.IP, q string) *query {
+		return &query{tar: &node{addr: &net.UDPAddr{IP: ip, Port: 6881}}, msg: makeQuery("aa", q, &PingArgs{})}
+	}
+	s.start(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)})
+	s.push(queryTo(net.IPv4(10, 0, 0, 2), getPeersType))
+	clock.Advance(time.Second)
+	s.push(queryTo(net.IPv4(10, 0, 0, 3), pingType))
+	s.push(queryTo(net.IPv4(10, 0, 1, 1), findNodeType))
+
+	if q := s.next(); q == nil || q.msg.Q != findNodeType {
+		t.Fatal("expected the query to the free subnet")
+	}
+	if q := s.oldest(clock.Now()); q == nil || q.msg.Q != getPeersType {
+		t.Fatal("expected the oldest query expired")
+	}
+	if s.oldest(clock.Now()) != nil || s.len() != 1 {
+		t.Fatal("expected the recent query kept")
+	}
+	if q := s.oldest(time.Time{}); q == nil || q.msg.Q != pingType || s.len() != 0 {
+		t.Fatal("expected the oldest query removed")
+	}
+
+	// the subnet is ready again once its query ends, with nothing queued.
+	s.done(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)}, true)
+	if s.next() != nil || len(s.queues[0])+len(s.queues[1]) != 0 {
+		t.Error("expected no query left")
+	}
+}
+
+func TestSchedulerExpiry(t *testing.T) {
+	mem := &memNet{}
+	addrA := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	addrB := &net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 6881}
+	addrC := &net.UDPAddr{IP: net.IPv4(10, 0, 1, 2), Port: 6881}
+
+	a, err := New(WithTransport(mem.listen(addrA)), WithBootstrapNodes(), WithMaxSubnetQueries(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.QueryQueueTimeout = time.Millisecond * 50
+	b, c := mem.listen(addrB), mem.listen(addrC) // never answer
+	go a.Run()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		a.Close(ctx)
+	}()
+	if !waitUntil(a.initialized) {
+		t.Fatal("a should run")
+	}
+
+	a.transacts.sendQuery(&node{addr: addrB}, pingType, &PingArgs{ID: a.idFor("")})
+	if readQuery(t, b) == nil {
+		t.Fatal("expected the ping sent")
+	}
+	a.transacts.sendQuery(&node{addr: addrC}, pingType, &PingArgs{ID: a.idFor("")})
+	if !waitUntil(func() bool { return a.DroppedQueries() == 1 }) {
+		t.Fatal("expected the query waiting for its subnet dropped")
+	}
+	select {
+	case <-c.in:
+		t.Error("expected no query sent")
+	default:
+	}
+}
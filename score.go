@@ -0,0 +1,133 @@
+package dhtlistener
+
+import (
+	"time"
+)
+
+// The weights of the components of a node score, they sum to 1.
+const (
+	scoreResponseWeight = 0.4
+	scoreRTTWeight      = 0.25
+	scoreAgeWeight      = 0.2
+	scoreBEP42Weight    = 0.15
+)
+
+const (
+	// scoreMaxRTT is the round-trip time scoring 0, the rtt score decreases
+	// linearly from 1 to 0 up to it.
+	scoreMaxRTT = time.Second
+	// scoreMaxAge is the age scoring 1, the age score increases linearly
+	// from 0 to 1 up to it.
+	scoreMaxAge = time.Hour
+)
+
+// queried records a query sent to the node.
+func (node *node) queried() {
+	node.Lock()
+	defer node.Unlock()
+
+	node.queries++
+}
+
+// answered records a response of the node to one of our queries.
+func (node *node) answered() {
+	node.Lock()
+	defer node.Unlock()
+
+	node.responses++
+}
+
+// score returns the reliability of the node in [0, 1], it weighs its
+// response rate, its round-trip time, how long it's known and whether its
+// id complies with BEP 42. A new node without history scores 0.325.
+func (node *node) score(now time.Time) float64 {
+	node.RLock()
+	queries, responses, srtt, created := node.queries, node.responses, node.srtt, node.created
+	addr := node.addr
+	node.RUnlock()
+
+	// smoothed so that a node without queries rates 0.5.
+	rate := float64(responses+1) / float64(queries+2)
+	if rate > 1 {
+		rate = 1
+	}
+
+	rtt := 0.5
+	if srtt != 0 {
+		rtt = 1 - float64(clampDuration(srtt, 0, scoreMaxRTT))/float64(scoreMaxRTT)
+	}
+
+	age := 0.0
+	if !created.IsZero() {
+		age = float64(clampDuration(now.Sub(created), 0, scoreMaxAge)) / float64(scoreMaxAge)
+	}
+
+	bep42 := 0.0
+	if bep42Valid(node.id.RawString(), addr.IP) {
+		bep42 = 1
+	}
+
+	return scoreResponseWeight*rate + scoreRTTWeight*rtt +
+		scoreAgeWeight*age + scoreBEP42Weight*bep42
+}
+
+// sortNodeByScore sorts the nodes closest to target first, the nodes in the
+// same bucket of target by descending score.
+type sortNodeByScore struct {
+	nodes  []*node
+	prefix []int // shared with target
+	scores []float64
+}
+
+func newSortNodeByScore(nodes []*node, target *HashID, now time.Time) *sortNodeByScore {
+	s := &sortNodeByScore{
+		nodes:  nodes,
+		prefix: make([]int, len(nodes)),
+		scores: make([]float64, len(nodes)),
+	}
+	for i, no := range nodes {
+		s.prefix[i] = hash_size * 8 // the target itself
+		if no.id.RawString() != target.RawString() {
+			s.prefix[i] = no.id.Xor(target).PrefixLen()
+		}
+		s.scores[i] = no.score(now)
+	}
+	return s
+}
+
+func (s *sortNodeByScore) Len() int {
+	return len(s.nodes)
+}
+
+func (s *sortNodeByScore) Swap(i, j int) {
+	s.nodes[i], s.nodes[j] = s.nodes[j], s.nodes[i]
+	s.prefix[i], s.prefix[j] = s.prefix[j], s.prefix[i]
+	s.scores[i], s.scores[j] = s.scores[j], s.scores[i]
+}
+
+func (s *sortNodeByScore) Less(i, j int) bool {
+	if s.prefix[i] != s.prefix[j] {
+		return s.prefix[i] > s.prefix[j]
+	}
+	return s.scores[i] > s.scores[j]
+}
+
+// victim returns the lowest scoring node of the bucket which failed a query
+// since its last response, nil if there is none.
+func (b *bucket) victim(now time.Time) *node {
+	var ret *node
+	min := 2.0
+
+	b.Foreach(func(v interface{}) bool {
+		no := v.(*node)
+		no.RLock()
+		failed := no.failures != 0
+		no.RUnlock()
+
+		if score := no.score(now); failed && score < min {
+			ret, min = no, score
+		}
+		return true
+	})
+	return ret
+}
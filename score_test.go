@@ -0,0 +1,108 @@
+package dhtlistener
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNodeScore(t *testing.T) {
+	ip := net.IPv4(124, 31, 75, 21)
+	fresh := &node{id: newHashId(GetRandString(20)), addr: &net.UDPAddr{IP: ip, Port: 6881}}
+	if s := fresh.score(time.Now()); s < 0.32 || s > 0.33 {
+		t.Error("expected 0.325 without history, got", s)
+	}
+
+	good := &node{id: newHashId(bep42ID(ip)), addr: &net.UDPAddr{IP: ip, Port: 6881},
+		created: time.Now().Add(-time.Hour)}
+	for i := 0; i < 10; i++ {
+		good.queried()
+		good.answered()
+	}
+	good.observeRTT(time.Millisecond * 100)
+	if s := good.score(time.Now()); s < 0.9 {
+		t.Error("expected a high score, got", s)
+	}
+	if good.score(good.created) >= good.score(time.Now()) {
+		t.Error("expected the age of the node at the time given")
+	}
+
+	bad := &node{id: newHashId(GetRandString(20)), addr: &net.UDPAddr{IP: ip, Port: 6881}}
+	for i := 0; i < 10; i++ {
+		bad.queried()
+	}
+	if bad.score(time.Now()) >= fresh.score(time.Now()) {
+		t.Error("expected an unresponsive node below a fresh one")
+	}
+}
+
+func TestFindClosestNodeScore(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+
+	nodes := make([]*node, 3)
+	for i := range nodes {
+		no, err := newNode(dht.randomChildID(3), "udp", fmt.Sprintf("127.0.0.%d:6881", i+1), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = no
+		dht.rt.Insert(no)
+	}
+	nodes[1].queried()
+	nodes[1].answered()
+	nodes[2].queried()
+
+	// the closest node is first, the others share the same prefix with
+	// our id.
+	got := dht.rt.FindClosest(nodes[2].id, 3)
+	if len(got) != 3 || got[0] != nodes[2] {
+		t.Fatal("expected the target first")
+	}
+
+	got = dht.rt.FindClosest(dht.me.id, 3)
+	if got[0] != nodes[1] || got[2] != nodes[2] {
+		t.Error("expected the nodes by descending score")
+	}
+}
+
+func TestEvictVictim(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.K = 2
+	dht.init()
+	defer dht.conn.Close()
+
+	nodes := make([]*node, 4)
+	for i := range nodes {
+		no, err := newNode(dht.randomChildID(7), "udp", fmt.Sprintf("127.0.0.%d:6881", i+1), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		no.heardResponse(time.Now())
+		nodes[i] = no
+	}
+	dht.rt.Insert(nodes[0])
+	dht.rt.Insert(nodes[1])
+
+	// no node failed, the newcomer waits in the replacement cache.
+	if dht.rt.Insert(nodes[2]) {
+		t.Fatal("expected a full bucket")
+	}
+
+	nodes[0].queried()
+	dht.rt.Fail(nodes[0].id)
+	if !dht.rt.Insert(nodes[3]) {
+		t.Fatal("expected the failed node replaced")
+	}
+	if dht.rt.GetNode(nodes[0].id.RawString()) != nil || dht.rt.GetNode(nodes[3].id.RawString()) == nil {
+		t.Error("expected the failed node evicted")
+	}
+}
@@ -0,0 +1,42 @@
+package dhtlistener
+
+import (
+	"net"
+)
+
+// packetWriter writes the packets of a transport.
+type packetWriter interface {
+	// write sends data to addr, it returns once data is sent.
+	write(data []byte, addr *net.UDPAddr) error
+}
+
+// newPacketWriter returns a packetWriter of conn writing at most batch
+// packets at a time, batches are only written to a *net.UDPConn.
+func newPacketWriter(conn Transport, batch int) (packetWriter, error) {
+	if udp, ok := conn.(*net.UDPConn); ok {
+		return newUDPWriter(udp, batch)
+	}
+	return transportWriter{conn}, nil
+}
+
+// transportWriter writes one packet at a time.
+type transportWriter struct {
+	conn Transport
+}
+
+func (w transportWriter) write(data []byte, addr *net.UDPAddr) error {
+	_, err := w.conn.WriteToUDP(data, addr)
+	return err
+}
+
+// writeTo sends data to addr through the writer of the DHT, or its
+// transport if it's not running.
+func (dht *DHT) writeTo(data []byte, addr *net.UDPAddr) (int, error) {
+	if dht.writer == nil {
+		return dht.conn.WriteToUDP(data, addr)
+	}
+	if err := dht.writer.write(data, addr); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
@@ -0,0 +1,224 @@
+package dhtlistener
+
+import (
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// pendingWrite is a packet waiting to be sent by an mmsgWriter.
+type pendingWrite struct {
+	data []byte
+	addr *net.UDPAddr
+	err  error
+	done chan struct{} // closed once sent, or to hand over the writes
+	lead bool          // whether it's handed over the writes
+}
+
+// mmsgWriter writes batches of packets with a single sendmmsg(2). The
+// packets written concurrently are queued while one of the writers sends
+// them all, there's no wait when there's a single writer.
+type mmsgWriter struct {
+	conn   syscall.RawConn
+	family int // of the socket
+
+	mu      sync.Mutex
+	pending []*pendingWrite
+	writing bool // whether a writer is sending the pending packets
+
+	// used by the writer sending only.
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrInet6
+	batch []*pendingWrite
+}
+
+// newUDPWriter returns a new mmsgWriter writing at most batch packets to
+// conn at a time.
+func newUDPWriter(conn *net.UDPConn, batch int) (packetWriter, error) {
+	if batch < 1 {
+		batch = 1
+	}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		sa    syscall.Sockaddr
+		saErr error
+	)
+	if err := rc.Control(func(fd uintptr) {
+		sa, saErr = syscall.Getsockname(int(fd))
+	}); err != nil {
+		return nil, err
+	}
+	if saErr != nil {
+		return nil, saErr
+	}
+
+	w := &mmsgWriter{
+		conn:   rc,
+		family: syscall.AF_INET,
+		hdrs:   make([]mmsghdr, batch),
+		iovs:   make([]syscall.Iovec, batch),
+		names:  make([]syscall.RawSockaddrInet6, batch),
+		batch:  make([]*pendingWrite, 0, batch),
+	}
+	if _, ok := sa.(*syscall.SockaddrInet6); ok {
+		w.family = syscall.AF_INET6
+	}
+	for i := range w.hdrs {
+		w.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&w.names[i]))
+		w.hdrs[i].hdr.Iov = &w.iovs[i]
+		w.hdrs[i].hdr.Iovlen = 1
+	}
+	return w, nil
+}
+
+func (w *mmsgWriter) write(data []byte, addr *net.UDPAddr) error {
+	p := &pendingWrite{data: data, addr: addr, done: make(chan struct{})}
+
+	w.mu.Lock()
+	w.pending = append(w.pending, p)
+	lead := !w.writing
+	w.writing = true
+	w.mu.Unlock()
+
+	if !lead {
+		<-p.done
+		if !p.lead {
+			return p.err
+		}
+	}
+	w.flush()
+	return p.err
+}
+
+// flush sends the pending packets, then hands the writes over to the
+// first packet queued meanwhile, if any.
+func (w *mmsgWriter) flush() {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+
+	for len(pending) > 0 {
+		n := len(pending)
+		if n > len(w.hdrs) {
+			n = len(w.hdrs)
+		}
+		w.send(pending[:n])
+		pending = pending[n:]
+	}
+
+	w.mu.Lock()
+	if len(w.pending) == 0 {
+		w.writing = false
+	} else {
+		next := w.pending[0]
+		next.lead = true
+		close(next.done)
+	}
+	w.mu.Unlock()
+}
+
+// send sends the packets ps, at most len(w.hdrs), and closes their done
+// chan but that of the ones handed over the writes, already closed.
+func (w *mmsgWriter) send(ps []*pendingWrite) {
+	w.batch = w.batch[:0]
+	for _, p := range ps {
+		i := len(w.batch)
+		namelen, err := w.sockaddr(&w.names[i], p.addr)
+		if err != nil {
+			p.err = err
+			continue
+		}
+		w.hdrs[i].hdr.Namelen = namelen
+		if len(p.data) > 0 {
+			w.iovs[i].Base = &p.data[0]
+		} else {
+			w.iovs[i].Base = nil
+		}
+		w.iovs[i].SetLen(len(p.data))
+		w.batch = append(w.batch, p)
+	}
+
+	for i := 0; i < len(w.batch); {
+		var (
+			n     int
+			errno syscall.Errno
+		)
+		err := w.conn.Write(func(fd uintptr) bool {
+			m, _, e := syscall.Syscall6(sysSendmmsg, fd,
+				uintptr(unsafe.Pointer(&w.hdrs[i])), uintptr(len(w.batch)-i), 0, 0, 0)
+			if e == syscall.EAGAIN {
+				return false
+			}
+			n, errno = int(m), e
+			return true
+		})
+		switch {
+		case err != nil:
+			for _, p := range w.batch[i:] {
+				p.err = err
+			}
+			i = len(w.batch)
+		case errno != 0:
+			// the error is that of the first packet, the next ones are
+			// sent again.
+			w.batch[i].err = errno
+			i++
+		case n <= 0:
+			w.batch[i].err = io.ErrShortWrite
+			i++
+		default:
+			i += n
+		}
+	}
+
+	for _, p := range ps {
+		if !p.lead {
+			close(p.done)
+		}
+	}
+}
+
+// sockaddr writes the address of addr for the socket of w to rsa, it
+// returns its length.
+func (w *mmsgWriter) sockaddr(rsa *syscall.RawSockaddrInet6, addr *net.UDPAddr) (uint32, error) {
+	if addr == nil {
+		return 0, syscall.EDESTADDRREQ
+	}
+
+	if w.family == syscall.AF_INET {
+		ip := addr.IP.To4()
+		if ip == nil {
+			return 0, syscall.EAFNOSUPPORT
+		}
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		*sa = syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+		copy(sa.Addr[:], ip)
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		p[0], p[1] = byte(addr.Port>>8), byte(addr.Port)
+		return syscall.SizeofSockaddrInet4, nil
+	}
+
+	ip := addr.IP.To16()
+	if ip == nil {
+		return 0, syscall.EAFNOSUPPORT
+	}
+	*rsa = syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+	copy(rsa.Addr[:], ip)
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			rsa.Scope_id = uint32(ifi.Index)
+		}
+	}
+	p := (*[2]byte)(unsafe.Pointer(&rsa.Port))
+	p[0], p[1] = byte(addr.Port>>8), byte(addr.Port)
+	return syscall.SizeofSockaddrInet6, nil
+}
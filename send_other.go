@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package dhtlistener
+
+import "net"
+
+// newUDPWriter returns a packetWriter of conn writing one packet at a time,
+// batch is ignored.
+func newUDPWriter(conn *net.UDPConn, batch int) (packetWriter, error) {
+	return transportWriter{conn}, nil
+}
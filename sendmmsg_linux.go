@@ -0,0 +1,9 @@
+//go:build linux && !amd64 && !386
+// +build linux,!amd64,!386
+
+package dhtlistener
+
+import "syscall"
+
+// sysSendmmsg is the number of sendmmsg(2).
+const sysSendmmsg = syscall.SYS_SENDMMSG
@@ -0,0 +1,4 @@
+package dhtlistener
+
+// sysSendmmsg is the number of sendmmsg(2), missing from package syscall.
+const sysSendmmsg = 307
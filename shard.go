@@ -0,0 +1,40 @@
+package dhtlistener
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errReusePortUnsupported = errors.New("SO_REUSEPORT is not supported")
+
+// listenShards returns shards sockets bound to laddr with SO_REUSEPORT, so
+// the kernel spreads the packets among their read loops. The first one
+// picks the port if laddr has none. It returns a single socket if shards
+// isn't greater than one or SO_REUSEPORT isn't supported.
+func listenShards(laddr *net.UDPAddr, shards int) ([]*net.UDPConn, error) {
+	if shards <= 1 || !reusePortSupported {
+		conn, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.UDPConn{conn}, nil
+	}
+
+	lc := net.ListenConfig{Control: reusePort}
+	conns := make([]*net.UDPConn, 0, shards)
+	addr := laddr.String()
+	for i := 0; i < shards; i++ {
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		conn := pc.(*net.UDPConn)
+		conns = append(conns, conn)
+		addr = conn.LocalAddr().String()
+	}
+	return conns, nil
+}
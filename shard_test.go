@@ -0,0 +1,62 @@
+package dhtlistener
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestShards(t *testing.T) {
+	dht, err := New(WithAddr("127.0.0.1:0"), WithShards(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dht.Close(context.Background())
+	laddr := dht.conn.LocalAddr().String()
+
+	expected := 1
+	if reusePortSupported {
+		expected = dht.Shards
+	}
+	if len(dht.conns) != expected {
+		t.Fatalf("expected %d sockets, got %d", expected, len(dht.conns))
+	}
+
+	for _, conn := range dht.conns {
+		if conn.LocalAddr().String() != laddr {
+			t.Fatalf("expected %s, got %s", laddr, conn.LocalAddr())
+		}
+	}
+	if dht.conn != dht.conns[0] {
+		t.Fatal("dht.conn should be the first shard")
+	}
+}
+
+func TestShardsClosedOnError(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT isn't supported")
+	}
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.LocalAddr().(*net.UDPAddr)
+	l.Close()
+
+	_, err = New(WithConfig(Config{
+		Addr:           addr.String(),
+		Shards:         4,
+		BlocklistFiles: []string{filepath.Join(t.TempDir(), "missing.txt")},
+	}))
+	if err == nil {
+		t.Fatal("expected the missing blocklist to fail")
+	}
+
+	// a socket without SO_REUSEPORT binds once all the shards are closed.
+	l, err = net.ListenUDP("udp4", addr)
+	if err != nil {
+		t.Fatalf("expected the shards closed, %v", err)
+	}
+	l.Close()
+}
@@ -0,0 +1,232 @@
+package dhtlistener
+
+import (
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// simNet runs in-process DHTs joined by a memNet. The nodes bootstrap from
+// the running node knowing the most nodes.
+type simNet struct {
+	t     *testing.T
+	net   *memNet
+	nodes []*DHT
+	next  int // of the addresses
+}
+
+// newSimNet returns a simNet of n running nodes whose packets take latency
+// plus up to jitter and are lost with the probability loss, seed makes the
+// delays and drops reproducible.
+func newSimNet(t *testing.T, n int, latency, jitter time.Duration, loss float64, seed int64) *simNet {
+	s := &simNet{
+		t: t,
+		net: &memNet{
+			latency: latency,
+			jitter:  jitter,
+			loss:    loss,
+			rand:    rand.New(rand.NewSource(seed)),
+		},
+	}
+	for i := 0; i < n; i++ {
+		s.add()
+	}
+	return s
+}
+
+// add starts a new node, it returns once the node has joined.
+func (s *simNet) add() *DHT {
+	s.next++
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, byte(s.next>>8), byte(s.next)), Port: 6881}
+
+	var routers []string
+	var router *DHT
+	for _, no := range s.nodes {
+		if !no.closed() && (router == nil || len(no.RoutingTable().AllNodes()) > len(router.RoutingTable().AllNodes())) {
+			router = no
+		}
+	}
+	if router != nil {
+		routers = append(routers, router.me.addr.String())
+	}
+
+	dht, err := New(
+		WithTransport(s.net.listen(addr)),
+		WithBootstrapNodes(routers...),
+		WithQueryTimeout(time.Second),
+		WithWorkers(4),
+	)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	dht.AllowPrivateAddrs = true
+	dht.rt = newRouteTable(dht) // before Run, read by the tests
+	go dht.Run()
+
+	if len(routers) != 0 {
+		// the join is retried every 5s if all its queries are lost.
+		s.waitFor("join", 15*time.Second, func() bool { return len(dht.RoutingTable().AllNodes()) != 0 })
+	}
+	s.nodes = append(s.nodes, dht)
+	return dht
+}
+
+// stop closes the node i.
+func (s *simNet) stop(i int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.nodes[i].Close(ctx); err != nil {
+		s.t.Error(err)
+	}
+}
+
+// close closes the running nodes.
+func (s *simNet) close() {
+	for i, no := range s.nodes {
+		if !no.closed() {
+			s.stop(i)
+		}
+	}
+}
+
+// waitFor waits until f returns true, it fails the test after timeout.
+func (s *simNet) waitFor(what string, timeout time.Duration, f func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !f() {
+		if time.Now().After(deadline) {
+			s.t.Fatalf("%s not reached in %v", what, timeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// joined returns whether the running nodes know at least min nodes each
+// and mean nodes on average.
+func (s *simNet) joined(min, mean int) bool {
+	running, known := 0, 0
+	for _, no := range s.nodes {
+		if no.closed() {
+			continue
+		}
+		n := len(no.RoutingTable().AllNodes())
+		if n < min {
+			return false
+		}
+		running++
+		known += n
+	}
+	return known >= mean*running
+}
+
+func TestSimBootstrap(t *testing.T) {
+	s := newSimNet(t, 20, 5*time.Millisecond, 5*time.Millisecond, 0.05, 1)
+	defer s.close()
+
+	s.waitFor("bootstrap", 5*time.Second, func() bool { return s.joined(1, 8) })
+
+	for _, no := range s.nodes {
+		for _, info := range no.RoutingTable().AllNodes() {
+			if info.Addr == no.me.addr.String() {
+				t.Fatalf("%v should not know itself", no.me.addr)
+			}
+		}
+	}
+}
+
+func TestSimAnnounceGetPeers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the announce waits for its lookup")
+	}
+
+	s := newSimNet(t, 20, 5*time.Millisecond, 5*time.Millisecond, 0, 2)
+	defer s.close()
+	s.waitFor("bootstrap", 5*time.Second, func() bool { return s.joined(1, 8) })
+
+	infoHash := strings.Repeat("ab", 20)
+	raw, _ := hex.DecodeString(infoHash)
+	announcer := s.nodes[5]
+
+	seen := make([]<-chan Event, len(s.nodes))
+	for i, no := range s.nodes {
+		seen[i] = no.Subscribe(EventGetPeersSeen)
+	}
+
+	n, err := announcer.Announce(infoHash, 6000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("the announce should reach nodes")
+	}
+
+	// stores returns the nodes storing the announced peer.
+	stores := func() map[int]bool {
+		ret := make(map[int]bool)
+		for i, no := range s.nodes {
+			for _, p := range no.peers.GetPeers(InfoHash(raw), no.K) {
+				if p.IP.Equal(announcer.me.addr.IP) && p.Port == 6000 {
+					ret[i] = true
+				}
+			}
+		}
+		return ret
+	}
+	s.waitFor("announce", 5*time.Second, func() bool { return len(stores()) != 0 })
+
+	// the nodes storing peers don't answer get_peers with them, check that
+	// the lookup of another node reaches one of them.
+	holders := stores()
+	querier := 0
+	for holders[querier] || s.nodes[querier] == announcer {
+		querier++
+	}
+	go s.nodes[querier].GetPeers(infoHash)
+
+	deadline := time.After(5 * time.Second)
+	for {
+		for i := range holders {
+			select {
+			case e := <-seen[i]:
+				if e := e.(GetPeersSeen); e.InfoHash.RawString() == string(raw) &&
+					e.IP == s.nodes[querier].me.addr.IP.String() {
+					return
+				}
+			default:
+			}
+		}
+
+		select {
+		case <-deadline:
+			t.Fatalf("the get_peers of %d should reach one of %v", querier, holders)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+func TestSimChurn(t *testing.T) {
+	s := newSimNet(t, 20, 5*time.Millisecond, 5*time.Millisecond, 0.05, 3)
+	defer s.close()
+	s.waitFor("bootstrap", 5*time.Second, func() bool { return s.joined(1, 8) })
+
+	// a quarter of the network leaves, the earliest nodes.
+	for i := 0; i < 5; i++ {
+		s.stop(i)
+	}
+
+	late := s.add()
+	s.waitFor("late join", 5*time.Second, func() bool {
+		live := 0
+		for _, info := range late.RoutingTable().AllNodes() {
+			for _, no := range s.nodes[5:] {
+				if info.Addr == no.me.addr.String() {
+					live++
+				}
+			}
+		}
+		return live >= 4
+	})
+}
@@ -0,0 +1,58 @@
+package dhtlistener
+
+import "time"
+
+// sinkFlushInterval is how often the sinks having a Flush method are flushed.
+const sinkFlushInterval = time.Second
+
+// Sink receives the events of a DHT, see AddSink.
+type Sink interface {
+	// Write handles an event, it's called by one goroutine.
+	Write(e Event) error
+	// Close flushes and releases the sink.
+	Close() error
+}
+
+// flusher is implemented by the sinks buffering their writes.
+type flusher interface {
+	Flush() error
+}
+
+// AddSink writes the events of types to sink until dht is closed, then
+// closes sink. Close waits for it. A sink having a Flush method is flushed
+// every second. The events are dropped when the sink is slow, see
+// EventDropPolicy.
+func (dht *DHT) AddSink(sink Sink, types ...EventType) {
+	events, cancel := dht.subscribeAll(types)
+	f, _ := sink.(flusher)
+
+	dht.spawn(func() {
+		defer func() {
+			cancel()
+			if err := sink.Close(); err != nil {
+				dht.Logger.Warn("close sink failed", F("err", err))
+			}
+		}()
+
+		ticker := time.NewTicker(sinkFlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case e := <-events:
+				if err := sink.Write(e); err != nil {
+					dht.Logger.Warn("sink write failed", F("err", err))
+				}
+			case <-ticker.C:
+				if f == nil {
+					continue
+				}
+				if err := f.Flush(); err != nil {
+					dht.Logger.Warn("sink flush failed", F("err", err))
+				}
+			case <-dht.done:
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package dhtlistener
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeSink struct {
+	sync.Mutex
+	events []Event
+	closed bool
+}
+
+func (s *fakeSink) Write(e Event) error {
+	s.Lock()
+	defer s.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestAddSink(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+
+	sink := &fakeSink{}
+	dht.AddSink(sink, EventPeerAnnounced)
+
+	dht.publish(EventPeerAnnounced, func() Event {
+		return PeerAnnounced{"mnopqrstuvwxyz123456", "1.2.3.4", 6881, time.Now(), nil}
+	})
+	dht.publish(EventGetPeersSeen, func() Event {
+		return GetPeersSeen{"mnopqrstuvwxyz123456", "1.2.3.4", 6881, time.Now(), nil}
+	})
+
+	for i := 0; ; i++ {
+		sink.Lock()
+		n := len(sink.events)
+		sink.Unlock()
+		if n != 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("no event written")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if err := dht.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !sink.closed || len(sink.events) != 1 || sink.events[0].Type() != EventPeerAnnounced {
+		t.Fatalf("unexpected sink %+v", sink)
+	}
+	if dht.events.has(EventPeerAnnounced) {
+		t.Error("expected the sink to unsubscribe")
+	}
+}
@@ -0,0 +1,60 @@
+package dhtlistener
+
+import (
+	"errors"
+	"net"
+)
+
+var errSockoptUnsupported = errors.New("socket options are not supported")
+
+// sockOpts holds the options of a socket.
+type sockOpts struct {
+	readBuffer  int
+	writeBuffer int
+	tos         int
+	ttl         int
+}
+
+// setSocketOptions sets ReadBuffer, WriteBuffer, TOS and TTL on the
+// sockets of dht, those which are zero are left unchanged, and logs their
+// effective values. The kernel may cap or double the buffer sizes, see
+// net.core.rmem_max on Linux.
+func (dht *DHT) setSocketOptions() {
+	for _, t := range dht.conns {
+		conn, ok := t.(*net.UDPConn)
+		if !ok {
+			continue
+		}
+		addr := conn.LocalAddr()
+
+		if dht.ReadBuffer > 0 {
+			if err := conn.SetReadBuffer(dht.ReadBuffer); err != nil {
+				dht.Logger.Warn("set read buffer failed", F("addr", addr), F("err", err))
+			}
+		}
+		if dht.WriteBuffer > 0 {
+			if err := conn.SetWriteBuffer(dht.WriteBuffer); err != nil {
+				dht.Logger.Warn("set write buffer failed", F("addr", addr), F("err", err))
+			}
+		}
+		if dht.TOS > 0 || dht.TTL > 0 {
+			if err := setIPOptions(conn, dht.TOS, dht.TTL); err != nil {
+				dht.Logger.Warn("set ip options failed", F("addr", addr), F("err", err))
+			}
+		}
+
+		opts, err := socketOptions(conn)
+		if err != nil {
+			continue
+		}
+		dht.Logger.Info("socket options", F("addr", addr),
+			F("read_buffer", opts.readBuffer), F("write_buffer", opts.writeBuffer),
+			F("tos", opts.tos), F("ttl", opts.ttl))
+	}
+}
+
+// ipv6 returns whether conn is an IPv6 socket, which may be dual-stack.
+func ipv6(conn *net.UDPConn) bool {
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() == nil
+}
@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package dhtlistener
+
+import "net"
+
+// setIPOptions always fails, the IP options aren't supported here.
+func setIPOptions(conn *net.UDPConn, tos, ttl int) error {
+	return errSockoptUnsupported
+}
+
+// socketOptions always fails, the options can't be read here.
+func socketOptions(conn *net.UDPConn) (sockOpts, error) {
+	return sockOpts{}, errSockoptUnsupported
+}
@@ -0,0 +1,30 @@
+package dhtlistener
+
+import (
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestSocketOptions(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+
+	dht, err := New(WithAddr("127.0.0.1:0"), WithSocketBuffers(1<<16, 1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dht.TOS, dht.TTL = 0x28, 32
+	dht.init()
+	defer dht.conn.Close()
+
+	opts, err := socketOptions(dht.conn.(*net.UDPConn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Linux doubles the buffer sizes.
+	if opts.readBuffer < 1<<16 || opts.writeBuffer < 1<<16 || opts.tos != 0x28 || opts.ttl != 32 {
+		t.Errorf("unexpected options %+v", opts)
+	}
+}
@@ -0,0 +1,77 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package dhtlistener
+
+import (
+	"net"
+	"syscall"
+)
+
+// setIPOptions sets the TOS, or traffic class, and the TTL, or hop limit,
+// of the packets sent by conn, unless they are zero. The IPv4 options are
+// also set on the IPv6 sockets, for their IPv4-mapped packets.
+func setIPOptions(conn *net.UDPConn, tos, ttl int) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	v6 := ipv6(conn)
+	var serr error
+	set := func(fd uintptr, level, opt, v int, ignore bool) {
+		if err := syscall.SetsockoptInt(int(fd), level, opt, v); err != nil && !ignore && serr == nil {
+			serr = err
+		}
+	}
+
+	if cerr := rc.Control(func(fd uintptr) {
+		if tos > 0 {
+			set(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos, v6)
+			if v6 {
+				set(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos, false)
+			}
+		}
+		if ttl > 0 {
+			set(fd, syscall.IPPROTO_IP, syscall.IP_TTL, ttl, v6)
+			if v6 {
+				set(fd, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl, false)
+			}
+		}
+	}); cerr != nil {
+		return cerr
+	}
+	return serr
+}
+
+// socketOptions returns the effective options of conn.
+func socketOptions(conn *net.UDPConn) (opts sockOpts, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return opts, err
+	}
+
+	level, tosOpt, ttlOpt := syscall.IPPROTO_IP, syscall.IP_TOS, syscall.IP_TTL
+	if ipv6(conn) {
+		level, tosOpt, ttlOpt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, syscall.IPV6_UNICAST_HOPS
+	}
+
+	if cerr := rc.Control(func(fd uintptr) {
+		for _, o := range []struct {
+			v          *int
+			level, opt int
+		}{
+			{&opts.readBuffer, syscall.SOL_SOCKET, syscall.SO_RCVBUF},
+			{&opts.writeBuffer, syscall.SOL_SOCKET, syscall.SO_SNDBUF},
+			{&opts.tos, level, tosOpt},
+			{&opts.ttl, level, ttlOpt},
+		} {
+			if *o.v, err = syscall.GetsockoptInt(int(fd), o.level, o.opt); err != nil {
+				return
+			}
+		}
+	}); cerr != nil {
+		return opts, cerr
+	}
+	return opts, err
+}
@@ -0,0 +1,288 @@
+package dhtlistener
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Socks5 is a SOCKS5 proxy, RFC 1928, with an optional username and
+// password, RFC 1929. It relays the UDP packets of a dht, see ListenUDP,
+// and the TCP connections of the metadata fetcher, see Dial.
+type Socks5 struct {
+	Addr     string
+	Username string
+	Password string
+	// Timeout bounds the handshakes, 15s if 0.
+	Timeout time.Duration
+}
+
+const (
+	socks5Version  = 5
+	socks5Connect  = 1
+	socks5Assoc    = 3
+	socks5IPv4     = 1
+	socks5Domain   = 3
+	socks5IPv6     = 4
+	socks5NoAuth   = 0
+	socks5UserPass = 2
+)
+
+var errSocks5 = errors.New("socks5: bad reply")
+
+// ParseSocks5 returns the proxy of a "socks5://[user:password@]host:port"
+// url.
+func ParseSocks5(rawurl string) (*Socks5, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("invalid proxy address %q: %v", u.Host, err)
+	}
+
+	p := &Socks5{Addr: u.Host}
+	if u.User != nil {
+		p.Username = u.User.Username()
+		p.Password, _ = u.User.Password()
+	}
+	return p, nil
+}
+
+func (p *Socks5) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	return time.Second * 15
+}
+
+// handshake authenticates on the control connection conn and sends the
+// request cmd for addr, it returns the address bound by the proxy.
+func (p *Socks5) handshake(conn net.Conn, cmd byte, addr string) (*net.UDPAddr, error) {
+	conn.SetDeadline(time.Now().Add(p.timeout()))
+	defer conn.SetDeadline(time.Time{})
+
+	methods := []byte{socks5NoAuth}
+	if p.Username != "" {
+		methods = append(methods, socks5UserPass)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	if buf[0] != socks5Version {
+		return nil, errSocks5
+	}
+
+	switch buf[1] {
+	case socks5NoAuth:
+	case socks5UserPass:
+		if len(p.Username) > 255 || len(p.Password) > 255 {
+			return nil, errors.New("socks5: username or password too long")
+		}
+		req := []byte{1, byte(len(p.Username))}
+		req = append(req, p.Username...)
+		req = append(req, byte(len(p.Password)))
+		req = append(req, p.Password...)
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+		if buf[1] != 0 {
+			return nil, errors.New("socks5: authentication failed")
+		}
+	default:
+		return nil, errors.New("socks5: no acceptable authentication method")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portn, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	req := []byte{socks5Version, cmd, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		req = appendSocks5Addr(req, &net.UDPAddr{IP: ip, Port: int(portn)})
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("socks5: host name too long")
+		}
+		req = append(req, socks5Domain, byte(len(host)))
+		req = append(req, host...)
+		req = append(req, byte(portn>>8), byte(portn))
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, err
+	}
+	if head[0] != socks5Version {
+		return nil, errSocks5
+	}
+	if head[1] != 0 {
+		return nil, fmt.Errorf("socks5: request failed with code %d", head[1])
+	}
+
+	var ip net.IP
+	switch head[3] {
+	case socks5IPv4:
+		ip = make(net.IP, net.IPv4len)
+	case socks5IPv6:
+		ip = make(net.IP, net.IPv6len)
+	case socks5Domain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return nil, err
+		}
+		ip = make(net.IP, buf[0]) // the name, skipped
+	default:
+		return nil, errSocks5
+	}
+	if _, err := io.ReadFull(conn, ip); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	if head[3] == socks5Domain {
+		ip = nil
+	}
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(buf))}, nil
+}
+
+// appendSocks5Addr appends the type, ip and port of addr to b.
+func appendSocks5Addr(b []byte, addr *net.UDPAddr) []byte {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append(b, socks5IPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5IPv6)
+		b = append(b, addr.IP.To16()...)
+	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port))
+}
+
+// Dial connects to addr through the proxy, which resolves the host names.
+// It has the signature of DHT.DialTCP.
+func (p *Socks5) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", p.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.handshake(conn, socks5Connect, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ListenUDP returns a Transport relaying the packets of a UDP socket
+// listening on laddr through the proxy with a UDP ASSOCIATE. The
+// association ends, and the transport fails, when the proxy closes the
+// control connection.
+func (p *Socks5) ListenUDP(laddr string) (Transport, error) {
+	addr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl, err := net.DialTimeout("tcp", p.Addr, p.timeout())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// the packets come from an address we don't know before sending.
+	relay, err := p.handshake(ctrl, socks5Assoc, "0.0.0.0:0")
+	if err != nil {
+		ctrl.Close()
+		conn.Close()
+		return nil, err
+	}
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	t := &socks5Transport{UDPConn: conn, ctrl: ctrl, relay: relay}
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		t.Close()
+	}()
+	return t, nil
+}
+
+// socks5Transport is the Transport of a UDP association of a Socks5 proxy.
+type socks5Transport struct {
+	*net.UDPConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+}
+
+func (t *socks5Transport) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		n, from, err := t.UDPConn.ReadFromUDP(b)
+		if err != nil {
+			return n, nil, err
+		}
+		if !from.IP.Equal(t.relay.IP) || from.Port != t.relay.Port {
+			continue
+		}
+		// RSV, FRAG, ATYP, the address and the port. The fragments are
+		// dropped like the RFC allows.
+		if n < 4 || b[2] != 0 {
+			continue
+		}
+		var ipLen int
+		switch b[3] {
+		case socks5IPv4:
+			ipLen = net.IPv4len
+		case socks5IPv6:
+			ipLen = net.IPv6len
+		default:
+			continue
+		}
+		head := 4 + ipLen + 2
+		if n < head {
+			continue
+		}
+		addr := &net.UDPAddr{
+			IP:   append(net.IP{}, b[4:4+ipLen]...),
+			Port: int(binary.BigEndian.Uint16(b[4+ipLen:])),
+		}
+		return copy(b, b[head:n]), addr, nil
+	}
+}
+
+func (t *socks5Transport) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	pkt := appendSocks5Addr(make([]byte, 3, 3+1+net.IPv6len+2+len(b)), addr)
+	if _, err := t.UDPConn.WriteToUDP(append(pkt, b...), t.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (t *socks5Transport) Close() error {
+	t.ctrl.Close()
+	return t.UDPConn.Close()
+}
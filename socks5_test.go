@@ -0,0 +1,230 @@
+package dhtlistener
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// socks5Server is a minimal SOCKS5 proxy relaying CONNECT and UDP
+// ASSOCIATE requests, with the user "u" and password "p" if auth.
+type socks5Server struct {
+	l    net.Listener
+	auth bool
+}
+
+func newSocks5Server(t *testing.T, auth bool) *socks5Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks5Server{l: l, auth: auth}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socks5Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	buf := make([]byte, 512)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	io.ReadFull(conn, buf[:buf[1]])
+	if !s.auth {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		io.ReadFull(conn, buf[:2])
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if string(user) != "u" || string(pass) != "p" {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	io.ReadFull(conn, buf[:4])
+	cmd := buf[1]
+	var host string
+	switch buf[3] {
+	case socks5IPv4:
+		io.ReadFull(conn, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case socks5Domain:
+		io.ReadFull(conn, buf[:1])
+		name := make([]byte, buf[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	io.ReadFull(conn, buf[:2])
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf))))
+
+	switch cmd {
+	case socks5Connect:
+		target, err := net.Dial("tcp", addr)
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+	case socks5Assoc:
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		// an unspecified address, the one of the proxy is used.
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+		go s.relay(relay)
+		io.Copy(io.Discard, conn)
+	}
+}
+
+// relay forwards the packets of the client to their destination and back.
+func (s *socks5Server) relay(relay *net.UDPConn) {
+	var client *net.UDPAddr
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || (from.IP.Equal(client.IP) && from.Port == client.Port) {
+			client = from
+			dst := &net.UDPAddr{IP: net.IP(buf[4:8]), Port: int(binary.BigEndian.Uint16(buf[8:10]))}
+			relay.WriteToUDP(buf[10:n], dst)
+			continue
+		}
+		pkt := appendSocks5Addr([]byte{0, 0, 0}, from)
+		relay.WriteToUDP(append(pkt, buf[:n]...), client)
+	}
+}
+
+func (s *socks5Server) url(userinfo string) string {
+	return "socks5://" + userinfo + s.l.Addr().String()
+}
+
+func TestParseSocks5(t *testing.T) {
+	p, err := ParseSocks5("socks5://u:p@127.0.0.1:1080")
+	if err != nil || p.Addr != "127.0.0.1:1080" || p.Username != "u" || p.Password != "p" {
+		t.Errorf("unexpected proxy %+v, %v", p, err)
+	}
+	for _, s := range []string{"http://127.0.0.1:8080", "socks5://127.0.0.1"} {
+		if _, err := ParseSocks5(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestSocks5Dial(t *testing.T) {
+	s := newSocks5Server(t, true)
+	defer s.l.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	p, _ := ParseSocks5(s.url("u:x@"))
+	if _, err := p.Dial(l.Addr().String(), time.Second); err == nil {
+		t.Error("expected the authentication to fail")
+	}
+
+	p, _ = ParseSocks5(s.url("u:p@"))
+	conn, err := p.Dial(l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("expected the echo, got %q, %v", buf, err)
+	}
+}
+
+func TestSocks5ListenUDP(t *testing.T) {
+	s := newSocks5Server(t, false)
+	defer s.l.Close()
+
+	dht, err := New(WithAddr("127.0.0.1:0"), WithProxy(s.url("")), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dht.conn.(*socks5Transport); !ok || dht.DialTCP == nil {
+		t.Fatal("expected the proxy to be used")
+	}
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, raddr, err := dht.conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			handle(dht, packet{data: append([]byte{}, buf[:n]...), raddr: raddr})
+		}
+	}()
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	data, _ := Marshal(makeQuery("aa", pingType, &PingArgs{ID: GetRandString(20)}))
+	laddr := dht.conn.LocalAddr().(*net.UDPAddr)
+	// the relay learns the client address from its first packet.
+	send(dht, l.LocalAddr().(*net.UDPAddr), makeQuery("bb", pingType, &PingArgs{ID: dht.me.id.RawString()}))
+
+	buf := make([]byte, 1500)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	_, relay, err := l.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relay.Port == laddr.Port {
+		t.Fatal("expected the query to come from the relay")
+	}
+
+	l.WriteToUDP(data, relay)
+	n, _, err := l.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("expected a reply through the proxy: %v", err)
+	}
+	var reply map[string]interface{}
+	if err := Unmarshal(buf[:n], &reply); err != nil || reply["y"] != "r" {
+		t.Errorf("expected a ping response, got %v, %v", reply, err)
+	}
+}
@@ -0,0 +1,111 @@
+package dhtlistener
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// EventSuspiciousNode is published when a node looks like a sybil.
+const EventSuspiciousNode EventType = EventNodeBanned + 1
+
+// SuspiciousNode is the event of a node kept out of the routing table.
+type SuspiciousNode struct {
+	ID     string
+	Addr   *net.UDPAddr
+	Reason string
+}
+
+// Type implements Event.
+func (SuspiciousNode) Type() EventType { return EventSuspiciousNode }
+
+// idTracker remembers the node ids seen per ip for about ttl, holding at
+// most size ips. Like dedupeCache, it keeps two generations.
+type idTracker struct {
+	sync.Mutex
+	ttl     time.Duration
+	size    int
+	cur     map[string]map[string]struct{} // ip : ids
+	prev    map[string]map[string]struct{} // ip : ids
+	rotated time.Time
+}
+
+// newIDTracker returns a new idTracker pointer.
+func newIDTracker(ttl time.Duration, size int) *idTracker {
+	return &idTracker{
+		ttl:     ttl,
+		size:    size,
+		cur:     make(map[string]map[string]struct{}),
+		prev:    make(map[string]map[string]struct{}),
+		rotated: time.Now(),
+	}
+}
+
+// add remembers id for ip, keeping at most max+1 ids per ip. It returns
+// whether id is new and how many ids ip has.
+func (it *idTracker) add(ip net.IP, id string, max int) (bool, int) {
+	key := string(ip.To16())
+
+	it.Lock()
+	defer it.Unlock()
+
+	if len(it.cur) >= it.size/2 || time.Since(it.rotated) > it.ttl {
+		it.prev, it.cur = it.cur, make(map[string]map[string]struct{})
+		it.rotated = time.Now()
+	}
+
+	ids, ok := it.cur[key]
+	if !ok {
+		if ids, ok = it.prev[key]; !ok {
+			ids = make(map[string]struct{})
+		}
+		it.cur[key] = ids
+	}
+
+	if _, ok := ids[id]; ok {
+		return false, len(ids)
+	}
+	if len(ids) <= max {
+		ids[id] = struct{}{}
+	}
+	return true, len(ids)
+}
+
+// suspect reports no as a suspicious node.
+func (dht *DHT) suspect(no *node, reason string) {
+	dht.Logger.Debug("suspicious node", F("addr", no.address()), F("reason", reason))
+	dht.publish(EventSuspiciousNode, func() Event {
+		return SuspiciousNode{no.id.RawString(), no.address(), reason}
+	})
+}
+
+// tooManyIDs returns whether the ip of no presents more than MaxIDsPerIP
+// node ids.
+func (dht *DHT) tooManyIDs(no *node) bool {
+	if dht.MaxIDsPerIP <= 0 || dht.idsPerIP == nil {
+		return false
+	}
+
+	isNew, n := dht.idsPerIP.add(no.address().IP, no.id.RawString(), dht.MaxIDsPerIP)
+	if n <= dht.MaxIDsPerIP {
+		return false
+	}
+	if isNew {
+		dht.suspect(no, "too many ids per ip")
+	}
+	return true
+}
+
+// tooClose returns whether the id of no is unrealistically close to target,
+// that is it shares SuspiciousPrefixLen bits or more without being target.
+// Such a node is removed from the routing table.
+func (dht *DHT) tooClose(no *node, target *HashID) bool {
+	if dht.SuspiciousPrefixLen <= 0 || no.id.RawString() == target.RawString() ||
+		no.id.Xor(target).PrefixLen() < dht.SuspiciousPrefixLen {
+		return false
+	}
+
+	dht.rt.Remove(no.id)
+	dht.suspect(no, "id too close to target")
+	return true
+}
@@ -0,0 +1,57 @@
+package dhtlistener
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestTooManyIDs(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.MaxIDsPerIP = 2
+	dht.init()
+	defer dht.Close(context.Background())
+
+	events := dht.Subscribe(EventSuspiciousNode)
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+
+	for i := 0; i < 4; i++ {
+		no := &node{id: newHashId(fmt.Sprintf("%020d", i)), addr: addr}
+		if dht.rt.Insert(no) != (i < 2) {
+			t.Fatalf("unexpected insert of id %d", i)
+		}
+	}
+
+	if dht.rt.Len() != 2 {
+		t.Fatal("expected 2 nodes, got", dht.rt.Len())
+	}
+	if len(events) != 2 {
+		t.Fatal("expected 2 SuspiciousNode events, got", len(events))
+	}
+}
+
+func TestTooClose(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.Close(context.Background())
+
+	target := newHashId("abcdefghij0123456789")
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+
+	if dht.tooClose(&node{id: target, addr: addr}, target) {
+		t.Fatal("the target itself is not suspicious")
+	}
+	if dht.tooClose(&node{id: newHashId("abcdzzzzzzzzzzzzzzzz"), addr: addr}, target) {
+		t.Fatal("a 32-bit prefix is not suspicious")
+	}
+	if !dht.tooClose(&node{id: newHashId("abcdefzzzzzzzzzzzzzz"), addr: addr}, target) {
+		t.Fatal("a 48-bit prefix is suspicious")
+	}
+}
@@ -0,0 +1,114 @@
+package dhtlistener
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// wheelInterval is the resolution of the transaction timeouts.
+	wheelInterval = time.Millisecond * 100
+	// wheelSize is the number of slots of the timer wheel, a timeout longer
+	// than wheelSize*wheelInterval takes several rounds.
+	wheelSize = 512
+)
+
+// timerWheel is a hashed timer wheel expiring the transactions in flight,
+// it's advanced every interval by tick. A transaction is in a slot at most.
+type timerWheel struct {
+	sync.Mutex
+	slots    []map[*transaction]int // transaction : remaining rounds
+	interval time.Duration
+	cur      int
+	n        int
+}
+
+// newTimerWheel returns a new timerWheel pointer.
+func newTimerWheel(interval time.Duration, size int) *timerWheel {
+	slots := make([]map[*transaction]int, size)
+	for i := range slots {
+		slots[i] = make(map[*transaction]int)
+	}
+
+	return &timerWheel{
+		slots:    slots,
+		interval: interval,
+	}
+}
+
+// schedule adds trans to the slot d ahead, the caller holds the lock.
+func (w *timerWheel) schedule(trans *transaction, d time.Duration) {
+	ticks := int((d + w.interval - 1) / w.interval)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	trans.slot = (w.cur + ticks) % len(w.slots)
+	w.slots[trans.slot][trans] = (ticks - 1) / len(w.slots)
+	w.n++
+}
+
+// add schedules the expiry of trans in d.
+func (w *timerWheel) add(trans *transaction, d time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.schedule(trans, d)
+}
+
+// remove unschedules trans and returns whether it was scheduled.
+func (w *timerWheel) remove(trans *transaction) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	if trans.slot < 0 {
+		return false
+	}
+
+	delete(w.slots[trans.slot], trans)
+	trans.slot = -1
+	w.n--
+	return true
+}
+
+// tick advances the wheel by a slot. Each expired transaction is passed to
+// f, under the lock, and is scheduled again if f returns a positive
+// duration. tick returns the rescheduled and the dropped transactions.
+func (w *timerWheel) tick(f func(*transaction) time.Duration) (again, expired []*transaction) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.cur = (w.cur + 1) % len(w.slots)
+	slot := w.slots[w.cur]
+	var due []*transaction
+	for trans, rounds := range slot {
+		if rounds > 0 {
+			slot[trans] = rounds - 1
+			continue
+		}
+
+		delete(slot, trans)
+		trans.slot = -1
+		w.n--
+		due = append(due, trans)
+	}
+
+	// rescheduled once the slot is walked, a full round lands in it.
+	for _, trans := range due {
+		if d := f(trans); d > 0 {
+			w.schedule(trans, d)
+			again = append(again, trans)
+		} else {
+			expired = append(expired, trans)
+		}
+	}
+	return
+}
+
+// len returns how many transactions are scheduled.
+func (w *timerWheel) len() int {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.n
+}
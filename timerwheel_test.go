@@ -0,0 +1,93 @@
+package dhtlistener
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTimerWheel(t *testing.T) {
+	w := newTimerWheel(time.Millisecond*100, 4)
+	a, b, c := &transaction{slot: -1}, &transaction{slot: -1}, &transaction{slot: -1}
+
+	w.add(a, time.Millisecond*100)
+	w.add(b, time.Millisecond*250) // 3 ticks
+	w.add(c, time.Millisecond*500) // 5 ticks, a round and a tick
+	if w.len() != 3 {
+		t.Fatal("expected 3 transactions, got", w.len())
+	}
+
+	expiredAt := make(map[*transaction]int)
+	for i := 1; i <= 5; i++ {
+		_, expired := w.tick(func(*transaction) time.Duration { return 0 })
+		for _, trans := range expired {
+			expiredAt[trans] = i
+		}
+	}
+	if expiredAt[a] != 1 || expiredAt[b] != 3 || expiredAt[c] != 5 {
+		t.Errorf("unexpected expiries %d %d %d", expiredAt[a], expiredAt[b], expiredAt[c])
+	}
+
+	w.add(a, time.Millisecond*400) // a full round
+	if !w.remove(a) || w.remove(a) || w.len() != 0 {
+		t.Error("expected a removed once")
+	}
+
+	w.add(a, time.Millisecond*400)
+	tries := 0
+	for i := 0; i < 8; i++ {
+		again, expired := w.tick(func(*transaction) time.Duration {
+			tries++
+			if tries == 1 {
+				return time.Millisecond * 400
+			}
+			return 0
+		})
+		if i == 3 && len(again) != 1 || i == 7 && len(expired) != 1 {
+			t.Fatalf("unexpected tick %d: %d again, %d expired", i, len(again), len(expired))
+		}
+	}
+}
+
+func TestTransactionTimeout(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.QueryTimeout = time.Millisecond * 100
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+
+	// nothing answers.
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go dht.transacts.run()
+	dht.transacts.ping(&node{addr: l.LocalAddr().(*net.UDPAddr)})
+
+	deadline := time.Now().Add(time.Second * 5)
+	for dht.transacts.len() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	for dht.transacts.len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	buf := make([]byte, 1024)
+	for i := 0; i < dht.Try; i++ {
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := l.ReadFromUDP(buf); err != nil {
+			t.Fatalf("expected query %d, got %v", i+1, err)
+		}
+	}
+	if dht.transacts.len() != 0 || dht.transacts.wheel.len() != 0 {
+		t.Error("expected the transaction expired")
+	}
+	if n := dht.metrics.transTimeout; n != 1 {
+		t.Error("expected a timeout, got", n)
+	}
+}
@@ -1,73 +1,203 @@
 package dhtlistener
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	// token‘s validity, unit sencond
-	token_active_time = 60 * 10
+	// token_size is the length of tokens we hand out
+	token_size = 8
+	// secret_size is the length of the secrets tokens derive from
+	secret_size = 20
 )
 
-// token used in getpeer and announce_peer
-type token struct {
-	data       string
-	createTime int64
-}
-
+// tokenMgr hands out tokens used in get_peers and announce_peer. A token is
+// the HMAC/SHA1 of the requester's ip keyed by a secret which rotates
+// periodically. Tokens of the current and the previous secret are accepted.
+// See http://www.bittorrent.org/beps/bep_0005.html.
+//
+// No token is stored, so they don't grow with the requesters: a token
+// expires with its secret, from one to two rotations after it's handed
+// out.
 type tokenMgr struct {
-	*syncMap
+	sync.RWMutex
+	secret   string
+	previous string
+	retired  string    // before previous, to tell the stale tokens
+	rotated  time.Time // when secret was made
+	rejected uint64    // accessed atomically
+	now      func() time.Time
 }
 
-// newTokenMgr returns a new tokenManager.
-func newTokenMgr() *tokenMgr {
+// newTokenMgr returns a new tokenManager whose time is that of now.
+func newTokenMgr(now func() time.Time) *tokenMgr {
+	secret := GetRandString(secret_size)
+
 	return &tokenMgr{
-		syncMap: newsyncMap(),
+		secret:   secret,
+		previous: secret,
+		rotated:  now(),
+		now:      now,
 	}
 }
 
+// genToken returns the token of ip derived from secret.
+func genToken(secret string, ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(ip)
+	return string(mac.Sum(nil)[:token_size])
+}
+
 // getToken returns a token.
 func (tm *tokenMgr) getToken(addr *net.UDPAddr) string {
-	v, ok := tm.Get(addr.IP.String())
-	tk, _ := v.(token)
+	tm.RLock()
+	defer tm.RUnlock()
 
-	if !ok || time.Now().Unix()-tk.createTime > token_active_time {
-		tk = token{
-			data:       GetRandString(4),
-			createTime: time.Now().Unix(),
-		}
+	return genToken(tm.secret, addr.IP)
+}
 
-		tm.Set(addr.IP.String(), tk)
+// rotate replaces the secret with a new one and keeps the current one as
+// the previous.
+func (tm *tokenMgr) rotate() {
+	tm.Lock()
+	defer tm.Unlock()
+
+	tm.retired = tm.previous
+	tm.previous = tm.secret
+	tm.secret = GetRandString(secret_size)
+	tm.rotated = tm.now()
+}
+
+// check returns whether the token is valid.
+func (tm *tokenMgr) check(addr *net.UDPAddr, tokenString string) bool {
+	tm.RLock()
+	ok := hmac.Equal([]byte(tokenString), []byte(genToken(tm.secret, addr.IP))) ||
+		hmac.Equal([]byte(tokenString), []byte(genToken(tm.previous, addr.IP)))
+	tm.RUnlock()
+
+	if !ok {
+		atomic.AddUint64(&tm.rejected, 1)
 	}
+	return ok
+}
 
-	return tk.data
+// stale returns whether the token rejected by check was handed out to addr
+// before the previous secret, so it expired rather than being forged.
+func (tm *tokenMgr) stale(addr *net.UDPAddr, tokenString string) bool {
+	tm.RLock()
+	defer tm.RUnlock()
+
+	return tm.retired != "" &&
+		hmac.Equal([]byte(tokenString), []byte(genToken(tm.retired, addr.IP)))
 }
 
-// clear removes expired tokens.
-func (tm *tokenMgr) clearExpired() {
-	for _ = range time.Tick(time.Minute * 3) {
-		keys := make([]interface{}, 0, 100)
+// Rejected returns how many tokens have been rejected.
+func (tm *tokenMgr) Rejected() uint64 {
+	return atomic.LoadUint64(&tm.rejected)
+}
 
-		for item := range tm.Iter() {
-			if time.Now().Unix()-item.val.(token).createTime > token_active_time {
-				keys = append(keys, item.key)
-			}
-		}
+// tokenState is the content of TokenFile.
+type tokenState struct {
+	Secret   string    `json:"secret"`   // hex
+	Previous string    `json:"previous"` // hex
+	Rotated  time.Time `json:"rotated"`  // when Secret was made
+}
+
+// state returns the secrets of tm.
+func (tm *tokenMgr) state() tokenState {
+	tm.RLock()
+	defer tm.RUnlock()
 
-		tm.DeleteMulti(keys)
+	return tokenState{
+		Secret:   hex.EncodeToString([]byte(tm.secret)),
+		Previous: hex.EncodeToString([]byte(tm.previous)),
+		Rotated:  tm.rotated,
 	}
 }
 
-// check returns whether the token is valid.
-func (tm *tokenMgr) check(addr *net.UDPAddr, tokenString string) bool {
-	key := addr.IP.String()
-	v, ok := tm.Get(key)
-	tk, _ := v.(token)
+// restore makes the saved secrets of s the ones of tm, as if they had been
+// rotated every interval since: both are kept if the secret is younger than
+// interval, the secret is kept as the previous one if it's younger than
+// twice interval, none otherwise.
+func (tm *tokenMgr) restore(s tokenState, interval time.Duration) error {
+	secret, err := hex.DecodeString(s.Secret)
+	if err != nil || len(secret) != secret_size {
+		return errors.New("invalid token secret")
+	}
+	previous, err := hex.DecodeString(s.Previous)
+	if err != nil || len(previous) != secret_size {
+		return errors.New("invalid token secret")
+	}
+
+	tm.Lock()
+	defer tm.Unlock()
+
+	switch age := tm.now().Sub(s.Rotated); {
+	case age < 0 || age >= 2*interval:
+	case age < interval:
+		tm.secret, tm.previous, tm.rotated = string(secret), string(previous), s.Rotated
+	default:
+		tm.previous = string(secret)
+	}
+	return nil
+}
+
+// initTokens restores the token secrets of TokenFile, if set, at startup
+// and saves the ones in use.
+func (dht *DHT) initTokens() {
+	if dht.TokenFile == "" {
+		return
+	}
 
-	if ok {
-		tm.Delete(key)
+	data, err := os.ReadFile(dht.TokenFile)
+	if err == nil {
+		var s tokenState
+		if err = json.Unmarshal(data, &s); err == nil {
+			err = dht.tokens.restore(s, dht.TokenRotateTime)
+		}
+		if err != nil {
+			dht.Logger.Warn("invalid token file, new secrets are used",
+				F("path", dht.TokenFile), F("err", err))
+		}
+	} else if !os.IsNotExist(err) {
+		dht.Logger.Warn("read token file failed", F("path", dht.TokenFile), F("err", err))
+	}
+	dht.saveTokens()
+}
+
+// saveTokens writes the token secrets to TokenFile, if set.
+func (dht *DHT) saveTokens() {
+	if dht.TokenFile == "" {
+		return
 	}
 
-	return ok && tokenString == tk.data
+	data, err := json.Marshal(dht.tokens.state())
+	if err == nil {
+		tmp := dht.TokenFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, dht.TokenFile)
+		}
+	}
+	if err != nil {
+		dht.Logger.Warn("save token file failed", F("path", dht.TokenFile), F("err", err))
+	}
+}
+
+// rotateTokens rotates the token secrets and saves them.
+func (dht *DHT) rotateTokens() {
+	dht.tokens.rotate()
+	dht.saveTokens()
 }
@@ -0,0 +1,79 @@
+package dhtlistener
+
+import (
+	"encoding/hex"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenRotate(t *testing.T) {
+	tm := newTokenMgr(time.Now)
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+	other := &net.UDPAddr{IP: net.IPv4(4, 3, 2, 1), Port: 6881}
+
+	token := tm.getToken(addr)
+	if !tm.check(addr, token) {
+		t.Fatal("valid token rejected")
+	}
+	if tm.check(other, token) {
+		t.Fatal("token of another ip accepted")
+	}
+
+	tm.rotate()
+	if !tm.check(addr, token) {
+		t.Fatal("token of the previous secret rejected")
+	}
+
+	tm.rotate()
+	if tm.check(addr, token) {
+		t.Fatal("expired token accepted")
+	}
+
+	if tm.Rejected() != 2 {
+		t.Fatal(tm.Rejected())
+	}
+}
+
+func TestTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+
+	var token string
+	for i := 0; i < 2; i++ {
+		dht := NewDht("127.0.0.1:0")
+		if dht == nil {
+			t.Fatal("listen failed")
+		}
+		dht.TokenFile = path
+		dht.initTokens()
+		dht.conn.Close()
+
+		if i == 0 {
+			token = dht.tokens.getToken(addr)
+		} else if !dht.tokens.check(addr, token) {
+			t.Fatal("token handed out before the restart rejected")
+		}
+	}
+
+	s := newTokenMgr(time.Now).state()
+	for _, c := range []struct {
+		age   time.Duration
+		valid bool
+	}{
+		{time.Minute, true},
+		{time.Minute * 7, true},
+		{time.Minute * 11, false},
+	} {
+		saved := newTokenMgr(time.Now)
+		s.Rotated = time.Now().Add(-c.age)
+		if err := saved.restore(s, time.Minute*5); err != nil {
+			t.Fatal(err)
+		}
+		secret, _ := hex.DecodeString(s.Secret)
+		if ok := saved.check(addr, genToken(string(secret), addr.IP)); ok != c.valid {
+			t.Errorf("expected the token of secrets %v old valid: %v", c.age, c.valid)
+		}
+	}
+}
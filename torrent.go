@@ -0,0 +1,130 @@
+package dhtlistener
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// File represents a file described by the metadata info.
+type File struct {
+	Path   []string `json:"path"`
+	Length int      `json:"length"`
+}
+
+// TorrentInfo represents the info dictionary of a torrent.
+// See http://www.bittorrent.org/beps/bep_0003.html.
+type TorrentInfo struct {
+	InfoHash    string // raw 20 bytes
+	Name        string
+	Length      int // total length of all files
+	PieceLength int
+	Pieces      string // concatenated SHA1 of the pieces
+	Private     bool
+	Files       []File // a single file torrent has one file named Name
+	Raw         []byte // the bencoded info dictionary
+}
+
+// ParseTorrentInfo validates the SHA1 of the bencoded info dictionary data
+// against infoHash and decodes it.
+func ParseTorrentInfo(infoHash, data []byte) (*TorrentInfo, error) {
+	sum := sha1.Sum(data)
+	if !bytes.Equal(sum[:], infoHash) {
+		return nil, errors.New("info hash mismatch")
+	}
+
+	return parseTorrentInfo(data)
+}
+
+// parseTorrentInfo decodes the bencoded info dictionary data.
+func parseTorrentInfo(data []byte) (*TorrentInfo, error) {
+	info := map[string]interface{}{}
+	if err := Decode(data, &info); err != nil {
+		return nil, err
+	}
+
+	if err := parseKeys(info, [][]string{
+		{"name", "string"}, {"piece length", "int"}, {"pieces", "string"}}); err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum(data)
+	ti := &TorrentInfo{
+		InfoHash:    string(sum[:]),
+		Name:        info["name"].(string),
+		PieceLength: info["piece length"].(int),
+		Pieces:      info["pieces"].(string),
+		Raw:         data,
+	}
+
+	if len(ti.Pieces)%20 != 0 {
+		return nil, errors.New("the length of pieces should can be divided by 20")
+	}
+
+	if private, ok := toInt(info["private"], true); ok && private == 1 {
+		ti.Private = true
+	}
+
+	if err := parseKey(info, "files", "list"); err != nil {
+		if err = parseKey(info, "length", "int"); err != nil {
+			return nil, err
+		}
+
+		ti.Length = info["length"].(int)
+		ti.Files = []File{{Path: []string{ti.Name}, Length: ti.Length}}
+		return ti, nil
+	}
+
+	for _, item := range info["files"].([]interface{}) {
+		f, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("file is not dict")
+		}
+		if err := parseKeys(f, [][]string{{"length", "int"}, {"path", "list"}}); err != nil {
+			return nil, err
+		}
+
+		file := File{Length: f["length"].(int)}
+		for _, p := range f["path"].([]interface{}) {
+			s, ok := p.(string)
+			if !ok {
+				return nil, errors.New("path is not string")
+			}
+			file.Path = append(file.Path, s)
+		}
+
+		ti.Files = append(ti.Files, file)
+		ti.Length += file.Length
+	}
+
+	return ti, nil
+}
+
+// Torrent returns the content of a .torrent file holding the info
+// dictionary. The first tracker, if any, is the announce url, all of them
+// make up the announce-list.
+func (ti *TorrentInfo) Torrent(trackers ...string) []byte {
+	parts := []string{"d"}
+
+	if len(trackers) != 0 {
+		announce, _ := encodeString(trackers[0])
+		parts = append(parts, "8:announce", announce)
+
+		tiers := make([]interface{}, len(trackers))
+		for k, v := range trackers {
+			tiers[k] = []interface{}{v}
+		}
+		list, _ := Encode(tiers)
+		parts = append(parts, "13:announce-list", list)
+	}
+
+	parts = append(parts, "4:info", string(ti.Raw), "e")
+	return []byte(strings.Join(parts, ""))
+}
+
+// WriteTorrentFile writes a .torrent file to path.
+func (ti *TorrentInfo) WriteTorrentFile(path string, trackers ...string) error {
+	return ioutil.WriteFile(path, ti.Torrent(trackers...), 0644)
+}
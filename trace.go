@@ -0,0 +1,39 @@
+package dhtlistener
+
+import "context"
+
+// Tracer starts the spans of the lookups, of the transactions and of the
+// metadata fetches. The oteltrace package implements it with OpenTelemetry.
+type Tracer interface {
+	// Start starts the span name, a child of the span of ctx if any, and
+	// returns the context holding it.
+	Start(ctx context.Context, name string, fields ...Field) (context.Context, Span)
+}
+
+// Span is an operation traced by a Tracer.
+type Span interface {
+	// SetFields adds attributes to the span.
+	SetFields(fields ...Field)
+	// End ends the span, which failed if err isn't nil.
+	End(err error)
+}
+
+// nopTracer starts spans which do nothing.
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, _ string, _ ...Field) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetFields(...Field) {}
+func (nopSpan) End(error)          {}
+
+// startSpan starts the span name with the Tracer of dht.
+func (dht *DHT) startSpan(ctx context.Context, name string, fields ...Field) (context.Context, Span) {
+	if dht.Tracer == nil {
+		return nopTracer{}.Start(ctx, name, fields...)
+	}
+	return dht.Tracer.Start(ctx, name, fields...)
+}
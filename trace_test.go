@@ -0,0 +1,151 @@
+package dhtlistener
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordedSpan is a span of a recordTracer.
+type recordedSpan struct {
+	name   string
+	parent *recordedSpan
+	fields map[string]interface{}
+	err    error
+	ended  bool
+}
+
+// recordSpanKey is the key of the recordedSpan of a context.
+type recordSpanKey struct{}
+
+// recordTracer records the spans started.
+type recordTracer struct {
+	sync.Mutex
+	spans []*recordedSpan
+}
+
+func (rt *recordTracer) Start(ctx context.Context, name string, fields ...Field) (context.Context, Span) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	s := &recordedSpan{name: name, fields: make(map[string]interface{})}
+	s.parent, _ = ctx.Value(recordSpanKey{}).(*recordedSpan)
+	rt.spans = append(rt.spans, s)
+	return context.WithValue(ctx, recordSpanKey{}, s), recordSpan{rt, s}.with(fields)
+}
+
+// ended returns the first ended span named name, nil if none.
+func (rt *recordTracer) ended(name string) *recordedSpan {
+	rt.Lock()
+	defer rt.Unlock()
+
+	for _, s := range rt.spans {
+		if s.name == name && s.ended {
+			return s
+		}
+	}
+	return nil
+}
+
+type recordSpan struct {
+	rt *recordTracer
+	s  *recordedSpan
+}
+
+func (rs recordSpan) with(fields []Field) Span {
+	for _, f := range fields {
+		rs.s.fields[f.Key] = f.Value
+	}
+	return rs
+}
+
+func (rs recordSpan) SetFields(fields ...Field) {
+	rs.rt.Lock()
+	defer rs.rt.Unlock()
+	rs.with(fields)
+}
+
+func (rs recordSpan) End(err error) {
+	rs.rt.Lock()
+	defer rs.rt.Unlock()
+	rs.s.err, rs.s.ended = err, true
+}
+
+func TestTraceTransactions(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	clock := newFakeClock()
+	dht.Clock = clock
+	tracer := &recordTracer{}
+	dht.Tracer = tracer
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+	go dht.transacts.run()
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.LocalAddr().(*net.UDPAddr)
+
+	// answered by l
+	dht.transacts.ping(&node{addr: addr})
+	buf := make([]byte, 1500)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := l.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var q rawMessage
+	if err := Unmarshal(buf[:n], &q); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := Marshal(makeResponse(q.T, &PingResponse{ID: GetRandString(20)}))
+	handle(dht, packet{data: data, raddr: addr, recvTime: clock.Now()})
+
+	s := tracer.ended("krpc.ping")
+	if s == nil || s.err != nil || s.fields["tries"] != 1 || s.fields["addr"] != addr.String() {
+		t.Fatalf("expected an answered ping span, got %+v", s)
+	}
+
+	// answered by an error, in a lookup
+	ctx, lookup := tracer.Start(context.Background(), "lookup")
+	dht.transacts.getPeers(ctx, &node{addr: addr}, GetRandString(20))
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err = l.ReadFromUDP(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unmarshal(buf[:n], &q); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = Marshal(makeError(q.T, 201, "generic error"))
+	handle(dht, packet{data: data, raddr: addr, recvTime: clock.Now()})
+	lookup.End(nil)
+
+	s = tracer.ended("krpc.get_peers")
+	if s == nil || s.parent != tracer.ended("lookup") {
+		t.Fatalf("expected a get_peers span in the lookup, got %+v", s)
+	}
+	if e, ok := s.err.(*KRPCError); !ok || e.Code != 201 || s.fields["error"] != 201 {
+		t.Errorf("expected a failed get_peers span, got %+v", s)
+	}
+
+	// never answered
+	dht.transacts.findNode(&node{addr: addr}, GetRandString(20))
+	if !waitUntil(func() bool { return dht.transacts.len() == 1 }) {
+		t.Fatal("expected a transaction")
+	}
+	clock.Advance(dht.QueryTimeout * time.Duration(dht.Try+1))
+	if !waitUntil(func() bool { return tracer.ended("krpc.find_node") != nil }) {
+		t.Fatal("expected a find_node span")
+	}
+	if s := tracer.ended("krpc.find_node"); s.err != ErrTimeout || s.fields["tries"] != dht.Try {
+		t.Errorf("expected a timed out span, got %+v", s)
+	}
+}
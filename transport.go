@@ -0,0 +1,81 @@
+package dhtlistener
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Transport is the packet socket a DHT reads and sends its messages with, a
+// *net.UDPConn by default. Other transports, in-memory ones for tests or
+// proxied ones, are set by WithTransport. LocalAddr should return a
+// *net.UDPAddr and Close should make a blocked ReadFromUDP return an error.
+type Transport interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+var errTransportAddr = errors.New("the local address of the transport is not a *net.UDPAddr")
+
+// newDhtOn returns a new DHT using the transport t with the default
+// settings.
+func newDhtOn(t Transport) (*DHT, error) {
+	laddr, ok := t.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, errTransportAddr
+	}
+	return newDhtWith(t, newRandomNodeFromUdpAddr(laddr, time.Now()), laddr.String()), nil
+}
+
+// packetConnTransport is the Transport of a net.PacketConn.
+type packetConnTransport struct {
+	net.PacketConn
+}
+
+// PacketConnTransport returns the Transport of pc, a conn shared with
+// another protocol like uTP for instance. pc is returned as is if it's a
+// *net.UDPConn. The addresses of pc are converted to *net.UDPAddr, the
+// packets from other addresses are skipped.
+func PacketConnTransport(pc net.PacketConn) Transport {
+	if conn, ok := pc.(*net.UDPConn); ok {
+		return conn
+	}
+	return packetConnTransport{pc}
+}
+
+// udpAddr returns addr as a *net.UDPAddr, nil if it's not an ip and port.
+func udpAddr(addr net.Addr) *net.UDPAddr {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return a
+	}
+	a, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil || a.IP == nil {
+		return nil
+	}
+	return a
+}
+
+func (t packetConnTransport) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		n, addr, err := t.ReadFrom(b)
+		if err != nil {
+			return n, nil, err
+		}
+		if a := udpAddr(addr); a != nil {
+			return n, a, nil
+		}
+	}
+}
+
+func (t packetConnTransport) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	return t.WriteTo(b, addr)
+}
+
+func (t packetConnTransport) LocalAddr() net.Addr {
+	if a := udpAddr(t.PacketConn.LocalAddr()); a != nil {
+		return a
+	}
+	return t.PacketConn.LocalAddr()
+}
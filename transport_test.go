@@ -0,0 +1,221 @@
+package dhtlistener
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memPacket is a packet sent on a memNet.
+type memPacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// memNet delivers packets between the memTransports it made, after
+// latency plus up to jitter, and drops loss of them. rand decides the
+// delays and drops, nil means none.
+type memNet struct {
+	sync.Mutex
+	ports   map[string]*memTransport
+	latency time.Duration
+	jitter  time.Duration
+	loss    float64
+	rand    *rand.Rand
+	lost    int
+}
+
+// memTransport is a Transport of a memNet.
+type memTransport struct {
+	net   *memNet
+	addr  *net.UDPAddr
+	in    chan memPacket
+	close sync.Once
+	done  chan struct{}
+}
+
+func (n *memNet) listen(addr *net.UDPAddr) *memTransport {
+	n.Lock()
+	defer n.Unlock()
+
+	t := &memTransport{
+		net:  n,
+		addr: addr,
+		in:   make(chan memPacket, 256),
+		done: make(chan struct{}),
+	}
+	if n.ports == nil {
+		n.ports = make(map[string]*memTransport)
+	}
+	n.ports[addr.String()] = t
+	return t
+}
+
+func (t *memTransport) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case pkt := <-t.in:
+		return copy(b, pkt.data), pkt.from, nil
+	case <-t.done:
+		return 0, nil, errors.New("closed")
+	}
+}
+
+func (t *memTransport) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-t.done:
+		return 0, errors.New("closed")
+	default:
+	}
+
+	n := t.net
+	n.Lock()
+	to := n.ports[addr.String()]
+	delay := n.latency
+	if n.rand != nil && n.jitter > 0 {
+		delay += time.Duration(n.rand.Int63n(int64(n.jitter)))
+	}
+	if n.rand != nil && n.rand.Float64() < n.loss {
+		to = nil
+		n.lost++
+	}
+	n.Unlock()
+	if to == nil {
+		return len(b), nil
+	}
+
+	pkt := memPacket{append([]byte(nil), b...), t.addr}
+	if delay <= 0 {
+		to.deliver(pkt)
+	} else {
+		time.AfterFunc(delay, func() { to.deliver(pkt) })
+	}
+	return len(b), nil
+}
+
+// deliver queues pkt to be read, it's dropped if the queue is full.
+func (t *memTransport) deliver(pkt memPacket) {
+	select {
+	case t.in <- pkt:
+	default:
+	}
+}
+
+func (t *memTransport) LocalAddr() net.Addr { return t.addr }
+
+func (t *memTransport) Close() error {
+	t.close.Do(func() {
+		close(t.done)
+
+		t.net.Lock()
+		delete(t.net.ports, t.addr.String())
+		t.net.Unlock()
+	})
+	return nil
+}
+
+func TestTransport(t *testing.T) {
+	mem := &memNet{}
+	addrA := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	addrB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+
+	a, err := New(WithTransport(mem.listen(addrA)), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(WithTransport(mem.listen(addrB)), WithBootstrapNodes(addrA.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.me.addr.String() != addrA.String() {
+		t.Fatalf("expected our address %v, got %v", addrA, a.me.addr)
+	}
+
+	for _, dht := range []*DHT{a, b} {
+		dht.rt = newRouteTable(dht) // before Run, read below
+		go dht.Run()
+		defer func(dht *DHT) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := dht.Close(ctx); err != nil {
+				t.Error(err)
+			}
+		}(dht)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !hasNode(b, addrA.String()) {
+		if time.Now().After(deadline) {
+			t.Fatal("b should join a through the transport")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransportAddr(t *testing.T) {
+	mem := &memNet{}
+	tr := mem.listen(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881})
+
+	if _, err := newDhtOn(struct{ *memTransport }{tr}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newDhtOn(badAddrTransport{tr}); err != errTransportAddr {
+		t.Fatalf("expected %v, got %v", errTransportAddr, err)
+	}
+}
+
+type badAddrTransport struct {
+	*memTransport
+}
+
+func (badAddrTransport) LocalAddr() net.Addr { return &net.IPAddr{} }
+
+// hasNode returns whether the routing table of dht holds a node at addr.
+func hasNode(dht *DHT, addr string) bool {
+	for _, no := range dht.RoutingTable().AllNodes() {
+		if no.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// packetConn hides the *net.UDPConn it embeds.
+type packetConn struct {
+	net.PacketConn
+}
+
+func TestPacketConn(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(WithPacketConn(packetConn{pc}), WithBootstrapNodes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.conn.(packetConnTransport); !ok {
+		t.Fatalf("expected a packetConnTransport, got %T", a.conn)
+	}
+	b, err := New(WithAddr("127.0.0.1:0"), WithBootstrapNodes(pc.LocalAddr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dht := range []*DHT{a, b} {
+		dht.rt = newRouteTable(dht) // before Run, read below
+		go dht.Run()
+		defer func(dht *DHT) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			dht.Close(ctx)
+		}(dht)
+	}
+
+	if !waitUntil(func() bool { return hasNode(b, pc.LocalAddr().String()) && hasNode(a, b.conn.LocalAddr().String()) }) {
+		t.Fatal("a and b should know each other through the conn")
+	}
+}
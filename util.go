@@ -89,6 +89,14 @@ func encodeCompactIPPortInfo(ip net.IP, port int) (info string, err error) {
 		return
 	}
 
+	// ip may be an IPv4 address in its 16 bytes form.
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		err = errors.New("compact info only holds IPv4 addresses")
+		return
+	}
+
 	p := I64toA(uint64(port))
 	if len(p) < 2 {
 		p = append(p, p[0])
@@ -83,6 +83,11 @@ func TestEncodeCompactIPPortInfo(t *testing.T) {
 			port int
 		}{ip: []byte("1111"), port: 12593},
 			"111111"},
+		{struct {
+			ip   net.IP
+			port int
+		}{ip: net.IPv4('1', '1', '1', '1'), port: 12593},
+			"111111"},
 	}
 	for _, c := range cases {
 		compact, err := encodeCompactIPPortInfo(c.in.ip, c.in.port)
@@ -0,0 +1,144 @@
+package dhtlistener
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// utpQueueSize is the number of uTP packets waiting to be read, the new
+// ones are dropped when it's full.
+const utpQueueSize = 1024
+
+// isUTP returns whether data is a uTP packet (BEP 29) rather than a krpc
+// message, which is a bencoded dict: its first byte holds the type, at
+// most ST_SYN, and the version 1.
+func isUTP(data []byte) bool {
+	return len(data) >= 20 && data[0]&0x0f == 1 && data[0]>>4 <= 4
+}
+
+// utpConn is the net.PacketConn of the uTP packets of a DHT socket.
+type utpConn struct {
+	dht       *DHT
+	in        chan packet
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time // of the reads
+}
+
+var errUTPClosed = errors.New("utp conn closed")
+
+// errNoUTP is returned by the DialUTP of a Wire which can't dial uTP, the
+// error of the TCP dial is returned instead.
+var errNoUTP = errors.New("no utp dialer")
+
+// UTPConn returns the net.PacketConn of the uTP packets received on the
+// socket of dht, for a uTP stack sharing it. The metadata of the peers only
+// accepting uTP can then be fetched through DialUTP. The other packets are
+// handled as krpc messages. Its writes are sent by the socket
+// of dht, its write deadlines are ignored. The same conn is returned until
+// its Close, which stops the delivery of the uTP packets, a new one
+// afterwards.
+func (dht *DHT) UTPConn() net.PacketConn {
+	dht.utpMu.Lock()
+	defer dht.utpMu.Unlock()
+
+	if dht.utp == nil || dht.utp.isClosed() {
+		dht.utp = &utpConn{
+			dht:    dht,
+			in:     make(chan packet, utpQueueSize),
+			closed: make(chan struct{}),
+		}
+	}
+	return dht.utp
+}
+
+// deliverUTP passes the uTP packet data of addr to the UTPConn, it returns
+// false if there is none.
+func (dht *DHT) deliverUTP(data []byte, addr *net.UDPAddr) bool {
+	dht.utpMu.Lock()
+	c := dht.utp
+	dht.utpMu.Unlock()
+	if c == nil {
+		return false
+	}
+
+	if c.isClosed() {
+		return false
+	}
+
+	select {
+	case c.in <- packet{data: append([]byte(nil), data...), raddr: addr}:
+	default:
+		atomic.AddUint64(&dht.metrics.utpDropped, 1)
+	}
+	return true
+}
+
+// isClosed returns whether c is closed.
+func (c *utpConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *utpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case pkt := <-c.in:
+		return copy(b, pkt.data), pkt.raddr, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, nil, errUTPClosed
+	case <-c.dht.done:
+		return 0, nil, errClosed
+	}
+}
+
+func (c *utpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	a := udpAddr(addr)
+	if a == nil {
+		return 0, errors.New("invalid address " + addr.String())
+	}
+	return c.dht.writeTo(b, a)
+}
+
+func (c *utpConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *utpConn) LocalAddr() net.Addr { return c.dht.conn.LocalAddr() }
+
+// SetDeadline sets the read deadline, see UTPConn.
+func (c *utpConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+// SetReadDeadline sets the deadline of the next reads.
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error { return nil }
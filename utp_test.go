@@ -0,0 +1,131 @@
+package dhtlistener
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIsUTP(t *testing.T) {
+	syn := make([]byte, 20)
+	syn[0] = 4<<4 | 1
+	if !isUTP(syn) {
+		t.Error("expected a ST_SYN to be uTP")
+	}
+
+	data, _ := Marshal(makeQuery("aa", pingType, &PingArgs{ID: GetRandString(20)}))
+	for _, b := range [][]byte{data, syn[:19], append([]byte{5<<4 | 1}, syn[1:]...)} {
+		if isUTP(b) {
+			t.Errorf("expected %q not to be uTP", b)
+		}
+	}
+}
+
+func TestUTPConn(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+	defer close(dht.done)
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.LocalAddr().(*net.UDPAddr)
+
+	syn := make([]byte, 20)
+	syn[0] = 4<<4 | 1
+
+	// without UTPConn, they are krpc messages.
+	handle(dht, packet{data: syn, raddr: addr})
+
+	conn := dht.UTPConn()
+	handle(dht, packet{data: syn, raddr: addr})
+
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil || n != len(syn) || from.String() != addr.String() {
+		t.Fatalf("expected the uTP packet, got %d from %v, %v", n, from, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := conn.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected a deadline exceeded, got %v", err)
+	}
+
+	if _, err := conn.WriteTo([]byte("state"), addr); err != nil {
+		t.Fatal(err)
+	}
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := l.ReadFromUDP(buf); err != nil || string(buf[:n]) != "state" {
+		t.Errorf("expected the uTP packet sent, got %q, %v", buf[:n], err)
+	}
+
+	for i := 0; i <= utpQueueSize; i++ {
+		dht.deliverUTP(syn, addr)
+	}
+	if n := dht.Stats().DroppedUTP; n != 1 {
+		t.Errorf("expected a uTP packet dropped, got %d", n)
+	}
+
+	conn.Close()
+	if dht.deliverUTP(syn, addr) {
+		t.Error("expected no delivery once closed")
+	}
+
+	// a new conn replaces the closed one.
+	if c := dht.UTPConn(); c == conn || !dht.deliverUTP(syn, addr) {
+		t.Error("expected a new conn delivered the uTP packets")
+	}
+}
+
+func TestWireDialUTP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	wire := NewWire(0, 0)
+	if _, err := wire.dial(address); err == nil {
+		t.Fatal("expected the tcp dial to fail")
+	}
+
+	var dialed string
+	wire.DialUTP = func(addr string, timeout time.Duration) (net.Conn, error) {
+		dialed = addr
+		c, _ := net.Pipe()
+		return c, nil
+	}
+	conn, err := wire.dial(address)
+	if err != nil || dialed != address {
+		t.Fatalf("expected a uTP dial of %s, got %q, %v", address, dialed, err)
+	}
+	conn.Close()
+
+	// the metadata fetcher dials with the DialUTP of the dht, even set
+	// after it's made.
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	defer dht.conn.Close()
+	mf := newMetadataFetcher(dht)
+	if _, err := mf.wire.dial(address); err == nil || err == errNoUTP {
+		t.Fatalf("expected the tcp dial error, got %v", err)
+	}
+	dialed = ""
+	dht.DialUTP = wire.DialUTP
+	if conn, err = mf.wire.dial(address); err != nil || dialed != address {
+		t.Fatalf("expected a uTP dial of %s, got %q, %v", address, dialed, err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,169 @@
+package dhtlistener
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The verification states of a Peer.
+const (
+	// PeerUnverified is the state of the peers not verified yet.
+	PeerUnverified = iota
+	// PeerVerified is the state of the peers which completed a handshake
+	// for their infohash.
+	PeerVerified
+	// PeerFailed is the state of the peers which were unreachable or
+	// refused the handshake.
+	PeerFailed
+)
+
+// verifyQueueSize is the max number of peers waiting for verification.
+const verifyQueueSize = 1024
+
+var errHandshake = errors.New("invalid handshake")
+
+// VerifyingPeerStore is implemented by the PeerStores recording the
+// verification of their peers, as the in-memory one does.
+type VerifyingPeerStore interface {
+	PeerStore
+	// SetVerification sets the verification state of a stored peer.
+	SetVerification(infoHash InfoHash, ip net.IP, port int, state int)
+}
+
+// VerifyStats counts the verifications of peers.
+type VerifyStats struct {
+	Verified uint64 `json:"verified"`
+	Failed   uint64 `json:"failed"`
+	Dropped  uint64 `json:"dropped"` // the queue was full
+}
+
+// verification is a peer waiting for verification.
+type verification struct {
+	infoHash string
+	ip       net.IP
+	port     int
+}
+
+// verifier verifies peers with a BitTorrent handshake.
+type verifier struct {
+	queue    chan verification
+	recent   *dedupeCache // infohash and address of the queued peers
+	verified uint64       // accessed atomically
+	failed   uint64       // accessed atomically
+	dropped  uint64       // accessed atomically
+}
+
+// newVerifier returns a new verifier pointer.
+func newVerifier() *verifier {
+	return &verifier{
+		queue:  make(chan verification, verifyQueueSize),
+		recent: newDedupeCache(time.Hour, 1<<16),
+	}
+}
+
+// Verification returns the verification state of p, see PeerVerified.
+func (p *Peer) Verification() int {
+	return int(atomic.LoadInt32(&p.state))
+}
+
+// verifyPeer queues the verification of a peer of infoHash if it's in
+// VerifyInfoHashes and the peer was not queued within the hour. It never
+// blocks, a peer dropped because the queue is full is queued again when
+// it's seen next.
+func (dht *DHT) verifyPeer(infoHash string, ip net.IP, port int) {
+	v := dht.verifier
+	key := infoHash + genAddress(ip.String(), port)
+	if v == nil || !dht.VerifyInfoHashes.Has(infoHash) || v.recent.Seen(key) {
+		return
+	}
+
+	select {
+	case v.queue <- verification{infoHash, ip, port}:
+	default:
+		v.recent.forget(key)
+		atomic.AddUint64(&v.dropped, 1)
+	}
+}
+
+// handshake connects to addr and checks that it answers a BitTorrent
+// handshake for infoHash.
+func handshake(addr, infoHash string, timeout time.Duration) error {
+	dial, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	conn := dial.(*net.TCPConn)
+	conn.SetLinger(0)
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.Close()
+
+	if err := sendHandshake(conn, []byte(infoHash), []byte(GetRandString(20))); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 68)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(resp[:20], handshakePrefix[:20]) || string(resp[28:48]) != infoHash {
+		return errHandshake
+	}
+	return nil
+}
+
+// verify verifies the queued peers until the dht is closed.
+func (dht *DHT) verify() {
+	v := dht.verifier
+	for {
+		select {
+		case p := <-v.queue:
+			state := PeerVerified
+			err := handshake(net.JoinHostPort(p.ip.String(), strconv.Itoa(p.port)), p.infoHash, dht.VerifyTimeout)
+			if err != nil {
+				state = PeerFailed
+				atomic.AddUint64(&v.failed, 1)
+				dht.Logger.Debug("peer verification failed", F("ip", p.ip), F("port", p.port), F("err", err))
+			} else {
+				atomic.AddUint64(&v.verified, 1)
+			}
+
+			if s, ok := dht.peers.(VerifyingPeerStore); ok {
+				s.SetVerification(InfoHash(p.infoHash), p.ip, p.port, state)
+			}
+		case <-dht.done:
+			return
+		}
+	}
+}
+
+// VerifyStats returns the counts of the peer verifications.
+func (dht *DHT) VerifyStats() VerifyStats {
+	v := dht.verifier
+	if v == nil {
+		return VerifyStats{}
+	}
+
+	return VerifyStats{
+		Verified: atomic.LoadUint64(&v.verified),
+		Failed:   atomic.LoadUint64(&v.failed),
+		Dropped:  atomic.LoadUint64(&v.dropped),
+	}
+}
+
+// SetVerification implements VerifyingPeerStore.
+func (pm *peersManager) SetVerification(infoHash InfoHash, ip net.IP, port int, state int) {
+	v, ok := pm.table.Get(string(infoHash))
+	if !ok {
+		return
+	}
+
+	if p, ok := v.(*keylist).Get(genAddress(ip.String(), port)); ok {
+		atomic.StoreInt32(&p.(*Peer).state, int32(state))
+	}
+}
@@ -0,0 +1,136 @@
+package dhtlistener
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// servePeer accepts the connections of l and answers their handshakes for
+// infoHash.
+func servePeer(l net.Listener, infoHash string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			data := make([]byte, 68)
+			if _, err := io.ReadFull(conn, data); err != nil {
+				return
+			}
+			copy(data[28:48], infoHash)
+			conn.Write(data)
+		}()
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go servePeer(l, "mnopqrstuvwxyz123456")
+
+	if err := handshake(l.Addr().String(), "mnopqrstuvwxyz123456", time.Second); err != nil {
+		t.Error("expected a verified peer, got", err)
+	}
+	if err := handshake(l.Addr().String(), "abcdefghij0123456789", time.Second); err != errHandshake {
+		t.Error("expected an invalid handshake, got", err)
+	}
+}
+
+func TestVerifyPeer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go servePeer(l, "mnopqrstuvwxyz123456")
+	port := l.Addr().(*net.TCPAddr).Port
+
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.conn.Close()
+	dht.VerifyInfoHashes.Add("mnopqrstuvwxyz123456")
+
+	ip := net.IPv4(127, 0, 0, 1)
+	dht.peers.Insert("mnopqrstuvwxyz123456", newPeer(ip, port, ""))
+	dht.peers.Insert("mnopqrstuvwxyz123456", newPeer(ip, 1, ""))
+	dht.peers.Insert("abcdefghij0123456789", newPeer(ip, port, ""))
+
+	dht.verifyPeer("mnopqrstuvwxyz123456", ip, port)
+	dht.verifyPeer("mnopqrstuvwxyz123456", ip, port)
+	dht.verifyPeer("mnopqrstuvwxyz123456", ip, 1)
+	dht.verifyPeer("abcdefghij0123456789", ip, port)
+	if n := len(dht.verifier.queue); n != 2 {
+		t.Fatalf("expected 2 queued peers, got %d", n)
+	}
+
+	go dht.verify()
+	defer close(dht.done)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for dht.VerifyStats().Verified+dht.VerifyStats().Failed < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if s := dht.VerifyStats(); s.Verified != 1 || s.Failed != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	states := make(map[int]int)
+	for _, p := range dht.peers.GetPeers("mnopqrstuvwxyz123456", 10) {
+		states[p.Port] = p.Verification()
+	}
+	if states[port] != PeerVerified || states[1] != PeerFailed {
+		t.Errorf("unexpected states %v", states)
+	}
+	if p := dht.peers.GetPeers("abcdefghij0123456789", 10); p[0].Verification() != PeerUnverified {
+		t.Error("expected an unverified peer")
+	}
+
+	// a reannounce keeps the state.
+	dht.peers.Insert("mnopqrstuvwxyz123456", newPeer(ip, port, ""))
+	for _, p := range dht.peers.GetPeers("mnopqrstuvwxyz123456", 10) {
+		if p.Port == port && p.Verification() != PeerVerified {
+			t.Error("expected the state kept")
+		}
+	}
+}
+
+func TestVerifyPeerDropped(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	defer dht.conn.Close()
+	dht.VerifyInfoHashes.Add("mnopqrstuvwxyz123456")
+
+	ip := net.IPv4(127, 0, 0, 1)
+	for port := 1; port <= verifyQueueSize; port++ {
+		dht.verifyPeer("mnopqrstuvwxyz123456", ip, port)
+	}
+	dht.verifyPeer("mnopqrstuvwxyz123456", ip, 6881)
+	if s := dht.VerifyStats(); s.Dropped != 1 {
+		t.Fatalf("expected a dropped peer, got %+v", s)
+	}
+
+	// the dropped peer is queued once there's room.
+	<-dht.verifier.queue
+	dht.verifyPeer("mnopqrstuvwxyz123456", ip, 6881)
+	if n := len(dht.verifier.queue); n != verifyQueueSize {
+		t.Fatalf("expected the dropped peer queued, %d queued", n)
+	}
+	dht.verifyPeer("mnopqrstuvwxyz123456", ip, 6881)
+	if s := dht.VerifyStats(); s.Dropped != 1 {
+		t.Errorf("expected the queued peer not queued again, got %+v", s)
+	}
+}
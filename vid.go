@@ -0,0 +1,66 @@
+package dhtlistener
+
+// initIDs makes the virtual ids of dht: me and VirtualIDs - 1 other random
+// ids whose 16 bit prefixes are spread uniformly across the keyspace from
+// me's one, then the ones of AddVirtualIDNear. The caller holds idMu unless
+// the dht isn't running.
+func (dht *DHT) initIDs() {
+	dht.ids = []*HashID{dht.me.id}
+
+	me := dht.me.id.RawString()
+	base := int(me[0])<<8 | int(me[1])
+
+	for i := 1; i < dht.VirtualIDs; i++ {
+		prefix := (base + i*65536/dht.VirtualIDs) % 65536
+
+		id := []byte(GetRandString(20))
+		id[0], id[1] = byte(prefix>>8), byte(prefix)
+		dht.ids = append(dht.ids, newHashIdFromBytes(id))
+	}
+	dht.ids = append(dht.ids, dht.targetIDs...)
+}
+
+// idFor returns the raw virtual id closest to target, which is the identity
+// used to query or answer about target. It's me without virtual ids.
+func (dht *DHT) idFor(target string) string {
+	dht.idMu.RLock()
+	defer dht.idMu.RUnlock()
+
+	if len(dht.ids) <= 1 || len(target) != 20 {
+		return dht.me.id.RawString()
+	}
+
+	tar := newHashId(target)
+	closest, distance := dht.ids[0], dht.ids[0].Xor(tar).RawString()
+	for _, id := range dht.ids[1:] {
+		if d := id.Xor(tar).RawString(); d < distance {
+			closest, distance = id, d
+		}
+	}
+	return closest.RawString()
+}
+
+// isSelf returns whether the raw id is one of the virtual ids.
+func (dht *DHT) isSelf(id string) bool {
+	dht.idMu.RLock()
+	defer dht.idMu.RUnlock()
+
+	if dht.ids == nil {
+		return id == dht.me.id.RawString()
+	}
+
+	for _, self := range dht.ids {
+		if self.RawString() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// virtualIDs returns the virtual ids, me first.
+func (dht *DHT) virtualIDs() []*HashID {
+	dht.idMu.RLock()
+	defer dht.idMu.RUnlock()
+
+	return dht.ids
+}
@@ -0,0 +1,39 @@
+package dhtlistener
+
+import (
+	"testing"
+)
+
+func TestVirtualIDs(t *testing.T) {
+	dht := &DHT{
+		me:         &node{id: newHashIdFromBytes([]byte("\x00\x00abcdefghij01234567"))},
+		VirtualIDs: 4,
+	}
+	dht.initIDs()
+
+	if len(dht.ids) != 4 || dht.ids[0] != dht.me.id {
+		t.Fatalf("expected 4 ids, me first, got %d", len(dht.ids))
+	}
+
+	for i, id := range dht.ids {
+		if raw := id.RawString(); raw[0] != byte(i*0x40) || raw[1] != 0 {
+			t.Fatalf("id %d: unexpected prefix %x", i, raw[:2])
+		}
+		if !dht.isSelf(id.RawString()) {
+			t.Fatalf("id %d should be self", i)
+		}
+	}
+	if dht.isSelf("mnopqrstuvwxyz123456") {
+		t.Fatal("unexpected self")
+	}
+
+	for i, id := range dht.ids {
+		target := []byte(id.RawString())
+		target[1] ^= 0xff
+		target[19] ^= 0xff
+
+		if dht.idFor(string(target)) != id.RawString() {
+			t.Fatalf("expected id %d to be the closest", i)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package dhtlistener
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventPeerFound is published when a get_peers response holds a peer.
+const EventPeerFound EventType = EventSuspiciousNode + 1
+
+// PeerFound is the event of a peer of an infohash reported by a node.
+type PeerFound struct {
+	InfoHash InfoHash
+	IP       string
+	Port     int
+	From     *net.UDPAddr // the node
+	Time     time.Time
+	Geo      *GeoInfo // of IP, see GeoIP
+}
+
+// Type implements Event.
+func (PeerFound) Type() EventType { return EventPeerFound }
+
+const (
+	webhookWorkers    = 4
+	webhookQueueSize  = 1024
+	webhookMaxBackoff = time.Minute
+)
+
+var errNotWatched = errors.New("infohash is not watched by this url")
+
+// Watch is a watched infohash and the url notified about it.
+type Watch struct {
+	InfoHash string `json:"infohash"` // hex
+	URL      string `json:"url"`
+}
+
+// webhook is a pending notification.
+type webhook struct {
+	url  string
+	body []byte
+}
+
+// webhooks holds the watched infohashes.
+type webhooks struct {
+	sync.RWMutex
+	watches map[string]map[string]struct{} // infohash : urls
+	queue   chan webhook
+	once    sync.Once
+	dropped uint64 // accessed atomically
+}
+
+// newWebhooks returns a new webhooks pointer.
+func newWebhooks() *webhooks {
+	return &webhooks{
+		watches: make(map[string]map[string]struct{}),
+		queue:   make(chan webhook, webhookQueueSize),
+	}
+}
+
+// urls returns the urls watching infoHash.
+func (wh *webhooks) urls(infoHash string) []string {
+	wh.RLock()
+	defer wh.RUnlock()
+
+	urls := wh.watches[infoHash]
+	if len(urls) == 0 {
+		return nil
+	}
+
+	ret := make([]string, 0, len(urls))
+	for u := range urls {
+		ret = append(ret, u)
+	}
+	return ret
+}
+
+// rawInfoHash returns the raw infohash of its raw or hex form, or of a
+// magnet link.
+func rawInfoHash(infoHash string) (string, error) {
+	if strings.HasPrefix(infoHash, "magnet:") {
+		m, err := ParseMagnet(infoHash)
+		if err != nil {
+			return "", err
+		}
+		return m.InfoHash.RawString(), nil
+	}
+	if len(infoHash) == 40 {
+		data, err := hex.DecodeString(infoHash)
+		if err != nil {
+			return "", errInvalidInfoHash
+		}
+		infoHash = string(data)
+	}
+	if len(infoHash) != 20 {
+		return "", errInvalidInfoHash
+	}
+	return infoHash, nil
+}
+
+// Watch makes dht POST a JSON StreamEvent to rawurl when a peer of
+// infoHash, raw or hex encoded or a magnet link, announces itself
+// ("announce") or is reported by a node ("peer"). Failed requests are
+// retried with an exponential backoff, see WebhookRetries.
+func (dht *DHT) Watch(infoHash, rawurl string) error {
+	infoHash, err := rawInfoHash(infoHash)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid webhook url %q", rawurl)
+	}
+
+	wh := dht.webhooks
+	wh.once.Do(dht.startWebhooks)
+
+	wh.Lock()
+	defer wh.Unlock()
+
+	urls := wh.watches[infoHash]
+	if urls == nil {
+		urls = make(map[string]struct{})
+		wh.watches[infoHash] = urls
+	}
+	urls[rawurl] = struct{}{}
+	return nil
+}
+
+// Unwatch stops notifying rawurl about infoHash.
+func (dht *DHT) Unwatch(infoHash, rawurl string) error {
+	infoHash, err := rawInfoHash(infoHash)
+	if err != nil {
+		return err
+	}
+
+	wh := dht.webhooks
+	wh.Lock()
+	defer wh.Unlock()
+
+	urls := wh.watches[infoHash]
+	if _, ok := urls[rawurl]; !ok {
+		return errNotWatched
+	}
+	delete(urls, rawurl)
+	if len(urls) == 0 {
+		delete(wh.watches, infoHash)
+	}
+	return nil
+}
+
+// Watches returns the watched infohashes.
+func (dht *DHT) Watches() []Watch {
+	wh := dht.webhooks
+	wh.RLock()
+	defer wh.RUnlock()
+
+	ret := make([]Watch, 0, len(wh.watches))
+	for infoHash, urls := range wh.watches {
+		for u := range urls {
+			ret = append(ret, Watch{hex.EncodeToString([]byte(infoHash)), u})
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].InfoHash != ret[j].InfoHash {
+			return ret[i].InfoHash < ret[j].InfoHash
+		}
+		return ret[i].URL < ret[j].URL
+	})
+	return ret
+}
+
+// DroppedWebhooks returns how many notifications have been dropped because
+// the queue was full or the retries were exhausted.
+func (dht *DHT) DroppedWebhooks() uint64 {
+	return atomic.LoadUint64(&dht.webhooks.dropped)
+}
+
+// startWebhooks starts the goroutines matching the events with the watches
+// and posting the notifications.
+func (dht *DHT) startWebhooks() {
+	wh := dht.webhooks
+	events, cancel := dht.subscribeAll([]EventType{EventPeerAnnounced, EventPeerFound})
+
+	dht.spawn(func() {
+		defer cancel()
+
+		for {
+			select {
+			case e := <-events:
+				dht.notify(e)
+			case <-dht.done:
+				return
+			}
+		}
+	})
+
+	// the requests in flight are canceled on Close.
+	ctx, stop := context.WithCancel(context.Background())
+	dht.spawn(func() {
+		<-dht.done
+		stop()
+	})
+
+	client := &http.Client{Timeout: dht.WebhookTimeout}
+	for i := 0; i < webhookWorkers; i++ {
+		dht.spawn(func() {
+			for {
+				select {
+				case w := <-wh.queue:
+					dht.postWebhook(ctx, client, w)
+				case <-dht.done:
+					return
+				}
+			}
+		})
+	}
+}
+
+// notify queues the notifications of e.
+func (dht *DHT) notify(e Event) {
+	var infoHash InfoHash
+	switch e := e.(type) {
+	case PeerAnnounced:
+		infoHash = e.InfoHash
+	case PeerFound:
+		infoHash = e.InfoHash
+	}
+
+	urls := dht.webhooks.urls(infoHash.RawString())
+	if len(urls) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(NewStreamEvent(e))
+	if err != nil {
+		return
+	}
+
+	for _, u := range urls {
+		select {
+		case dht.webhooks.queue <- webhook{u, body}:
+		default:
+			atomic.AddUint64(&dht.webhooks.dropped, 1)
+		}
+	}
+}
+
+// postWebhook posts w, retrying the network errors, the 5xx and the 429
+// responses.
+func (dht *DHT) postWebhook(ctx context.Context, client *http.Client, w webhook) {
+	backoff := dht.WebhookBackoff
+
+	for try := 0; ; try++ {
+		retry, err := sendWebhook(ctx, client, w)
+		if err == nil {
+			return
+		}
+		dht.Logger.Debug("webhook failed", F("url", w.url), F("err", err))
+
+		if !retry || try >= dht.WebhookRetries {
+			atomic.AddUint64(&dht.webhooks.dropped, 1)
+			return
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-dht.done:
+			timer.Stop()
+			return
+		}
+
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+// sendWebhook posts w once, it returns whether a failure may be retried.
+func sendWebhook(ctx context.Context, client *http.Client, w webhook) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(w.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, errors.New(resp.Status)
+	default:
+		return false, errors.New(resp.Status)
+	}
+}
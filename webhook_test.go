@@ -0,0 +1,89 @@
+package dhtlistener
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatches(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	defer dht.Close(context.Background())
+
+	if err := dht.Watch("zz", "http://localhost/"); err != errInvalidInfoHash {
+		t.Error("expected an invalid infohash, got", err)
+	}
+	if err := dht.Watch("mnopqrstuvwxyz123456", "ftp://localhost/"); err == nil {
+		t.Error("expected an invalid url")
+	}
+
+	dht.Watch("mnopqrstuvwxyz123456", "http://b/")
+	dht.Watch("6d6e6f707172737475767778797a313233343536", "http://a/")
+
+	ws := dht.Watches()
+	if len(ws) != 2 || ws[0].URL != "http://a/" || ws[0].InfoHash != "6d6e6f707172737475767778797a313233343536" {
+		t.Fatalf("unexpected watches %+v", ws)
+	}
+
+	if err := dht.Unwatch("mnopqrstuvwxyz123456", "http://c/"); err != errNotWatched {
+		t.Error("expected not watched, got", err)
+	}
+	dht.Unwatch("mnopqrstuvwxyz123456", "http://a/")
+	dht.Unwatch("mnopqrstuvwxyz123456", "http://b/")
+	if ws := dht.Watches(); len(ws) != 0 {
+		t.Fatalf("unexpected watches %+v", ws)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	var calls int32
+	events := make(chan StreamEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e StreamEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer srv.Close()
+
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	defer dht.Close(context.Background())
+	dht.WebhookBackoff = time.Millisecond
+
+	if err := dht.Watch("mnopqrstuvwxyz123456", srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// another infohash isn't notified.
+	dht.publish(EventPeerAnnounced, func() Event {
+		return PeerAnnounced{"abcdefghijklmnopqrst", "1.2.3.4", 1, time.Now(), nil}
+	})
+	dht.publish(EventPeerFound, func() Event {
+		return PeerFound{"mnopqrstuvwxyz123456", "1.2.3.4", 6881, nil, time.Now(), nil}
+	})
+
+	select {
+	case e := <-events:
+		if e.Type != "peer" || e.Port != 6881 || e.InfoHash != "6d6e6f707172737475767778797a313233343536" {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no webhook")
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected a retry, got %d calls", n)
+	}
+}
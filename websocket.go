@@ -0,0 +1,391 @@
+package dhtlistener
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsGUID is appended to the key of a websocket handshake (RFC 6455).
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// The websocket opcodes.
+const (
+	wsText  = 1
+	wsClose = 8
+	wsPing  = 9
+	wsPong  = 10
+)
+
+// wsMaxFrame is the max payload of a received frame.
+const wsMaxFrame = 4096
+
+// wsWriteTimeout is how long a frame may take to be sent.
+const wsWriteTimeout = time.Second * 10
+
+var errWSFrame = errors.New("invalid websocket frame")
+
+// wsConn is the server side of a websocket connection.
+type wsConn struct {
+	sync.Mutex // of writes
+	conn       net.Conn
+	r          *bufio.Reader
+}
+
+// headerHas returns whether the comma separated header name of h contains
+// token.
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseOrigin returns the lower case "scheme://host" of the origin s, "*"
+// if s is "*".
+func parseOrigin(s string) (string, error) {
+	if s == "*" {
+		return s, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return "", fmt.Errorf("invalid origin %q", s)
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
+
+// allowOrigin returns whether the Origin of r, if any, is that of r.Host
+// or one of EventsOrigins.
+func (dht *DHT) allowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	o, err := parseOrigin(origin)
+	if err != nil || o == "*" {
+		return false
+	}
+	if u, _ := url.Parse(o); strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range dht.EventsOrigins {
+		if a, err := parseOrigin(allowed); err == nil && (a == "*" || a == o) {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket answers the websocket handshake of r, or an error.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" ||
+		!headerHas(r.Header, "Connection", "upgrade") ||
+		!headerHas(r.Header, "Upgrade", "websocket") {
+
+		writeError(w, http.StatusBadRequest, "websocket handshake expected")
+		return nil, errors.New("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, http.StatusUpgradeRequired, "unsupported websocket version")
+		return nil, errors.New("unsupported websocket version")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "connection can't be hijacked")
+		return nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// writeFrame sends an unfragmented frame.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.Lock()
+	defer c.Unlock()
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | op
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := (&net.Buffers{header, payload}).WriteTo(c.conn)
+	return err
+}
+
+// readFrame reads a frame, which must be masked as sent by a client.
+func (c *wsConn) readFrame() (op byte, payload []byte, err error) {
+	var header [14]byte
+	if _, err := io.ReadFull(c.r, header[:2]); err != nil {
+		return 0, nil, err
+	}
+	op = header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		return 0, nil, errWSFrame
+	}
+
+	size := int(header[1] & 0x7f)
+	switch size {
+	case 126:
+		if _, err := io.ReadFull(c.r, header[2:4]); err != nil {
+			return 0, nil, err
+		}
+		size = int(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		// bigger than wsMaxFrame anyway.
+		return 0, nil, errWSFrame
+	}
+	if size > wsMaxFrame || op >= wsClose && size > 125 {
+		return 0, nil, errWSFrame
+	}
+
+	mask := header[10:14]
+	if _, err := io.ReadFull(c.r, mask); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+// readLoop answers the control frames of the client, discarding its
+// messages, until the connection is closed.
+func (c *wsConn) readLoop() {
+	for {
+		op, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+
+		switch op {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+		case wsClose:
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsClose, payload)
+			return
+		}
+	}
+}
+
+// close sends a close frame with code then closes the connection.
+func (c *wsConn) close(code uint16) {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], code)
+	c.writeFrame(wsClose, payload[:])
+	c.conn.Close()
+}
+
+// StreamEvent is the JSON form of the events sent by EventsHandler and
+// written by JSONLSink.
+type StreamEvent struct {
+	Type     string    `json:"type"`     // one of streamEventTypes or "peer"
+	InfoHash string    `json:"infohash"` // hex
+	IP       string    `json:"ip"`
+	Port     int       `json:"port"`
+	Time     time.Time `json:"time"`
+	Name     string    `json:"name,omitempty"`  // of metadata
+	Size     int       `json:"size,omitempty"`  // of metadata
+	Files    []File    `json:"files,omitempty"` // of metadata
+	Geo      *GeoInfo  `json:"geo,omitempty"`
+}
+
+// streamEventTypes are the names of the events sent by EventsHandler.
+var streamEventTypes = map[string]EventType{
+	"get_peers": EventGetPeersSeen,
+	"announce":  EventPeerAnnounced,
+	"metadata":  EventMetadataReceived,
+}
+
+// NewStreamEvent returns the StreamEvent of e, nil unless e is a GetPeersSeen,
+// a PeerAnnounced, a PeerFound or a MetadataReceived.
+func NewStreamEvent(e Event) *StreamEvent {
+	switch e := e.(type) {
+	case GetPeersSeen:
+		return &StreamEvent{"get_peers", e.InfoHash.Hex(), e.IP, e.Port, e.Time, "", 0, nil, e.Geo}
+	case PeerAnnounced:
+		return &StreamEvent{"announce", e.InfoHash.Hex(), e.IP, e.Port, e.Time, "", 0, nil, e.Geo}
+	case PeerFound:
+		return &StreamEvent{"peer", e.InfoHash.Hex(), e.IP, e.Port, e.Time, "", 0, nil, e.Geo}
+	case MetadataReceived:
+		return &StreamEvent{"metadata", e.InfoHash.Hex(), e.IP, e.Port, e.Time, e.Name, e.Size, e.Files, e.Geo}
+	}
+	return nil
+}
+
+// streamFilter selects the events of a connection.
+type streamFilter struct {
+	types  []EventType
+	prefix string // lower case hex
+}
+
+// parseStreamFilter returns the filter of the query parameters types, a
+// comma separated list of streamEventTypes, and prefix, a hex prefix of the
+// infohashes.
+func parseStreamFilter(q url.Values) (*streamFilter, error) {
+	f := &streamFilter{prefix: strings.ToLower(q.Get("prefix"))}
+
+	if len(f.prefix) > 40 {
+		return nil, errors.New("prefix too long")
+	}
+	for _, c := range f.prefix {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return nil, fmt.Errorf("invalid prefix %q", f.prefix)
+		}
+	}
+
+	if types := q.Get("types"); types != "" {
+		for _, name := range strings.Split(types, ",") {
+			t, ok := streamEventTypes[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown event type %q", name)
+			}
+			f.types = append(f.types, t)
+		}
+	} else {
+		f.types = []EventType{EventGetPeersSeen, EventPeerAnnounced, EventMetadataReceived}
+	}
+	return f, nil
+}
+
+// subscribeAll merges the subscriptions of types into a channel, the
+// returned function unsubscribes them.
+func (dht *DHT) subscribeAll(types []EventType) (<-chan Event, func()) {
+	events := make(chan Event)
+	done := make(chan struct{})
+	chans := make([]<-chan Event, 0, len(types))
+
+	for _, t := range types {
+		ch := dht.Subscribe(t)
+		chans = append(chans, ch)
+
+		// drains ch until it's closed, so a Block policy can't stall.
+		go func() {
+			for e := range ch {
+				select {
+				case events <- e:
+				case <-done:
+				}
+			}
+		}()
+	}
+
+	return events, func() {
+		close(done)
+		for _, ch := range chans {
+			dht.Unsubscribe(ch)
+		}
+	}
+}
+
+// EventsHandler returns a http.Handler streaming the get_peers, announce
+// and metadata events of dht as JSON StreamEvents over a websocket. The
+// query parameters filter the events of a connection:
+//
+//	types   comma separated "get_peers", "announce" and "metadata", all by default
+//	prefix  hex prefix of the infohashes
+//
+// The events are dropped rather than queued when the client is slow, see
+// EventDropPolicy. The web pages of other origins than EventsOrigins are
+// forbidden, so a page can't read the events through the browser of an
+// admin.
+func (dht *DHT) EventsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !dht.allowOrigin(r) {
+			writeError(w, http.StatusForbidden, "origin not allowed")
+			return
+		}
+
+		f, err := parseStreamFilter(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		c, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer c.conn.Close()
+
+		events, cancel := dht.subscribeAll(f.types)
+		defer cancel()
+
+		closed := make(chan struct{})
+		go func() {
+			c.readLoop()
+			close(closed)
+		}()
+
+		for {
+			select {
+			case e := <-events:
+				se := NewStreamEvent(e)
+				if se == nil || !strings.HasPrefix(se.InfoHash, f.prefix) {
+					continue
+				}
+
+				data, err := json.Marshal(se)
+				if err != nil {
+					continue
+				}
+				if err := c.writeFrame(wsText, data); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			case <-dht.done:
+				c.close(1001) // going away
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package dhtlistener
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStreamFilter(t *testing.T) {
+	f, err := parseStreamFilter(url.Values{"types": {"announce,metadata"}, "prefix": {"AB"}})
+	if err != nil || len(f.types) != 2 || f.types[0] != EventPeerAnnounced || f.prefix != "ab" {
+		t.Fatalf("unexpected filter %+v %v", f, err)
+	}
+
+	if f, _ := parseStreamFilter(url.Values{}); len(f.types) != 3 {
+		t.Fatalf("expected all types, got %v", f.types)
+	}
+
+	for _, q := range []url.Values{
+		{"types": {"ping"}},
+		{"prefix": {"xyz"}},
+		{"prefix": {strings.Repeat("a", 41)}},
+	} {
+		if _, err := parseStreamFilter(q); err == nil {
+			t.Errorf("expected an error for %v", q)
+		}
+	}
+}
+
+func TestAllowOrigin(t *testing.T) {
+	dht := &DHT{EventsOrigins: []string{"https://Dash.example.com/"}}
+	for origin, ok := range map[string]bool{
+		"":                          true, // not a browser
+		"http://admin:8080":         true, // same origin
+		"https://dash.example.com":  true,
+		"https://dash.example.com:": false,
+		"http://dash.example.com":   false,
+		"https://evil.com":          false,
+		"null":                      false,
+		"*":                         false,
+	} {
+		r := httptest.NewRequest("GET", "http://admin:8080/events", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if dht.allowOrigin(r) != ok {
+			t.Errorf("expected %q allowed %v", origin, ok)
+		}
+	}
+
+	dht.EventsOrigins = []string{"*"}
+	r := httptest.NewRequest("GET", "http://admin:8080/events", nil)
+	r.Header.Set("Origin", "https://evil.com")
+	if !dht.allowOrigin(r) {
+		t.Error("expected every origin allowed")
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	dht := NewDht("127.0.0.1:0")
+	if dht == nil {
+		t.Fatal("listen failed")
+	}
+	dht.init()
+	defer dht.Close(context.Background())
+
+	srv := httptest.NewServer(dht.EventsHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected a bad request, got", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Origin", "https://evil.com")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatal("expected a forbidden origin, got", resp.StatusCode)
+	}
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	// the handshake of RFC 6455.
+	conn.Write([]byte("GET /?types=announce&prefix=6d6e HTTP/1.1\r\nHost: x\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+
+	r := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected handshake %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// wait for the subscription.
+	for i := 0; !dht.events.has(EventPeerAnnounced); i++ {
+		if i == 100 {
+			t.Fatal("no subscription")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	dht.publish(EventPeerAnnounced, func() Event {
+		return PeerAnnounced{"abcdefghijklmnopqrst", "1.2.3.4", 1, time.Now(), nil}
+	})
+	dht.publish(EventPeerAnnounced, func() Event {
+		return PeerAnnounced{"mnopqrstuvwxyz123456", "1.2.3.4", 6881, time.Now(), nil}
+	})
+
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != 0x80|wsText || header[1]&0x80 != 0 {
+		t.Fatalf("unexpected frame header %x", header)
+	}
+	size := int(header[1])
+	if size == 126 {
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		size = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	var e StreamEvent
+	if err := json.Unmarshal(payload, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != "announce" || e.InfoHash != "6d6e6f707172737475767778797a313233343536" || e.Port != 6881 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	// a masked close frame is answered.
+	conn.Write([]byte{0x80 | wsClose, 0x82, 0, 0, 0, 0, 0x03, 0xe8})
+	if _, err := io.ReadFull(r, header[:]); err != nil || header[0] != 0x80|wsClose {
+		t.Fatalf("expected a close frame, got %x %v", header, err)
+	}
+}
@@ -42,7 +42,7 @@ var handshakePrefix = []byte{
 }
 
 // read reads size-length bytes from conn to data.
-func read(conn *net.TCPConn, size int, data *bytes.Buffer) error {
+func read(conn net.Conn, size int, data *bytes.Buffer) error {
 	conn.SetReadDeadline(time.Now().Add(time.Second * 15))
 
 	n, err := io.CopyN(data, conn, int64(size))
@@ -53,7 +53,7 @@ func read(conn *net.TCPConn, size int, data *bytes.Buffer) error {
 }
 
 // readMessage gets a message from the tcp connection.
-func readMessage(conn *net.TCPConn, data *bytes.Buffer) (length int, err error) {
+func readMessage(conn net.Conn, data *bytes.Buffer) (length int, err error) {
 	if err = read(conn, 4, data); err != nil {
 		return
 	}
@@ -70,7 +70,7 @@ func readMessage(conn *net.TCPConn, data *bytes.Buffer) (length int, err error)
 }
 
 // sendMessage sends data to the connection.
-func sendMessage(conn *net.TCPConn, data []byte) error {
+func sendMessage(conn net.Conn, data []byte) error {
 	length := int32(len(data))
 
 	buffer := bytes.NewBuffer(nil)
@@ -82,7 +82,7 @@ func sendMessage(conn *net.TCPConn, data []byte) error {
 }
 
 // sendHandshake sends handshake message to conn.
-func sendHandshake(conn *net.TCPConn, infoHash, peerID []byte) error {
+func sendHandshake(conn net.Conn, infoHash, peerID []byte) error {
 	data := make([]byte, 68)
 	copy(data[:28], handshakePrefix)
 	copy(data[28:48], infoHash)
@@ -102,7 +102,7 @@ func onHandshake(data []byte) (err error) {
 }
 
 // sendExtHandshake requests for the ut_metadata and metadata_size.
-func sendExtHandshake(conn *net.TCPConn) error {
+func sendExtHandshake(conn net.Conn) error {
 	bc, _ := Encode(map[string]interface{}{
 		"m": map[string]interface{}{"ut_metadata": 1},
 	})
@@ -157,6 +157,13 @@ type Response struct {
 
 // Wire represents the wire protocol.
 type Wire struct {
+	// DialTCP, if set, connects to the peers instead of a plain TCP dial,
+	// see DHT.DialTCP.
+	DialTCP func(addr string, timeout time.Duration) (net.Conn, error)
+	// DialUTP, if set, connects to the peers which can't be reached with
+	// TCP, see DHT.DialUTP.
+	DialUTP func(addr string, timeout time.Duration) (net.Conn, error)
+
 	queue        *syncMap
 	requests     chan Request
 	responses    chan Response
@@ -195,7 +202,7 @@ func (wire *Wire) isDone(pieces [][]byte) bool {
 	return true
 }
 
-func (wire *Wire) requestPieces(conn *net.TCPConn, utMetadata int, metadataSize int, piecesNum int) {
+func (wire *Wire) requestPieces(conn net.Conn, utMetadata int, metadataSize int, piecesNum int) {
 
 	buffer := make([]byte, 1024)
 	for i := 0; i < piecesNum; i++ {
@@ -215,8 +222,52 @@ func (wire *Wire) requestPieces(conn *net.TCPConn, utMetadata int, metadataSize
 	buffer = nil
 }
 
+// dial connects to the peer at address with TCP, or with uTP if it fails
+// and DialUTP is set.
+func (wire *Wire) dial(address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if wire.DialTCP != nil {
+		conn, err = wire.DialTCP(address, time.Second*15)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, time.Second*15)
+	}
+	if err == nil {
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
+		return conn, nil
+	}
+	if wire.DialUTP == nil {
+		return nil, err
+	}
+	conn, uerr := wire.DialUTP(address, time.Second*15)
+	if uerr == errNoUTP {
+		return nil, err
+	}
+	return conn, uerr
+}
+
+// errFetchMetadata is returned when the peer misbehaves during the metadata
+// exchange.
+var errFetchMetadata = errors.New("fetch metadata failed")
+
 // fetchMetadata fetchs medata info accroding to infohash from dht.
 func (wire *Wire) fetchMetadata(r Request) {
+	metadataInfo, err := wire.fetch(r)
+	if err != nil {
+		return
+	}
+
+	wire.responses <- Response{
+		Request:      r,
+		MetadataInfo: metadataInfo,
+	}
+}
+
+// fetch downloads the metadata info of r.InfoHash from the peer of r and
+// returns it once its SHA1 is verified.
+func (wire *Wire) fetch(r Request) (metadataInfo []byte, err error) {
 	var (
 		length       int
 		msgType      byte
@@ -228,18 +279,18 @@ func (wire *Wire) fetchMetadata(r Request) {
 
 	defer func() {
 		pieces = nil
-		recover()
+		if recover() != nil || (metadataInfo == nil && err == nil) {
+			metadataInfo, err = nil, errFetchMetadata
+		}
 	}()
 
 	infoHash := r.InfoHash
 	address := genAddress(r.IP, r.Port)
 
-	dial, err := net.DialTimeout("tcp", address, time.Second*15)
+	conn, err := wire.dial(address)
 	if err != nil {
-		return
+		return nil, err
 	}
-	conn := dial.(*net.TCPConn)
-	conn.SetLinger(0)
 	defer conn.Close()
 
 	data := bytes.NewBuffer(nil)
@@ -249,13 +300,13 @@ func (wire *Wire) fetchMetadata(r Request) {
 		read(conn, 68, data) != nil ||
 		onHandshake(data.Next(68)) != nil ||
 		sendExtHandshake(conn) != nil {
-		return
+		return nil, errors.New("handshake failed")
 	}
 
 	for {
 		length, err = readMessage(conn, data)
 		if err != nil {
-			return
+			return nil, err
 		}
 
 		if length == 0 {
@@ -264,29 +315,29 @@ func (wire *Wire) fetchMetadata(r Request) {
 
 		msgType, err = data.ReadByte()
 		if err != nil {
-			return
+			return nil, err
 		}
 
 		switch msgType {
 		case EXTENDED:
 			extendedID, err := data.ReadByte()
 			if err != nil {
-				return
+				return nil, err
 			}
 
 			payload, err := ioutil.ReadAll(data)
 			if err != nil {
-				return
+				return nil, err
 			}
 
 			if extendedID == 0 {
 				if pieces != nil {
-					return
+					return nil, errFetchMetadata
 				}
 
 				utMetadata, metadataSize, err = getUTMetaSize(payload)
 				if err != nil {
-					return
+					return nil, err
 				}
 
 				piecesNum = metadataSize / BLOCK
@@ -301,24 +352,24 @@ func (wire *Wire) fetchMetadata(r Request) {
 			}
 
 			if pieces == nil {
-				return
+				return nil, errFetchMetadata
 			}
 
 			decode_type, index, err := findFirstNode(payload, 0)
 			if err != nil || decode_type != bencode_type_map {
-				return
+				return nil, errFetchMetadata
 			}
 			index += 1
 			dict := map[string]interface{}{}
 			err = Decode(payload[:index], &dict)
 			if err != nil {
-				return
+				return nil, err
 			}
 
 			if err = parseKeys(dict, [][]string{
 				{"msg_type", "int"},
 				{"piece", "int"}}); err != nil {
-				return
+				return nil, err
 			}
 
 			if dict["msg_type"].(int) != DATA {
@@ -330,7 +381,7 @@ func (wire *Wire) fetchMetadata(r Request) {
 
 			if (piece != piecesNum-1 && pieceLen != BLOCK) ||
 				(piece == piecesNum-1 && pieceLen != metadataSize%BLOCK) {
-				return
+				return nil, errFetchMetadata
 			}
 
 			pieces[piece] = payload[index:]
@@ -340,14 +391,10 @@ func (wire *Wire) fetchMetadata(r Request) {
 
 				info := sha1.Sum(metadataInfo)
 				if !bytes.Equal(infoHash, info[:]) {
-					return
+					return nil, errors.New("info hash mismatch")
 				}
 
-				wire.responses <- Response{
-					Request:      r,
-					MetadataInfo: metadataInfo,
-				}
-				return
+				return metadataInfo, nil
 			}
 		default:
 			data.Reset()
@@ -369,9 +416,10 @@ func (wire *Wire) Run() {
 				string(r.InfoHash), genAddress(r.IP, r.Port),
 			}, ":")
 
-			if len(r.InfoHash) != 20 || wire.queue.Has(key) {
+			if len(r.InfoHash) != 20 || !wire.queue.SetIfAbsent(key, struct{}{}) {
 				return
 			}
+			defer wire.queue.Delete(key)
 
 			wire.fetchMetadata(r)
 		}(r)
@@ -0,0 +1,17 @@
+// Package yamlconfig makes dhtlistener.LoadConfig read YAML files, import it
+// for its side effect:
+//
+//	import _ "github.com/2qif49lt/dhtlistener/yamlconfig"
+//
+//	config, err := dhtlistener.LoadConfig("dht.yaml")
+package yamlconfig
+
+import (
+	"github.com/2qif49lt/dhtlistener"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	dhtlistener.RegisterConfigFormat(".yaml", yaml.Unmarshal)
+	dhtlistener.RegisterConfigFormat(".yml", yaml.Unmarshal)
+}